@@ -0,0 +1,339 @@
+package alerter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// Alerter evaluates alert rules against the state of devices, and notifies the
+// channels of a rule when it starts or stops firing for a device. Rules are
+// evaluated on every interval, and for a device as soon as it reports its
+// state. Notifications are sent in the background, so that slow channels don't
+// hold back evaluations.
+type Alerter struct {
+	Interval time.Duration
+	Clients  Clients
+
+	// Serializes transitions of alert states, so that a transition is only
+	// notified once
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	notifyMu sync.Mutex
+	stopped  bool
+	// notifications tracks notifications being sent, so that stopping waits
+	// for them
+	notifications sync.WaitGroup
+
+	// ctx is passed to notifications, it's only cancelled if they take longer
+	// than allowed on stop
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type Clients struct {
+	Storage StorageClient
+	// Notifiers send notifications to channels of their type. Channels without
+	// a notifier are skipped.
+	Notifiers map[alert.ChannelType]Notifier
+}
+
+type StorageClient interface {
+	FetchAlertRules(ctx context.Context) ([]alert.Rule, error)
+	FetchDeviceAlertRules(ctx context.Context, deviceID string) ([]alert.Rule, error)
+	FetchAlertState(ctx context.Context, ruleID int64, deviceID string) (*alert.State, error)
+	UpdateAlertState(ctx context.Context, state *alert.State) error
+	FetchCurrentStates(ctx context.Context) ([]thermostat.CurrentState, error)
+	FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error)
+	FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error)
+	FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error)
+	FetchLastCycleStart(ctx context.Context, deviceID string, before time.Time) (*thermostat.OperatingStateChange, error)
+}
+
+type Notifier interface {
+	SendNotification(ctx context.Context, target string, n *alert.Notification) error
+}
+
+func New(interval time.Duration, clients Clients) *Alerter {
+	var a Alerter
+
+	a.Interval = interval
+	a.Clients = clients
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+
+	return &a
+}
+
+func (a *Alerter) Start(ctx context.Context, errc chan<- error) {
+	defer close(a.done)
+
+	slog.Info(fmt.Sprintf("Alerter evaluating rules every %s", a.Interval))
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := a.evaluate(ctx, time.Now())
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error evaluating alert rules: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Alerter) Stop(ctx context.Context) error {
+	a.stopOnce.Do(func() { close(a.stop) })
+
+	// Notifications of evaluations after stop are sent right away
+	a.notifyMu.Lock()
+	a.stopped = true
+	a.notifyMu.Unlock()
+
+	notified := make(chan struct{})
+	go func() {
+		a.notifications.Wait()
+		close(notified)
+	}()
+
+	for _, done := range []chan struct{}{a.done, notified} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			a.cancel()
+			return fmt.Errorf("error waiting for alerter to stop: %v", ctx.Err())
+		}
+	}
+
+	a.cancel()
+
+	return nil
+}
+
+// EvaluateAlerts evaluates the rules that apply to the device, against its
+// current state.
+func (a *Alerter) EvaluateAlerts(ctx context.Context, deviceID string) error {
+	now := time.Now()
+
+	rules, err := a.Clients.Storage.FetchDeviceAlertRules(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching alert rules: %v", err)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	h, err := a.Clients.Storage.FetchDeviceHome(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching device home: %v", err)
+	}
+
+	state, err := a.Clients.Storage.FetchCurrentState(ctx, h.ID, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Device hasn't reported its state yet
+		default:
+			return fmt.Errorf("error fetching current state: %v", err)
+		}
+	}
+
+	for _, rule := range rules {
+		err := a.evaluateRule(ctx, &rule, deviceID, state, now)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error evaluating alert rule %d for device %s: %v", rule.ID, deviceID, err))
+		}
+	}
+
+	return nil
+}
+
+// evaluate evaluates the rules for every device they apply to.
+func (a *Alerter) evaluate(ctx context.Context, now time.Time) error {
+	rules, err := a.Clients.Storage.FetchAlertRules(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching alert rules: %v", err)
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	states, err := a.Clients.Storage.FetchCurrentStates(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching current states: %v", err)
+	}
+
+	statesByDevice := make(map[string]*thermostat.CurrentState, len(states))
+	for i := range states {
+		statesByDevice[states[i].DeviceID] = &states[i]
+	}
+
+	for _, rule := range rules {
+		var deviceIDs []string
+		if rule.DeviceID != nil {
+			deviceIDs = []string{*rule.DeviceID}
+		} else {
+			for _, state := range states {
+				deviceIDs = append(deviceIDs, state.DeviceID)
+			}
+		}
+
+		for _, deviceID := range deviceIDs {
+			err := a.evaluateRule(ctx, &rule, deviceID, statesByDevice[deviceID], now)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error evaluating alert rule %d for device %s: %v", rule.ID, deviceID, err))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Alerter) evaluateRule(ctx context.Context, rule *alert.Rule, deviceID string, state *thermostat.CurrentState, now time.Time) error {
+	result, err := a.check(ctx, rule, deviceID, state, now)
+	if err != nil {
+		return fmt.Errorf("error checking rule: %v", err)
+	}
+
+	if result == nil {
+		// Not enough data to tell, keep the last state
+		return nil
+	}
+
+	status := alert.ResolvedStatus
+	if result.firing {
+		status = alert.FiringStatus
+	}
+
+	changed, err := a.transition(ctx, rule.ID, deviceID, status, result.message, now)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	slog.Info(fmt.Sprintf("Alert rule %d is %s for device %s: %s", rule.ID, status, deviceID, result.message))
+
+	a.notifyInBackground(ctx, *rule, &alert.Notification{
+		RuleID:   rule.ID,
+		RuleName: rule.Name,
+		Kind:     rule.Kind,
+		DeviceID: deviceID,
+		Status:   status,
+		Message:  result.message,
+		SentAt:   now,
+	})
+
+	return nil
+}
+
+// transition stores the status of the rule for the device, and returns true if
+// it changed. Evaluations older than the last transition don't override it.
+func (a *Alerter) transition(ctx context.Context, ruleID int64, deviceID string, status alert.Status, message string, now time.Time) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	last, err := a.Clients.Storage.FetchAlertState(ctx, ruleID, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Rule hasn't fired for the device yet
+		default:
+			return false, fmt.Errorf("error fetching alert state: %v", err)
+		}
+	}
+
+	if last == nil && status == alert.ResolvedStatus {
+		return false, nil
+	}
+
+	if last != nil && (last.Status == status || last.ChangedAt.After(now)) {
+		return false, nil
+	}
+
+	err = a.Clients.Storage.UpdateAlertState(ctx, &alert.State{
+		RuleID:    ruleID,
+		DeviceID:  deviceID,
+		Status:    status,
+		Message:   message,
+		ChangedAt: now,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error updating alert state: %v", err)
+	}
+
+	return true, nil
+}
+
+// notifyInBackground sends the notification without waiting for the channels.
+// It isn't cancelled with the evaluation that triggered it, only if stopping
+// takes longer than allowed. Once stopped, notifications are sent right away.
+func (a *Alerter) notifyInBackground(ctx context.Context, rule alert.Rule, n *alert.Notification) {
+	a.notifyMu.Lock()
+	stopped := a.stopped
+	if !stopped {
+		a.notifications.Add(1)
+	}
+	a.notifyMu.Unlock()
+
+	if stopped {
+		a.notify(ctx, &rule, n)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopCancel := context.AfterFunc(a.ctx, cancel)
+
+	go func() {
+		defer a.notifications.Done()
+		defer cancel()
+		defer stopCancel()
+
+		a.notify(ctx, &rule, n)
+	}()
+}
+
+// notify sends the notification to every channel of the rule. The transition is
+// already stored, so channels that fail to be notified miss it.
+func (a *Alerter) notify(ctx context.Context, rule *alert.Rule, n *alert.Notification) {
+	for _, channel := range rule.Channels {
+		notifier, ok := a.Clients.Notifiers[channel.Type]
+		if !ok {
+			slog.Warn(fmt.Sprintf("Skipping %s channel of alert rule %d, it is not configured", channel.Type, rule.ID))
+			metrics.AddAlertNotification(string(channel.Type), "skipped")
+			continue
+		}
+
+		err := notifier.SendNotification(ctx, channel.Target, n)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error notifying %s channel of alert rule %d: %v", channel.Type, rule.ID, err))
+			metrics.AddAlertNotification(string(channel.Type), "error")
+			continue
+		}
+
+		metrics.AddAlertNotification(string(channel.Type), "success")
+	}
+}
@@ -0,0 +1,577 @@
+package alerter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type fakeStorage struct {
+	Rules         []alert.Rule
+	States        map[string]alert.State
+	CurrentStates map[string]thermostat.CurrentState
+	TargetStates  map[string]thermostat.TargetState
+	CycleStarts   map[string]time.Time
+
+	shouldFail bool
+}
+
+func alertStateKey(ruleID int64, deviceID string) string {
+	return fmt.Sprintf("%d/%s", ruleID, deviceID)
+}
+
+func (f *fakeStorage) FetchAlertRules(ctx context.Context) ([]alert.Rule, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	return f.Rules, nil
+}
+
+func (f *fakeStorage) FetchDeviceAlertRules(ctx context.Context, deviceID string) ([]alert.Rule, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var rules []alert.Rule
+	for _, rule := range f.Rules {
+		if rule.DeviceID == nil || *rule.DeviceID == deviceID {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func (f *fakeStorage) FetchAlertState(ctx context.Context, ruleID int64, deviceID string) (*alert.State, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state, exists := f.States[alertStateKey(ruleID, deviceID)]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("alert state not found")}
+	}
+
+	return &state, nil
+}
+
+func (f *fakeStorage) UpdateAlertState(ctx context.Context, state *alert.State) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.States == nil {
+		f.States = make(map[string]alert.State)
+	}
+	f.States[alertStateKey(state.RuleID, state.DeviceID)] = *state
+
+	return nil
+}
+
+func (f *fakeStorage) FetchCurrentStates(ctx context.Context) ([]thermostat.CurrentState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var states []thermostat.CurrentState
+	for _, state := range f.CurrentStates {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].DeviceID < states[j].DeviceID })
+
+	return states, nil
+}
+
+func (f *fakeStorage) FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state, exists := f.CurrentStates[deviceID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("current state not found")}
+	}
+
+	return &state, nil
+}
+
+func (f *fakeStorage) FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error) {
+	return &home.Home{ID: home.DefaultID}, nil
+}
+
+func (f *fakeStorage) FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state := f.TargetStates[deviceID]
+	return &state, nil
+}
+
+func (f *fakeStorage) FetchLastCycleStart(ctx context.Context, deviceID string, before time.Time) (*thermostat.OperatingStateChange, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	start, exists := f.CycleStarts[deviceID]
+	if !exists || !start.Before(before) {
+		return nil, &client.ErrNotFound{Err: errors.New("cycle start not found")}
+	}
+
+	return &thermostat.OperatingStateChange{DeviceID: deviceID, OperatingState: thermostat.HeatingOperatingState, ChangedAt: start}, nil
+}
+
+type fakeNotifier struct {
+	Notifications []alert.Notification
+	Targets       []string
+	// Release blocks notifications until it's closed, if set
+	Release chan struct{}
+
+	mu         sync.Mutex
+	shouldFail bool
+}
+
+func (f *fakeNotifier) SendNotification(ctx context.Context, target string, n *alert.Notification) error {
+	if f.Release != nil {
+		select {
+		case <-f.Release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Targets = append(f.Targets, target)
+	f.Notifications = append(f.Notifications, *n)
+
+	return nil
+}
+
+func (f *fakeNotifier) notified() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.Notifications)
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	deviceID := "test_device_id"
+	minTemperature, maxHumidity := 16.0, 70.0
+	minutes := 30
+	humidity := 75.0
+	targetTemperature := 21
+
+	webhook := []alert.Channel{{Type: alert.WebhookChannel, Target: "https://example.com/hook"}}
+
+	tests := []struct {
+		name          string
+		rule          alert.Rule
+		currentStates map[string]thermostat.CurrentState
+		cycleStarts   map[string]time.Time
+		lastStatus    alert.Status
+		wantStatus    alert.Status
+		wantNotified  bool
+	}{
+		{
+			name: "should fire when temperature is out of range",
+			rule: alert.Rule{ID: 1, Name: "Too cold", Kind: alert.TemperatureRangeRule, Min: &minTemperature, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 14.5},
+			},
+			wantStatus:   alert.FiringStatus,
+			wantNotified: true,
+		},
+		{
+			name: "should not notify again while rule keeps firing",
+			rule: alert.Rule{ID: 1, Name: "Too cold", Kind: alert.TemperatureRangeRule, Min: &minTemperature, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 14.5},
+			},
+			lastStatus:   alert.FiringStatus,
+			wantStatus:   alert.FiringStatus,
+			wantNotified: false,
+		},
+		{
+			name: "should resolve when temperature is back in range",
+			rule: alert.Rule{ID: 1, Name: "Too cold", Kind: alert.TemperatureRangeRule, Min: &minTemperature, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 18},
+			},
+			lastStatus:   alert.FiringStatus,
+			wantStatus:   alert.ResolvedStatus,
+			wantNotified: true,
+		},
+		{
+			name: "should not notify of a rule that never fired",
+			rule: alert.Rule{ID: 1, Name: "Too cold", Kind: alert.TemperatureRangeRule, Min: &minTemperature, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 18},
+			},
+			wantNotified: false,
+		},
+		{
+			name: "should fire when device stopped reporting",
+			rule: alert.Rule{ID: 1, Name: "Offline", Kind: alert.DeviceOfflineRule, Minutes: &minutes, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now.Add(-time.Hour), OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 20},
+			},
+			wantStatus:   alert.FiringStatus,
+			wantNotified: true,
+		},
+		{
+			name:          "should fire when device of the rule never reported",
+			rule:          alert.Rule{ID: 1, Name: "Offline", Kind: alert.DeviceOfflineRule, DeviceID: &deviceID, Minutes: &minutes, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{},
+			wantStatus:    alert.FiringStatus,
+			wantNotified:  true,
+		},
+		{
+			name: "should fire when humidity is too high",
+			rule: alert.Rule{ID: 1, Name: "Too humid", Kind: alert.HumidityHighRule, Max: &maxHumidity, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.IdleOperatingState, CurrentTemperature: 20, CurrentHumidity: &humidity},
+			},
+			wantStatus:   alert.FiringStatus,
+			wantNotified: true,
+		},
+		{
+			name: "should fire when heating doesn't reach target in time",
+			rule: alert.Rule{ID: 1, Name: "Heating too slow", Kind: alert.TargetNotReachedRule, Minutes: &minutes, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.HeatingOperatingState, CurrentTemperature: 18},
+			},
+			cycleStarts:  map[string]time.Time{deviceID: now.Add(-45 * time.Minute)},
+			wantStatus:   alert.FiringStatus,
+			wantNotified: true,
+		},
+		{
+			name: "should not fire when heating only just started",
+			rule: alert.Rule{ID: 1, Name: "Heating too slow", Kind: alert.TargetNotReachedRule, Minutes: &minutes, Channels: webhook},
+			currentStates: map[string]thermostat.CurrentState{
+				deviceID: {DeviceID: deviceID, Timestamp: now, OperatingState: thermostat.HeatingOperatingState, CurrentTemperature: 18},
+			},
+			cycleStarts:  map[string]time.Time{deviceID: now.Add(-10 * time.Minute)},
+			wantNotified: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &fakeStorage{
+				Rules:         []alert.Rule{tt.rule},
+				CurrentStates: tt.currentStates,
+				TargetStates:  map[string]thermostat.TargetState{deviceID: {DeviceID: deviceID, TargetTemperature: &targetTemperature}},
+				CycleStarts:   tt.cycleStarts,
+			}
+			if tt.lastStatus != "" {
+				storage.States = map[string]alert.State{
+					alertStateKey(tt.rule.ID, deviceID): {RuleID: tt.rule.ID, DeviceID: deviceID, Status: tt.lastStatus, ChangedAt: now.Add(-time.Hour)},
+				}
+			}
+			notifier := &fakeNotifier{}
+
+			a := New(time.Minute, Clients{
+				Storage:   storage,
+				Notifiers: map[alert.ChannelType]Notifier{alert.WebhookChannel: notifier},
+			})
+
+			err := a.evaluate(context.Background(), now)
+			if err != nil {
+				t.Fatalf("evaluate() error = %v", err)
+			}
+			a.notifications.Wait()
+
+			state, exists := storage.States[alertStateKey(tt.rule.ID, deviceID)]
+			if tt.wantStatus == "" && exists {
+				t.Errorf("evaluate() stored state %+v, want none", state)
+			} else if tt.wantStatus != "" && state.Status != tt.wantStatus {
+				t.Errorf("evaluate() state = %s, want %s", state.Status, tt.wantStatus)
+			}
+
+			if notified := len(notifier.Notifications) > 0; notified != tt.wantNotified {
+				t.Fatalf("evaluate() notified = %v, want %v", notified, tt.wantNotified)
+			}
+
+			if tt.wantNotified {
+				n := notifier.Notifications[0]
+				if n.RuleID != tt.rule.ID || n.DeviceID != deviceID || n.Status != tt.wantStatus || notifier.Targets[0] != webhook[0].Target {
+					t.Errorf("evaluate() notification = %+v to %s, want %s of rule %d for %s to %s", n, notifier.Targets[0], tt.wantStatus, tt.rule.ID, deviceID, webhook[0].Target)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateNotificationFailure(t *testing.T) {
+	now := time.Now()
+	minTemperature := 16.0
+
+	storage := &fakeStorage{
+		Rules: []alert.Rule{{
+			ID:   1,
+			Name: "Too cold",
+			Kind: alert.TemperatureRangeRule,
+			Min:  &minTemperature,
+			Channels: []alert.Channel{
+				{Type: alert.WebhookChannel, Target: "https://example.com/hook"},
+				{Type: alert.EmailChannel, Target: "owner@example.com"},
+				{Type: alert.MQTTChannel, Target: "alerts"},
+			},
+		}},
+		CurrentStates: map[string]thermostat.CurrentState{
+			"test_device_id": {DeviceID: "test_device_id", Timestamp: now, CurrentTemperature: 14.5},
+		},
+	}
+	failing := &fakeNotifier{shouldFail: true}
+	mqtt := &fakeNotifier{}
+
+	// Email channels aren't configured
+	a := New(time.Minute, Clients{
+		Storage: storage,
+		Notifiers: map[alert.ChannelType]Notifier{
+			alert.WebhookChannel: failing,
+			alert.MQTTChannel:    mqtt,
+		},
+	})
+
+	err := a.EvaluateAlerts(context.Background(), "test_device_id")
+	if err != nil {
+		t.Fatalf("EvaluateAlerts() error = %v", err)
+	}
+	a.notifications.Wait()
+
+	if len(mqtt.Notifications) != 1 {
+		t.Errorf("EvaluateAlerts() notified MQTT channel %d times, want 1", len(mqtt.Notifications))
+	}
+
+	if storage.States[alertStateKey(1, "test_device_id")].Status != alert.FiringStatus {
+		t.Errorf("EvaluateAlerts() state = %+v, want firing despite failed channels", storage.States)
+	}
+}
+
+func TestEvaluateAlertsDevice(t *testing.T) {
+	now := time.Now()
+	minTemperature := 16.0
+	bedroom, office := "bedroom", "office"
+	webhook := []alert.Channel{{Type: alert.WebhookChannel, Target: "https://example.com/hook"}}
+
+	storage := &fakeStorage{
+		Rules: []alert.Rule{
+			{ID: 1, Kind: alert.TemperatureRangeRule, Min: &minTemperature, Channels: webhook},
+			{ID: 2, Kind: alert.TemperatureRangeRule, DeviceID: &bedroom, Min: &minTemperature, Channels: webhook},
+			{ID: 3, Kind: alert.TemperatureRangeRule, DeviceID: &office, Min: &minTemperature, Channels: webhook},
+		},
+		CurrentStates: map[string]thermostat.CurrentState{
+			bedroom: {DeviceID: bedroom, Timestamp: now, CurrentTemperature: 14.5},
+			office:  {DeviceID: office, Timestamp: now, CurrentTemperature: 14.5},
+		},
+	}
+	notifier := &fakeNotifier{}
+
+	a := New(time.Minute, Clients{
+		Storage:   storage,
+		Notifiers: map[alert.ChannelType]Notifier{alert.WebhookChannel: notifier},
+	})
+
+	err := a.EvaluateAlerts(context.Background(), bedroom)
+	if err != nil {
+		t.Fatalf("EvaluateAlerts() error = %v", err)
+	}
+	a.notifications.Wait()
+
+	// Only the rules of the device and the rules for every device apply
+	wantStates := []string{alertStateKey(1, bedroom), alertStateKey(2, bedroom)}
+	if len(storage.States) != len(wantStates) {
+		t.Errorf("EvaluateAlerts() states = %+v, want %v", storage.States, wantStates)
+	}
+	for _, key := range wantStates {
+		if storage.States[key].Status != alert.FiringStatus {
+			t.Errorf("EvaluateAlerts() state %s = %+v, want firing", key, storage.States[key])
+		}
+	}
+
+	if notifier.notified() != len(wantStates) {
+		t.Errorf("EvaluateAlerts() notified %d times, want %d", notifier.notified(), len(wantStates))
+	}
+}
+
+func TestEvaluateAlertsStale(t *testing.T) {
+	now := time.Now()
+	minTemperature := 16.0
+
+	storage := &fakeStorage{
+		Rules: []alert.Rule{{
+			ID:       1,
+			Kind:     alert.TemperatureRangeRule,
+			Min:      &minTemperature,
+			Channels: []alert.Channel{{Type: alert.WebhookChannel, Target: "https://example.com/hook"}},
+		}},
+		CurrentStates: map[string]thermostat.CurrentState{
+			"test_device_id": {DeviceID: "test_device_id", Timestamp: now, CurrentTemperature: 14.5},
+		},
+		// A later evaluation already resolved the rule
+		States: map[string]alert.State{
+			alertStateKey(1, "test_device_id"): {RuleID: 1, DeviceID: "test_device_id", Status: alert.ResolvedStatus, ChangedAt: now.Add(time.Minute)},
+		},
+	}
+	notifier := &fakeNotifier{}
+
+	a := New(time.Minute, Clients{
+		Storage:   storage,
+		Notifiers: map[alert.ChannelType]Notifier{alert.WebhookChannel: notifier},
+	})
+
+	err := a.evaluate(context.Background(), now)
+	if err != nil {
+		t.Fatalf("evaluate() error = %v", err)
+	}
+	a.notifications.Wait()
+
+	if status := storage.States[alertStateKey(1, "test_device_id")].Status; status != alert.ResolvedStatus {
+		t.Errorf("evaluate() state = %s, want %s", status, alert.ResolvedStatus)
+	}
+
+	if notifier.notified() != 0 {
+		t.Errorf("evaluate() notified %d times, want none", notifier.notified())
+	}
+}
+
+func TestEvaluateAlertsSlowNotifier(t *testing.T) {
+	now := time.Now()
+	minTemperature := 16.0
+
+	storage := &fakeStorage{
+		Rules: []alert.Rule{{
+			ID:       1,
+			Kind:     alert.TemperatureRangeRule,
+			Min:      &minTemperature,
+			Channels: []alert.Channel{{Type: alert.WebhookChannel, Target: "https://example.com/hook"}},
+		}},
+		CurrentStates: map[string]thermostat.CurrentState{
+			"bedroom": {DeviceID: "bedroom", Timestamp: now, CurrentTemperature: 14.5},
+			"office":  {DeviceID: "office", Timestamp: now, CurrentTemperature: 14.5},
+		},
+	}
+	notifier := &fakeNotifier{Release: make(chan struct{})}
+
+	a := New(time.Minute, Clients{
+		Storage:   storage,
+		Notifiers: map[alert.ChannelType]Notifier{alert.WebhookChannel: notifier},
+	})
+
+	// Neither evaluation waits for the notification of the other
+	evaluated := make(chan error)
+	for _, deviceID := range []string{"bedroom", "office"} {
+		go func() {
+			evaluated <- a.EvaluateAlerts(context.Background(), deviceID)
+		}()
+
+		select {
+		case err := <-evaluated:
+			if err != nil {
+				t.Fatalf("EvaluateAlerts() error = %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("EvaluateAlerts() of %s waited for notifications", deviceID)
+		}
+	}
+
+	if notifier.notified() != 0 {
+		t.Fatalf("EvaluateAlerts() notified %d times before release, want none", notifier.notified())
+	}
+
+	close(notifier.Release)
+	a.notifications.Wait()
+
+	if notifier.notified() != 2 {
+		t.Errorf("EvaluateAlerts() notified %d times, want %d", notifier.notified(), 2)
+	}
+}
+
+func TestStopNotifications(t *testing.T) {
+	tests := []struct {
+		name         string
+		release      bool
+		wantErr      bool
+		wantNotified int
+	}{
+		{
+			name:         "should wait for notifications being sent",
+			release:      true,
+			wantErr:      false,
+			wantNotified: 1,
+		},
+		{
+			name:         "should cancel notifications, if they take longer than allowed",
+			release:      false,
+			wantErr:      true,
+			wantNotified: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minTemperature := 16.0
+			storage := &fakeStorage{
+				Rules: []alert.Rule{{
+					ID:       1,
+					Kind:     alert.TemperatureRangeRule,
+					Min:      &minTemperature,
+					Channels: []alert.Channel{{Type: alert.WebhookChannel, Target: "https://example.com/hook"}},
+				}},
+				CurrentStates: map[string]thermostat.CurrentState{
+					"test_device_id": {DeviceID: "test_device_id", Timestamp: time.Now(), CurrentTemperature: 14.5},
+				},
+			}
+			notifier := &fakeNotifier{Release: make(chan struct{})}
+
+			a := New(time.Hour, Clients{
+				Storage:   storage,
+				Notifiers: map[alert.ChannelType]Notifier{alert.WebhookChannel: notifier},
+			})
+			go a.Start(context.Background(), make(chan error, 1))
+
+			// Rule fires once, whichever evaluation gets to it first
+			err := a.EvaluateAlerts(context.Background(), "test_device_id")
+			if err != nil {
+				t.Fatalf("EvaluateAlerts() error = %v", err)
+			}
+
+			if tt.release {
+				time.AfterFunc(20*time.Millisecond, func() { close(notifier.Release) })
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err = a.Stop(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Stop() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			a.notifications.Wait()
+
+			if notifier.notified() != tt.wantNotified {
+				t.Errorf("Stop() notified %d times, want %d", notifier.notified(), tt.wantNotified)
+			}
+
+			// Stopping again doesn't panic
+			_ = a.Stop(ctx)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package alerter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type result struct {
+	firing  bool
+	message string
+}
+
+// check tells whether the rule fires for the device, given its current state.
+// It returns nil if there isn't enough data to tell.
+func (a *Alerter) check(ctx context.Context, rule *alert.Rule, deviceID string, state *thermostat.CurrentState, now time.Time) (*result, error) {
+	switch rule.Kind {
+	case alert.DeviceOfflineRule:
+		if state == nil {
+			return &result{true, fmt.Sprintf("device %s has never reported its state", deviceID)}, nil
+		}
+
+		silence := now.Sub(state.Timestamp)
+		if silence >= rule.Duration() {
+			return &result{true, fmt.Sprintf("device %s hasn't reported its state for %s", deviceID, silence.Round(time.Second))}, nil
+		}
+
+		return &result{false, fmt.Sprintf("device %s reported its state %s ago", deviceID, silence.Round(time.Second))}, nil
+
+	case alert.TemperatureRangeRule:
+		if state == nil {
+			return nil, nil
+		}
+
+		if rule.Min != nil && state.CurrentTemperature < *rule.Min {
+			return &result{true, fmt.Sprintf("temperature %.2f is below %.2f", state.CurrentTemperature, *rule.Min)}, nil
+		}
+
+		if rule.Max != nil && state.CurrentTemperature > *rule.Max {
+			return &result{true, fmt.Sprintf("temperature %.2f is above %.2f", state.CurrentTemperature, *rule.Max)}, nil
+		}
+
+		return &result{false, fmt.Sprintf("temperature %.2f is back in range", state.CurrentTemperature)}, nil
+
+	case alert.HumidityHighRule:
+		if state == nil || state.CurrentHumidity == nil {
+			return nil, nil
+		}
+
+		if *state.CurrentHumidity > *rule.Max {
+			return &result{true, fmt.Sprintf("humidity %.2f is above %.2f", *state.CurrentHumidity, *rule.Max)}, nil
+		}
+
+		return &result{false, fmt.Sprintf("humidity %.2f is back below %.2f", *state.CurrentHumidity, *rule.Max)}, nil
+
+	case alert.TargetNotReachedRule:
+		if state == nil {
+			return nil, nil
+		}
+
+		return a.checkTargetNotReached(ctx, rule, state, now)
+
+	default:
+		return nil, fmt.Errorf("unknown rule kind %s", rule.Kind)
+	}
+}
+
+func (a *Alerter) checkTargetNotReached(ctx context.Context, rule *alert.Rule, state *thermostat.CurrentState, now time.Time) (*result, error) {
+	if !state.OperatingState.Active() {
+		return &result{false, fmt.Sprintf("device %s is %s", state.DeviceID, state.OperatingState)}, nil
+	}
+
+	h, err := a.Clients.Storage.FetchDeviceHome(ctx, state.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching device home: %v", err)
+	}
+
+	target, err := a.Clients.Storage.FetchTargetState(ctx, h.ID, state.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching target state: %v", err)
+	}
+
+	if target.TargetTemperature == nil {
+		return nil, nil
+	}
+
+	targetTemperature := float64(*target.TargetTemperature)
+	reached := (state.OperatingState == thermostat.HeatingOperatingState && state.CurrentTemperature >= targetTemperature) ||
+		(state.OperatingState == thermostat.CoolingOperatingState && state.CurrentTemperature <= targetTemperature)
+	if reached {
+		return &result{false, fmt.Sprintf("temperature %.2f reached target %d", state.CurrentTemperature, *target.TargetTemperature)}, nil
+	}
+
+	// The change to the current operating state is recorded at the timestamp
+	// of the state
+	start, err := a.Clients.Storage.FetchLastCycleStart(ctx, state.DeviceID, state.Timestamp.Add(time.Nanosecond))
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("error fetching last cycle start: %v", err)
+		}
+	}
+
+	running := now.Sub(start.ChangedAt)
+	if running >= rule.Duration() {
+		return &result{true, fmt.Sprintf("device %s has been %s for %s, temperature %.2f hasn't reached target %d", state.DeviceID, state.OperatingState, running.Round(time.Second), state.CurrentTemperature, *target.TargetTemperature)}, nil
+	}
+
+	return &result{false, fmt.Sprintf("device %s has been %s for %s", state.DeviceID, state.OperatingState, running.Round(time.Second))}, nil
+}
@@ -5,13 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/alerter"
+	"github.com/alexchebotarsky/thermostat-api/client/mail"
+	"github.com/alexchebotarsky/thermostat-api/client/oidc"
 	"github.com/alexchebotarsky/thermostat-api/client/pubsub"
 	"github.com/alexchebotarsky/thermostat-api/client/storage"
+	"github.com/alexchebotarsky/thermostat-api/client/weather"
+	"github.com/alexchebotarsky/thermostat-api/client/webhook"
+	"github.com/alexchebotarsky/thermostat-api/controller"
+	"github.com/alexchebotarsky/thermostat-api/dispatcher"
 	"github.com/alexchebotarsky/thermostat-api/env"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/poller"
 	"github.com/alexchebotarsky/thermostat-api/processor"
+	"github.com/alexchebotarsky/thermostat-api/processor/handler"
+	"github.com/alexchebotarsky/thermostat-api/processor/middleware"
 	"github.com/alexchebotarsky/thermostat-api/server"
+	servermiddleware "github.com/alexchebotarsky/thermostat-api/server/middleware"
+	"github.com/alexchebotarsky/thermostat-api/webhooks"
 )
 
 type App struct {
@@ -82,17 +98,165 @@ type Service interface {
 func setupServices(env *env.Config, clients *Clients) ([]Service, error) {
 	var services []Service
 
-	s := server.New(env.Host, env.Port, server.Clients{
-		Storage: clients.Storage,
-		PubSub:  clients.PubSub,
+	webhookClient := webhook.New(webhook.Config{
+		Timeout: env.WebhookTimeout,
+	})
+
+	notifiers := map[alert.ChannelType]alerter.Notifier{
+		alert.WebhookChannel: webhookClient,
+		alert.MQTTChannel:    clients.PubSub,
+	}
+
+	if env.SMTPHost != "" {
+		notifiers[alert.EmailChannel] = mail.New(mail.Config{
+			Host:     env.SMTPHost,
+			Port:     env.SMTPPort,
+			Username: env.SMTPUsername,
+			Password: env.SMTPPassword,
+			From:     env.SMTPFrom,
+			Timeout:  env.SMTPTimeout,
+		})
+	}
+
+	a := alerter.New(env.AlertInterval, alerter.Clients{
+		Storage:   clients.Storage,
+		Notifiers: notifiers,
 	})
-	services = append(services, s)
 
-	p := processor.New(processor.Clients{
+	// Current states reported over MQTT and live states share the bounds of
+	// device clocks
+	timestamps := thermostat.TimestampPolicy{
+		MaxAge:                env.TimestampMaxAge,
+		MaxAhead:              env.TimestampMaxAhead,
+		SubstituteReceiveTime: env.TimestampSubstituteReceiveTime,
+	}
+
+	p, err := processor.New(processor.Config{
+		Workers:     env.ProcessorWorkers,
+		QueueSize:   env.ProcessorQueueSize,
+		DedupWindow: env.EventDedupWindow,
+		Timestamps:  timestamps,
+		Cycles: handler.CyclePolicy{
+			MinCycleTime:     env.MinCycleTime,
+			HistoryRetention: env.OperatingStateRetention,
+		},
+		Safety: handler.SafetyPolicy{
+			FloorTemperature:   env.SafetyFloorTemperature,
+			CeilingTemperature: env.SafetyCeilingTemperature,
+			Margin:             env.SafetyMargin,
+		},
+		SensorReadingMaxAge: env.SensorReadingMaxAge,
+		OutdoorRetention:    env.OutdoorRetention,
+		Retry: middleware.RetryPolicy{
+			MaxAttempts: env.EventRetryMaxAttempts,
+			MinBackoff:  env.EventRetryMinBackoff,
+			MaxBackoff:  env.EventRetryMaxBackoff,
+		},
+		DeadLetterTopic: env.DeadLetterTopic,
+	}, processor.Clients{
 		PubSub:  clients.PubSub,
 		Storage: clients.Storage,
+		Alerter: a,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating processor: %v", err)
+	}
+
+	d := dispatcher.New(env.OutboxPollInterval, env.OutboxMinBackoff, env.OutboxMaxBackoff, env.TargetStateDebounce, dispatcher.Clients{
+		Storage: clients.Storage,
+		PubSub:  clients.PubSub,
 	})
+
+	var tokens servermiddleware.TokenVerifier
+	if env.JWTJWKSURL != "" || env.JWTJWKSFile != "" {
+		if env.JWTIssuer == "" || env.JWTAudience == "" {
+			return nil, errors.New("JWT_ISSUER and JWT_AUDIENCE must be set to accept JWTs")
+		}
+
+		scopes := slices.Collect(maps.Values(env.JWTScopes))
+		for _, scope := range append(scopes, env.JWTDefaultScopes...) {
+			err := scope.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("error validating JWT scopes: %v", err)
+			}
+		}
+
+		tokens = oidc.New(oidc.Config{
+			JWKSURL:         env.JWTJWKSURL,
+			JWKSFile:        env.JWTJWKSFile,
+			Issuer:          env.JWTIssuer,
+			Audience:        env.JWTAudience,
+			RolesClaim:      env.JWTRolesClaim,
+			HomeClaim:       env.JWTHomeClaim,
+			Scopes:          env.JWTScopes,
+			DefaultScopes:   env.JWTDefaultScopes,
+			Leeway:          env.JWTLeeway,
+			RefreshInterval: env.JWTJWKSRefreshInterval,
+			Timeout:         env.JWTJWKSTimeout,
+		})
+	}
+
+	s := server.New(env.Host, env.Port, server.AuthPolicy{
+		Enabled:        env.AuthEnabled,
+		ProtectHealth:  env.AuthProtectHealth,
+		ProtectMetrics: env.AuthProtectMetrics,
+	}, server.RateLimitPolicy{
+		AddressRate:  env.RateLimitAddressRate,
+		AddressBurst: env.RateLimitAddressBurst,
+		ClientRate:   env.RateLimitClientRate,
+		ClientBurst:  env.RateLimitClientBurst,
+		DeviceRate:   env.RateLimitDeviceRate,
+		DeviceBurst:  env.RateLimitDeviceBurst,
+	}, timestamps, server.Clients{
+		Storage:    clients.Storage,
+		PubSub:     clients.PubSub,
+		Dispatcher: d,
+		Processor:  p,
+		Tokens:     tokens,
+	})
+	services = append(services, s)
+
+	// Dispatcher and processor are stopped after the server, which uses them
+	services = append(services, d)
 	services = append(services, p)
+	// Alerter is stopped after the processor, which uses it
+	services = append(services, a)
+
+	services = append(services, webhooks.New(webhooks.Config{
+		PollInterval:        env.WebhookPollInterval,
+		MinBackoff:          env.WebhookMinBackoff,
+		MaxBackoff:          env.WebhookMaxBackoff,
+		MaxAttempts:         env.WebhookMaxAttempts,
+		MaxFailures:         env.WebhookMaxFailures,
+		AvailabilityTimeout: env.AvailabilityTimeout,
+		Retention:           env.WebhookDeliveryRetention,
+	}, webhooks.Clients{
+		Storage: clients.Storage,
+		HTTP:    webhookClient,
+	}))
+
+	if env.ControlEnabled {
+		services = append(services, controller.New(env.ControlInterval, env.ControlDecisionRetention, controller.Policy{
+			Hysteresis:   env.ControlHysteresis,
+			MinOnTime:    env.ControlMinOnTime,
+			MinOffTime:   env.ControlMinOffTime,
+			MinCycleTime: env.MinCycleTime,
+			MaxStateAge:  env.ControlMaxStateAge,
+		}, controller.Clients{
+			Storage: clients.Storage,
+			PubSub:  clients.PubSub,
+		}))
+	}
+
+	if env.WeatherProviderURL != "" {
+		services = append(services, poller.New(env.WeatherPollInterval, env.OutdoorRetention, poller.Clients{
+			Storage: clients.Storage,
+			Weather: weather.New(weather.Config{
+				URL:     env.WeatherProviderURL,
+				Timeout: env.WeatherTimeout,
+			}),
+		}))
+	}
 
 	return services, nil
 }
@@ -111,7 +275,20 @@ func setupClients(ctx context.Context, env *env.Config) (*Clients, error) {
 		return nil, fmt.Errorf("error creating new storage client: %v", err)
 	}
 
-	c.PubSub, err = pubsub.New(ctx, env.PubSubHost, env.PubSubPort, env.PubSubClientID, env.PubSubQoS)
+	c.PubSub, err = pubsub.New(ctx, pubsub.Config{
+		Scheme:         env.PubSubScheme,
+		Host:           env.PubSubHost,
+		Port:           env.PubSubPort,
+		Path:           env.PubSubPath,
+		ClientID:       env.PubSubClientID,
+		QoS:            env.PubSubQoS,
+		Username:       env.PubSubUsername,
+		Password:       env.PubSubPassword,
+		PasswordFile:   env.PubSubPasswordFile,
+		CACertPath:     env.PubSubCACertPath,
+		ClientCertPath: env.PubSubClientCertPath,
+		ClientKeyPath:  env.PubSubClientKeyPath,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error creating new pubsub client: %v", err)
 	}
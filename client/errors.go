@@ -11,3 +11,31 @@ func (e *ErrNotFound) Error() string {
 func (e *ErrNotFound) Unwrap() error {
 	return e.Err
 }
+
+// ErrConflict is returned when a change can't be made in the current state of
+// the resource.
+type ErrConflict struct {
+	Err error
+}
+
+func (e *ErrConflict) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrConflict) Unwrap() error {
+	return e.Err
+}
+
+// ErrUnauthorized is returned when credentials are invalid, as opposed to
+// failing to check them.
+type ErrUnauthorized struct {
+	Err error
+}
+
+func (e *ErrUnauthorized) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrUnauthorized) Unwrap() error {
+	return e.Err
+}
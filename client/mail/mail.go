@@ -0,0 +1,131 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+)
+
+// Client emails alert notifications through an SMTP server. Credentials are
+// optional, servers that relay for the host don't need them.
+type Client struct {
+	addr    string
+	host    string
+	from    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+type Config struct {
+	Host     string
+	Port     uint16
+	Username string
+	Password string
+	From     string
+	Timeout  time.Duration
+}
+
+func New(config Config) *Client {
+	var c Client
+
+	c.addr = net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	c.host = config.Host
+	c.from = config.From
+	c.timeout = config.Timeout
+
+	if config.Username != "" {
+		c.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+
+	return &c
+}
+
+func (c *Client) SendNotification(ctx context.Context, to string, n *alert.Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("error dialing SMTP server: %v", err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("error setting connection deadline: %v", err)
+	}
+
+	client, err := smtp.NewClient(conn, c.host)
+	if err != nil {
+		return fmt.Errorf("error creating SMTP client: %v", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(nil)
+		if err != nil {
+			return fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+
+	if c.auth != nil {
+		err = client.Auth(c.auth)
+		if err != nil {
+			return fmt.Errorf("error authenticating: %v", err)
+		}
+	}
+
+	err = client.Mail(c.from)
+	if err != nil {
+		return fmt.Errorf("error setting sender: %v", err)
+	}
+
+	err = client.Rcpt(to)
+	if err != nil {
+		return fmt.Errorf("error setting recipient: %v", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error starting message: %v", err)
+	}
+
+	_, err = w.Write(message(c.from, to, n))
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+
+	err = client.Quit()
+	if err != nil {
+		return fmt.Errorf("error closing SMTP session: %v", err)
+	}
+
+	return nil
+}
+
+func message(from, to string, n *alert.Notification) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: [%s] %s on %s\r\n", n.Status, n.RuleName, n.DeviceID)
+	fmt.Fprintf(&b, "Date: %s\r\n", n.SentAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "%s\r\n", n.Message)
+
+	return b.Bytes()
+}
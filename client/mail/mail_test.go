@@ -0,0 +1,171 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+)
+
+// smtpStub is a minimal SMTP server that accepts a single message, and
+// optionally rejects its recipient.
+type smtpStub struct {
+	listener     net.Listener
+	rejectRcpt   bool
+	from, to     string
+	data         string
+	sessionEnded chan struct{}
+}
+
+func newSMTPStub(t *testing.T, rejectRcpt bool) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := smtpStub{
+		listener:     listener,
+		rejectRcpt:   rejectRcpt,
+		sessionEnded: make(chan struct{}),
+	}
+
+	go s.serve()
+
+	return &s
+}
+
+func (s *smtpStub) serve() {
+	defer close(s.sessionEnded)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP stub")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = strings.TrimPrefix(line, "MAIL FROM:")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rejectRcpt {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+			s.to = strings.TrimPrefix(line, "RCPT TO:")
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.data = string(data)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *smtpStub) config() Config {
+	addr := s.listener.Addr().(*net.TCPAddr)
+
+	return Config{
+		Host:    "127.0.0.1",
+		Port:    uint16(addr.Port),
+		From:    "thermostat@example.com",
+		Timeout: time.Second,
+	}
+}
+
+func TestSendNotification(t *testing.T) {
+	notification := alert.Notification{
+		RuleID:   1,
+		RuleName: "Living room too cold",
+		Kind:     alert.TemperatureRangeRule,
+		DeviceID: "test_device_id",
+		Status:   alert.FiringStatus,
+		Message:  "temperature 14.50 is below 16.00",
+		SentAt:   time.Date(2024, 6, 7, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name       string
+		rejectRcpt bool
+		wantErr    bool
+	}{
+		{
+			name: "should email notification",
+		},
+		{
+			name:       "should return error, if recipient is rejected",
+			rejectRcpt: true,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newSMTPStub(t, tt.rejectRcpt)
+
+			c := New(stub.config())
+			err := c.SendNotification(context.Background(), "owner@example.com", &notification)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SendNotification() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			<-stub.sessionEnded
+
+			if stub.from != "<thermostat@example.com>" || stub.to != "<owner@example.com>" {
+				t.Errorf("SendNotification() sent from %s to %s, want from <thermostat@example.com> to <owner@example.com>", stub.from, stub.to)
+			}
+
+			if !strings.Contains(stub.data, "Subject: [FIRING] Living room too cold on test_device_id") {
+				t.Errorf("SendNotification() message is missing subject:\n%s", stub.data)
+			}
+
+			if !strings.Contains(stub.data, notification.Message) {
+				t.Errorf("SendNotification() message is missing %q:\n%s", notification.Message, stub.data)
+			}
+		})
+	}
+}
+
+func TestSendNotificationUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	c := New(Config{Host: "127.0.0.1", Port: uint16(port), From: "thermostat@example.com", Timeout: time.Second})
+	err = c.SendNotification(context.Background(), "owner@example.com", &alert.Notification{})
+	if err == nil {
+		t.Errorf("SendNotification() to closed port %d expected error, got nil", port)
+	}
+}
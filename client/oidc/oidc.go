@@ -0,0 +1,398 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Client verifies JWTs issued by an identity provider against its JWKS, which
+// is loaded from a URL or from a local file. Keys are cached, and refetched
+// every RefreshInterval or when a token is signed with an unknown key.
+type Client struct {
+	config     Config
+	httpClient *http.Client
+
+	// load makes concurrent requests wait for the JWKS being loaded instead
+	// of loading it again, without blocking requests with cached keys
+	load sync.Mutex
+
+	mu          sync.Mutex
+	keys        map[string]jose.JSONWebKey
+	loadErr     error
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+type Config struct {
+	JWKSURL  string
+	JWKSFile string
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim roles are read from, nested claims are separated
+	// by dots, e.g. "realm_access.roles"
+	RolesClaim string
+	// HomeClaim is the claim the ID of the home of the user is read from,
+	// nested the same way as RolesClaim
+	HomeClaim string
+	// Scopes maps values of the "scope" or "scp" claim to the scopes of the
+	// API, other values such as "openid" or "profile" are ignored
+	Scopes map[string]apikey.Scope
+	// DefaultScopes are given to tokens with none of the scopes in Scopes,
+	// which is the case for most tokens of providers that don't issue custom
+	// scopes
+	DefaultScopes []apikey.Scope
+	// Leeway is the clock skew allowed when checking expiry
+	Leeway          time.Duration
+	RefreshInterval time.Duration
+	Timeout         time.Duration
+}
+
+// Unknown keys and failed loads don't trigger a refetch more often than this,
+// so that tokens with made up key IDs can't be used to hammer the identity
+// provider
+const minRefetchInterval = 30 * time.Second
+
+// Only asymmetric algorithms are accepted, as anyone with the JWKS would be
+// able to sign tokens otherwise
+var algorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+}
+
+func New(config Config) *Client {
+	var c Client
+
+	c.config = config
+	c.httpClient = &http.Client{Timeout: config.Timeout}
+
+	return &c
+}
+
+// claims are all claims of the token, for the ones jwt.Claims doesn't have,
+// such as roles and scopes.
+type claims map[string]any
+
+// VerifyToken checks the signature, issuer, audience and expiry of the token,
+// and maps its claims to an identity. ErrUnauthorized is returned for tokens
+// that aren't valid.
+func (c *Client) VerifyToken(ctx context.Context, token string) (*identity.Identity, error) {
+	parsed, err := jwt.ParseSigned(token, algorithms)
+	if err != nil {
+		return nil, &client.ErrUnauthorized{Err: fmt.Errorf("error parsing token: %v", err)}
+	}
+
+	// Compact tokens always have exactly one signature
+	h := parsed.Headers[0]
+
+	key, err := c.key(ctx, h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAlgorithm(key, jose.SignatureAlgorithm(h.Algorithm))
+	if err != nil {
+		return nil, &client.ErrUnauthorized{Err: err}
+	}
+
+	var registered jwt.Claims
+	var custom claims
+	err = parsed.Claims(key, &registered, &custom)
+	if err != nil {
+		return nil, &client.ErrUnauthorized{Err: fmt.Errorf("error verifying token: %v", err)}
+	}
+
+	err = c.validateClaims(&registered, time.Now())
+	if err != nil {
+		return nil, &client.ErrUnauthorized{Err: err}
+	}
+
+	return c.identity(&registered, custom), nil
+}
+
+// checkAlgorithm rejects tokens whose algorithm doesn't match the key. The
+// algorithm of the JWK is used if it is set, otherwise it is derived from the
+// key type and curve, so that e.g. ES512 can't be used with a P-256 key.
+func checkAlgorithm(key jose.JSONWebKey, alg jose.SignatureAlgorithm) error {
+	if key.Algorithm != "" {
+		if string(alg) != key.Algorithm {
+			return fmt.Errorf("algorithm %s doesn't match algorithm %s of key %s", alg, key.Algorithm, key.KeyID)
+		}
+		return nil
+	}
+
+	var allowed []jose.SignatureAlgorithm
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		allowed = []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			allowed = []jose.SignatureAlgorithm{jose.ES256}
+		case elliptic.P384():
+			allowed = []jose.SignatureAlgorithm{jose.ES384}
+		case elliptic.P521():
+			allowed = []jose.SignatureAlgorithm{jose.ES512}
+		}
+	}
+
+	if !slices.Contains(allowed, alg) {
+		return fmt.Errorf("algorithm %s doesn't match key %s of type %s", alg, key.KeyID, keyType(key))
+	}
+
+	return nil
+}
+
+func keyType(key jose.JSONWebKey) string {
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("EC %s", k.Curve.Params().Name)
+	default:
+		return fmt.Sprintf("%T", k)
+	}
+}
+
+func (c *Client) validateClaims(registered *jwt.Claims, now time.Time) error {
+	if registered.Expiry == nil {
+		return errors.New("expiry must be set")
+	}
+
+	if registered.Subject == "" {
+		return errors.New("subject must be set")
+	}
+
+	err := registered.ValidateWithLeeway(jwt.Expected{
+		Issuer:      c.config.Issuer,
+		AnyAudience: jwt.Audience{c.config.Audience},
+		Time:        now,
+	}, c.config.Leeway)
+	if err != nil {
+		return fmt.Errorf("error validating claims: %v", err)
+	}
+
+	return nil
+}
+
+// identity maps standard OIDC claims to the identity. Scopes are read from
+// the space separated "scope" claim, or the "scp" list some providers use,
+// and mapped to the scopes of the API with Config.Scopes.
+func (c *Client) identity(registered *jwt.Claims, custom claims) *identity.Identity {
+	i := identity.Identity{Method: identity.JWTMethod, Scopes: []apikey.Scope{}}
+
+	i.Subject = registered.Subject
+	i.Email, _ = custom["email"].(string)
+	i.Name, _ = custom["name"].(string)
+	if i.Name == "" {
+		i.Name, _ = custom["preferred_username"].(string)
+	}
+
+	i.Roles = stringList(nestedClaim(custom, c.config.RolesClaim))
+	if c.config.HomeClaim != "" {
+		i.HomeID, _ = nestedClaim(custom, c.config.HomeClaim).(string)
+	}
+
+	scopes := custom["scp"]
+	if scope, ok := custom["scope"].(string); ok {
+		scopes = strings.Fields(scope)
+	}
+	for _, claimed := range stringList(scopes) {
+		scope, ok := c.config.Scopes[claimed]
+		if ok && !slices.Contains(i.Scopes, scope) {
+			i.Scopes = append(i.Scopes, scope)
+		}
+	}
+
+	if len(i.Scopes) == 0 {
+		i.Scopes = append(i.Scopes, c.config.DefaultScopes...)
+	}
+
+	return &i
+}
+
+// nestedClaim returns the claim at the dot separated path, or nil if any part
+// of the path is missing.
+func nestedClaim(custom claims, path string) any {
+	var claim any = map[string]any(custom)
+	for _, name := range strings.Split(path, ".") {
+		nested, _ := claim.(map[string]any)
+		claim = nested[name]
+	}
+
+	return claim
+}
+
+// stringList reads claims that can be a single string or a list of strings.
+func stringList(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// key returns the public key with the ID, reloading the JWKS when it is stale
+// or doesn't have the key. The JWKS is loaded without holding the lock of the
+// cached keys, so requests with known keys aren't blocked by a slow identity
+// provider.
+func (c *Client) key(ctx context.Context, kid string) (jose.JSONWebKey, error) {
+	key, known, shouldLoad := c.cachedKey(kid, time.Now())
+	if shouldLoad {
+		c.load.Lock()
+		// Another request might have loaded the JWKS while we were waiting
+		key, known, shouldLoad = c.cachedKey(kid, time.Now())
+		if shouldLoad {
+			c.reload(ctx)
+			key, known, _ = c.cachedKey(kid, time.Now())
+		}
+		c.load.Unlock()
+	}
+
+	if !known {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// Keep using the keys we have if the identity provider is down
+		if c.keys == nil {
+			return jose.JSONWebKey{}, fmt.Errorf("error loading jwks: %v", c.loadErr)
+		}
+
+		return jose.JSONWebKey{}, &client.ErrUnauthorized{Err: fmt.Errorf("key %s isn't in the jwks", kid)}
+	}
+
+	return key, nil
+}
+
+// cachedKey returns the cached key with the ID, and whether the JWKS should be
+// loaded, because it is stale or doesn't have the key. Loads aren't attempted
+// more often than minRefetchInterval, whether they succeeded or not.
+func (c *Client) cachedKey(kid string, now time.Time) (key jose.JSONWebKey, known, shouldLoad bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, known = c.keys[kid]
+	stale := c.keys == nil || now.Sub(c.fetchedAt) > c.config.RefreshInterval
+	shouldLoad = (stale || !known) && now.Sub(c.attemptedAt) > minRefetchInterval
+
+	return key, known, shouldLoad
+}
+
+func (c *Client) reload(ctx context.Context) {
+	keys, err := c.loadKeys(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.attemptedAt = now
+	c.loadErr = err
+	if err == nil {
+		c.keys = keys
+		c.fetchedAt = now
+	}
+}
+
+func (c *Client) loadKeys(ctx context.Context) (map[string]jose.JSONWebKey, error) {
+	var data []byte
+	var err error
+	if c.config.JWKSFile != "" {
+		data, err = os.ReadFile(c.config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading jwks file: %v", err)
+		}
+	} else {
+		data, err = c.fetchKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching jwks: %v", err)
+		}
+	}
+
+	// Keys are unmarshalled one by one, as a key of a type we can't verify
+	// with shouldn't make the whole JWKS unusable
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling jwks: %v", err)
+	}
+
+	keys := make(map[string]jose.JSONWebKey)
+	for _, raw := range set.Keys {
+		var meta struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+		}
+		err := json.Unmarshal(raw, &meta)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling jwk: %v", err)
+		}
+
+		// Encryption keys and key types we can't verify with are of no use
+		if (meta.Use != "" && meta.Use != "sig") || (meta.Kty != "RSA" && meta.Kty != "EC") {
+			continue
+		}
+
+		var key jose.JSONWebKey
+		err = key.UnmarshalJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %v", meta.Kid, err)
+		}
+
+		keys[key.KeyID] = key.Public()
+	}
+
+	return keys, nil
+}
+
+func (c *Client) fetchKeys(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.JWKSURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, body)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
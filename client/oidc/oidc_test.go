@@ -0,0 +1,553 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	testIssuer   = "https://id.example.com"
+	testAudience = "thermostat-api"
+)
+
+var (
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testEC384Key, _ = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+)
+
+var testScopes = map[string]apikey.Scope{
+	"thermostat.read":  apikey.ReadScope,
+	"thermostat.write": apikey.WriteScope,
+	"thermostat.admin": apikey.AdminScope,
+}
+
+func testJWKS(t *testing.T) []byte {
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &testRSAKey.PublicKey, KeyID: "rsa", Use: "sig"},
+		{Key: &testRSAKey.PublicKey, KeyID: "rsa-ps", Use: "sig", Algorithm: string(jose.PS256)},
+		{Key: &testECKey.PublicKey, KeyID: "ec"},
+		{Key: &testEC384Key.PublicKey, KeyID: "ec384"},
+	}}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("error marshalling jwks: %v", err)
+	}
+
+	// Keys of types we can't verify with are skipped
+	var raw struct {
+		Keys []any `json:"keys"`
+	}
+	_ = json.Unmarshal(data, &raw)
+	raw.Keys = append(raw.Keys, map[string]any{"kty": "OKP", "kid": "ed"})
+
+	data, err = json.Marshal(raw)
+	if err != nil {
+		t.Fatalf("error marshalling jwks: %v", err)
+	}
+
+	return data
+}
+
+func sign(t *testing.T, alg jose.SignatureAlgorithm, kid string, claims map[string]any) string {
+	var key any
+	switch alg {
+	case jose.ES256:
+		key = testECKey
+	case jose.ES384:
+		key = testEC384Key
+	case jose.HS256:
+		key = []byte("a secret of the length of the hash")
+	default:
+		key = testRSAKey
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+
+	return token
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":                testIssuer,
+		"aud":                []string{testAudience, "other"},
+		"sub":                "user-1",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alex",
+		"realm_access":       map[string]any{"roles": []string{"parent"}},
+		"scope":              "openid thermostat.read thermostat.write",
+		"home":               "smiths",
+	}
+}
+
+func withClaim(name string, value any) map[string]any {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+
+	return claims
+}
+
+func newFileClient(t *testing.T) *Client {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(path, testJWKS(t), 0o600)
+	if err != nil {
+		t.Fatalf("error writing jwks file: %v", err)
+	}
+
+	return New(Config{
+		JWKSFile:        path,
+		Issuer:          testIssuer,
+		Audience:        testAudience,
+		RolesClaim:      "realm_access.roles",
+		HomeClaim:       "home",
+		Scopes:          testScopes,
+		DefaultScopes:   []apikey.Scope{apikey.ReadScope},
+		Leeway:          time.Minute,
+		RefreshInterval: time.Hour,
+	})
+}
+
+func TestVerifyToken(t *testing.T) {
+	c := newFileClient(t)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "should accept RS256 token",
+			token: sign(t, jose.RS256, "rsa", validClaims()),
+		},
+		{
+			name:  "should accept ES256 token",
+			token: sign(t, jose.ES256, "ec", validClaims()),
+		},
+		{
+			name:  "should accept ES384 token",
+			token: sign(t, jose.ES384, "ec384", validClaims()),
+		},
+		{
+			name:  "should accept token with algorithm of key",
+			token: sign(t, jose.PS256, "rsa-ps", validClaims()),
+		},
+		{
+			name:  "should accept token expired within leeway",
+			token: sign(t, jose.RS256, "rsa", withClaim("exp", time.Now().Add(-30*time.Second).Unix())),
+		},
+		{
+			name:    "should reject expired token",
+			token:   sign(t, jose.RS256, "rsa", withClaim("exp", time.Now().Add(-time.Hour).Unix())),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token without expiry",
+			token:   sign(t, jose.RS256, "rsa", withClaim("exp", nil)),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token without subject",
+			token:   sign(t, jose.RS256, "rsa", withClaim("sub", nil)),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token that isn't valid yet",
+			token:   sign(t, jose.RS256, "rsa", withClaim("nbf", time.Now().Add(time.Hour).Unix())),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token of other issuer",
+			token:   sign(t, jose.RS256, "rsa", withClaim("iss", "https://evil.example.com")),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token for other audience",
+			token:   sign(t, jose.RS256, "rsa", withClaim("aud", "other")),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token signed with other key",
+			token:   sign(t, jose.RS256, "ec", validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token with other algorithm than the key",
+			token:   sign(t, jose.RS256, "rsa-ps", validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token signed with unknown key",
+			token:   sign(t, jose.RS256, "unknown", validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "should reject token signed with key of unsupported type",
+			token:   sign(t, jose.RS256, "ed", validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "should reject symmetric token",
+			token:   sign(t, jose.HS256, "rsa", validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "should reject unsigned token",
+			token:   sign(t, jose.RS256, "rsa", validClaims())[:10] + "..",
+			wantErr: true,
+		},
+		{
+			name:    "should reject tampered token",
+			token:   sign(t, jose.RS256, "rsa", validClaims()) + "AA",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.VerifyToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if _, ok := err.(*client.ErrUnauthorized); !ok {
+					t.Errorf("VerifyToken() error = %T, want ErrUnauthorized", err)
+				}
+				return
+			}
+
+			if got.Subject != "user-1" || got.Name != "alex" || !got.HasRole("parent") {
+				t.Errorf("VerifyToken() = %+v, want user-1 named alex with role parent", got)
+			}
+
+			if got.HomeID != "smiths" {
+				t.Errorf("VerifyToken() home = %s, want smiths", got.HomeID)
+			}
+
+			if !slices.Equal(got.Scopes, []apikey.Scope{apikey.ReadScope, apikey.WriteScope}) {
+				t.Errorf("VerifyToken() scopes = %v, want read and write", got.Scopes)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenScopes(t *testing.T) {
+	c := newFileClient(t)
+
+	tests := []struct {
+		name  string
+		scope any
+		want  []apikey.Scope
+	}{
+		{
+			name:  "should give default scopes to token without scopes of the api",
+			scope: "openid profile email",
+			want:  []apikey.Scope{apikey.ReadScope},
+		},
+		{
+			name:  "should give default scopes to token without scope claim",
+			scope: nil,
+			want:  []apikey.Scope{apikey.ReadScope},
+		},
+		{
+			name:  "should map scopes of the api and ignore others",
+			scope: "openid thermostat.write profile thermostat.admin",
+			want:  []apikey.Scope{apikey.WriteScope, apikey.AdminScope},
+		},
+		{
+			name:  "should map scp list",
+			scope: []string{"thermostat.read", "thermostat.read"},
+			want:  []apikey.Scope{apikey.ReadScope},
+		},
+		{
+			name:  "should not accept scopes of the api by their own names",
+			scope: "read write admin",
+			want:  []apikey.Scope{apikey.ReadScope},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := withClaim("scope", nil)
+			switch tt.scope.(type) {
+			case string:
+				claims["scope"] = tt.scope
+			case []string:
+				claims["scp"] = tt.scope
+			}
+
+			got, err := c.VerifyToken(context.Background(), sign(t, jose.ES256, "ec", claims))
+			if err != nil {
+				t.Fatalf("VerifyToken() error = %v", err)
+			}
+
+			if !slices.Equal(got.Scopes, tt.want) {
+				t.Errorf("VerifyToken() scopes = %v, want %v", got.Scopes, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     jose.JSONWebKey
+		alg     jose.SignatureAlgorithm
+		wantErr bool
+	}{
+		{
+			name: "should accept RSA algorithms for RSA key",
+			key:  jose.JSONWebKey{Key: &testRSAKey.PublicKey},
+			alg:  jose.PS512,
+		},
+		{
+			name:    "should reject EC algorithm for RSA key",
+			key:     jose.JSONWebKey{Key: &testRSAKey.PublicKey},
+			alg:     jose.ES256,
+			wantErr: true,
+		},
+		{
+			name: "should accept algorithm of curve",
+			key:  jose.JSONWebKey{Key: &testEC384Key.PublicKey},
+			alg:  jose.ES384,
+		},
+		{
+			name:    "should reject algorithm of other curve",
+			key:     jose.JSONWebKey{Key: &testEC384Key.PublicKey},
+			alg:     jose.ES256,
+			wantErr: true,
+		},
+		{
+			name:    "should reject RSA algorithm for EC key",
+			key:     jose.JSONWebKey{Key: &testECKey.PublicKey},
+			alg:     jose.RS256,
+			wantErr: true,
+		},
+		{
+			name:    "should reject other algorithm than the one of the key",
+			key:     jose.JSONWebKey{Key: &testRSAKey.PublicKey, Algorithm: string(jose.RS512)},
+			alg:     jose.RS256,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAlgorithm(tt.key, tt.alg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAlgorithm() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type fakeProvider struct {
+	JWKS []byte
+
+	mu       sync.Mutex
+	requests int
+	fail     bool
+	// Release blocks requests until it is closed, if set
+	Release chan struct{}
+}
+
+func (p *fakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests++
+	fail, release := p.fail, p.Release
+	p.mu.Unlock()
+
+	if release != nil {
+		<-release
+	}
+
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(p.JWKS)
+}
+
+func (p *fakeProvider) Requests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+func newURLClient(url string) *Client {
+	return New(Config{
+		JWKSURL:         url,
+		Issuer:          testIssuer,
+		Audience:        testAudience,
+		RolesClaim:      "roles",
+		Scopes:          testScopes,
+		RefreshInterval: time.Hour,
+		Timeout:         5 * time.Second,
+	})
+}
+
+// allowRefetch pretends the last load was attempted long enough ago for the
+// JWKS to be loaded again.
+func (c *Client) allowRefetch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attemptedAt = time.Now().Add(-2 * minRefetchInterval)
+}
+
+func TestVerifyTokenJWKSURL(t *testing.T) {
+	provider := fakeProvider{JWKS: testJWKS(t)}
+	server := httptest.NewServer(&provider)
+	defer server.Close()
+
+	c := newURLClient(server.URL)
+
+	for range 3 {
+		_, err := c.VerifyToken(context.Background(), sign(t, jose.ES256, "ec", validClaims()))
+		if err != nil {
+			t.Fatalf("VerifyToken() error = %v", err)
+		}
+	}
+
+	// Unknown keys don't refetch the JWKS right after it was fetched
+	_, err := c.VerifyToken(context.Background(), sign(t, jose.RS256, "rotated", validClaims()))
+	if err == nil {
+		t.Errorf("VerifyToken() error = nil, want error for unknown key")
+	}
+
+	if provider.Requests() != 1 {
+		t.Errorf("VerifyToken() fetched jwks %d times, want %d", provider.Requests(), 1)
+	}
+}
+
+func TestVerifyTokenJWKSFailure(t *testing.T) {
+	provider := fakeProvider{JWKS: testJWKS(t), fail: true}
+	server := httptest.NewServer(&provider)
+	defer server.Close()
+
+	c := newURLClient(server.URL)
+	token := sign(t, jose.ES256, "ec", validClaims())
+
+	for range 3 {
+		_, err := c.VerifyToken(context.Background(), token)
+		if err == nil {
+			t.Fatalf("VerifyToken() error = nil, want error for unavailable jwks")
+		}
+		if _, ok := err.(*client.ErrUnauthorized); ok {
+			t.Fatalf("VerifyToken() error = %v, want error other than ErrUnauthorized", err)
+		}
+	}
+
+	// Failed loads are throttled the same way as unknown keys
+	if provider.Requests() != 1 {
+		t.Errorf("VerifyToken() fetched jwks %d times, want %d", provider.Requests(), 1)
+	}
+
+	provider.mu.Lock()
+	provider.fail = false
+	provider.mu.Unlock()
+	c.allowRefetch()
+
+	_, err := c.VerifyToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("VerifyToken() error = %v", err)
+	}
+
+	// Cached keys keep being used when a refresh fails
+	provider.mu.Lock()
+	provider.fail = true
+	provider.mu.Unlock()
+	c.mu.Lock()
+	c.fetchedAt = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+	c.allowRefetch()
+
+	_, err = c.VerifyToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("VerifyToken() error = %v, want cached key to be used", err)
+	}
+
+	if provider.Requests() != 3 {
+		t.Errorf("VerifyToken() fetched jwks %d times, want %d", provider.Requests(), 3)
+	}
+}
+
+func TestVerifyTokenSlowJWKS(t *testing.T) {
+	provider := fakeProvider{JWKS: testJWKS(t)}
+	server := httptest.NewServer(&provider)
+	defer server.Close()
+
+	c := newURLClient(server.URL)
+	token := sign(t, jose.ES256, "ec", validClaims())
+
+	_, err := c.VerifyToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("VerifyToken() error = %v", err)
+	}
+
+	release := make(chan struct{})
+	provider.mu.Lock()
+	provider.Release = release
+	provider.mu.Unlock()
+	c.allowRefetch()
+
+	// A token with an unknown key makes the JWKS be fetched again, which
+	// hangs until released
+	rotated := sign(t, jose.RS256, "rotated", validClaims())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.VerifyToken(context.Background(), rotated)
+	}()
+
+	for provider.Requests() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := c.VerifyToken(context.Background(), token)
+		verified <- err
+	}()
+
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("VerifyToken() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("VerifyToken() of cached key waited for the jwks to be fetched")
+	}
+
+	close(release)
+	<-done
+}
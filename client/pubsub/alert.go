@@ -0,0 +1,23 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+)
+
+func (p *Client) PublishAlert(ctx context.Context, a *alert.Alert) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("error marshalling alert: %v", err)
+	}
+
+	err = p.Publish(ctx, "thermostat/alert", payload)
+	if err != nil {
+		return fmt.Errorf("error publishing alert: %v", err)
+	}
+
+	return nil
+}
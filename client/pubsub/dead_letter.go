@@ -0,0 +1,23 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+)
+
+func (p *Client) PublishDeadLetter(ctx context.Context, topic string, letter *deadletter.DeadLetter) error {
+	payload, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("error marshalling dead letter: %v", err)
+	}
+
+	err = p.Publish(ctx, topic, payload)
+	if err != nil {
+		return fmt.Errorf("error publishing dead letter: %v", err)
+	}
+
+	return nil
+}
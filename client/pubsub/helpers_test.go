@@ -0,0 +1,263 @@
+package pubsub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+type testBrokerOptions struct {
+	// TLS makes the broker listen with TLS, and require client certificates if
+	// RequireClientCert is set
+	TLS               *testCerts
+	RequireClientCert bool
+	// Websocket makes the broker listen over websockets instead of raw TCP
+	Websocket bool
+	// Users restricts connections to the given username/password pairs
+	Users map[string]string
+}
+
+// newTestBroker starts an in-process MQTT broker listening on a random local
+// port and returns it together with its host and port.
+func newTestBroker(t *testing.T, opts testBrokerOptions) (*mqtt.Server, string, uint16) {
+	broker := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	var err error
+	if len(opts.Users) > 0 {
+		ledger := &auth.Ledger{Users: auth.Users{}}
+		for username, password := range opts.Users {
+			ledger.Users[username] = auth.UserRule{
+				Username: auth.RString(username),
+				Password: auth.RString(password),
+			}
+		}
+		err = broker.AddHook(new(auth.Hook), &auth.Options{Ledger: ledger})
+	} else {
+		err = broker.AddHook(new(auth.AllowHook), nil)
+	}
+	if err != nil {
+		t.Fatalf("Error adding broker auth hook: %v", err)
+	}
+
+	config := listeners.Config{ID: "test", Address: freeAddress(t)}
+	if opts.TLS != nil {
+		config.TLSConfig = opts.TLS.serverTLSConfig(t, opts.RequireClientCert)
+	}
+
+	var listener listeners.Listener
+	if opts.Websocket {
+		listener = listeners.NewWebsocket(config)
+	} else {
+		listener = listeners.NewTCP(config)
+	}
+
+	err = broker.AddListener(listener)
+	if err != nil {
+		t.Fatalf("Error adding broker listener: %v", err)
+	}
+
+	err = broker.Serve()
+	if err != nil {
+		t.Fatalf("Error serving broker: %v", err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	// TCP listeners are bound when added, but websocket listeners only once
+	// served in the background. Wait until they accept connections, so that
+	// the client doesn't have to back off and retry
+	if opts.Websocket {
+		waitForWebsocketListener(t, config.Address, opts.TLS != nil)
+	}
+
+	host, port := splitHostPort(t, config.Address)
+
+	return broker, host, port
+}
+
+// waitForWebsocketListener probes the listener with a plain HTTP request,
+// which is rejected before the broker sets up an MQTT connection. Probing with
+// a connection the broker sets up could race with closing the broker, if the
+// test ends before the broker is done with it.
+func waitForWebsocketListener(t *testing.T, address string, secure bool) {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		res, err := client.Get(fmt.Sprintf("%s://%s", scheme, address))
+		if err == nil {
+			res.Body.Close()
+			return
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("Error waiting for broker listener: %v", err)
+		}
+	}
+}
+
+// freeAddress reserves a random local port and releases it, so that it can be
+// passed to listeners which don't report the port they end up bound to.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error reserving local port: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func splitHostPort(t *testing.T, address string) (string, uint16) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("Error splitting broker address: %v", err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		t.Fatalf("Error parsing broker port: %v", err)
+	}
+
+	return host, uint16(port)
+}
+
+// testCerts holds paths to a freshly generated CA and server/client
+// certificates signed by it.
+type testCerts struct {
+	CACertPath     string
+	ServerCertPath string
+	ServerKeyPath  string
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir := t.TempDir()
+
+	caKey := newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Error parsing CA certificate: %v", err)
+	}
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) (string, string) {
+		key := newTestKey(t)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Error creating %s certificate: %v", name, err)
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Error marshalling %s key: %v", name, err)
+		}
+
+		certPath := writePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der)
+		keyPath := writePEM(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+
+		return certPath, keyPath
+	}
+
+	var c testCerts
+	c.CACertPath = writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", caDER)
+	c.ServerCertPath, c.ServerKeyPath = issue(2, "server", x509.ExtKeyUsageServerAuth)
+	c.ClientCertPath, c.ClientKeyPath = issue(3, "client", x509.ExtKeyUsageClientAuth)
+
+	return &c
+}
+
+func (c *testCerts) serverTLSConfig(t *testing.T, requireClientCert bool) *tls.Config {
+	cert, err := tls.LoadX509KeyPair(c.ServerCertPath, c.ServerKeyPath)
+	if err != nil {
+		t.Fatalf("Error loading server certificate: %v", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if requireClientCert {
+		caCert, err := os.ReadFile(c.CACertPath)
+		if err != nil {
+			t.Fatalf("Error reading CA certificate: %v", err)
+		}
+
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AppendCertsFromPEM(caCert)
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	return key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatalf("Error writing %s: %v", path, err)
+	}
+
+	return path
+}
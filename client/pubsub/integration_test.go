@@ -0,0 +1,500 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/alexchebotarsky/thermostat-api/tracing/tracingtest"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testDeviceID = "test-device-id"
+
+func newTestConfig(host string, port uint16) Config {
+	return Config{
+		Scheme:   "mqtt",
+		Host:     host,
+		Port:     port,
+		ClientID: "test-client",
+		QoS:      1,
+	}
+}
+
+func newTestClient(ctx context.Context, t *testing.T, config Config) *Client {
+	// Connection lives as long as ctx, so it must not be cancelled early
+	p, err := New(ctx, config)
+	if err != nil {
+		t.Fatalf("Error creating new pubsub client: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Close(context.Background()) })
+
+	return p
+}
+
+// respond makes the broker answer every request published to topic with
+// response, echoing back its correlation data.
+func respond(t *testing.T, broker *mqtt.Server, topic string, response []byte) {
+	err := broker.Subscribe(topic, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		go func() {
+			_ = broker.InjectPacket(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish},
+				TopicName:   pk.Properties.ResponseTopic,
+				Payload:     response,
+				Properties: packets.Properties{
+					CorrelationData: pk.Properties.CorrelationData,
+				},
+			})
+		}()
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing broker responder: %v", err)
+	}
+}
+
+func TestRequestIntegration(t *testing.T) {
+	ctx := context.Background()
+	broker, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	respond(t, broker, "test/request", []byte("pong"))
+
+	// Request with a responder
+	reqCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	got, err := p.Request(reqCtx, "test/request", []byte("ping"))
+	if err != nil {
+		t.Fatalf("Error requesting: %v", err)
+	}
+
+	if string(got) != "pong" {
+		t.Errorf("Request() = %s, want %s", got, "pong")
+	}
+
+	// Request without a responder
+	reqCtx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+
+	_, err = p.Request(reqCtx, "test/unanswered", []byte("ping"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRequestCurrentStateIntegration(t *testing.T) {
+	ctx := context.Background()
+	broker, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	respond(t, broker, "thermostat/get/current-state", []byte(`{
+		"deviceId": "test-device-id",
+		"timestamp": "2024-06-07T12:34:56Z",
+		"operatingState": "HEATING",
+		"currentTemperature": 19.5
+	}`))
+
+	reqCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	got, err := p.RequestCurrentState(reqCtx, &home.Home{ID: home.DefaultID}, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error requesting current state: %v", err)
+	}
+
+	if got.DeviceID != testDeviceID {
+		t.Errorf("DeviceID = %v, want %v", got.DeviceID, testDeviceID)
+	}
+
+	if got.OperatingState != thermostat.HeatingOperatingState {
+		t.Errorf("OperatingState = %v, want %v", got.OperatingState, thermostat.HeatingOperatingState)
+	}
+
+	if got.CurrentTemperature != 19.5 {
+		t.Errorf("CurrentTemperature = %v, want %v", got.CurrentTemperature, 19.5)
+	}
+}
+
+func TestConnectIntegration(t *testing.T) {
+	certs := newTestCerts(t)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(passwordFile, []byte("test-password\n"), 0o600)
+	if err != nil {
+		t.Fatalf("Error writing password file: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		brokerOptions testBrokerOptions
+		config        func(c Config) Config
+		wantErr       bool
+	}{
+		{
+			name:          "should connect over mqtt",
+			brokerOptions: testBrokerOptions{},
+			config:        func(c Config) Config { return c },
+			wantErr:       false,
+		},
+		{
+			name:          "should connect over mqtts with CA certificate",
+			brokerOptions: testBrokerOptions{TLS: certs},
+			config: func(c Config) Config {
+				c.Scheme = "mqtts"
+				c.CACertPath = certs.CACertPath
+				return c
+			},
+			wantErr: false,
+		},
+		{
+			name:          "should connect over mqtts with client certificate",
+			brokerOptions: testBrokerOptions{TLS: certs, RequireClientCert: true},
+			config: func(c Config) Config {
+				c.Scheme = "mqtts"
+				c.CACertPath = certs.CACertPath
+				c.ClientCertPath = certs.ClientCertPath
+				c.ClientKeyPath = certs.ClientKeyPath
+				return c
+			},
+			wantErr: false,
+		},
+		{
+			name:          "should connect over wss",
+			brokerOptions: testBrokerOptions{TLS: certs, Websocket: true},
+			config: func(c Config) Config {
+				c.Scheme = "wss"
+				c.Path = "/mqtt"
+				c.CACertPath = certs.CACertPath
+				return c
+			},
+			wantErr: false,
+		},
+		{
+			name:          "should connect with username and password",
+			brokerOptions: testBrokerOptions{Users: map[string]string{"test-user": "test-password"}},
+			config: func(c Config) Config {
+				c.Username = "test-user"
+				c.Password = "test-password"
+				return c
+			},
+			wantErr: false,
+		},
+		{
+			name:          "should connect with username and password file",
+			brokerOptions: testBrokerOptions{Users: map[string]string{"test-user": "test-password"}},
+			config: func(c Config) Config {
+				c.Username = "test-user"
+				c.PasswordFile = passwordFile
+				return c
+			},
+			wantErr: false,
+		},
+		{
+			name:          "should error with wrong password",
+			brokerOptions: testBrokerOptions{Users: map[string]string{"test-user": "test-password"}},
+			config: func(c Config) Config {
+				c.Username = "test-user"
+				c.Password = "wrong-password"
+				return c
+			},
+			wantErr: true,
+		},
+		{
+			name:          "should error over mqtts without trusted CA",
+			brokerOptions: testBrokerOptions{TLS: certs},
+			config: func(c Config) Config {
+				c.Scheme = "mqtts"
+				return c
+			},
+			wantErr: true,
+		},
+		{
+			name:          "should error over mqtts without required client certificate",
+			brokerOptions: testBrokerOptions{TLS: certs, RequireClientCert: true},
+			config: func(c Config) Config {
+				c.Scheme = "mqtts"
+				c.CACertPath = certs.CACertPath
+				return c
+			},
+			wantErr: true,
+		},
+		{
+			name:          "should error with unsupported scheme",
+			brokerOptions: testBrokerOptions{},
+			config: func(c Config) Config {
+				c.Scheme = "http"
+				return c
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker, host, port := newTestBroker(t, tt.brokerOptions)
+			config := tt.config(newTestConfig(host, port))
+
+			// Connection lives as long as ctx, which is long enough for the test
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			p, err := New(ctx, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer p.Close(context.Background())
+
+			// Check the connection is usable end to end
+			respond(t, broker, "test/request", []byte("pong"))
+
+			got, err := p.Request(ctx, "test/request", []byte("ping"))
+			if err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+
+			if string(got) != "pong" {
+				t.Errorf("Request() = %s, want %s", got, "pong")
+			}
+		})
+	}
+}
+
+func TestSubscribeMetadataIntegration(t *testing.T) {
+	ctx := context.Background()
+	_, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	metadatac := make(chan *event.Metadata, 1)
+	err := p.Subscribe(ctx, "test/events", func(ctx context.Context, payload []byte) error {
+		metadatac <- event.MetadataFromContext(ctx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	_, err = p.connManager.Publish(ctx, &paho.Publish{
+		Topic:   "test/events",
+		QoS:     1,
+		Payload: []byte(`{"deviceId":"test-device-id"}`),
+		Properties: &paho.PublishProperties{
+			ContentType: "application/json",
+			User:        paho.UserProperties{{Key: "message-id", Value: "test-message-id"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	select {
+	case got := <-metadatac:
+		if got.Topic != "test/events" {
+			t.Errorf("Topic = %v, want %v", got.Topic, "test/events")
+		}
+
+		if got.ContentType != "application/json" {
+			t.Errorf("ContentType = %v, want %v", got.ContentType, "application/json")
+		}
+
+		if got.UserProperties["message-id"] != "test-message-id" {
+			t.Errorf("UserProperties[message-id] = %v, want %v", got.UserProperties["message-id"], "test-message-id")
+		}
+
+		if got.ReceivedAt.IsZero() {
+			t.Errorf("ReceivedAt = %v, want receive time", got.ReceivedAt)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestReconnectIntegration(t *testing.T) {
+	ctx := context.Background()
+	broker, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	respond(t, broker, "test/request", []byte("pong"))
+
+	receivedc := make(chan []byte, 10)
+	err := p.Subscribe(ctx, "test/events", func(ctx context.Context, payload []byte) error {
+		receivedc <- payload
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	// Broker loses the subscriptions of the client and drops the connection
+	cl, ok := broker.Clients.Get("test-client")
+	if !ok {
+		t.Fatal("Client is not connected to broker")
+	}
+	broker.UnsubscribeClient(cl)
+	cl.Stop(errors.New("test disconnect"))
+
+	// Responses are received again once the client resubscribed
+	var got []byte
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		got, err = p.Request(reqCtx, "test/request", []byte("ping"))
+		cancel()
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Error requesting after reconnect: %v", err)
+	}
+
+	if string(got) != "pong" {
+		t.Errorf("Request() after reconnect = %s, want %s", got, "pong")
+	}
+
+	err = broker.Publish("test/events", []byte("event"), false, 1)
+	if err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	select {
+	case payload := <-receivedc:
+		if string(payload) != "event" {
+			t.Errorf("received payload = %s, want %s", payload, "event")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for message after reconnect")
+	}
+}
+
+func TestPublishTargetStateIntegration(t *testing.T) {
+	ctx := context.Background()
+	_, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	type message struct {
+		contentType string
+		payload     []byte
+	}
+
+	messagec := make(chan message, 1)
+	// Published under the topic prefix of the home of the device
+	err := p.Subscribe(ctx, "smiths/thermostat/set/target-state", func(ctx context.Context, payload []byte) error {
+		messagec <- message{contentType: event.MetadataFromContext(ctx).ContentType, payload: payload}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	mode := thermostat.HeatMode
+	targetTemperature := 21
+	state := &thermostat.TargetState{DeviceID: testDeviceID, Mode: &mode, TargetTemperature: &targetTemperature}
+
+	err = p.PublishTargetState(ctx, &home.Home{ID: "smiths", TopicPrefix: "smiths"}, state, thermostat.SchemaV2, codec.CBOR)
+	if err != nil {
+		t.Fatalf("Error publishing target state: %v", err)
+	}
+
+	select {
+	case got := <-messagec:
+		if got.contentType != codec.CBORContentType {
+			t.Errorf("ContentType = %v, want %v", got.contentType, codec.CBORContentType)
+		}
+
+		var payload struct {
+			SchemaVersion int    `json:"schemaVersion"`
+			DeviceID      string `json:"deviceId"`
+			Mode          string `json:"mode"`
+			Target        int    `json:"target"`
+		}
+		err := codec.CBOR.Unmarshal(got.payload, &payload)
+		if err != nil {
+			t.Fatalf("Error unmarshalling target state: %v", err)
+		}
+
+		if payload.SchemaVersion != 2 || payload.DeviceID != testDeviceID || payload.Mode != string(mode) || payload.Target != targetTemperature {
+			t.Errorf("payload = %+v, want v2 target state of %s", payload, testDeviceID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for target state")
+	}
+}
+
+func TestTraceContextIntegration(t *testing.T) {
+	exporter := tracingtest.Init()
+
+	ctx := context.Background()
+	_, host, port := newTestBroker(t, testBrokerOptions{})
+	p := newTestClient(ctx, t, newTestConfig(host, port))
+
+	type message struct {
+		spanContext    trace.SpanContext
+		userProperties map[string]string
+	}
+
+	messagec := make(chan message, 1)
+	err := p.Subscribe(ctx, "test/traced", func(ctx context.Context, payload []byte) error {
+		messagec <- message{spanContext: trace.SpanContextFromContext(ctx), userProperties: event.MetadataFromContext(ctx).UserProperties}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	parentCtx, parent := tracing.Start(ctx, "test")
+	err = p.Publish(parentCtx, "test/traced", []byte("{}"))
+	parent.End()
+	if err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+
+	select {
+	case got := <-messagec:
+		if got.userProperties["traceparent"] == "" {
+			t.Errorf("UserProperties = %v, want traceparent", got.userProperties)
+		}
+
+		if got.spanContext.TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("TraceID = %v, want trace of publisher %v", got.spanContext.TraceID(), parent.SpanContext().TraceID())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	// Receive span ends once the handler returns
+	deadline := time.Now().Add(3 * time.Second)
+	for len(exporter.GetSpans()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	publish, published := spans["publish test/traced"]
+	receive, received := spans["receive test/traced"]
+	if !published || !received {
+		t.Fatalf("spans = %v, want publish and receive spans", slices.Collect(maps.Keys(spans)))
+	}
+
+	if receive.Parent.SpanID() != publish.SpanContext.SpanID() {
+		t.Errorf("receive span parent = %v, want publish span %v", receive.Parent.SpanID(), publish.SpanContext.SpanID())
+	}
+}
@@ -0,0 +1,24 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+)
+
+// SendNotification publishes the alert notification as JSON to the topic.
+func (p *Client) SendNotification(ctx context.Context, topic string, n *alert.Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("error marshalling notification: %v", err)
+	}
+
+	err = p.Publish(ctx, topic, payload)
+	if err != nil {
+		return fmt.Errorf("error publishing notification: %v", err)
+	}
+
+	return nil
+}
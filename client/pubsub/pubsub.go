@@ -1,40 +1,91 @@
 package pubsub
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"net/url"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
-	clientID      string
-	qos           byte
-	subscriptions map[string]func(ctx context.Context, payload []byte) error
+	clientID        string
+	qos             byte
+	subscriptionsMu sync.RWMutex
+	subscriptions   map[string]func(ctx context.Context, payload []byte) error
+
+	responseTopic string
+	requestsMu    sync.Mutex
+	requests      map[string]chan *paho.Publish
 
 	connManager *autopaho.ConnectionManager
 }
 
-func New(ctx context.Context, host string, port uint16, clientID string, qos byte) (*Client, error) {
+type Config struct {
+	Scheme   string // One of: mqtt, mqtts, ws, wss
+	Host     string
+	Port     uint16
+	Path     string // Only used by websocket schemes
+	ClientID string
+	QoS      byte
+
+	Username     string
+	Password     string
+	PasswordFile string // Takes precedence over Password if set
+
+	CACertPath     string
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+func New(ctx context.Context, config Config) (*Client, error) {
 	var p Client
 	var err error
 
-	p.clientID = clientID
-	p.qos = qos
+	p.clientID = config.ClientID
+	p.qos = config.QoS
 	p.subscriptions = make(map[string]func(ctx context.Context, payload []byte) error)
+	p.responseTopic = fmt.Sprintf("%s/response", config.ClientID)
+	p.requests = make(map[string]chan *paho.Publish)
 
-	brokerURL, err := url.Parse(fmt.Sprintf("mqtt://%s:%d", host, port))
+	brokerURL, err := brokerURL(config)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing broker URL: %v", err)
+		return nil, fmt.Errorf("error building broker URL: %v", err)
+	}
+
+	tlsConfig, err := tlsConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building TLS config: %v", err)
+	}
+
+	password, err := password(config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading password: %v", err)
 	}
 
 	cfg := autopaho.ClientConfig{
 		ServerUrls:            []*url.URL{brokerURL},
+		TlsCfg:                tlsConfig,
+		ConnectUsername:       config.Username,
+		ConnectPassword:       password,
 		SessionExpiryInterval: 10 * 60, // 10 minutes for reconnection
+		OnConnectionUp:        p.resubscribe,
 		OnConnectError:        p.handleConnectError,
+		ConnectPacketBuilder:  requestProblemInfo,
 		ClientConfig: paho.ClientConfig{
 			ClientID: p.clientID,
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
@@ -53,6 +104,15 @@ func New(ctx context.Context, host string, port uint16, clientID string, qos byt
 		return nil, fmt.Errorf("error awaiting pubsub connection: %v", err)
 	}
 
+	_, err = p.connManager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: p.responseTopic, QoS: p.qos},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to response topic: %v", err)
+	}
+
 	return &p, nil
 }
 
@@ -66,20 +126,97 @@ func (p *Client) Close(ctx context.Context) error {
 }
 
 func (p *Client) Publish(ctx context.Context, topic string, payload []byte) error {
-	_, err := p.connManager.Publish(ctx, &paho.Publish{
+	return p.publish(ctx, topic, payload, "")
+}
+
+// publish sets the MQTT v5 content type of the payload, if there is one, and
+// the trace context in user properties.
+func (p *Client) publish(ctx context.Context, topic string, payload []byte, contentType string) (err error) {
+	ctx, span := startPublishSpan(ctx, topic)
+	defer func() { tracing.End(span, err) }()
+
+	message := &paho.Publish{
+		Topic:      topic,
+		Payload:    payload,
+		QoS:        p.qos,
+		Properties: &paho.PublishProperties{ContentType: contentType},
+	}
+
+	tracing.Inject(ctx, userPropertiesCarrier{&message.Properties.User})
+
+	_, err = p.connManager.Publish(ctx, message)
+	if err != nil {
+		return fmt.Errorf("error publishing message: %v", err)
+	}
+
+	return nil
+}
+
+// Request publishes payload to topic with an MQTT v5 response topic and
+// correlation data, and blocks until the matching response arrives or ctx is
+// done.
+func (p *Client) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	response, err := p.request(ctx, topic, payload, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Payload, nil
+}
+
+// request returns the whole response message, for callers that need its
+// properties.
+func (p *Client) request(ctx context.Context, topic string, payload []byte, contentType string) (response *paho.Publish, err error) {
+	ctx, span := startPublishSpan(ctx, topic)
+	defer func() { tracing.End(span, err) }()
+
+	correlationID, err := newCorrelationID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating correlation id: %v", err)
+	}
+
+	responsec := make(chan *paho.Publish, 1)
+
+	p.requestsMu.Lock()
+	p.requests[correlationID] = responsec
+	p.requestsMu.Unlock()
+
+	defer func() {
+		p.requestsMu.Lock()
+		delete(p.requests, correlationID)
+		p.requestsMu.Unlock()
+	}()
+
+	message := &paho.Publish{
 		Topic:   topic,
 		Payload: payload,
 		QoS:     p.qos,
-	})
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   p.responseTopic,
+			CorrelationData: []byte(correlationID),
+			ContentType:     contentType,
+		},
+	}
+
+	tracing.Inject(ctx, userPropertiesCarrier{&message.Properties.User})
+
+	_, err = p.connManager.Publish(ctx, message)
 	if err != nil {
-		return fmt.Errorf("error publishing message: %v", err)
+		return nil, fmt.Errorf("error publishing request: %v", err)
 	}
 
-	return nil
+	select {
+	case response = <-responsec:
+		return response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error awaiting response: %w", ctx.Err())
+	}
 }
 
 func (p *Client) Subscribe(ctx context.Context, topic string, handler func(ctx context.Context, payload []byte) error) error {
+	p.subscriptionsMu.Lock()
 	p.subscriptions[topic] = handler
+	p.subscriptionsMu.Unlock()
 
 	_, err := p.connManager.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: []paho.SubscribeOptions{
@@ -94,19 +231,233 @@ func (p *Client) Subscribe(ctx context.Context, topic string, handler func(ctx c
 }
 
 func (p *Client) handleMessage(message paho.PublishReceived) (bool, error) {
+	if message.Packet.Topic == p.responseTopic {
+		p.handleResponse(message.Packet)
+		return true, nil
+	}
+
+	ctx := event.WithMetadata(context.Background(), messageMetadata(message.Packet))
+
+	// Continues the trace of the publisher, if it set the trace context
+	if message.Packet.Properties != nil {
+		ctx = tracing.Extract(ctx, userPropertiesCarrier{&message.Packet.Properties.User})
+	}
+
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("receive %s", message.Packet.Topic),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("mqtt"),
+			semconv.MessagingDestinationName(message.Packet.Topic),
+		),
+	)
+
+	p.subscriptionsMu.RLock()
+	handlers := make(map[string]func(ctx context.Context, payload []byte) error)
 	for topic, handler := range p.subscriptions {
-		if message.Packet.Topic == topic {
-			err := handler(context.Background(), message.Packet.Payload)
-			if err != nil {
-				slog.Error(fmt.Sprintf("Error handling message for topic %s: %v", topic, err))
-				return true, err
-			}
+		if event.MatchTopic(topic, message.Packet.Topic) {
+			handlers[topic] = handler
+		}
+	}
+	p.subscriptionsMu.RUnlock()
+
+	for topic, handler := range handlers {
+		err := handler(ctx, message.Packet.Payload)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error handling message for topic %s: %v", topic, err))
+			tracing.End(span, err)
+			return true, err
 		}
 	}
 
+	span.End()
+
 	return true, nil
 }
 
+func startPublishSpan(ctx context.Context, topic string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, fmt.Sprintf("publish %s", topic),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("mqtt"),
+			semconv.MessagingDestinationName(topic),
+		),
+	)
+}
+
+// userPropertiesCarrier reads and writes the trace context in MQTT v5 user
+// properties.
+type userPropertiesCarrier struct {
+	properties *paho.UserProperties
+}
+
+func (c userPropertiesCarrier) Get(key string) string {
+	return c.properties.Get(key)
+}
+
+func (c userPropertiesCarrier) Set(key, value string) {
+	c.properties.Add(key, value)
+}
+
+func (c userPropertiesCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.properties))
+	for _, property := range *c.properties {
+		keys = append(keys, property.Key)
+	}
+
+	return keys
+}
+
+// requestProblemInfo works around brokers such as mochi, which drop user
+// properties from every packet, including PUBLISH, once a client declines
+// problem info. MQTT v5 only applies Request Problem Information to reason
+// strings and user properties of other packets, but paho declines it by
+// default, and user properties carry message IDs and trace context.
+func requestProblemInfo(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+	if cp.Properties == nil {
+		cp.Properties = &paho.ConnectProperties{}
+	}
+	cp.Properties.RequestProblemInfo = true
+
+	return cp, nil
+}
+
+func messageMetadata(packet *paho.Publish) *event.Metadata {
+	metadata := event.Metadata{
+		Topic:          packet.Topic,
+		UserProperties: make(map[string]string),
+		ReceivedAt:     time.Now(),
+	}
+
+	if packet.Properties != nil {
+		metadata.ContentType = packet.Properties.ContentType
+		for _, property := range packet.Properties.User {
+			metadata.UserProperties[property.Key] = property.Value
+		}
+	}
+
+	return &metadata
+}
+
+func (p *Client) handleResponse(packet *paho.Publish) {
+	if packet.Properties == nil || len(packet.Properties.CorrelationData) == 0 {
+		slog.Warn("Received response without correlation data")
+		return
+	}
+
+	correlationID := string(packet.Properties.CorrelationData)
+
+	p.requestsMu.Lock()
+	responsec, ok := p.requests[correlationID]
+	p.requestsMu.Unlock()
+
+	if !ok {
+		slog.Warn(fmt.Sprintf("Received response for unknown or expired request %s", correlationID))
+		return
+	}
+
+	// Channel is buffered for a single response, duplicates are dropped
+	select {
+	case responsec <- packet:
+	default:
+	}
+}
+
+// resubscribe subscribes to the response topic and the topics of handlers
+// again whenever the connection comes up, since the broker may have lost them
+// with the session. It doesn't block the connection manager, which has to
+// receive the SUBACK.
+func (p *Client) resubscribe(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+	subscriptions := []paho.SubscribeOptions{{Topic: p.responseTopic, QoS: p.qos}}
+
+	p.subscriptionsMu.RLock()
+	for topic := range p.subscriptions {
+		subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: topic, QoS: p.qos})
+	}
+	p.subscriptionsMu.RUnlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+		defer cancel()
+
+		_, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subscriptions})
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error resubscribing after pubsub connection came up: %v", err))
+		}
+	}()
+}
+
+const resubscribeTimeout = 10 * time.Second
+
 func (p *Client) handleConnectError(err error) {
 	slog.Error(fmt.Sprintf("error with pubsub connection: %v", err))
 }
+
+func brokerURL(config Config) (*url.URL, error) {
+	switch config.Scheme {
+	case "mqtt", "mqtts", "ws", "wss":
+		// Valid
+	default:
+		return nil, fmt.Errorf("scheme must be one of: [mqtt, mqtts, ws, wss], got: '%s'", config.Scheme)
+	}
+
+	return url.Parse(fmt.Sprintf("%s://%s:%d%s", config.Scheme, config.Host, config.Port, config.Path))
+}
+
+// tlsConfig returns nil for plaintext schemes, otherwise a TLS config trusting
+// the configured CA (or system roots) and presenting the client certificate,
+// if any.
+func tlsConfig(config Config) (*tls.Config, error) {
+	if config.Scheme != "mqtts" && config.Scheme != "wss" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.CACertPath != "" {
+		caCert, err := os.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %v", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("error parsing CA certificate: no PEM certificates found in %s", config.CACertPath)
+		}
+	}
+
+	if config.ClientCertPath != "" || config.ClientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func password(config Config) ([]byte, error) {
+	if config.PasswordFile == "" {
+		return []byte(config.Password), nil
+	}
+
+	password, err := os.ReadFile(config.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading password file: %v", err)
+	}
+
+	return bytes.TrimSpace(password), nil
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
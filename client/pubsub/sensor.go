@@ -0,0 +1,24 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+)
+
+func (p *Client) PublishEffectiveTemperature(ctx context.Context, h *home.Home, temperature *sensor.EffectiveTemperature, c codec.Codec) error {
+	payload, err := c.Marshal(temperature)
+	if err != nil {
+		return fmt.Errorf("error marshalling effective temperature: %v", err)
+	}
+
+	err = p.publish(ctx, h.Topic("thermostat/set/effective-temperature"), payload, c.ContentType())
+	if err != nil {
+		return fmt.Errorf("error publishing effective temperature: %v", err)
+	}
+
+	return nil
+}
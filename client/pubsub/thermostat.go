@@ -5,19 +5,71 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 )
 
-func (p *Client) PublishTargetState(ctx context.Context, state *thermostat.TargetState) error {
-	payload, err := json.Marshal(&state)
+// PublishTargetState publishes the state to the topic of the home of the
+// device.
+func (p *Client) PublishTargetState(ctx context.Context, h *home.Home, state *thermostat.TargetState, version thermostat.SchemaVersion, c codec.Codec) error {
+	payload, err := thermostat.MarshalTargetState(state, version, c)
 	if err != nil {
 		return fmt.Errorf("error marshalling target state: %v", err)
 	}
 
-	err = p.Publish(ctx, "thermostat/set/target-state", payload)
+	err = p.publish(ctx, h.Topic("thermostat/set/target-state"), payload, c.ContentType())
 	if err != nil {
 		return fmt.Errorf("error publishing target state: %v", err)
 	}
 
 	return nil
 }
+
+type currentStateRequest struct {
+	DeviceID string `json:"deviceId"`
+}
+
+func (p *Client) RequestCurrentState(ctx context.Context, h *home.Home, deviceID string) (*thermostat.CurrentState, error) {
+	payload, err := json.Marshal(currentStateRequest{DeviceID: deviceID})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling current state request: %v", err)
+	}
+
+	response, err := p.request(ctx, h.Topic("thermostat/get/current-state"), payload, codec.JSONContentType)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting current state: %w", err)
+	}
+
+	var contentType string
+	if response.Properties != nil {
+		contentType = response.Properties.ContentType
+	}
+
+	c, err := codec.ForContentType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error choosing current state codec: %v", err)
+	}
+
+	state, _, err := thermostat.UnmarshalCurrentState(response.Payload, c)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling current state: %v", err)
+	}
+
+	return state, nil
+}
+
+func (p *Client) PublishRelayCommand(ctx context.Context, h *home.Home, command *control.RelayCommand, c codec.Codec) error {
+	payload, err := c.Marshal(command)
+	if err != nil {
+		return fmt.Errorf("error marshalling relay command: %v", err)
+	}
+
+	err = p.publish(ctx, h.Topic("thermostat/set/relay"), payload, c.ContentType())
+	if err != nil {
+		return fmt.Errorf("error publishing relay command: %v", err)
+	}
+
+	return nil
+}
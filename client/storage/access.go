@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initAccessTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS access_role (
+			name TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS access_grant (
+			role TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			permission TEXT NOT NULL,
+			min_temperature INTEGER,
+			max_temperature INTEGER,
+			PRIMARY KEY (role, device_id, permission)
+		);
+		CREATE TABLE IF NOT EXISTS access_user (
+			subject TEXT PRIMARY KEY,
+			name TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS access_user_role (
+			subject TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (subject, role)
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing access schema: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchRoles(ctx context.Context) (_ []access.Role, err error) {
+	ctx, span := startSpan(ctx, "FetchRoles")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT name
+		FROM access_role
+		ORDER BY name;
+	`
+
+	roles := []access.Role{}
+	err = c.db.SelectContext(ctx, &roles, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchRoles query: %v", err)
+	}
+
+	for i := range roles {
+		roles[i].Grants, err = c.fetchGrants(ctx, c.db, roles[i].Name)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching grants of role %s: %v", roles[i].Name, err)
+		}
+	}
+
+	return roles, nil
+}
+
+func (c *Client) fetchGrants(ctx context.Context, q sqlx.QueryerContext, role string) ([]access.Grant, error) {
+	query := `
+		SELECT device_id, permission, min_temperature, max_temperature
+		FROM access_grant
+		WHERE role = $1
+		ORDER BY device_id, permission;
+	`
+
+	grants := []access.Grant{}
+	err := sqlx.SelectContext(ctx, q, &grants, query, role)
+	if err != nil {
+		return nil, fmt.Errorf("error executing fetchGrants query: %v", err)
+	}
+
+	return grants, nil
+}
+
+// UpdateRole creates the role, or replaces the grants of an existing one.
+func (c *Client) UpdateRole(ctx context.Context, role *access.Role) (_ *access.Role, err error) {
+	ctx, span := startSpan(ctx, "UpdateRole")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO access_role (name)
+		VALUES ($1)
+		ON CONFLICT DO NOTHING;
+	`
+
+	_, err = tx.ExecContext(ctx, query, role.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateRole statement: %v", err)
+	}
+
+	query = `
+		DELETE FROM access_grant
+		WHERE role = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, role.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error executing delete grants statement: %v", err)
+	}
+
+	for _, grant := range role.Grants {
+		query := `
+			INSERT INTO access_grant (role, device_id, permission, min_temperature, max_temperature)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (role, device_id, permission) DO UPDATE SET
+				min_temperature = excluded.min_temperature,
+				max_temperature = excluded.max_temperature;
+		`
+
+		_, err = tx.ExecContext(ctx, query, role.Name, grant.DeviceID, grant.Permission, grant.MinTemperature, grant.MaxTemperature)
+		if err != nil {
+			return nil, fmt.Errorf("error executing add grant statement: %v", err)
+		}
+	}
+
+	grants, err := c.fetchGrants(ctx, tx, role.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching grants: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return &access.Role{
+		Name:   role.Name,
+		Grants: grants,
+	}, nil
+}
+
+// DeleteRole deletes the role and takes it away from the users it was
+// assigned to.
+func (c *Client) DeleteRole(ctx context.Context, name string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteRole")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM access_role
+		WHERE name = $1;
+	`
+
+	result, err := tx.ExecContext(ctx, query, name)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteRole statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("role %s not found", name)}
+	}
+
+	query = `
+		DELETE FROM access_grant
+		WHERE role = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, name)
+	if err != nil {
+		return fmt.Errorf("error executing delete grants statement: %v", err)
+	}
+
+	query = `
+		DELETE FROM access_user_role
+		WHERE role = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, name)
+	if err != nil {
+		return fmt.Errorf("error executing delete user roles statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchUsers(ctx context.Context) (_ []access.User, err error) {
+	ctx, span := startSpan(ctx, "FetchUsers")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT subject, name
+		FROM access_user
+		ORDER BY subject;
+	`
+
+	users := []access.User{}
+	err = c.db.SelectContext(ctx, &users, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchUsers query: %v", err)
+	}
+
+	for i := range users {
+		users[i].Roles, err = c.fetchUserRoles(ctx, c.db, users[i].Subject)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching roles of user %s: %v", users[i].Subject, err)
+		}
+	}
+
+	return users, nil
+}
+
+// FetchUserRoles returns the roles assigned to the subject, which is empty for
+// subjects that were never assigned any.
+func (c *Client) FetchUserRoles(ctx context.Context, subject string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "FetchUserRoles")
+	defer func() { tracing.End(span, err) }()
+
+	return c.fetchUserRoles(ctx, c.db, subject)
+}
+
+func (c *Client) fetchUserRoles(ctx context.Context, q sqlx.QueryerContext, subject string) ([]string, error) {
+	query := `
+		SELECT role
+		FROM access_user_role
+		WHERE subject = $1
+		ORDER BY role;
+	`
+
+	roles := []string{}
+	err := sqlx.SelectContext(ctx, q, &roles, query, subject)
+	if err != nil {
+		return nil, fmt.Errorf("error executing fetchUserRoles query: %v", err)
+	}
+
+	return roles, nil
+}
+
+// UpdateUser creates the user, or replaces the roles of an existing one.
+// ErrConflict is returned if any of the roles doesn't exist.
+func (c *Client) UpdateUser(ctx context.Context, user *access.User) (_ *access.User, err error) {
+	ctx, span := startSpan(ctx, "UpdateUser")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO access_user (subject, name)
+		VALUES ($1, $2)
+		ON CONFLICT (subject) DO UPDATE SET
+			name = excluded.name;
+	`
+
+	_, err = tx.ExecContext(ctx, query, user.Subject, user.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateUser statement: %v", err)
+	}
+
+	query = `
+		DELETE FROM access_user_role
+		WHERE subject = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, user.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("error executing delete user roles statement: %v", err)
+	}
+
+	for _, role := range user.Roles {
+		query := `
+			SELECT EXISTS (
+				SELECT 1
+				FROM access_role
+				WHERE name = $1
+			);
+		`
+
+		var exists bool
+		err = tx.GetContext(ctx, &exists, query, role)
+		if err != nil {
+			return nil, fmt.Errorf("error checking role %s exists: %v", role, err)
+		}
+
+		if !exists {
+			return nil, &client.ErrConflict{Err: fmt.Errorf("role %s doesn't exist", role)}
+		}
+
+		query = `
+			INSERT INTO access_user_role (subject, role)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING;
+		`
+
+		_, err = tx.ExecContext(ctx, query, user.Subject, role)
+		if err != nil {
+			return nil, fmt.Errorf("error executing add user role statement: %v", err)
+		}
+	}
+
+	roles, err := c.fetchUserRoles(ctx, tx, user.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching roles: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return &access.User{
+		Subject: user.Subject,
+		Name:    user.Name,
+		Roles:   roles,
+	}, nil
+}
+
+func (c *Client) DeleteUser(ctx context.Context, subject string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteUser")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM access_user
+		WHERE subject = $1;
+	`
+
+	result, err := tx.ExecContext(ctx, query, subject)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteUser statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("user %s not found", subject)}
+	}
+
+	query = `
+		DELETE FROM access_user_role
+		WHERE subject = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, subject)
+	if err != nil {
+		return fmt.Errorf("error executing delete user roles statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// FetchRoleGrants returns the grants of every role. Roles that don't exist
+// have no grants.
+func (c *Client) FetchRoleGrants(ctx context.Context, roles []string) (_ []access.Grant, err error) {
+	ctx, span := startSpan(ctx, "FetchRoleGrants")
+	defer func() { tracing.End(span, err) }()
+
+	grants := []access.Grant{}
+	for _, role := range roles {
+		roleGrants, err := c.fetchGrants(ctx, c.db, role)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching grants of role %s: %v", role, err)
+		}
+
+		grants = append(grants, roleGrants...)
+	}
+
+	return grants, nil
+}
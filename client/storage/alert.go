@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initAlertTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS alert_rule (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			device_id TEXT,
+			min REAL,
+			max REAL,
+			minutes INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS alert_rule_channel (
+			rule_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			target TEXT NOT NULL,
+			PRIMARY KEY (rule_id, type, target)
+		);
+		CREATE TABLE IF NOT EXISTS alert_state (
+			rule_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			message TEXT NOT NULL,
+			changed_at DATETIME NOT NULL,
+			PRIMARY KEY (rule_id, device_id)
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing alert schema: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchAlertRules(ctx context.Context) (_ []alert.Rule, err error) {
+	ctx, span := startSpan(ctx, "FetchAlertRules")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, kind, device_id, min, max, minutes
+		FROM alert_rule
+		ORDER BY id;
+	`
+
+	rules := []alert.Rule{}
+	err = c.db.SelectContext(ctx, &rules, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchAlertRules query: %v", err)
+	}
+
+	for i := range rules {
+		rules[i].Channels, err = c.fetchAlertRuleChannels(ctx, rules[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching channels of rule %d: %v", rules[i].ID, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// FetchDeviceAlertRules returns the rules for the device, and the rules for
+// every device.
+func (c *Client) FetchDeviceAlertRules(ctx context.Context, deviceID string) (_ []alert.Rule, err error) {
+	ctx, span := startSpan(ctx, "FetchDeviceAlertRules")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, kind, device_id, min, max, minutes
+		FROM alert_rule
+		WHERE device_id IS NULL OR device_id = $1
+		ORDER BY id;
+	`
+
+	rules := []alert.Rule{}
+	err = c.db.SelectContext(ctx, &rules, query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchDeviceAlertRules query: %v", err)
+	}
+
+	for i := range rules {
+		rules[i].Channels, err = c.fetchAlertRuleChannels(ctx, rules[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching channels of rule %d: %v", rules[i].ID, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func (c *Client) FetchAlertRule(ctx context.Context, id int64) (_ *alert.Rule, err error) {
+	ctx, span := startSpan(ctx, "FetchAlertRule")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, kind, device_id, min, max, minutes
+		FROM alert_rule
+		WHERE id = $1;
+	`
+
+	var rule alert.Rule
+	err = c.db.GetContext(ctx, &rule, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchAlertRule query: %v", err)
+		}
+	}
+
+	rule.Channels, err = c.fetchAlertRuleChannels(ctx, rule.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching channels: %v", err)
+	}
+
+	return &rule, nil
+}
+
+func (c *Client) fetchAlertRuleChannels(ctx context.Context, ruleID int64) ([]alert.Channel, error) {
+	query := `
+		SELECT type, target
+		FROM alert_rule_channel
+		WHERE rule_id = $1
+		ORDER BY type, target;
+	`
+
+	channels := []alert.Channel{}
+	err := c.db.SelectContext(ctx, &channels, query, ruleID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing fetchAlertRuleChannels query: %v", err)
+	}
+
+	return channels, nil
+}
+
+func (c *Client) AddAlertRule(ctx context.Context, rule *alert.Rule) (_ *alert.Rule, err error) {
+	ctx, span := startSpan(ctx, "AddAlertRule")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO alert_rule (name, kind, device_id, min, max, minutes)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`
+
+	result, err := tx.ExecContext(ctx, query, rule.Name, rule.Kind, rule.DeviceID, rule.Min, rule.Max, rule.Minutes)
+	if err != nil {
+		return nil, fmt.Errorf("error executing AddAlertRule statement: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting alert rule ID: %v", err)
+	}
+
+	err = c.replaceAlertRuleChannels(ctx, tx, id, rule.Channels)
+	if err != nil {
+		return nil, fmt.Errorf("error replacing channels: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchAlertRule(ctx, id)
+}
+
+// UpdateAlertRule replaces the rule. The rule is evaluated from scratch, so
+// that devices it fired for under its old condition are notified again if it
+// still fires.
+func (c *Client) UpdateAlertRule(ctx context.Context, rule *alert.Rule) (_ *alert.Rule, err error) {
+	ctx, span := startSpan(ctx, "UpdateAlertRule")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE alert_rule
+		SET name = $1, kind = $2, device_id = $3, min = $4, max = $5, minutes = $6
+		WHERE id = $7;
+	`
+
+	result, err := tx.ExecContext(ctx, query, rule.Name, rule.Kind, rule.DeviceID, rule.Min, rule.Max, rule.Minutes, rule.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateAlertRule statement: %v", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if updated == 0 {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("alert rule %d not found", rule.ID)}
+	}
+
+	err = c.replaceAlertRuleChannels(ctx, tx, rule.ID, rule.Channels)
+	if err != nil {
+		return nil, fmt.Errorf("error replacing channels: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM alert_state WHERE rule_id = $1;`, rule.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing alert state statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchAlertRule(ctx, rule.ID)
+}
+
+func (c *Client) replaceAlertRuleChannels(ctx context.Context, tx *sqlx.Tx, ruleID int64, channels []alert.Channel) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM alert_rule_channel WHERE rule_id = $1;`, ruleID)
+	if err != nil {
+		return fmt.Errorf("error executing delete channels statement: %v", err)
+	}
+
+	for _, channel := range channels {
+		query := `
+			INSERT INTO alert_rule_channel (rule_id, type, target)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING;
+		`
+
+		_, err = tx.ExecContext(ctx, query, ruleID, channel.Type, channel.Target)
+		if err != nil {
+			return fmt.Errorf("error executing add channel statement: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteAlertRule removes the rule together with its channels and states.
+func (c *Client) DeleteAlertRule(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "DeleteAlertRule")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM alert_rule WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteAlertRule statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("alert rule %d not found", id)}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM alert_rule_channel WHERE rule_id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing alert rule channel statement: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM alert_state WHERE rule_id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing alert state statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// FetchAlertStates returns the states of the rules for every device they were
+// evaluated for, optionally only those with the given status.
+func (c *Client) FetchAlertStates(ctx context.Context, status *alert.Status) (_ []alert.State, err error) {
+	ctx, span := startSpan(ctx, "FetchAlertStates")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT rule_id, device_id, status, message, changed_at
+		FROM alert_state
+		WHERE $1 IS NULL OR status = $1
+		ORDER BY changed_at DESC, rule_id, device_id;
+	`
+
+	states := []alert.State{}
+	err = c.db.SelectContext(ctx, &states, query, status)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchAlertStates query: %v", err)
+	}
+
+	return states, nil
+}
+
+func (c *Client) FetchAlertState(ctx context.Context, ruleID int64, deviceID string) (_ *alert.State, err error) {
+	ctx, span := startSpan(ctx, "FetchAlertState")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT rule_id, device_id, status, message, changed_at
+		FROM alert_state
+		WHERE rule_id = $1 AND device_id = $2;
+	`
+
+	var state alert.State
+	err = c.db.GetContext(ctx, &state, query, ruleID, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchAlertState query: %v", err)
+		}
+	}
+
+	return &state, nil
+}
+
+func (c *Client) UpdateAlertState(ctx context.Context, state *alert.State) (err error) {
+	ctx, span := startSpan(ctx, "UpdateAlertState")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO alert_state (rule_id, device_id, status, message, changed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (rule_id, device_id) DO UPDATE SET
+			status = excluded.status,
+			message = excluded.message,
+			changed_at = excluded.changed_at;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, state.RuleID, state.DeviceID, state.Status, state.Message, dbTime(state.ChangedAt))
+	if err != nil {
+		return fmt.Errorf("error executing UpdateAlertState statement: %v", err)
+	}
+
+	return nil
+}
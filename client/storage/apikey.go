@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initAPIKeyTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS api_key (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			revoked_at DATETIME
+		);
+		CREATE TABLE IF NOT EXISTS api_key_scope (
+			api_key_id INTEGER NOT NULL,
+			scope TEXT NOT NULL,
+			PRIMARY KEY (api_key_id, scope)
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing api key schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchAPIKeys returns every key ever issued, including revoked ones.
+func (c *Client) FetchAPIKeys(ctx context.Context) (_ []apikey.Key, err error) {
+	ctx, span := startSpan(ctx, "FetchAPIKeys")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, prefix, hash, created_at, last_used_at, revoked_at
+		FROM api_key
+		ORDER BY id;
+	`
+
+	keys := []apikey.Key{}
+	err = c.db.SelectContext(ctx, &keys, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchAPIKeys query: %v", err)
+	}
+
+	for i := range keys {
+		keys[i].Scopes, err = c.fetchAPIKeyScopes(ctx, c.db, keys[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching scopes of api key %d: %v", keys[i].ID, err)
+		}
+	}
+
+	return keys, nil
+}
+
+func (c *Client) fetchAPIKeyScopes(ctx context.Context, q sqlx.QueryerContext, keyID int64) ([]apikey.Scope, error) {
+	query := `
+		SELECT scope
+		FROM api_key_scope
+		WHERE api_key_id = $1
+		ORDER BY scope;
+	`
+
+	scopes := []apikey.Scope{}
+	err := sqlx.SelectContext(ctx, q, &scopes, query, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing fetchAPIKeyScopes query: %v", err)
+	}
+
+	return scopes, nil
+}
+
+// AddAPIKey stores the key by its hash. The key itself is never stored.
+func (c *Client) AddAPIKey(ctx context.Context, key *apikey.Key) (_ *apikey.Key, err error) {
+	ctx, span := startSpan(ctx, "AddAPIKey")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO api_key (name, prefix, hash, created_at)
+		VALUES ($1, $2, $3, $4);
+	`
+
+	createdAt := dbTime(time.Now())
+	result, err := tx.ExecContext(ctx, query, key.Name, key.Prefix, key.Hash, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("error executing AddAPIKey statement: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting api key ID: %v", err)
+	}
+
+	for _, scope := range key.Scopes {
+		query := `
+			INSERT INTO api_key_scope (api_key_id, scope)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING;
+		`
+
+		_, err = tx.ExecContext(ctx, query, id, scope)
+		if err != nil {
+			return nil, fmt.Errorf("error executing add scope statement: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	added := *key
+	added.ID = id
+	added.CreatedAt = createdAt
+
+	return &added, nil
+}
+
+// RevokeAPIKey stops the key from being accepted. Revoked keys are kept to
+// tell who used them.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int64, revokedAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "RevokeAPIKey")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		UPDATE api_key
+		SET revoked_at = $1
+		WHERE id = $2 AND revoked_at IS NULL;
+	`
+
+	result, err := c.db.ExecContext(ctx, query, dbTime(revokedAt), id)
+	if err != nil {
+		return fmt.Errorf("error executing RevokeAPIKey statement: %v", err)
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if revoked == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("active api key %d not found", id)}
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey returns the active key with the hash and records that it
+// was used. ErrNotFound is returned for unknown and revoked keys.
+func (c *Client) AuthenticateAPIKey(ctx context.Context, hash string, now time.Time) (_ *apikey.Key, err error) {
+	ctx, span := startSpan(ctx, "AuthenticateAPIKey")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE api_key
+		SET last_used_at = $1
+		WHERE hash = $2 AND revoked_at IS NULL
+		RETURNING id, name, prefix, hash, created_at, last_used_at, revoked_at;
+	`
+
+	var key apikey.Key
+	err = tx.GetContext(ctx, &key, query, dbTime(now), hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing AuthenticateAPIKey statement: %v", err)
+		}
+	}
+
+	key.Scopes, err = c.fetchAPIKeyScopes(ctx, tx, key.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching scopes: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return &key, nil
+}
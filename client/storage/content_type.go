@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initContentTypeTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS content_type (
+			device_id TEXT PRIMARY KEY,
+			content_type TEXT NOT NULL
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing content type schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchContentType returns the payload content type preferred by the device,
+// which is the one it last reported in.
+func (c *Client) FetchContentType(ctx context.Context, deviceID string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "FetchContentType")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT content_type
+		FROM content_type
+		WHERE device_id = $1;
+	`
+
+	var contentType string
+	err = c.db.GetContext(ctx, &contentType, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", &client.ErrNotFound{Err: err}
+		} else {
+			return "", fmt.Errorf("error executing FetchContentType query: %v", err)
+		}
+	}
+
+	return contentType, nil
+}
+
+func (c *Client) UpdateContentType(ctx context.Context, deviceID string, contentType string) (err error) {
+	ctx, span := startSpan(ctx, "UpdateContentType")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO content_type (device_id, content_type)
+		VALUES ($1, $2)
+		ON CONFLICT (device_id) DO UPDATE SET content_type = excluded.content_type
+		WHERE content_type != excluded.content_type;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, deviceID, contentType)
+	if err != nil {
+		return fmt.Errorf("error executing UpdateContentType statement: %v", err)
+	}
+
+	return nil
+}
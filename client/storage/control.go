@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initControlTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS control_settings (
+			device_id TEXT PRIMARY KEY,
+			controlled_by TEXT NOT NULL,
+			min_cycle_seconds INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS control_decision (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id TEXT NOT NULL,
+			decided_at DATETIME NOT NULL,
+			mode TEXT NOT NULL,
+			target_temperature INTEGER NOT NULL,
+			current_temperature REAL,
+			command TEXT NOT NULL,
+			command_since DATETIME NOT NULL,
+			reason TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS control_decision_device_id ON control_decision (device_id, id);
+		CREATE INDEX IF NOT EXISTS control_decision_decided_at ON control_decision (decided_at);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing control schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchControlSettings returns the control settings of the device. Devices
+// without settings run their own control loop.
+func (c *Client) FetchControlSettings(ctx context.Context, deviceID string) (_ *control.Settings, err error) {
+	ctx, span := startSpan(ctx, "FetchControlSettings")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, controlled_by, min_cycle_seconds
+		FROM control_settings
+		WHERE device_id = $1;
+	`
+
+	var settings control.Settings
+	err = c.db.GetContext(ctx, &settings, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &control.Settings{DeviceID: deviceID, ControlledBy: control.DeviceControlled}, nil
+		} else {
+			return nil, fmt.Errorf("error executing FetchControlSettings query: %v", err)
+		}
+	}
+
+	return &settings, nil
+}
+
+func (c *Client) UpdateControlSettings(ctx context.Context, settings *control.Settings) (_ *control.Settings, err error) {
+	ctx, span := startSpan(ctx, "UpdateControlSettings")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO control_settings (device_id, controlled_by, min_cycle_seconds)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE SET
+			controlled_by = excluded.controlled_by,
+			min_cycle_seconds = excluded.min_cycle_seconds;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, settings.DeviceID, settings.ControlledBy, settings.MinCycleSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateControlSettings statement: %v", err)
+	}
+
+	return c.FetchControlSettings(ctx, settings.DeviceID)
+}
+
+func (c *Client) FetchServerControlledDevices(ctx context.Context) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "FetchServerControlledDevices")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id
+		FROM control_settings
+		WHERE controlled_by = $1
+		ORDER BY device_id;
+	`
+
+	deviceIDs := []string{}
+	err = c.db.SelectContext(ctx, &deviceIDs, query, control.ServerControlled)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchServerControlledDevices query: %v", err)
+	}
+
+	return deviceIDs, nil
+}
+
+// FetchControlDecisions returns the most recent decisions for the device,
+// newest first.
+func (c *Client) FetchControlDecisions(ctx context.Context, deviceID string, limit int) (_ []control.Decision, err error) {
+	ctx, span := startSpan(ctx, "FetchControlDecisions")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, device_id, decided_at, mode, target_temperature, current_temperature, command, command_since, reason
+		FROM control_decision
+		WHERE device_id = $1
+		ORDER BY id DESC
+		LIMIT $2;
+	`
+
+	decisions := []control.Decision{}
+	err = c.db.SelectContext(ctx, &decisions, query, deviceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchControlDecisions query: %v", err)
+	}
+
+	return decisions, nil
+}
+
+// FetchLastControlCycleStart returns the latest decision that switched the
+// relay of the device on.
+func (c *Client) FetchLastControlCycleStart(ctx context.Context, deviceID string) (_ *control.Decision, err error) {
+	ctx, span := startSpan(ctx, "FetchLastControlCycleStart")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, device_id, decided_at, mode, target_temperature, current_temperature, command, command_since, reason
+		FROM control_decision
+		WHERE device_id = $1 AND command != $2
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+
+	var decision control.Decision
+	err = c.db.GetContext(ctx, &decision, query, deviceID, control.IdleCommand)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchLastControlCycleStart query: %v", err)
+		}
+	}
+
+	return &decision, nil
+}
+
+func (c *Client) FetchLatestControlDecision(ctx context.Context, deviceID string) (_ *control.Decision, err error) {
+	ctx, span := startSpan(ctx, "FetchLatestControlDecision")
+	defer func() { tracing.End(span, err) }()
+
+	decisions, err := c.FetchControlDecisions(ctx, deviceID, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decisions) == 0 {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("no control decisions for device %s", deviceID)}
+	}
+
+	return &decisions[0], nil
+}
+
+// AddControlDecision records the decision, and forgets decisions made before
+// expiredBefore, so that the log stays bounded.
+func (c *Client) AddControlDecision(ctx context.Context, decision *control.Decision, expiredBefore time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AddControlDecision")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO control_decision (device_id, decided_at, mode, target_temperature, current_temperature, command, command_since, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+
+	_, err = tx.ExecContext(ctx, query,
+		decision.DeviceID,
+		dbTime(decision.DecidedAt),
+		decision.Mode,
+		decision.TargetTemperature,
+		decision.CurrentTemperature,
+		decision.Command,
+		dbTime(decision.CommandSince),
+		decision.Reason,
+	)
+	if err != nil {
+		return fmt.Errorf("error executing AddControlDecision statement: %v", err)
+	}
+
+	// The latest decision of every device is kept, since it tells the state
+	// the relay was last switched to
+	query = `
+		DELETE FROM control_decision
+		WHERE decided_at < $1
+		AND id NOT IN (SELECT MAX(id) FROM control_decision GROUP BY device_id);
+	`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(expiredBefore))
+	if err != nil {
+		return fmt.Errorf("error executing expired control decisions statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/alexchebotarsky/thermostat-api/client"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
 )
 
 func (c *Client) initCurrentStateTable(ctx context.Context) error {
@@ -28,7 +31,16 @@ func (c *Client) initCurrentStateTable(ctx context.Context) error {
 	return nil
 }
 
-func (c *Client) FetchCurrentState(ctx context.Context, deviceID string) (*thermostat.CurrentState, error) {
+// FetchCurrentState returns ErrNotFound if the device belongs to another home.
+func (c *Client) FetchCurrentState(ctx context.Context, homeID, deviceID string) (_ *thermostat.CurrentState, err error) {
+	ctx, span := startSpan(ctx, "FetchCurrentState")
+	defer func() { tracing.End(span, err) }()
+
+	err = c.scopeDevice(ctx, c.db, homeID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		SELECT device_id, timestamp, operating_state, current_temperature, current_humidity
 		FROM current_state
@@ -36,7 +48,7 @@ func (c *Client) FetchCurrentState(ctx context.Context, deviceID string) (*therm
 	`
 
 	var state thermostat.CurrentState
-	err := c.db.GetContext(ctx, &state, query, deviceID)
+	err = c.db.GetContext(ctx, &state, query, deviceID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, &client.ErrNotFound{Err: err}
@@ -48,7 +60,46 @@ func (c *Client) FetchCurrentState(ctx context.Context, deviceID string) (*therm
 	return &state, nil
 }
 
-func (c *Client) UpdateCurrentState(ctx context.Context, state *thermostat.CurrentState) (*thermostat.CurrentState, error) {
+// FetchCurrentStates returns the current state of every device that reported
+// one.
+func (c *Client) FetchCurrentStates(ctx context.Context) (_ []thermostat.CurrentState, err error) {
+	ctx, span := startSpan(ctx, "FetchCurrentStates")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, timestamp, operating_state, current_temperature, current_humidity
+		FROM current_state
+		ORDER BY device_id;
+	`
+
+	states := []thermostat.CurrentState{}
+	err = c.db.SelectContext(ctx, &states, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchCurrentStates query: %v", err)
+	}
+
+	return states, nil
+}
+
+// UpdateCurrentState stores the state together with the webhook events about
+// it, and marks the device as available. Devices that aren't registered yet
+// are registered in the home, and ErrNotFound is returned for devices of
+// another home.
+func (c *Client) UpdateCurrentState(ctx context.Context, homeID string, state *thermostat.CurrentState) (_ *thermostat.CurrentState, err error) {
+	ctx, span := startSpan(ctx, "UpdateCurrentState")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = c.claimDevice(ctx, tx, homeID, state.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		INSERT INTO current_state (device_id, timestamp, operating_state, current_temperature, current_humidity)
 		VALUES (:device_id, :timestamp, :operating_state, :current_temperature, :current_humidity)
@@ -59,10 +110,32 @@ func (c *Client) UpdateCurrentState(ctx context.Context, state *thermostat.Curre
 			current_humidity = :current_humidity;
 	`
 
-	_, err := c.db.NamedExecContext(ctx, query, state)
+	_, err = tx.NamedExecContext(ctx, query, state)
 	if err != nil {
 		return nil, fmt.Errorf("error executing UpdateCurrentState statement: %v", err)
 	}
 
-	return c.FetchCurrentState(ctx, state.DeviceID)
+	now := time.Now()
+
+	err = c.enqueueWebhookEvent(ctx, tx, &webhook.Event{
+		Type:       webhook.CurrentStateEvent,
+		DeviceID:   state.DeviceID,
+		OccurredAt: state.Timestamp,
+		Data:       state,
+	}, now)
+	if err != nil {
+		return nil, fmt.Errorf("error enqueueing current state event: %v", err)
+	}
+
+	err = c.markAvailable(ctx, tx, state.DeviceID, now)
+	if err != nil {
+		return nil, fmt.Errorf("error marking device available: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchCurrentState(ctx, homeID, state.DeviceID)
 }
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initDeadLetterTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS dead_letter (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			payload BLOB,
+			reason TEXT NOT NULL,
+			received_at DATETIME NOT NULL,
+			replayed_at DATETIME
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing dead letter schema: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) AddDeadLetter(ctx context.Context, letter *deadletter.DeadLetter) (err error) {
+	ctx, span := startSpan(ctx, "AddDeadLetter")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO dead_letter (topic, payload, reason, received_at)
+		VALUES ($1, $2, $3, $4);
+	`
+
+	_, err = c.db.ExecContext(ctx, query, letter.Topic, letter.Payload, letter.Reason, dbTime(letter.ReceivedAt))
+	if err != nil {
+		return fmt.Errorf("error executing AddDeadLetter statement: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchDeadLetters(ctx context.Context, limit int) (_ []deadletter.DeadLetter, err error) {
+	ctx, span := startSpan(ctx, "FetchDeadLetters")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, topic, payload, reason, received_at, replayed_at
+		FROM dead_letter
+		ORDER BY id DESC
+		LIMIT $1;
+	`
+
+	letters := []deadletter.DeadLetter{}
+	err = c.db.SelectContext(ctx, &letters, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchDeadLetters query: %v", err)
+	}
+
+	return letters, nil
+}
+
+func (c *Client) FetchDeadLetter(ctx context.Context, id int64) (_ *deadletter.DeadLetter, err error) {
+	ctx, span := startSpan(ctx, "FetchDeadLetter")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, topic, payload, reason, received_at, replayed_at
+		FROM dead_letter
+		WHERE id = $1;
+	`
+
+	var letter deadletter.DeadLetter
+	err = c.db.GetContext(ctx, &letter, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchDeadLetter query: %v", err)
+		}
+	}
+
+	return &letter, nil
+}
+
+func (c *Client) MarkDeadLetterReplayed(ctx context.Context, id int64, replayedAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "MarkDeadLetterReplayed")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		UPDATE dead_letter
+		SET replayed_at = $2
+		WHERE id = $1;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, id, dbTime(replayedAt))
+	if err != nil {
+		return fmt.Errorf("error executing MarkDeadLetterReplayed statement: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,515 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initHomeTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS home (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			topic_prefix TEXT NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS device (
+			id TEXT PRIMARY KEY,
+			home_id TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS device_home_id ON device (home_id);
+		CREATE TABLE IF NOT EXISTS home_member (
+			subject TEXT PRIMARY KEY,
+			home_id TEXT NOT NULL
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing home schema: %v", err)
+	}
+
+	now := dbTime(time.Now())
+
+	query := `
+		INSERT INTO home (id, name, topic_prefix, created_at)
+		VALUES ($1, 'Default', '', $2)
+		ON CONFLICT DO NOTHING;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, home.DefaultID, now)
+	if err != nil {
+		return fmt.Errorf("error adding default home: %v", err)
+	}
+
+	// Devices known from before homes existed belong to the default home. The
+	// WHERE clause keeps SQLite from parsing ON CONFLICT as a join constraint.
+	query = `
+		INSERT INTO device (id, home_id, created_at)
+		SELECT device_id, $1, $2
+		FROM (
+			SELECT device_id FROM target_state
+			UNION
+			SELECT device_id FROM current_state
+		)
+		WHERE true
+		ON CONFLICT DO NOTHING;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, home.DefaultID, now)
+	if err != nil {
+		return fmt.Errorf("error registering existing devices: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchHomes(ctx context.Context) (_ []home.Home, err error) {
+	ctx, span := startSpan(ctx, "FetchHomes")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, topic_prefix, created_at
+		FROM home
+		ORDER BY id;
+	`
+
+	homes := []home.Home{}
+	err = c.db.SelectContext(ctx, &homes, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchHomes query: %v", err)
+	}
+
+	return homes, nil
+}
+
+func (c *Client) FetchHome(ctx context.Context, id string) (_ *home.Home, err error) {
+	ctx, span := startSpan(ctx, "FetchHome")
+	defer func() { tracing.End(span, err) }()
+
+	return c.fetchHome(ctx, c.db, id)
+}
+
+func (c *Client) fetchHome(ctx context.Context, q sqlx.QueryerContext, id string) (*home.Home, error) {
+	query := `
+		SELECT id, name, topic_prefix, created_at
+		FROM home
+		WHERE id = $1;
+	`
+
+	var h home.Home
+	err := sqlx.GetContext(ctx, q, &h, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: fmt.Errorf("home %s not found", id)}
+		} else {
+			return nil, fmt.Errorf("error executing fetchHome query: %v", err)
+		}
+	}
+
+	return &h, nil
+}
+
+// FetchHomeByTopicPrefix returns the home that devices publish to topics with
+// the prefix in.
+func (c *Client) FetchHomeByTopicPrefix(ctx context.Context, prefix string) (_ *home.Home, err error) {
+	ctx, span := startSpan(ctx, "FetchHomeByTopicPrefix")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, topic_prefix, created_at
+		FROM home
+		WHERE topic_prefix = $1;
+	`
+
+	var h home.Home
+	err = c.db.GetContext(ctx, &h, query, prefix)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: fmt.Errorf("home with topic prefix '%s' not found", prefix)}
+		} else {
+			return nil, fmt.Errorf("error executing FetchHomeByTopicPrefix query: %v", err)
+		}
+	}
+
+	return &h, nil
+}
+
+// AddHome returns ErrConflict if the ID or the topic prefix is taken.
+func (c *Client) AddHome(ctx context.Context, h *home.Home) (_ *home.Home, err error) {
+	ctx, span := startSpan(ctx, "AddHome")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM home
+			WHERE id = $1 OR topic_prefix = $2
+		);
+	`
+
+	var exists bool
+	err = tx.GetContext(ctx, &exists, query, h.ID, h.TopicPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error checking home exists: %v", err)
+	}
+
+	if exists {
+		return nil, &client.ErrConflict{Err: fmt.Errorf("home %s or topic prefix %s is taken", h.ID, h.TopicPrefix)}
+	}
+
+	query = `
+		INSERT INTO home (id, name, topic_prefix, created_at)
+		VALUES ($1, $2, $3, $4);
+	`
+
+	createdAt := dbTime(time.Now())
+	_, err = tx.ExecContext(ctx, query, h.ID, h.Name, h.TopicPrefix, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("error executing AddHome statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	added := *h
+	added.CreatedAt = createdAt
+
+	return &added, nil
+}
+
+// DeleteHome deletes the home and its members. ErrConflict is returned for
+// the default home, and for homes that still own devices.
+func (c *Client) DeleteHome(ctx context.Context, id string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteHome")
+	defer func() { tracing.End(span, err) }()
+
+	if id == home.DefaultID {
+		return &client.ErrConflict{Err: fmt.Errorf("home %s can't be deleted", home.DefaultID)}
+	}
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT COUNT(*)
+		FROM device
+		WHERE home_id = $1;
+	`
+
+	var devices int
+	err = tx.GetContext(ctx, &devices, query, id)
+	if err != nil {
+		return fmt.Errorf("error counting devices: %v", err)
+	}
+
+	if devices > 0 {
+		return &client.ErrConflict{Err: fmt.Errorf("home %s still owns %d devices", id, devices)}
+	}
+
+	query = `
+		DELETE FROM home
+		WHERE id = $1;
+	`
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteHome statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("home %s not found", id)}
+	}
+
+	query = `
+		DELETE FROM home_member
+		WHERE home_id = $1;
+	`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("error executing delete members statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// FetchDeviceHome returns the home that owns the device. Devices that were
+// never registered belong to the default home.
+func (c *Client) FetchDeviceHome(ctx context.Context, deviceID string) (_ *home.Home, err error) {
+	ctx, span := startSpan(ctx, "FetchDeviceHome")
+	defer func() { tracing.End(span, err) }()
+
+	homeID, err := c.deviceHomeID(ctx, c.db, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching home ID: %v", err)
+	}
+
+	return c.fetchHome(ctx, c.db, homeID)
+}
+
+func (c *Client) deviceHomeID(ctx context.Context, q sqlx.QueryerContext, deviceID string) (string, error) {
+	query := `
+		SELECT COALESCE((SELECT home_id FROM device WHERE id = $1), $2);
+	`
+
+	var homeID string
+	err := sqlx.GetContext(ctx, q, &homeID, query, deviceID, home.DefaultID)
+	if err != nil {
+		return "", fmt.Errorf("error executing deviceHomeID query: %v", err)
+	}
+
+	return homeID, nil
+}
+
+// scopeDevice returns ErrNotFound if the device belongs to another home, so
+// that homes can't tell devices of other homes from devices that don't exist.
+func (c *Client) scopeDevice(ctx context.Context, q sqlx.QueryerContext, homeID, deviceID string) error {
+	deviceHomeID, err := c.deviceHomeID(ctx, q, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if deviceHomeID != homeID {
+		return &client.ErrNotFound{Err: fmt.Errorf("device %s not found in home %s", deviceID, homeID)}
+	}
+
+	return nil
+}
+
+// ClaimDevice registers the device in the home, if it isn't registered yet.
+// ErrNotFound is returned if the device belongs to another home.
+func (c *Client) ClaimDevice(ctx context.Context, homeID, deviceID string) (err error) {
+	ctx, span := startSpan(ctx, "ClaimDevice")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = c.claimDevice(ctx, tx, homeID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) claimDevice(ctx context.Context, tx *sqlx.Tx, homeID, deviceID string) error {
+	query := `
+		INSERT INTO device (id, home_id, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING;
+	`
+
+	_, err := tx.ExecContext(ctx, query, deviceID, homeID, dbTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error executing claimDevice statement: %v", err)
+	}
+
+	return c.scopeDevice(ctx, tx, homeID, deviceID)
+}
+
+func (c *Client) FetchDevices(ctx context.Context, homeID string) (_ []home.Device, err error) {
+	ctx, span := startSpan(ctx, "FetchDevices")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, home_id, created_at
+		FROM device
+		WHERE home_id = $1
+		ORDER BY id;
+	`
+
+	devices := []home.Device{}
+	err = c.db.SelectContext(ctx, &devices, query, homeID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchDevices query: %v", err)
+	}
+
+	return devices, nil
+}
+
+// UpdateDevice registers the device in the home, or moves it there from the
+// home it was in. ErrNotFound is returned if the home doesn't exist.
+func (c *Client) UpdateDevice(ctx context.Context, device *home.Device) (_ *home.Device, err error) {
+	ctx, span := startSpan(ctx, "UpdateDevice")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = c.fetchHome(ctx, tx, device.HomeID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO device (id, home_id, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET
+			home_id = excluded.home_id
+		RETURNING id, home_id, created_at;
+	`
+
+	var updated home.Device
+	err = tx.GetContext(ctx, &updated, query, device.ID, device.HomeID, dbTime(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateDevice statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return &updated, nil
+}
+
+func (c *Client) FetchMembers(ctx context.Context, homeID string) (_ []home.Member, err error) {
+	ctx, span := startSpan(ctx, "FetchMembers")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT subject, home_id
+		FROM home_member
+		WHERE home_id = $1
+		ORDER BY subject;
+	`
+
+	members := []home.Member{}
+	err = c.db.SelectContext(ctx, &members, query, homeID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchMembers query: %v", err)
+	}
+
+	return members, nil
+}
+
+// FetchMemberHome returns the home the subject is a member of. ErrNotFound is
+// returned for subjects that aren't a member of any home.
+func (c *Client) FetchMemberHome(ctx context.Context, subject string) (_ *home.Home, err error) {
+	ctx, span := startSpan(ctx, "FetchMemberHome")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT h.id, h.name, h.topic_prefix, h.created_at
+		FROM home_member m
+		JOIN home h ON h.id = m.home_id
+		WHERE m.subject = $1;
+	`
+
+	var h home.Home
+	err = c.db.GetContext(ctx, &h, query, subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: fmt.Errorf("%s isn't a member of any home", subject)}
+		} else {
+			return nil, fmt.Errorf("error executing FetchMemberHome query: %v", err)
+		}
+	}
+
+	return &h, nil
+}
+
+// UpdateMember makes the subject a member of the home, moving it from the home
+// it was a member of. ErrNotFound is returned if the home doesn't exist.
+func (c *Client) UpdateMember(ctx context.Context, member *home.Member) (_ *home.Member, err error) {
+	ctx, span := startSpan(ctx, "UpdateMember")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = c.fetchHome(ctx, tx, member.HomeID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO home_member (subject, home_id)
+		VALUES ($1, $2)
+		ON CONFLICT (subject) DO UPDATE SET
+			home_id = excluded.home_id;
+	`
+
+	_, err = tx.ExecContext(ctx, query, member.Subject, member.HomeID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateMember statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return member, nil
+}
+
+func (c *Client) DeleteMember(ctx context.Context, homeID, subject string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteMember")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		DELETE FROM home_member
+		WHERE home_id = $1 AND subject = $2;
+	`
+
+	result, err := c.db.ExecContext(ctx, query, homeID, subject)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteMember statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("%s isn't a member of home %s", subject, homeID)}
+	}
+
+	return nil
+}
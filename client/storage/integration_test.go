@@ -2,11 +2,27 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+	"github.com/alexchebotarsky/thermostat-api/tracing/tracingtest"
+	"go.opentelemetry.io/otel/codes"
 )
 
 const testDeviceID = "test-device-id"
@@ -98,7 +114,7 @@ func TestTargetStateIntegration(t *testing.T) {
 	}
 
 	// Read (defaults)
-	got, err := s.FetchTargetState(ctx, testDeviceID)
+	got, err := s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
 	if err != nil {
 		t.Fatalf("Error fetching default target state: %v", err)
 	}
@@ -106,7 +122,7 @@ func TestTargetStateIntegration(t *testing.T) {
 	compareTargetStates(t, got, defaultState)
 
 	// Create
-	got, err = s.UpdateTargetState(ctx, initialState)
+	got, err = s.UpdateTargetState(ctx, home.DefaultID, initialState)
 	if err != nil {
 		t.Fatalf("Error creating target state: %v", err)
 	}
@@ -114,7 +130,7 @@ func TestTargetStateIntegration(t *testing.T) {
 	compareTargetStates(t, got, initialState)
 
 	// Read (created)
-	got, err = s.FetchTargetState(ctx, testDeviceID)
+	got, err = s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
 	if err != nil {
 		t.Fatalf("Error reading target state: %v", err)
 	}
@@ -122,7 +138,7 @@ func TestTargetStateIntegration(t *testing.T) {
 	compareTargetStates(t, got, initialState)
 
 	// Update
-	got, err = s.UpdateTargetState(ctx, updatedState)
+	got, err = s.UpdateTargetState(ctx, home.DefaultID, updatedState)
 	if err != nil {
 		t.Fatalf("Error updating target state: %v", err)
 	}
@@ -130,7 +146,7 @@ func TestTargetStateIntegration(t *testing.T) {
 	compareTargetStates(t, got, updatedState)
 
 	// Read (updated)
-	got, err = s.FetchTargetState(ctx, testDeviceID)
+	got, err = s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
 	if err != nil {
 		t.Fatalf("Error reading target state: %v", err)
 	}
@@ -161,7 +177,7 @@ func TestCurrentStateIntegration(t *testing.T) {
 	}
 
 	// Read (not found)
-	_, err := s.FetchCurrentState(ctx, testDeviceID)
+	_, err := s.FetchCurrentState(ctx, home.DefaultID, testDeviceID)
 	switch err.(type) {
 	case *client.ErrNotFound:
 		// Expected
@@ -172,7 +188,7 @@ func TestCurrentStateIntegration(t *testing.T) {
 	}
 
 	// Create
-	got, err := s.UpdateCurrentState(ctx, state)
+	got, err := s.UpdateCurrentState(ctx, home.DefaultID, state)
 	if err != nil {
 		t.Fatalf("Error creating current state: %v", err)
 	}
@@ -180,7 +196,7 @@ func TestCurrentStateIntegration(t *testing.T) {
 	compareCurrentStates(t, got, state)
 
 	// Read (created)
-	got, err = s.FetchCurrentState(ctx, testDeviceID)
+	got, err = s.FetchCurrentState(ctx, home.DefaultID, testDeviceID)
 	if err != nil {
 		t.Fatalf("Error reading current state: %v", err)
 	}
@@ -188,7 +204,7 @@ func TestCurrentStateIntegration(t *testing.T) {
 	compareCurrentStates(t, got, state)
 
 	// Update
-	got, err = s.UpdateCurrentState(ctx, updatedState)
+	got, err = s.UpdateCurrentState(ctx, home.DefaultID, updatedState)
 	if err != nil {
 		t.Fatalf("Error updating current state: %v", err)
 	}
@@ -196,10 +212,1482 @@ func TestCurrentStateIntegration(t *testing.T) {
 	compareCurrentStates(t, got, updatedState)
 
 	// Read (updated)
-	got, err = s.FetchCurrentState(ctx, testDeviceID)
+	got, err = s.FetchCurrentState(ctx, home.DefaultID, testDeviceID)
 	if err != nil {
 		t.Fatalf("Error reading updated current state: %v", err)
 	}
 
 	compareCurrentStates(t, got, updatedState)
 }
+
+func TestOutboxIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	mode := thermostat.HeatMode
+	state := &thermostat.TargetState{
+		DeviceID: testDeviceID,
+		Mode:     &mode,
+	}
+
+	// Read (not found)
+	_, err := s.FetchDelivery(ctx, testDeviceID)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent delivery, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent delivery, got: %v", err)
+	}
+
+	// Enqueue with target state update
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, state)
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	entry, err := s.FetchDelivery(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching delivery: %v", err)
+	}
+
+	if entry.Version != 1 || entry.Attempts != 0 {
+		t.Errorf("Version, Attempts = %d, %d, want %d, %d", entry.Version, entry.Attempts, 1, 0)
+	}
+
+	// Due now
+	due, err := s.FetchDueDeliveries(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatalf("Error fetching due deliveries: %v", err)
+	}
+
+	if len(due) != 1 || due[0].DeviceID != testDeviceID {
+		t.Fatalf("FetchDueDeliveries() = %v, want delivery for %s", due, testDeviceID)
+	}
+
+	// Retry later
+	err = s.RetryDelivery(ctx, testDeviceID, entry.Version, time.Now().Add(time.Minute), "test error")
+	if err != nil {
+		t.Fatalf("Error retrying delivery: %v", err)
+	}
+
+	due, err = s.FetchDueDeliveries(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatalf("Error fetching due deliveries: %v", err)
+	}
+
+	if len(due) != 0 {
+		t.Errorf("FetchDueDeliveries() = %v, want none before retry time", due)
+	}
+
+	entry, err = s.FetchDelivery(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching delivery: %v", err)
+	}
+
+	if entry.Attempts != 1 || entry.LastError == nil || *entry.LastError != "test error" {
+		t.Errorf("Attempts, LastError = %d, %v, want %d, %s", entry.Attempts, entry.LastError, 1, "test error")
+	}
+
+	// Newer update coalesces into the same entry
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, state)
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	count, err := s.CountPendingDeliveries(ctx)
+	if err != nil {
+		t.Fatalf("Error counting pending deliveries: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("CountPendingDeliveries() = %d, want %d", count, 1)
+	}
+
+	// Completing an outdated version keeps the entry
+	err = s.CompleteDelivery(ctx, testDeviceID, entry.Version)
+	if err != nil {
+		t.Fatalf("Error completing delivery: %v", err)
+	}
+
+	entry, err = s.FetchDelivery(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching delivery: %v", err)
+	}
+
+	if entry.Version != 2 || entry.Attempts != 0 {
+		t.Errorf("Version, Attempts = %d, %d, want %d, %d", entry.Version, entry.Attempts, 2, 0)
+	}
+
+	// Completing the latest version removes the entry
+	err = s.CompleteDelivery(ctx, testDeviceID, entry.Version)
+	if err != nil {
+		t.Fatalf("Error completing delivery: %v", err)
+	}
+
+	count, err = s.CountPendingDeliveries(ctx)
+	if err != nil {
+		t.Fatalf("Error counting pending deliveries: %v", err)
+	}
+
+	if count != 0 {
+		t.Errorf("CountPendingDeliveries() = %d, want %d", count, 0)
+	}
+}
+
+func TestDeadLetterIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	letter := &deadletter.DeadLetter{
+		Topic:      "thermostat/current-state",
+		Payload:    []byte(`{"deviceId":`),
+		Reason:     "error unmarshalling current state",
+		ReceivedAt: time.Now(),
+	}
+
+	// Create
+	err := s.AddDeadLetter(ctx, letter)
+	if err != nil {
+		t.Fatalf("Error adding dead letter: %v", err)
+	}
+
+	// Read (list)
+	letters, err := s.FetchDeadLetters(ctx, 10)
+	if err != nil {
+		t.Fatalf("Error fetching dead letters: %v", err)
+	}
+
+	if len(letters) != 1 {
+		t.Fatalf("len(FetchDeadLetters()) = %d, want %d", len(letters), 1)
+	}
+
+	// Read (single)
+	got, err := s.FetchDeadLetter(ctx, letters[0].ID)
+	if err != nil {
+		t.Fatalf("Error fetching dead letter: %v", err)
+	}
+
+	if got.Topic != letter.Topic {
+		t.Errorf("Topic = %v, want %v", got.Topic, letter.Topic)
+	}
+
+	if string(got.Payload) != string(letter.Payload) {
+		t.Errorf("Payload = %s, want %s", got.Payload, letter.Payload)
+	}
+
+	if got.Reason != letter.Reason {
+		t.Errorf("Reason = %v, want %v", got.Reason, letter.Reason)
+	}
+
+	if !got.ReceivedAt.Equal(letter.ReceivedAt) {
+		t.Errorf("ReceivedAt = %v, want %v", got.ReceivedAt, letter.ReceivedAt)
+	}
+
+	if got.ReplayedAt != nil {
+		t.Errorf("ReplayedAt = %v, want nil", got.ReplayedAt)
+	}
+
+	// Update (replayed)
+	replayedAt := time.Now()
+	err = s.MarkDeadLetterReplayed(ctx, got.ID, replayedAt)
+	if err != nil {
+		t.Fatalf("Error marking dead letter as replayed: %v", err)
+	}
+
+	got, err = s.FetchDeadLetter(ctx, got.ID)
+	if err != nil {
+		t.Fatalf("Error fetching dead letter: %v", err)
+	}
+
+	if got.ReplayedAt == nil || !got.ReplayedAt.Equal(replayedAt) {
+		t.Errorf("ReplayedAt = %v, want %v", got.ReplayedAt, replayedAt)
+	}
+
+	// Read (not found)
+	_, err = s.FetchDeadLetter(ctx, got.ID+1)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent dead letter, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent dead letter, got: %v", err)
+	}
+}
+
+func TestProcessedMessageIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	topic := "thermostat/current-state"
+	now := time.Now()
+	window := time.Hour
+
+	processed, err := s.HasProcessedMessage(ctx, topic, "message-1", now.Add(-window))
+	if err != nil {
+		t.Fatalf("Error checking processed message: %v", err)
+	}
+
+	if processed {
+		t.Errorf("HasProcessedMessage() = %v before it was added, want %v", processed, false)
+	}
+
+	err = s.AddProcessedMessage(ctx, topic, "message-1", now.Add(-2*window), now.Add(-3*window))
+	if err != nil {
+		t.Fatalf("Error adding processed message: %v", err)
+	}
+
+	processed, err = s.HasProcessedMessage(ctx, topic, "message-1", now.Add(-window))
+	if err != nil {
+		t.Fatalf("Error checking processed message: %v", err)
+	}
+
+	if processed {
+		t.Errorf("HasProcessedMessage() = %v for message outside the window, want %v", processed, false)
+	}
+
+	err = s.AddProcessedMessage(ctx, topic, "message-2", now, now.Add(-window))
+	if err != nil {
+		t.Fatalf("Error adding processed message: %v", err)
+	}
+
+	processed, err = s.HasProcessedMessage(ctx, topic, "message-2", now.Add(-window))
+	if err != nil {
+		t.Fatalf("Error checking processed message: %v", err)
+	}
+
+	if !processed {
+		t.Errorf("HasProcessedMessage() = %v for message within the window, want %v", processed, true)
+	}
+
+	processed, err = s.HasProcessedMessage(ctx, "thermostat/other", "message-2", now.Add(-window))
+	if err != nil {
+		t.Fatalf("Error checking processed message: %v", err)
+	}
+
+	if processed {
+		t.Errorf("HasProcessedMessage() = %v for message of another topic, want %v", processed, false)
+	}
+
+	var count int
+	err = s.db.GetContext(ctx, &count, `SELECT COUNT(*) FROM processed_message;`)
+	if err != nil {
+		t.Fatalf("Error counting processed messages: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("processed messages = %d, want %d after expired ones are forgotten", count, 1)
+	}
+}
+
+func TestSchemaVersionIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	// Read (not found)
+	_, err := s.FetchSchemaVersion(ctx, testDeviceID)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent schema version, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent schema version, got: %v", err)
+	}
+
+	for _, version := range []thermostat.SchemaVersion{thermostat.SchemaV2, thermostat.SchemaV2, thermostat.SchemaV1} {
+		err = s.UpdateSchemaVersion(ctx, testDeviceID, version)
+		if err != nil {
+			t.Fatalf("Error updating schema version: %v", err)
+		}
+
+		got, err := s.FetchSchemaVersion(ctx, testDeviceID)
+		if err != nil {
+			t.Fatalf("Error fetching schema version: %v", err)
+		}
+
+		if got != version {
+			t.Errorf("FetchSchemaVersion() = %d, want %d", got, version)
+		}
+	}
+}
+
+func TestContentTypeIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	// Read (not found)
+	_, err := s.FetchContentType(ctx, testDeviceID)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent content type, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent content type, got: %v", err)
+	}
+
+	for _, contentType := range []string{"application/cbor", "application/json"} {
+		err = s.UpdateContentType(ctx, testDeviceID, contentType)
+		if err != nil {
+			t.Fatalf("Error updating content type: %v", err)
+		}
+
+		got, err := s.FetchContentType(ctx, testDeviceID)
+		if err != nil {
+			t.Fatalf("Error fetching content type: %v", err)
+		}
+
+		if got != contentType {
+			t.Errorf("FetchContentType() = %s, want %s", got, contentType)
+		}
+	}
+}
+
+func TestSensorIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	// Read (not found)
+	_, err := s.FetchSensor(ctx, "kitchen")
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent sensor, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent sensor, got: %v", err)
+	}
+
+	for _, id := range []string{"kitchen", "bedroom"} {
+		_, err = s.UpdateSensor(ctx, &sensor.Sensor{ID: id, Name: id, Room: id})
+		if err != nil {
+			t.Fatalf("Error updating sensor: %v", err)
+		}
+	}
+
+	sensors, err := s.FetchSensors(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching sensors: %v", err)
+	}
+
+	if len(sensors) != 2 {
+		t.Errorf("FetchSensors() returned %d sensors, want %d", len(sensors), 2)
+	}
+
+	now := time.Now()
+
+	err = s.UpdateSensorReading(ctx, &sensor.Reading{SensorID: "kitchen", Timestamp: now, Temperature: 21})
+	if err != nil {
+		t.Fatalf("Error updating sensor reading: %v", err)
+	}
+
+	// Older reading is ignored
+	err = s.UpdateSensorReading(ctx, &sensor.Reading{SensorID: "kitchen", Timestamp: now.Add(-time.Minute), Temperature: 15})
+	if err != nil {
+		t.Fatalf("Error updating sensor reading: %v", err)
+	}
+
+	reading, err := s.FetchSensorReading(ctx, "kitchen")
+	if err != nil {
+		t.Fatalf("Error fetching sensor reading: %v", err)
+	}
+
+	if reading.Temperature != 21 || !reading.Timestamp.Equal(now) {
+		t.Errorf("FetchSensorReading() = %+v, want temperature %v at %v", reading, 21, now)
+	}
+
+	err = s.UpdateSensorReading(ctx, &sensor.Reading{SensorID: "bedroom", Timestamp: now, Temperature: 19})
+	if err != nil {
+		t.Fatalf("Error updating sensor reading: %v", err)
+	}
+
+	assignment, err := s.UpdateSensorAssignment(ctx, &sensor.Assignment{
+		DeviceID:  testDeviceID,
+		Strategy:  sensor.AverageStrategy,
+		SensorIDs: []string{"kitchen", "bedroom"},
+	})
+	if err != nil {
+		t.Fatalf("Error updating sensor assignment: %v", err)
+	}
+
+	if assignment.Strategy != sensor.AverageStrategy || len(assignment.SensorIDs) != 2 {
+		t.Errorf("UpdateSensorAssignment() = %+v, want strategy %s with 2 sensors", assignment, sensor.AverageStrategy)
+	}
+
+	readings, err := s.FetchAssignedReadings(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching assigned readings: %v", err)
+	}
+
+	if len(readings) != 2 {
+		t.Errorf("FetchAssignedReadings() returned %d readings, want %d", len(readings), 2)
+	}
+
+	deviceIDs, err := s.FetchAssignedDevices(ctx, "kitchen")
+	if err != nil {
+		t.Fatalf("Error fetching assigned devices: %v", err)
+	}
+
+	if len(deviceIDs) != 1 || deviceIDs[0] != testDeviceID {
+		t.Errorf("FetchAssignedDevices() = %v, want [%s]", deviceIDs, testDeviceID)
+	}
+
+	// Deleting a sensor unassigns it
+	err = s.DeleteSensor(ctx, "kitchen")
+	if err != nil {
+		t.Fatalf("Error deleting sensor: %v", err)
+	}
+
+	assignment, err = s.FetchSensorAssignment(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching sensor assignment: %v", err)
+	}
+
+	if len(assignment.SensorIDs) != 1 || assignment.SensorIDs[0] != "bedroom" {
+		t.Errorf("FetchSensorAssignment() sensor IDs = %v, want [bedroom]", assignment.SensorIDs)
+	}
+
+	_, err = s.FetchSensorReading(ctx, "kitchen")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when fetching reading of deleted sensor, got: %v", err)
+	}
+
+	err = s.DeleteSensor(ctx, "kitchen")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when deleting non-existent sensor, got: %v", err)
+	}
+}
+
+func TestOutdoorReadingIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	// Read (not found)
+	_, err := s.FetchLatestOutdoorReading(ctx)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent outdoor reading, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent outdoor reading, got: %v", err)
+	}
+
+	now := time.Now()
+	for i := range 3 {
+		reading := outdoor.Reading{
+			Timestamp:   now.Add(-time.Duration(i) * time.Hour),
+			Temperature: float64(10 - i),
+			Source:      outdoor.StationSource,
+		}
+
+		err = s.AddOutdoorReading(ctx, &reading, now.Add(-24*time.Hour))
+		if err != nil {
+			t.Fatalf("Error adding outdoor reading: %v", err)
+		}
+	}
+
+	// Same reading again is ignored
+	err = s.AddOutdoorReading(ctx, &outdoor.Reading{Timestamp: now, Temperature: 10, Source: outdoor.StationSource}, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("Error adding outdoor reading: %v", err)
+	}
+
+	latest, err := s.FetchLatestOutdoorReading(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching latest outdoor reading: %v", err)
+	}
+
+	if !latest.Timestamp.Equal(now) || latest.Temperature != 10 {
+		t.Errorf("FetchLatestOutdoorReading() = %+v, want temperature %v at %v", latest, 10, now)
+	}
+
+	readings, err := s.FetchOutdoorReadings(ctx, now.Add(-90*time.Minute), 10)
+	if err != nil {
+		t.Fatalf("Error fetching outdoor readings: %v", err)
+	}
+
+	if len(readings) != 2 || !readings[0].Timestamp.After(readings[1].Timestamp) {
+		t.Errorf("FetchOutdoorReadings() = %+v, want the 2 readings of the last 90 minutes, newest first", readings)
+	}
+
+	// Readings past retention are dropped with the next one added
+	err = s.AddOutdoorReading(ctx, &outdoor.Reading{Timestamp: now.Add(time.Hour), Temperature: 11, Source: outdoor.ProviderSource}, now.Add(-30*time.Minute))
+	if err != nil {
+		t.Fatalf("Error adding outdoor reading: %v", err)
+	}
+
+	readings, err = s.FetchOutdoorReadings(ctx, now.Add(-24*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("Error fetching outdoor readings: %v", err)
+	}
+
+	if len(readings) != 2 {
+		t.Errorf("FetchOutdoorReadings() returned %d readings, want %d", len(readings), 2)
+	}
+}
+
+func TestControlIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	// Devices run their own control loop by default
+	settings, err := s.FetchControlSettings(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching control settings: %v", err)
+	}
+
+	if settings.ControlledBy != control.DeviceControlled {
+		t.Errorf("FetchControlSettings() controlled by = %s, want %s", settings.ControlledBy, control.DeviceControlled)
+	}
+
+	minCycleSeconds := 600
+	settings, err = s.UpdateControlSettings(ctx, &control.Settings{DeviceID: testDeviceID, ControlledBy: control.ServerControlled, MinCycleSeconds: &minCycleSeconds})
+	if err != nil {
+		t.Fatalf("Error updating control settings: %v", err)
+	}
+
+	if settings.ControlledBy != control.ServerControlled || !ptrEqual(settings.MinCycleSeconds, &minCycleSeconds) {
+		t.Errorf("UpdateControlSettings() = %+v, want server controlled with min cycle of %d seconds", settings, minCycleSeconds)
+	}
+
+	deviceIDs, err := s.FetchServerControlledDevices(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching server controlled devices: %v", err)
+	}
+
+	if len(deviceIDs) != 1 || deviceIDs[0] != testDeviceID {
+		t.Errorf("FetchServerControlledDevices() = %v, want [%s]", deviceIDs, testDeviceID)
+	}
+
+	// Read (not found)
+	_, err = s.FetchLatestControlDecision(ctx, testDeviceID)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent control decision, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent control decision, got: %v", err)
+	}
+
+	now := time.Now()
+	temperature := 18.5
+	commands := []control.Command{control.IdleCommand, control.HeatCommand, control.HeatCommand}
+	for i, command := range commands {
+		decidedAt := now.Add(time.Duration(i-len(commands)) * time.Hour)
+		err = s.AddControlDecision(ctx, &control.Decision{
+			DeviceID:           testDeviceID,
+			DecidedAt:          decidedAt,
+			Mode:               thermostat.HeatMode,
+			TargetTemperature:  20,
+			CurrentTemperature: &temperature,
+			Command:            command,
+			CommandSince:       decidedAt,
+			Reason:             "test reason",
+		}, now.Add(-24*time.Hour))
+		if err != nil {
+			t.Fatalf("Error adding control decision: %v", err)
+		}
+	}
+
+	latest, err := s.FetchLatestControlDecision(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching latest control decision: %v", err)
+	}
+
+	lastStart, err := s.FetchLastControlCycleStart(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching last control cycle start: %v", err)
+	}
+
+	if lastStart.ID != latest.ID {
+		t.Errorf("FetchLastControlCycleStart() = %+v, want the latest decision", lastStart)
+	}
+
+	if latest.Command != control.HeatCommand || !ptrEqual(latest.CurrentTemperature, &temperature) {
+		t.Errorf("FetchLatestControlDecision() = %+v, want command %s", latest, control.HeatCommand)
+	}
+
+	decisions, err := s.FetchControlDecisions(ctx, testDeviceID, 2)
+	if err != nil {
+		t.Fatalf("Error fetching control decisions: %v", err)
+	}
+
+	if len(decisions) != 2 || decisions[0].ID <= decisions[1].ID {
+		t.Errorf("FetchControlDecisions() = %+v, want the 2 latest decisions, newest first", decisions)
+	}
+
+	// Expired decisions are forgotten, except the latest one of each device
+	err = s.AddControlDecision(ctx, &control.Decision{
+		DeviceID:     "other-device-id",
+		DecidedAt:    now,
+		Mode:         thermostat.OffMode,
+		Command:      control.IdleCommand,
+		CommandSince: now,
+		Reason:       "test reason",
+	}, now)
+	if err != nil {
+		t.Fatalf("Error adding control decision: %v", err)
+	}
+
+	decisions, err = s.FetchControlDecisions(ctx, testDeviceID, 10)
+	if err != nil {
+		t.Fatalf("Error fetching control decisions: %v", err)
+	}
+
+	if len(decisions) != 1 || decisions[0].ID != latest.ID {
+		t.Errorf("FetchControlDecisions() after expiry = %+v, want only the latest decision", decisions)
+	}
+}
+
+func TestOperatingStateIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	now := time.Now()
+
+	// Read (not found)
+	_, err := s.FetchLastCycleStart(ctx, testDeviceID, now)
+	switch err.(type) {
+	case *client.ErrNotFound:
+		// Expected
+	case nil:
+		t.Fatal("Expected error when fetching non-existent cycle start, got nil")
+	default:
+		t.Fatalf("Expected ErrNotFound when fetching non-existent cycle start, got: %v", err)
+	}
+
+	states := []thermostat.OperatingState{
+		thermostat.HeatingOperatingState,
+		thermostat.IdleOperatingState,
+		thermostat.CoolingOperatingState,
+		thermostat.IdleOperatingState,
+	}
+	for i, state := range states {
+		err = s.AddOperatingStateChange(ctx, &thermostat.OperatingStateChange{
+			DeviceID:       testDeviceID,
+			OperatingState: state,
+			ChangedAt:      now.Add(time.Duration(i-len(states)) * time.Minute),
+		}, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("Error adding operating state change: %v", err)
+		}
+	}
+
+	lastStart, err := s.FetchLastCycleStart(ctx, testDeviceID, now)
+	if err != nil {
+		t.Fatalf("Error fetching last cycle start: %v", err)
+	}
+
+	if lastStart.OperatingState != thermostat.CoolingOperatingState || !lastStart.ChangedAt.Equal(now.Add(-2*time.Minute)) {
+		t.Errorf("FetchLastCycleStart() = %+v, want cooling 2 minutes ago", lastStart)
+	}
+
+	lastStart, err = s.FetchLastCycleStart(ctx, testDeviceID, now.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatalf("Error fetching last cycle start: %v", err)
+	}
+
+	if lastStart.OperatingState != thermostat.HeatingOperatingState {
+		t.Errorf("FetchLastCycleStart() before cooling = %+v, want heating", lastStart)
+	}
+
+	// Adding a change again keeps the one recorded at that time
+	err = s.AddOperatingStateChange(ctx, &thermostat.OperatingStateChange{
+		DeviceID:       testDeviceID,
+		OperatingState: thermostat.IdleOperatingState,
+		ChangedAt:      now.Add(-2 * time.Minute),
+	}, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Error adding operating state change again: %v", err)
+	}
+
+	lastStart, err = s.FetchLastCycleStart(ctx, testDeviceID, now)
+	if err != nil {
+		t.Fatalf("Error fetching last cycle start: %v", err)
+	}
+
+	if lastStart.OperatingState != thermostat.CoolingOperatingState || !lastStart.ChangedAt.Equal(now.Add(-2*time.Minute)) {
+		t.Errorf("FetchLastCycleStart() after adding change again = %+v, want cooling 2 minutes ago", lastStart)
+	}
+
+	// Changes past retention are forgotten with the next one added
+	err = s.AddOperatingStateChange(ctx, &thermostat.OperatingStateChange{
+		DeviceID:       testDeviceID,
+		OperatingState: thermostat.HeatingOperatingState,
+		ChangedAt:      now,
+	}, now.Add(-3*time.Minute))
+	if err != nil {
+		t.Fatalf("Error adding operating state change: %v", err)
+	}
+
+	_, err = s.FetchLastCycleStart(ctx, testDeviceID, now.Add(-2*time.Minute))
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when fetching expired cycle start, got: %v", err)
+	}
+}
+
+func TestSafetyIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+	now := time.Now().UTC()
+
+	// Limits fall back to the configured defaults until set
+	limits, err := s.FetchSafetyLimits(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching safety limits: %v", err)
+	}
+
+	if limits.FloorTemperature != nil || limits.CeilingTemperature != nil {
+		t.Errorf("FetchSafetyLimits() = %+v, want no limits", limits)
+	}
+
+	floor, ceiling := 8.0, 28.0
+	limits, err = s.UpdateSafetyLimits(ctx, &safety.Limits{DeviceID: testDeviceID, FloorTemperature: &floor, CeilingTemperature: &ceiling})
+	if err != nil {
+		t.Fatalf("Error updating safety limits: %v", err)
+	}
+
+	if !ptrEqual(limits.FloorTemperature, &floor) || !ptrEqual(limits.CeilingTemperature, &ceiling) {
+		t.Errorf("UpdateSafetyLimits() = %+v, want floor %.2f and ceiling %.2f", limits, floor, ceiling)
+	}
+
+	previous, err := s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching target state: %v", err)
+	}
+
+	e := safety.Event{
+		DeviceID:                  testDeviceID,
+		Kind:                      safety.FreezeKind,
+		Temperature:               6.5,
+		Limit:                     floor,
+		TriggeredAt:               now,
+		PreviousMode:              previous.Mode,
+		PreviousTargetTemperature: previous.TargetTemperature,
+	}
+	protective := e.ProtectiveState(2)
+
+	triggered, err := s.TriggerSafetyEvent(ctx, &e, protective)
+	if err != nil {
+		t.Fatalf("Error triggering safety event: %v", err)
+	}
+
+	state, err := s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching target state: %v", err)
+	}
+	compareTargetStates(t, state, protective)
+
+	_, err = s.FetchDelivery(ctx, testDeviceID)
+	if err != nil {
+		t.Errorf("Expected protective target state to be enqueued for delivery, got: %v", err)
+	}
+
+	// Target state is locked while the event lasts
+	heatMode := thermostat.HeatMode
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: testDeviceID, Mode: &heatMode})
+	if _, ok := err.(*client.ErrConflict); !ok {
+		t.Errorf("Expected ErrConflict when updating locked target state, got: %v", err)
+	}
+
+	active, err := s.FetchActiveSafetyEvent(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching active safety event: %v", err)
+	}
+
+	if active.ID != triggered.ID || active.Kind != safety.FreezeKind || !ptrEqual(active.PreviousMode, previous.Mode) {
+		t.Errorf("FetchActiveSafetyEvent() = %+v, want %+v", active, triggered)
+	}
+
+	err = s.ClearSafetyEvent(ctx, active, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error clearing safety event: %v", err)
+	}
+
+	state, err = s.FetchTargetState(ctx, home.DefaultID, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching target state: %v", err)
+	}
+	compareTargetStates(t, state, previous)
+
+	_, err = s.FetchActiveSafetyEvent(ctx, testDeviceID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when fetching cleared safety event, got: %v", err)
+	}
+
+	events, err := s.FetchSafetyEvents(ctx, testDeviceID, 10)
+	if err != nil {
+		t.Fatalf("Error fetching safety events: %v", err)
+	}
+
+	if len(events) != 1 || events[0].ClearedAt == nil || !events[0].ClearedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("FetchSafetyEvents() = %+v, want one event cleared an hour after it triggered", events)
+	}
+
+	// Target state can be updated again once the event clears
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: testDeviceID, Mode: &heatMode})
+	if err != nil {
+		t.Errorf("Error updating target state after safety event cleared: %v", err)
+	}
+}
+
+func TestAlertIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+	now := time.Now().UTC()
+	minTemperature := 16.0
+
+	rule, err := s.AddAlertRule(ctx, &alert.Rule{
+		Name: "Too cold",
+		Kind: alert.TemperatureRangeRule,
+		Min:  &minTemperature,
+		Channels: []alert.Channel{
+			{Type: alert.WebhookChannel, Target: "https://example.com/hook"},
+			{Type: alert.MQTTChannel, Target: "alerts"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error adding alert rule: %v", err)
+	}
+
+	if rule.ID == 0 || rule.DeviceID != nil || !ptrEqual(rule.Min, &minTemperature) || len(rule.Channels) != 2 {
+		t.Errorf("AddAlertRule() = %+v, want rule with ID, min %.2f and 2 channels", rule, minTemperature)
+	}
+
+	// Rules without a device apply to every device
+	deviceRules, err := s.FetchDeviceAlertRules(ctx, "other-device-id")
+	if err != nil {
+		t.Fatalf("Error fetching alert rules of device: %v", err)
+	}
+
+	if len(deviceRules) != 1 || deviceRules[0].ID != rule.ID || len(deviceRules[0].Channels) != 2 {
+		t.Errorf("FetchDeviceAlertRules() = %+v, want rule %d with 2 channels", deviceRules, rule.ID)
+	}
+
+	err = s.UpdateAlertState(ctx, &alert.State{RuleID: rule.ID, DeviceID: testDeviceID, Status: alert.FiringStatus, Message: "too cold", ChangedAt: now})
+	if err != nil {
+		t.Fatalf("Error updating alert state: %v", err)
+	}
+
+	firing := alert.FiringStatus
+	states, err := s.FetchAlertStates(ctx, &firing)
+	if err != nil {
+		t.Fatalf("Error fetching alert states: %v", err)
+	}
+
+	if len(states) != 1 || states[0].RuleID != rule.ID || !states[0].ChangedAt.Equal(now) {
+		t.Errorf("FetchAlertStates() = %+v, want firing state of rule %d", states, rule.ID)
+	}
+
+	resolved := alert.ResolvedStatus
+	states, err = s.FetchAlertStates(ctx, &resolved)
+	if err != nil {
+		t.Fatalf("Error fetching alert states: %v", err)
+	}
+
+	if len(states) != 0 {
+		t.Errorf("FetchAlertStates() resolved = %+v, want none", states)
+	}
+
+	// Updating a rule replaces its channels and forgets its states
+	deviceID := testDeviceID
+	rule.DeviceID = &deviceID
+	rule.Channels = []alert.Channel{{Type: alert.EmailChannel, Target: "owner@example.com"}}
+	rule, err = s.UpdateAlertRule(ctx, rule)
+	if err != nil {
+		t.Fatalf("Error updating alert rule: %v", err)
+	}
+
+	if !ptrEqual(rule.DeviceID, &deviceID) || len(rule.Channels) != 1 || rule.Channels[0].Type != alert.EmailChannel {
+		t.Errorf("UpdateAlertRule() = %+v, want rule of %s with an email channel", rule, deviceID)
+	}
+
+	_, err = s.FetchAlertState(ctx, rule.ID, testDeviceID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when fetching state of updated rule, got: %v", err)
+	}
+
+	deviceRules, err = s.FetchDeviceAlertRules(ctx, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching alert rules of device: %v", err)
+	}
+
+	if len(deviceRules) != 1 || deviceRules[0].ID != rule.ID || len(deviceRules[0].Channels) != 1 {
+		t.Errorf("FetchDeviceAlertRules() = %+v, want rule %d with 1 channel", deviceRules, rule.ID)
+	}
+
+	deviceRules, err = s.FetchDeviceAlertRules(ctx, "other-device-id")
+	if err != nil {
+		t.Fatalf("Error fetching alert rules of other device: %v", err)
+	}
+
+	if len(deviceRules) != 0 {
+		t.Errorf("FetchDeviceAlertRules() of other device = %+v, want none", deviceRules)
+	}
+
+	err = s.DeleteAlertRule(ctx, rule.ID)
+	if err != nil {
+		t.Fatalf("Error deleting alert rule: %v", err)
+	}
+
+	rules, err := s.FetchAlertRules(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching alert rules: %v", err)
+	}
+
+	if len(rules) != 0 {
+		t.Errorf("FetchAlertRules() = %+v, want none", rules)
+	}
+
+	err = s.DeleteAlertRule(ctx, rule.ID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when deleting deleted rule, got: %v", err)
+	}
+
+	_, err = s.UpdateAlertRule(ctx, rule)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("Expected ErrNotFound when updating deleted rule, got: %v", err)
+	}
+}
+
+func TestWebhookIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	deviceID := testDeviceID
+	subscription, err := s.AddWebhookSubscription(ctx, &webhook.Subscription{
+		URL:        "https://example.com/hook",
+		EventTypes: []webhook.EventType{webhook.TargetStateEvent, webhook.AvailabilityEvent},
+		DeviceID:   &deviceID,
+		Secret:     "test_secret_0123456789",
+	})
+	if err != nil {
+		t.Fatalf("Error adding webhook subscription: %v", err)
+	}
+
+	if subscription.ID == 0 || !subscription.Enabled || len(subscription.EventTypes) != 2 || subscription.Secret != "test_secret_0123456789" {
+		t.Errorf("AddWebhookSubscription() = %+v, want enabled subscription to 2 event types", subscription)
+	}
+
+	// Events of other devices and unsubscribed types aren't delivered
+	mode := thermostat.HeatMode
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: "other-device-id", Mode: &mode})
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: testDeviceID, Mode: &mode})
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	_, err = s.UpdateCurrentState(ctx, home.DefaultID, &thermostat.CurrentState{DeviceID: testDeviceID, Timestamp: time.Now(), CurrentTemperature: 20})
+	if err != nil {
+		t.Fatalf("Error updating current state: %v", err)
+	}
+
+	deliveries, err := s.FetchDueWebhookDeliveries(ctx, time.Now(), 100)
+	if err != nil {
+		t.Fatalf("Error fetching due webhook deliveries: %v", err)
+	}
+
+	if len(deliveries) != 2 || deliveries[0].EventType != webhook.TargetStateEvent || deliveries[1].EventType != webhook.AvailabilityEvent {
+		t.Fatalf("FetchDueWebhookDeliveries() = %+v, want target state and availability deliveries", deliveries)
+	}
+
+	var event struct {
+		Type webhook.EventType      `json:"type"`
+		Data thermostat.TargetState `json:"data"`
+	}
+	err = json.Unmarshal([]byte(deliveries[0].Payload), &event)
+	if err != nil {
+		t.Fatalf("Error unmarshalling delivery payload: %v", err)
+	}
+
+	targetTemperature := defaultTargetTemperature
+
+	if event.Type != webhook.TargetStateEvent || !ptrEqual(event.Data.Mode, &mode) || !ptrEqual(event.Data.TargetTemperature, &targetTemperature) {
+		t.Errorf("delivery payload = %s, want full target state of %s", deliveries[0].Payload, testDeviceID)
+	}
+
+	err = s.CompleteWebhookDelivery(ctx, &deliveries[0], 200, time.Now())
+	if err != nil {
+		t.Fatalf("Error completing webhook delivery: %v", err)
+	}
+
+	// Subscription is disabled after reaching max failures in a row
+	disabled, err := s.FailWebhookDelivery(ctx, &deliveries[1], nil, "connection refused", nil, 1, time.Now())
+	if err != nil {
+		t.Fatalf("Error failing webhook delivery: %v", err)
+	}
+
+	if !disabled {
+		t.Errorf("FailWebhookDelivery() disabled = false, want true")
+	}
+
+	log, err := s.FetchWebhookDeliveries(ctx, subscription.ID, 100)
+	if err != nil {
+		t.Fatalf("Error fetching webhook deliveries: %v", err)
+	}
+
+	if len(log) != 2 || log[0].Status != webhook.FailedStatus || log[1].Status != webhook.DeliveredStatus || log[1].CompletedAt == nil {
+		t.Errorf("FetchWebhookDeliveries() = %+v, want failed and delivered deliveries, newest first", log)
+	}
+
+	count, err := s.CountPendingWebhookDeliveries(ctx)
+	if err != nil {
+		t.Fatalf("Error counting pending webhook deliveries: %v", err)
+	}
+
+	if count != 0 {
+		t.Errorf("CountPendingWebhookDeliveries() = %d, want %d", count, 0)
+	}
+
+	// Disabled subscriptions get no new deliveries
+	_, err = s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: testDeviceID, Mode: &mode})
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	deliveries, err = s.FetchDueWebhookDeliveries(ctx, time.Now(), 100)
+	if err != nil {
+		t.Fatalf("Error fetching due webhook deliveries: %v", err)
+	}
+
+	if len(deliveries) != 0 {
+		t.Errorf("FetchDueWebhookDeliveries() = %+v, want none for disabled subscription", deliveries)
+	}
+
+	// Re-enabling resets failures and keeps the secret
+	subscription.Enabled = true
+	subscription.Secret = ""
+	subscription, err = s.UpdateWebhookSubscription(ctx, subscription)
+	if err != nil {
+		t.Fatalf("Error updating webhook subscription: %v", err)
+	}
+
+	if !subscription.Enabled || subscription.ConsecutiveFailures != 0 || subscription.DisabledAt != nil || subscription.Secret != "test_secret_0123456789" {
+		t.Errorf("UpdateWebhookSubscription() = %+v, want enabled subscription with its secret and no failures", subscription)
+	}
+
+	// Devices that stop reporting become unavailable
+	unavailable, err := s.MarkUnavailableDevices(ctx, time.Now().Add(time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("Error marking unavailable devices: %v", err)
+	}
+
+	if len(unavailable) != 1 || unavailable[0].DeviceID != testDeviceID || unavailable[0].Available {
+		t.Errorf("MarkUnavailableDevices() = %+v, want %s unavailable", unavailable, testDeviceID)
+	}
+
+	deliveries, err = s.FetchDueWebhookDeliveries(ctx, time.Now(), 100)
+	if err != nil {
+		t.Fatalf("Error fetching due webhook deliveries: %v", err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].EventType != webhook.AvailabilityEvent {
+		t.Errorf("FetchDueWebhookDeliveries() = %+v, want availability delivery", deliveries)
+	}
+
+	err = s.DeleteWebhookSubscription(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("Error deleting webhook subscription: %v", err)
+	}
+
+	_, err = s.FetchWebhookSubscription(ctx, subscription.ID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("FetchWebhookSubscription() error = %v, want ErrNotFound after delete", err)
+	}
+}
+
+func TestAPIKeyIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	token, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		t.Fatalf("Error generating api key: %v", err)
+	}
+
+	key, err := s.AddAPIKey(ctx, &apikey.Key{
+		Name:   "Home Assistant",
+		Prefix: prefix,
+		Hash:   hash,
+		Scopes: []apikey.Scope{apikey.ReadScope, apikey.WriteScope},
+	})
+	if err != nil {
+		t.Fatalf("Error adding api key: %v", err)
+	}
+
+	now := time.Now().UTC()
+	authenticated, err := s.AuthenticateAPIKey(ctx, apikey.Hash(token), now)
+	if err != nil {
+		t.Fatalf("Error authenticating api key: %v", err)
+	}
+
+	if authenticated.ID != key.ID || !authenticated.HasScope(apikey.WriteScope) || authenticated.HasScope(apikey.AdminScope) {
+		t.Errorf("AuthenticateAPIKey() = %+v, want key %d with read and write scopes", authenticated, key.ID)
+	}
+
+	if authenticated.LastUsedAt == nil || !authenticated.LastUsedAt.Equal(now) {
+		t.Errorf("AuthenticateAPIKey() LastUsedAt = %v, want %v", authenticated.LastUsedAt, now)
+	}
+
+	_, err = s.AuthenticateAPIKey(ctx, apikey.Hash(token+"x"), now)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("AuthenticateAPIKey() error = %v, want ErrNotFound for unknown key", err)
+	}
+
+	err = s.RevokeAPIKey(ctx, key.ID, now)
+	if err != nil {
+		t.Fatalf("Error revoking api key: %v", err)
+	}
+
+	_, err = s.AuthenticateAPIKey(ctx, apikey.Hash(token), now)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("AuthenticateAPIKey() error = %v, want ErrNotFound for revoked key", err)
+	}
+
+	err = s.RevokeAPIKey(ctx, key.ID, now)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("RevokeAPIKey() error = %v, want ErrNotFound for revoked key", err)
+	}
+
+	keys, err := s.FetchAPIKeys(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching api keys: %v", err)
+	}
+
+	if len(keys) != 1 || keys[0].RevokedAt == nil || len(keys[0].Scopes) != 2 {
+		t.Errorf("FetchAPIKeys() = %+v, want revoked key with 2 scopes", keys)
+	}
+}
+
+func TestAccessIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	maxTemperature := 22
+	_, err := s.UpdateRole(ctx, &access.Role{
+		Name: "kid",
+		Grants: []access.Grant{
+			{DeviceID: "bedroom", Permission: access.SetTemperaturePermission, MaxTemperature: &maxTemperature},
+			{DeviceID: "bedroom", Permission: access.ViewPermission},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error adding role: %v", err)
+	}
+
+	role, err := s.UpdateRole(ctx, &access.Role{
+		Name:   "kid",
+		Grants: []access.Grant{{DeviceID: "bedroom", Permission: access.SetTemperaturePermission, MaxTemperature: &maxTemperature}},
+	})
+	if err != nil {
+		t.Fatalf("Error updating role: %v", err)
+	}
+
+	if len(role.Grants) != 1 || !ptrEqual(role.Grants[0].MaxTemperature, &maxTemperature) {
+		t.Errorf("UpdateRole() = %+v, want grants replaced by set temperature grant up to %d", role, maxTemperature)
+	}
+
+	_, err = s.UpdateUser(ctx, &access.User{Subject: "user-1", Roles: []string{"kid", "parent"}})
+	if _, ok := err.(*client.ErrConflict); !ok {
+		t.Errorf("UpdateUser() error = %v, want ErrConflict for unknown role", err)
+	}
+
+	_, err = s.UpdateUser(ctx, &access.User{Subject: "user-1", Name: "Alex", Roles: []string{"kid", "kid"}})
+	if err != nil {
+		t.Fatalf("Error updating user: %v", err)
+	}
+
+	roles, err := s.FetchUserRoles(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("Error fetching user roles: %v", err)
+	}
+
+	if len(roles) != 1 || roles[0] != "kid" {
+		t.Errorf("FetchUserRoles() = %v, want [kid]", roles)
+	}
+
+	grants, err := s.FetchRoleGrants(ctx, append(roles, "unknown"))
+	if err != nil {
+		t.Fatalf("Error fetching role grants: %v", err)
+	}
+
+	if len(grants) != 1 || grants[0].Permission != access.SetTemperaturePermission {
+		t.Errorf("FetchRoleGrants() = %+v, want set temperature grant of kid", grants)
+	}
+
+	err = s.DeleteRole(ctx, "kid")
+	if err != nil {
+		t.Fatalf("Error deleting role: %v", err)
+	}
+
+	users, err := s.FetchUsers(ctx)
+	if err != nil {
+		t.Fatalf("Error fetching users: %v", err)
+	}
+
+	if len(users) != 1 || len(users[0].Roles) != 0 {
+		t.Errorf("FetchUsers() = %+v, want user-1 without roles", users)
+	}
+
+	err = s.DeleteRole(ctx, "kid")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("DeleteRole() error = %v, want ErrNotFound for deleted role", err)
+	}
+
+	err = s.DeleteUser(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("Error deleting user: %v", err)
+	}
+
+	err = s.DeleteUser(ctx, "user-1")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("DeleteUser() error = %v, want ErrNotFound for deleted user", err)
+	}
+}
+
+func TestHomeIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	mode := thermostat.HeatMode
+	_, err := s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: testDeviceID, Mode: &mode})
+	if err != nil {
+		t.Fatalf("Error updating target state: %v", err)
+	}
+
+	smiths, err := s.AddHome(ctx, &home.Home{ID: "smiths", Name: "The Smiths", TopicPrefix: "smiths"})
+	if err != nil {
+		t.Fatalf("Error adding home: %v", err)
+	}
+
+	_, err = s.AddHome(ctx, &home.Home{ID: "joneses", Name: "The Joneses", TopicPrefix: "smiths"})
+	if _, ok := err.(*client.ErrConflict); !ok {
+		t.Errorf("AddHome() error = %v, want ErrConflict for taken topic prefix", err)
+	}
+
+	h, err := s.FetchHomeByTopicPrefix(ctx, "smiths")
+	if err != nil {
+		t.Fatalf("Error fetching home by topic prefix: %v", err)
+	}
+
+	if h.ID != smiths.ID {
+		t.Errorf("FetchHomeByTopicPrefix() = %s, want %s", h.ID, smiths.ID)
+	}
+
+	// Devices are registered by the first home they report in
+	_, err = s.UpdateCurrentState(ctx, smiths.ID, &thermostat.CurrentState{DeviceID: "other-device-id", Timestamp: time.Now(), CurrentTemperature: 20})
+	if err != nil {
+		t.Fatalf("Error updating current state: %v", err)
+	}
+
+	_, err = s.UpdateCurrentState(ctx, smiths.ID, &thermostat.CurrentState{DeviceID: testDeviceID, Timestamp: time.Now(), CurrentTemperature: 20})
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("UpdateCurrentState() error = %v, want ErrNotFound for device of another home", err)
+	}
+
+	err = s.ClaimDevice(ctx, smiths.ID, "other-device-id")
+	if err != nil {
+		t.Errorf("Error claiming device of the home again: %v", err)
+	}
+
+	err = s.ClaimDevice(ctx, smiths.ID, testDeviceID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("ClaimDevice() error = %v, want ErrNotFound for device of another home", err)
+	}
+
+	_, err = s.FetchTargetState(ctx, smiths.ID, testDeviceID)
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("FetchTargetState() error = %v, want ErrNotFound for device of another home", err)
+	}
+
+	_, err = s.FetchCurrentState(ctx, home.DefaultID, "other-device-id")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("FetchCurrentState() error = %v, want ErrNotFound for device of another home", err)
+	}
+
+	_, err = s.UpdateDevice(ctx, &home.Device{ID: testDeviceID, HomeID: smiths.ID})
+	if err != nil {
+		t.Fatalf("Error moving device: %v", err)
+	}
+
+	state, err := s.FetchTargetState(ctx, smiths.ID, testDeviceID)
+	if err != nil {
+		t.Fatalf("Error fetching target state of moved device: %v", err)
+	}
+
+	if !ptrEqual(state.Mode, &mode) {
+		t.Errorf("FetchTargetState() mode = %v, want %v kept after move", state.Mode, mode)
+	}
+
+	devices, err := s.FetchDevices(ctx, smiths.ID)
+	if err != nil {
+		t.Fatalf("Error fetching devices: %v", err)
+	}
+
+	if len(devices) != 2 {
+		t.Errorf("FetchDevices() = %+v, want 2 devices", devices)
+	}
+
+	_, err = s.UpdateDevice(ctx, &home.Device{ID: testDeviceID, HomeID: "joneses"})
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("UpdateDevice() error = %v, want ErrNotFound for unknown home", err)
+	}
+
+	_, err = s.UpdateMember(ctx, &home.Member{Subject: "api-key:1", HomeID: smiths.ID})
+	if err != nil {
+		t.Fatalf("Error adding member: %v", err)
+	}
+
+	h, err = s.FetchMemberHome(ctx, "api-key:1")
+	if err != nil {
+		t.Fatalf("Error fetching member home: %v", err)
+	}
+
+	if h.ID != smiths.ID {
+		t.Errorf("FetchMemberHome() = %s, want %s", h.ID, smiths.ID)
+	}
+
+	err = s.DeleteHome(ctx, smiths.ID)
+	if _, ok := err.(*client.ErrConflict); !ok {
+		t.Errorf("DeleteHome() error = %v, want ErrConflict for home with devices", err)
+	}
+
+	err = s.DeleteHome(ctx, home.DefaultID)
+	if _, ok := err.(*client.ErrConflict); !ok {
+		t.Errorf("DeleteHome() error = %v, want ErrConflict for default home", err)
+	}
+
+	for _, deviceID := range []string{testDeviceID, "other-device-id"} {
+		_, err = s.UpdateDevice(ctx, &home.Device{ID: deviceID, HomeID: home.DefaultID})
+		if err != nil {
+			t.Fatalf("Error moving device back: %v", err)
+		}
+	}
+
+	err = s.DeleteHome(ctx, smiths.ID)
+	if err != nil {
+		t.Fatalf("Error deleting home: %v", err)
+	}
+
+	_, err = s.FetchMemberHome(ctx, "api-key:1")
+	if _, ok := err.(*client.ErrNotFound); !ok {
+		t.Errorf("FetchMemberHome() error = %v, want ErrNotFound after home is deleted", err)
+	}
+}
+
+func TestSpanIntegration(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(ctx, t)
+
+	tests := []struct {
+		name       string
+		call       func(ctx context.Context) error
+		wantName   string
+		wantStatus codes.Code
+	}{
+		{
+			name: "should leave span status unset, if call succeeded",
+			call: func(ctx context.Context) error {
+				_, err := s.FetchSafetyLimits(ctx, testDeviceID)
+				return err
+			},
+			wantName:   "storage.FetchSafetyLimits",
+			wantStatus: codes.Unset,
+		},
+		{
+			name: "should mark span as failed, if call failed",
+			call: func(ctx context.Context) error {
+				_, err := s.FetchDeadLetter(ctx, 404)
+				return err
+			},
+			wantName:   "storage.FetchDeadLetter",
+			wantStatus: codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracingtest.Init()
+
+			callErr := tt.call(ctx)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("len(spans) = %d, want %d", len(spans), 1)
+			}
+
+			span := spans[0]
+			if span.Name != tt.wantName {
+				t.Errorf("span.Name = %v, want %v", span.Name, tt.wantName)
+			}
+
+			if span.Status.Code != tt.wantStatus {
+				t.Errorf("span.Status = %v, want %v", span.Status.Code, tt.wantStatus)
+			}
+
+			if callErr != nil && span.Status.Description != callErr.Error() {
+				t.Errorf("span.Status.Description = %q, want %q", span.Status.Description, callErr.Error())
+			}
+		})
+	}
+}
+
+func TestConcurrentWritesIntegration(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := New(ctx, filepath.Join(t.TempDir(), "storage.db"), defaultMode, defaultTargetTemperature)
+	if err != nil {
+		t.Fatalf("Error creating new storage: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	var journalMode string
+	err = s.db.GetContext(ctx, &journalMode, "PRAGMA journal_mode;")
+	if err != nil {
+		t.Fatalf("Error fetching journal mode: %v", err)
+	}
+
+	if journalMode != "wal" {
+		t.Errorf("journal mode = %q, want %q", journalMode, "wal")
+	}
+
+	const writers = 8
+	const writes = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers*writes)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			deviceID := fmt.Sprintf("device-%d", i)
+			for j := range writes {
+				targetTemperature := 15 + j%10
+				_, err := s.UpdateTargetState(ctx, home.DefaultID, &thermostat.TargetState{DeviceID: deviceID, TargetTemperature: &targetTemperature})
+				if err != nil {
+					errs <- fmt.Errorf("error updating target state of %s: %v", deviceID, err)
+				}
+
+				_, err = s.FetchTargetState(ctx, home.DefaultID, deviceID)
+				if err != nil {
+					errs <- fmt.Errorf("error fetching target state of %s: %v", deviceID, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initOperatingStateTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS operating_state_change (
+			device_id TEXT NOT NULL,
+			operating_state TEXT NOT NULL,
+			changed_at DATETIME NOT NULL,
+			PRIMARY KEY (device_id, changed_at)
+		);
+		CREATE INDEX IF NOT EXISTS operating_state_change_changed_at ON operating_state_change (changed_at);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing operating state schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchLastCycleStart returns the latest change of the device to an active
+// operating state before the given time.
+func (c *Client) FetchLastCycleStart(ctx context.Context, deviceID string, before time.Time) (_ *thermostat.OperatingStateChange, err error) {
+	ctx, span := startSpan(ctx, "FetchLastCycleStart")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, operating_state, changed_at
+		FROM operating_state_change
+		WHERE device_id = $1 AND operating_state IN ($2, $3) AND changed_at < $4
+		ORDER BY changed_at DESC
+		LIMIT 1;
+	`
+
+	var change thermostat.OperatingStateChange
+	err = c.db.GetContext(ctx, &change, query, deviceID, thermostat.HeatingOperatingState, thermostat.CoolingOperatingState, dbTime(before))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchLastCycleStart query: %v", err)
+		}
+	}
+
+	return &change, nil
+}
+
+// AddOperatingStateChange appends the change to the operating state history of
+// the device, and forgets changes before expiredBefore, so that the history
+// stays bounded. A change already recorded at the same time is kept, so that
+// adding it again on retry is a no-op.
+func (c *Client) AddOperatingStateChange(ctx context.Context, change *thermostat.OperatingStateChange, expiredBefore time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AddOperatingStateChange")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO operating_state_change (device_id, operating_state, changed_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id, changed_at) DO NOTHING;
+	`
+
+	_, err = tx.ExecContext(ctx, query, change.DeviceID, change.OperatingState, dbTime(change.ChangedAt))
+	if err != nil {
+		return fmt.Errorf("error executing AddOperatingStateChange statement: %v", err)
+	}
+
+	query = `DELETE FROM operating_state_change WHERE changed_at < $1;`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(expiredBefore))
+	if err != nil {
+		return fmt.Errorf("error executing expired operating state changes statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
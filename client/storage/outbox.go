@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/outbox"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initOutboxTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS target_state_outbox (
+			device_id TEXT PRIMARY KEY,
+			version INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_error TEXT,
+			created_at DATETIME NOT NULL
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing outbox schema: %v", err)
+	}
+
+	return nil
+}
+
+// enqueueDelivery has to run in the same transaction as the target state
+// update it belongs to. Pending deliveries for the same device are coalesced
+// into one, with attempts reset.
+func (c *Client) enqueueDelivery(ctx context.Context, tx sqlx.ExecerContext, deviceID string, now time.Time) error {
+	query := `
+		INSERT INTO target_state_outbox (device_id, version, attempts, next_attempt_at, last_error, created_at)
+		VALUES ($1, 1, 0, $2, NULL, $2)
+		ON CONFLICT(device_id) DO UPDATE SET
+			version = version + 1,
+			attempts = 0,
+			next_attempt_at = $2,
+			last_error = NULL;
+	`
+
+	_, err := tx.ExecContext(ctx, query, deviceID, dbTime(now))
+	if err != nil {
+		return fmt.Errorf("error executing enqueueDelivery query: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchDelivery(ctx context.Context, deviceID string) (_ *outbox.Entry, err error) {
+	ctx, span := startSpan(ctx, "FetchDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, version, attempts, next_attempt_at, last_error, created_at
+		FROM target_state_outbox
+		WHERE device_id = $1;
+	`
+
+	var entry outbox.Entry
+	err = c.db.GetContext(ctx, &entry, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchDelivery query: %v", err)
+		}
+	}
+
+	return &entry, nil
+}
+
+func (c *Client) FetchDueDeliveries(ctx context.Context, now time.Time, limit int) (_ []outbox.Entry, err error) {
+	ctx, span := startSpan(ctx, "FetchDueDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, version, attempts, next_attempt_at, last_error, created_at
+		FROM target_state_outbox
+		WHERE next_attempt_at <= $1
+		ORDER BY next_attempt_at
+		LIMIT $2;
+	`
+
+	entries := []outbox.Entry{}
+	err = c.db.SelectContext(ctx, &entries, query, dbTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchDueDeliveries query: %v", err)
+	}
+
+	return entries, nil
+}
+
+func (c *Client) CountPendingDeliveries(ctx context.Context) (_ int, err error) {
+	ctx, span := startSpan(ctx, "CountPendingDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT COUNT(*)
+		FROM target_state_outbox;
+	`
+
+	var count int
+	err = c.db.GetContext(ctx, &count, query)
+	if err != nil {
+		return 0, fmt.Errorf("error executing CountPendingDeliveries query: %v", err)
+	}
+
+	return count, nil
+}
+
+// CompleteDelivery removes the entry, unless it has been updated to a newer
+// version in the meantime.
+func (c *Client) CompleteDelivery(ctx context.Context, deviceID string, version int) (err error) {
+	ctx, span := startSpan(ctx, "CompleteDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		DELETE FROM target_state_outbox
+		WHERE device_id = $1 AND version = $2;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, deviceID, version)
+	if err != nil {
+		return fmt.Errorf("error executing CompleteDelivery query: %v", err)
+	}
+
+	return nil
+}
+
+// RetryDelivery records a failed attempt, unless the entry has been updated to
+// a newer version in the meantime.
+func (c *Client) RetryDelivery(ctx context.Context, deviceID string, version int, nextAttemptAt time.Time, lastError string) (err error) {
+	ctx, span := startSpan(ctx, "RetryDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		UPDATE target_state_outbox
+		SET attempts = attempts + 1, next_attempt_at = $3, last_error = $4
+		WHERE device_id = $1 AND version = $2;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, deviceID, version, dbTime(nextAttemptAt), lastError)
+	if err != nil {
+		return fmt.Errorf("error executing RetryDelivery query: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initOutdoorReadingTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS outdoor_reading (
+			timestamp DATETIME NOT NULL,
+			source TEXT NOT NULL,
+			temperature REAL NOT NULL,
+			humidity REAL,
+			PRIMARY KEY (timestamp, source)
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing outdoor reading schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchOutdoorReadings returns readings taken at or after since, newest first.
+func (c *Client) FetchOutdoorReadings(ctx context.Context, since time.Time, limit int) (_ []outdoor.Reading, err error) {
+	ctx, span := startSpan(ctx, "FetchOutdoorReadings")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT timestamp, source, temperature, humidity
+		FROM outdoor_reading
+		WHERE timestamp >= $1
+		ORDER BY timestamp DESC
+		LIMIT $2;
+	`
+
+	readings := []outdoor.Reading{}
+	err = c.db.SelectContext(ctx, &readings, query, dbTime(since), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchOutdoorReadings query: %v", err)
+	}
+
+	return readings, nil
+}
+
+func (c *Client) FetchLatestOutdoorReading(ctx context.Context) (_ *outdoor.Reading, err error) {
+	ctx, span := startSpan(ctx, "FetchLatestOutdoorReading")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT timestamp, source, temperature, humidity
+		FROM outdoor_reading
+		ORDER BY timestamp DESC
+		LIMIT 1;
+	`
+
+	var reading outdoor.Reading
+	err = c.db.GetContext(ctx, &reading, query)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchLatestOutdoorReading query: %v", err)
+		}
+	}
+
+	return &reading, nil
+}
+
+// AddOutdoorReading appends the reading to the series, and drops readings taken
+// before expiredBefore, so that the series stays bounded. A reading the source
+// already reported for the same time is ignored.
+func (c *Client) AddOutdoorReading(ctx context.Context, reading *outdoor.Reading, expiredBefore time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AddOutdoorReading")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO outdoor_reading (timestamp, source, temperature, humidity)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (timestamp, source) DO NOTHING;
+	`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(reading.Timestamp), reading.Source, reading.Temperature, reading.Humidity)
+	if err != nil {
+		return fmt.Errorf("error executing AddOutdoorReading statement: %v", err)
+	}
+
+	query = `DELETE FROM outdoor_reading WHERE timestamp < $1;`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(expiredBefore))
+	if err != nil {
+		return fmt.Errorf("error executing expired outdoor readings statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initProcessedMessageTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS processed_message (
+			topic TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			processed_at DATETIME NOT NULL,
+			PRIMARY KEY (topic, message_id)
+		);
+		CREATE INDEX IF NOT EXISTS processed_message_processed_at ON processed_message (processed_at);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing processed message schema: %v", err)
+	}
+
+	return nil
+}
+
+// HasProcessedMessage reports whether the message was processed after since.
+func (c *Client) HasProcessedMessage(ctx context.Context, topic, messageID string, since time.Time) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "HasProcessedMessage")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM processed_message
+			WHERE topic = $1 AND message_id = $2 AND processed_at >= $3
+		);
+	`
+
+	var processed bool
+	err = c.db.GetContext(ctx, &processed, query, topic, messageID, dbTime(since))
+	if err != nil {
+		return false, fmt.Errorf("error executing HasProcessedMessage query: %v", err)
+	}
+
+	return processed, nil
+}
+
+// AddProcessedMessage records the message as processed, and forgets messages
+// processed before expiredBefore, so that the window stays bounded.
+func (c *Client) AddProcessedMessage(ctx context.Context, topic, messageID string, processedAt, expiredBefore time.Time) (err error) {
+	ctx, span := startSpan(ctx, "AddProcessedMessage")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO processed_message (topic, message_id, processed_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (topic, message_id) DO UPDATE SET processed_at = excluded.processed_at;
+	`
+
+	_, err = tx.ExecContext(ctx, query, topic, messageID, dbTime(processedAt))
+	if err != nil {
+		return fmt.Errorf("error executing AddProcessedMessage statement: %v", err)
+	}
+
+	query = `DELETE FROM processed_message WHERE processed_at < $1;`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(expiredBefore))
+	if err != nil {
+		return fmt.Errorf("error executing expired processed messages statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
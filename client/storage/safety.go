@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initSafetyTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS safety_limits (
+			device_id TEXT PRIMARY KEY,
+			floor_temperature REAL,
+			ceiling_temperature REAL
+		);
+		CREATE TABLE IF NOT EXISTS safety_event (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			device_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			temperature REAL NOT NULL,
+			limit_temperature REAL NOT NULL,
+			triggered_at DATETIME NOT NULL,
+			cleared_at DATETIME,
+			previous_mode TEXT,
+			previous_target_temperature INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS safety_event_device_id ON safety_event (device_id, id);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing safety schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchSafetyLimits returns the limits configured for the device. Limits that
+// aren't configured are left unset.
+func (c *Client) FetchSafetyLimits(ctx context.Context, deviceID string) (_ *safety.Limits, err error) {
+	ctx, span := startSpan(ctx, "FetchSafetyLimits")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, floor_temperature, ceiling_temperature
+		FROM safety_limits
+		WHERE device_id = $1;
+	`
+
+	var limits safety.Limits
+	err = c.db.GetContext(ctx, &limits, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &safety.Limits{DeviceID: deviceID}, nil
+		} else {
+			return nil, fmt.Errorf("error executing FetchSafetyLimits query: %v", err)
+		}
+	}
+
+	return &limits, nil
+}
+
+func (c *Client) UpdateSafetyLimits(ctx context.Context, limits *safety.Limits) (_ *safety.Limits, err error) {
+	ctx, span := startSpan(ctx, "UpdateSafetyLimits")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO safety_limits (device_id, floor_temperature, ceiling_temperature)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE SET
+			floor_temperature = excluded.floor_temperature,
+			ceiling_temperature = excluded.ceiling_temperature;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, limits.DeviceID, limits.FloorTemperature, limits.CeilingTemperature)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateSafetyLimits statement: %v", err)
+	}
+
+	return c.FetchSafetyLimits(ctx, limits.DeviceID)
+}
+
+// FetchSafetyEvents returns the most recent safety events of the device,
+// newest first.
+func (c *Client) FetchSafetyEvents(ctx context.Context, deviceID string, limit int) (_ []safety.Event, err error) {
+	ctx, span := startSpan(ctx, "FetchSafetyEvents")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, device_id, kind, temperature, limit_temperature, triggered_at, cleared_at, previous_mode, previous_target_temperature
+		FROM safety_event
+		WHERE device_id = $1
+		ORDER BY id DESC
+		LIMIT $2;
+	`
+
+	events := []safety.Event{}
+	err = c.db.SelectContext(ctx, &events, query, deviceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchSafetyEvents query: %v", err)
+	}
+
+	return events, nil
+}
+
+// FetchActiveSafetyEvent returns the safety event the device is held in, if
+// any.
+func (c *Client) FetchActiveSafetyEvent(ctx context.Context, deviceID string) (_ *safety.Event, err error) {
+	ctx, span := startSpan(ctx, "FetchActiveSafetyEvent")
+	defer func() { tracing.End(span, err) }()
+
+	return c.fetchActiveSafetyEvent(ctx, c.db, deviceID)
+}
+
+func (c *Client) fetchActiveSafetyEvent(ctx context.Context, q sqlx.QueryerContext, deviceID string) (*safety.Event, error) {
+	query := `
+		SELECT id, device_id, kind, temperature, limit_temperature, triggered_at, cleared_at, previous_mode, previous_target_temperature
+		FROM safety_event
+		WHERE device_id = $1 AND cleared_at IS NULL
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+
+	var event safety.Event
+	err := sqlx.GetContext(ctx, q, &event, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing fetchActiveSafetyEvent query: %v", err)
+		}
+	}
+
+	return &event, nil
+}
+
+// TriggerSafetyEvent records the event and forces the protective target state
+// on the device, together with an outbox entry to deliver it.
+func (c *Client) TriggerSafetyEvent(ctx context.Context, event *safety.Event, protective *thermostat.TargetState) (_ *safety.Event, err error) {
+	ctx, span := startSpan(ctx, "TriggerSafetyEvent")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO safety_event (device_id, kind, temperature, limit_temperature, triggered_at, previous_mode, previous_target_temperature)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`
+
+	result, err := tx.ExecContext(ctx, query,
+		event.DeviceID,
+		event.Kind,
+		event.Temperature,
+		event.Limit,
+		dbTime(event.TriggeredAt),
+		event.PreviousMode,
+		event.PreviousTargetTemperature,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error executing TriggerSafetyEvent statement: %v", err)
+	}
+
+	err = c.forceTargetState(ctx, tx, protective, event.TriggeredAt)
+	if err != nil {
+		return nil, fmt.Errorf("error forcing protective target state: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	triggered := *event
+	triggered.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting safety event ID: %v", err)
+	}
+
+	return &triggered, nil
+}
+
+// ClearSafetyEvent ends the event and restores the target state the device was
+// in before it, together with an outbox entry to deliver it.
+func (c *Client) ClearSafetyEvent(ctx context.Context, event *safety.Event, clearedAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "ClearSafetyEvent")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE safety_event SET cleared_at = $1 WHERE id = $2;`
+
+	_, err = tx.ExecContext(ctx, query, dbTime(clearedAt), event.ID)
+	if err != nil {
+		return fmt.Errorf("error executing ClearSafetyEvent statement: %v", err)
+	}
+
+	err = c.forceTargetState(ctx, tx, &thermostat.TargetState{
+		DeviceID:          event.DeviceID,
+		Mode:              event.PreviousMode,
+		TargetTemperature: event.PreviousTargetTemperature,
+	}, clearedAt)
+	if err != nil {
+		return fmt.Errorf("error restoring previous target state: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) forceTargetState(ctx context.Context, tx *sqlx.Tx, state *thermostat.TargetState, now time.Time) error {
+	if state.Mode != nil {
+		err := c.updateMode(ctx, tx, state.DeviceID, *state.Mode)
+		if err != nil {
+			return fmt.Errorf("error updating mode: %v", err)
+		}
+	}
+
+	if state.TargetTemperature != nil {
+		err := c.updateTargetTemperature(ctx, tx, state.DeviceID, *state.TargetTemperature)
+		if err != nil {
+			return fmt.Errorf("error updating target temperature: %v", err)
+		}
+	}
+
+	err := c.enqueueDelivery(ctx, tx, state.DeviceID, now)
+	if err != nil {
+		return fmt.Errorf("error enqueueing delivery: %v", err)
+	}
+
+	err = c.enqueueTargetStateEvent(ctx, tx, state.DeviceID, now)
+	if err != nil {
+		return fmt.Errorf("error enqueueing target state event: %v", err)
+	}
+
+	return nil
+}
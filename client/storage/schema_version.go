@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initSchemaVersionTable(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			device_id TEXT PRIMARY KEY,
+			schema_version INTEGER NOT NULL
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing schema version schema: %v", err)
+	}
+
+	return nil
+}
+
+// FetchSchemaVersion returns the payload schema version negotiated with the
+// device, which is the one it last reported in.
+func (c *Client) FetchSchemaVersion(ctx context.Context, deviceID string) (_ thermostat.SchemaVersion, err error) {
+	ctx, span := startSpan(ctx, "FetchSchemaVersion")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT schema_version
+		FROM schema_version
+		WHERE device_id = $1;
+	`
+
+	var version thermostat.SchemaVersion
+	err = c.db.GetContext(ctx, &version, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, &client.ErrNotFound{Err: err}
+		} else {
+			return 0, fmt.Errorf("error executing FetchSchemaVersion query: %v", err)
+		}
+	}
+
+	return version, nil
+}
+
+func (c *Client) UpdateSchemaVersion(ctx context.Context, deviceID string, version thermostat.SchemaVersion) (err error) {
+	ctx, span := startSpan(ctx, "UpdateSchemaVersion")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO schema_version (device_id, schema_version)
+		VALUES ($1, $2)
+		ON CONFLICT (device_id) DO UPDATE SET schema_version = excluded.schema_version
+		WHERE schema_version != excluded.schema_version;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, deviceID, version)
+	if err != nil {
+		return fmt.Errorf("error executing UpdateSchemaVersion statement: %v", err)
+	}
+
+	return nil
+}
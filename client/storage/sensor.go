@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+)
+
+func (c *Client) initSensorTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS sensor (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			room TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS sensor_reading (
+			sensor_id TEXT PRIMARY KEY,
+			timestamp DATETIME NOT NULL,
+			temperature REAL NOT NULL,
+			humidity REAL,
+			occupied BOOLEAN
+		);
+		CREATE TABLE IF NOT EXISTS sensor_assignment (
+			device_id TEXT PRIMARY KEY,
+			strategy TEXT NOT NULL,
+			sensor_id TEXT
+		);
+		CREATE TABLE IF NOT EXISTS sensor_assignment_sensor (
+			device_id TEXT NOT NULL,
+			sensor_id TEXT NOT NULL,
+			PRIMARY KEY (device_id, sensor_id)
+		);
+		CREATE INDEX IF NOT EXISTS sensor_assignment_sensor_sensor_id ON sensor_assignment_sensor (sensor_id);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing sensor schema: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchSensors(ctx context.Context) (_ []sensor.Sensor, err error) {
+	ctx, span := startSpan(ctx, "FetchSensors")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, room
+		FROM sensor
+		ORDER BY id;
+	`
+
+	sensors := []sensor.Sensor{}
+	err = c.db.SelectContext(ctx, &sensors, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchSensors query: %v", err)
+	}
+
+	return sensors, nil
+}
+
+func (c *Client) FetchSensor(ctx context.Context, sensorID string) (_ *sensor.Sensor, err error) {
+	ctx, span := startSpan(ctx, "FetchSensor")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, name, room
+		FROM sensor
+		WHERE id = $1;
+	`
+
+	var s sensor.Sensor
+	err = c.db.GetContext(ctx, &s, query, sensorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchSensor query: %v", err)
+		}
+	}
+
+	return &s, nil
+}
+
+func (c *Client) UpdateSensor(ctx context.Context, s *sensor.Sensor) (_ *sensor.Sensor, err error) {
+	ctx, span := startSpan(ctx, "UpdateSensor")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO sensor (id, name, room)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, room = excluded.room;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, s.ID, s.Name, s.Room)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateSensor statement: %v", err)
+	}
+
+	return c.FetchSensor(ctx, s.ID)
+}
+
+// DeleteSensor removes the sensor together with its reading, and unassigns it
+// from thermostats.
+func (c *Client) DeleteSensor(ctx context.Context, sensorID string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteSensor")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM sensor WHERE id = $1;`, sensorID)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteSensor statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("sensor %s not found", sensorID)}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sensor_reading WHERE sensor_id = $1;`, sensorID)
+	if err != nil {
+		return fmt.Errorf("error executing sensor reading statement: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sensor_assignment_sensor WHERE sensor_id = $1;`, sensorID)
+	if err != nil {
+		return fmt.Errorf("error executing sensor assignment statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchSensorReading(ctx context.Context, sensorID string) (_ *sensor.Reading, err error) {
+	ctx, span := startSpan(ctx, "FetchSensorReading")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT sensor_id, timestamp, temperature, humidity, occupied
+		FROM sensor_reading
+		WHERE sensor_id = $1;
+	`
+
+	var reading sensor.Reading
+	err = c.db.GetContext(ctx, &reading, query, sensorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchSensorReading query: %v", err)
+		}
+	}
+
+	return &reading, nil
+}
+
+// UpdateSensorReading keeps the latest reading of the sensor, readings older
+// than the stored one are ignored.
+func (c *Client) UpdateSensorReading(ctx context.Context, reading *sensor.Reading) (err error) {
+	ctx, span := startSpan(ctx, "UpdateSensorReading")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		INSERT INTO sensor_reading (sensor_id, timestamp, temperature, humidity, occupied)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (sensor_id) DO UPDATE SET
+			timestamp = excluded.timestamp,
+			temperature = excluded.temperature,
+			humidity = excluded.humidity,
+			occupied = excluded.occupied
+		WHERE excluded.timestamp >= sensor_reading.timestamp;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, reading.SensorID, dbTime(reading.Timestamp), reading.Temperature, reading.Humidity, reading.Occupied)
+	if err != nil {
+		return fmt.Errorf("error executing UpdateSensorReading statement: %v", err)
+	}
+
+	return nil
+}
+
+// FetchAssignedReadings returns the latest readings of the sensors assigned to
+// the thermostat.
+func (c *Client) FetchAssignedReadings(ctx context.Context, deviceID string) (_ []sensor.Reading, err error) {
+	ctx, span := startSpan(ctx, "FetchAssignedReadings")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT r.sensor_id, r.timestamp, r.temperature, r.humidity, r.occupied
+		FROM sensor_reading r
+		JOIN sensor_assignment_sensor a ON a.sensor_id = r.sensor_id
+		WHERE a.device_id = $1
+		ORDER BY r.sensor_id;
+	`
+
+	readings := []sensor.Reading{}
+	err = c.db.SelectContext(ctx, &readings, query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchAssignedReadings query: %v", err)
+	}
+
+	return readings, nil
+}
+
+// FetchAssignedDevices returns the thermostats the sensor is assigned to.
+func (c *Client) FetchAssignedDevices(ctx context.Context, sensorID string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "FetchAssignedDevices")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id
+		FROM sensor_assignment_sensor
+		WHERE sensor_id = $1
+		ORDER BY device_id;
+	`
+
+	deviceIDs := []string{}
+	err = c.db.SelectContext(ctx, &deviceIDs, query, sensorID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchAssignedDevices query: %v", err)
+	}
+
+	return deviceIDs, nil
+}
+
+func (c *Client) FetchSensorAssignment(ctx context.Context, deviceID string) (_ *sensor.Assignment, err error) {
+	ctx, span := startSpan(ctx, "FetchSensorAssignment")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT device_id, strategy, sensor_id
+		FROM sensor_assignment
+		WHERE device_id = $1;
+	`
+
+	var assignment sensor.Assignment
+	err = c.db.GetContext(ctx, &assignment, query, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchSensorAssignment query: %v", err)
+		}
+	}
+
+	query = `
+		SELECT sensor_id
+		FROM sensor_assignment_sensor
+		WHERE device_id = $1
+		ORDER BY sensor_id;
+	`
+
+	assignment.SensorIDs = []string{}
+	err = c.db.SelectContext(ctx, &assignment.SensorIDs, query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing assigned sensors query: %v", err)
+	}
+
+	return &assignment, nil
+}
+
+// UpdateSensorAssignment replaces the sensors assigned to the thermostat and
+// their strategy.
+func (c *Client) UpdateSensorAssignment(ctx context.Context, assignment *sensor.Assignment) (_ *sensor.Assignment, err error) {
+	ctx, span := startSpan(ctx, "UpdateSensorAssignment")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO sensor_assignment (device_id, strategy, sensor_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE SET strategy = excluded.strategy, sensor_id = excluded.sensor_id;
+	`
+
+	_, err = tx.ExecContext(ctx, query, assignment.DeviceID, assignment.Strategy, assignment.SensorID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateSensorAssignment statement: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sensor_assignment_sensor WHERE device_id = $1;`, assignment.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing unassign sensors statement: %v", err)
+	}
+
+	for _, sensorID := range assignment.SensorIDs {
+		query := `
+			INSERT INTO sensor_assignment_sensor (device_id, sensor_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING;
+		`
+
+		_, err = tx.ExecContext(ctx, query, assignment.DeviceID, sensorID)
+		if err != nil {
+			return nil, fmt.Errorf("error executing assign sensor statement: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchSensorAssignment(ctx, assignment.DeviceID)
+}
@@ -3,9 +3,14 @@ package storage
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
 	"github.com/jmoiron/sqlx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 
 	// sqlite driver
 	_ "modernc.org/sqlite"
@@ -18,6 +23,29 @@ type Client struct {
 	db *sqlx.DB
 }
 
+const memoryPath = ":memory:"
+
+// busyTimeout is how long a write waits for the write of another connection
+// to finish, before failing with "database is locked".
+const busyTimeout = 5 * time.Second
+
+// dataSourceName sets up database files for concurrent use. With the write
+// ahead log, reads don't wait for writes, and writes wait for each other up to
+// busyTimeout. Transactions take the write lock as they begin, since a read
+// transaction can't wait for it once it tries to write.
+func dataSourceName(path string) string {
+	if path == memoryPath {
+		return path
+	}
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	return fmt.Sprintf("%s%s_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate", path, separator, busyTimeout.Milliseconds())
+}
+
 func New(ctx context.Context, path string, defaultMode thermostat.Mode, defaultTargetTemperature int) (*Client, error) {
 	var c Client
 	var err error
@@ -25,24 +53,107 @@ func New(ctx context.Context, path string, defaultMode thermostat.Mode, defaultT
 	c.defaultMode = defaultMode
 	c.defaultTargetTemperature = defaultTargetTemperature
 
-	c.db, err = sqlx.Open("sqlite", path)
+	c.db, err = sqlx.Open("sqlite", dataSourceName(path))
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %v", err)
 	}
 
+	// Every connection to an in-memory database would see its own empty
+	// database
+	if path == memoryPath {
+		c.db.SetMaxOpenConns(1)
+	}
+
 	err = c.initTargetStateTable(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing target state table: %v", err)
 	}
 
-	err = c.reportTargetStateMetrics(ctx)
+	err = c.initCurrentStateTable(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error reporting initial target state metrics: %v", err)
+		return nil, fmt.Errorf("error initializing current state table: %v", err)
 	}
 
-	err = c.initCurrentStateTable(ctx)
+	err = c.initOperatingStateTable(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error initializing current state table: %v", err)
+		return nil, fmt.Errorf("error initializing operating state table: %v", err)
+	}
+
+	err = c.initOutboxTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing outbox table: %v", err)
+	}
+
+	err = c.initDeadLetterTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing dead letter table: %v", err)
+	}
+
+	err = c.initProcessedMessageTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing processed message table: %v", err)
+	}
+
+	err = c.initSchemaVersionTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing schema version table: %v", err)
+	}
+
+	err = c.initContentTypeTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing content type table: %v", err)
+	}
+
+	err = c.initSensorTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing sensor tables: %v", err)
+	}
+
+	err = c.initOutdoorReadingTable(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing outdoor reading table: %v", err)
+	}
+
+	err = c.initControlTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing control tables: %v", err)
+	}
+
+	err = c.initSafetyTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing safety tables: %v", err)
+	}
+
+	err = c.initAlertTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing alert tables: %v", err)
+	}
+
+	err = c.initWebhookTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing webhook tables: %v", err)
+	}
+
+	err = c.initAPIKeyTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing api key tables: %v", err)
+	}
+
+	err = c.initAccessTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing access tables: %v", err)
+	}
+
+	err = c.initHomeTables(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing home tables: %v", err)
+	}
+
+	// Reported once every table exists, since the metrics are labelled with
+	// the home of the device
+	err = c.reportTargetStateMetrics(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reporting initial target state metrics: %v", err)
 	}
 
 	return &c, nil
@@ -51,3 +162,20 @@ func New(ctx context.Context, path string, defaultMode thermostat.Mode, defaultT
 func (c *Client) Close() error {
 	return c.db.Close()
 }
+
+// dbTime normalizes times before they are written, since the driver stores
+// them as text and compares them as such. Monotonic clock readings are
+// stripped and all times are kept in UTC, so that text order matches time
+// order.
+func dbTime(t time.Time) time.Time {
+	return t.UTC().Round(0)
+}
+
+// startSpan starts the span of a storage method. Callers end it with
+// tracing.End, so that the span records the error they return.
+func startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, fmt.Sprintf("storage.%s", method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemSqlite),
+	)
+}
@@ -4,9 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/client"
 	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
 )
 
 func (c *Client) initTargetStateTable(ctx context.Context) error {
@@ -28,30 +34,43 @@ func (c *Client) initTargetStateTable(ctx context.Context) error {
 
 func (c *Client) reportTargetStateMetrics(ctx context.Context) error {
 	query := `
-		SELECT device_id, mode, target_temperature
-		FROM target_state
+		SELECT t.device_id, COALESCE(d.home_id, $1) AS home_id, t.mode, t.target_temperature
+		FROM target_state t
+		LEFT JOIN device d ON d.id = t.device_id
 	`
 
-	var states []thermostat.TargetState
-	err := c.db.SelectContext(ctx, &states, query)
+	var states []struct {
+		HomeID string `db:"home_id"`
+		thermostat.TargetState
+	}
+	err := c.db.SelectContext(ctx, &states, query, home.DefaultID)
 	if err != nil {
 		return fmt.Errorf("error executing reportTargetStateMetrics query: %v", err)
 	}
 
 	for _, state := range states {
 		if state.Mode != nil {
-			metrics.SetThermostatMode(state.DeviceID, *state.Mode)
+			metrics.SetThermostatMode(state.HomeID, state.DeviceID, *state.Mode)
 		}
 
 		if state.TargetTemperature != nil {
-			metrics.SetThermostatTargetTemperature(state.DeviceID, *state.TargetTemperature)
+			metrics.SetThermostatTargetTemperature(state.HomeID, state.DeviceID, *state.TargetTemperature)
 		}
 	}
 
 	return nil
 }
 
-func (c *Client) FetchTargetState(ctx context.Context, deviceID string) (*thermostat.TargetState, error) {
+// FetchTargetState returns ErrNotFound if the device belongs to another home.
+func (c *Client) FetchTargetState(ctx context.Context, homeID, deviceID string) (_ *thermostat.TargetState, err error) {
+	ctx, span := startSpan(ctx, "FetchTargetState")
+	defer func() { tracing.End(span, err) }()
+
+	err = c.scopeDevice(ctx, c.db, homeID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		SELECT mode, target_temperature
 		FROM target_state
@@ -62,7 +81,7 @@ func (c *Client) FetchTargetState(ctx context.Context, deviceID string) (*thermo
 		Mode              sql.NullString `db:"mode"`
 		TargetTemperature sql.NullInt32  `db:"target_temperature"`
 	}
-	err := c.db.GetContext(ctx, &data, query, deviceID)
+	err = c.db.GetContext(ctx, &data, query, deviceID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, fmt.Errorf("error executing FetchTargetState query: %v", err)
 	}
@@ -76,7 +95,7 @@ func (c *Client) FetchTargetState(ctx context.Context, deviceID string) (*thermo
 		state.Mode = &modeValue
 	} else {
 		state.Mode = &c.defaultMode
-		err := c.updateMode(ctx, deviceID, c.defaultMode)
+		err := c.updateMode(ctx, c.db, deviceID, c.defaultMode)
 		if err != nil {
 			return nil, fmt.Errorf("error setting default mode: %v", err)
 		}
@@ -86,7 +105,7 @@ func (c *Client) FetchTargetState(ctx context.Context, deviceID string) (*thermo
 		targetTemperatureValue := int(data.TargetTemperature.Int32)
 		state.TargetTemperature = &targetTemperatureValue
 	} else {
-		err := c.updateTargetTemperature(ctx, deviceID, c.defaultTargetTemperature)
+		err := c.updateTargetTemperature(ctx, c.db, deviceID, c.defaultTargetTemperature)
 		if err != nil {
 			return nil, fmt.Errorf("error setting default target temperature: %v", err)
 		}
@@ -96,32 +115,122 @@ func (c *Client) FetchTargetState(ctx context.Context, deviceID string) (*thermo
 	return &state, nil
 }
 
-func (c *Client) UpdateTargetState(ctx context.Context, state *thermostat.TargetState) (*thermostat.TargetState, error) {
+// UpdateTargetState stores the state together with an outbox entry, so that
+// the state is guaranteed to be delivered to the device eventually. The state
+// can't be updated while the device is held in a protective state, ErrConflict
+// is returned instead. Devices that aren't registered yet are registered in
+// the home, and ErrNotFound is returned for devices of another home.
+func (c *Client) UpdateTargetState(ctx context.Context, homeID string, state *thermostat.TargetState) (_ *thermostat.TargetState, err error) {
+	ctx, span := startSpan(ctx, "UpdateTargetState")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = c.claimDevice(ctx, tx, homeID, state.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := c.fetchActiveSafetyEvent(ctx, tx, state.DeviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Device isn't held in a protective state
+		default:
+			return nil, fmt.Errorf("error fetching active safety event: %v", err)
+		}
+	}
+
+	if event != nil {
+		return nil, &client.ErrConflict{Err: fmt.Errorf("device %s is held in %s protection since %s", state.DeviceID, event.Kind, event.TriggeredAt.Format(time.RFC3339))}
+	}
+
 	if state.Mode != nil {
-		err := c.updateMode(ctx, state.DeviceID, *state.Mode)
+		err := c.updateMode(ctx, tx, state.DeviceID, *state.Mode)
 		if err != nil {
 			return nil, fmt.Errorf("error updating mode: %v", err)
 		}
 	}
 
 	if state.TargetTemperature != nil {
-		err := c.updateTargetTemperature(ctx, state.DeviceID, *state.TargetTemperature)
+		err := c.updateTargetTemperature(ctx, tx, state.DeviceID, *state.TargetTemperature)
 		if err != nil {
 			return nil, fmt.Errorf("error updating target temperature: %v", err)
 		}
 	}
 
-	return c.FetchTargetState(ctx, state.DeviceID)
+	now := time.Now()
+
+	err = c.enqueueDelivery(ctx, tx, state.DeviceID, now)
+	if err != nil {
+		return nil, fmt.Errorf("error enqueueing delivery: %v", err)
+	}
+
+	err = c.enqueueTargetStateEvent(ctx, tx, state.DeviceID, now)
+	if err != nil {
+		return nil, fmt.Errorf("error enqueueing target state event: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchTargetState(ctx, homeID, state.DeviceID)
+}
+
+// enqueueTargetStateEvent has to run in the same transaction as the target
+// state update, after it. Unset values are reported as their defaults.
+func (c *Client) enqueueTargetStateEvent(ctx context.Context, tx *sqlx.Tx, deviceID string, now time.Time) error {
+	query := `
+		SELECT mode, target_temperature
+		FROM target_state
+		WHERE device_id = $1;
+	`
+
+	var data struct {
+		Mode              sql.NullString `db:"mode"`
+		TargetTemperature sql.NullInt32  `db:"target_temperature"`
+	}
+	err := tx.GetContext(ctx, &data, query, deviceID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error executing target state query: %v", err)
+	}
+
+	mode := c.defaultMode
+	if data.Mode.Valid {
+		mode = thermostat.Mode(data.Mode.String)
+	}
+
+	targetTemperature := c.defaultTargetTemperature
+	if data.TargetTemperature.Valid {
+		targetTemperature = int(data.TargetTemperature.Int32)
+	}
+
+	return c.enqueueWebhookEvent(ctx, tx, &webhook.Event{
+		Type:       webhook.TargetStateEvent,
+		DeviceID:   deviceID,
+		OccurredAt: now,
+		Data: thermostat.TargetState{
+			DeviceID:          deviceID,
+			Mode:              &mode,
+			TargetTemperature: &targetTemperature,
+		},
+	}, now)
 }
 
-func (c *Client) updateMode(ctx context.Context, deviceID string, mode thermostat.Mode) error {
+func (c *Client) updateMode(ctx context.Context, tx sqlx.ExecerContext, deviceID string, mode thermostat.Mode) error {
 	query := `
 		INSERT INTO target_state (device_id, mode)
 		VALUES ($1, $2)
 		ON CONFLICT(device_id) DO UPDATE SET mode = $2;
 	`
 
-	_, err := c.db.ExecContext(ctx, query, deviceID, mode)
+	_, err := tx.ExecContext(ctx, query, deviceID, mode)
 	if err != nil {
 		return fmt.Errorf("error executing updateMode query: %v", err)
 	}
@@ -129,14 +238,14 @@ func (c *Client) updateMode(ctx context.Context, deviceID string, mode thermosta
 	return nil
 }
 
-func (c *Client) updateTargetTemperature(ctx context.Context, deviceID string, targetTemperature int) error {
+func (c *Client) updateTargetTemperature(ctx context.Context, tx sqlx.ExecerContext, deviceID string, targetTemperature int) error {
 	query := `
 		INSERT INTO target_state (device_id, target_temperature)
 		VALUES ($1, $2)
 		ON CONFLICT(device_id) DO UPDATE SET target_temperature = $2;
 	`
 
-	_, err := c.db.ExecContext(ctx, query, deviceID, targetTemperature)
+	_, err := tx.ExecContext(ctx, query, deviceID, targetTemperature)
 	if err != nil {
 		return fmt.Errorf("error executing updateTargetTemperature query: %v", err)
 	}
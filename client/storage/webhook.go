@@ -0,0 +1,593 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+func (c *Client) initWebhookTables(ctx context.Context) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS webhook_subscription (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			device_id TEXT,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			consecutive_failures INTEGER NOT NULL DEFAULT 0,
+			disabled_at DATETIME,
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS webhook_subscription_event (
+			subscription_id INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			PRIMARY KEY (subscription_id, event_type)
+		);
+		CREATE TABLE IF NOT EXISTS webhook_delivery (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_status_code INTEGER,
+			last_error TEXT,
+			created_at DATETIME NOT NULL,
+			completed_at DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery (status, next_attempt_at);
+		CREATE INDEX IF NOT EXISTS webhook_delivery_subscription_id ON webhook_delivery (subscription_id, id);
+		CREATE TABLE IF NOT EXISTS device_availability (
+			device_id TEXT PRIMARY KEY,
+			available BOOLEAN NOT NULL,
+			last_seen_at DATETIME NOT NULL
+		);
+	`
+
+	_, err := c.db.ExecContext(ctx, schema)
+	if err != nil {
+		return fmt.Errorf("error executing webhook schema: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) FetchWebhookSubscriptions(ctx context.Context) (_ []webhook.Subscription, err error) {
+	ctx, span := startSpan(ctx, "FetchWebhookSubscriptions")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, url, device_id, secret, enabled, consecutive_failures, disabled_at, created_at
+		FROM webhook_subscription
+		ORDER BY id;
+	`
+
+	subscriptions := []webhook.Subscription{}
+	err = c.db.SelectContext(ctx, &subscriptions, query)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchWebhookSubscriptions query: %v", err)
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].EventTypes, err = c.fetchWebhookEventTypes(ctx, subscriptions[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching event types of subscription %d: %v", subscriptions[i].ID, err)
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func (c *Client) FetchWebhookSubscription(ctx context.Context, id int64) (_ *webhook.Subscription, err error) {
+	ctx, span := startSpan(ctx, "FetchWebhookSubscription")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, url, device_id, secret, enabled, consecutive_failures, disabled_at, created_at
+		FROM webhook_subscription
+		WHERE id = $1;
+	`
+
+	var subscription webhook.Subscription
+	err = c.db.GetContext(ctx, &subscription, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &client.ErrNotFound{Err: err}
+		} else {
+			return nil, fmt.Errorf("error executing FetchWebhookSubscription query: %v", err)
+		}
+	}
+
+	subscription.EventTypes, err = c.fetchWebhookEventTypes(ctx, subscription.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching event types: %v", err)
+	}
+
+	return &subscription, nil
+}
+
+func (c *Client) fetchWebhookEventTypes(ctx context.Context, subscriptionID int64) ([]webhook.EventType, error) {
+	query := `
+		SELECT event_type
+		FROM webhook_subscription_event
+		WHERE subscription_id = $1
+		ORDER BY event_type;
+	`
+
+	eventTypes := []webhook.EventType{}
+	err := c.db.SelectContext(ctx, &eventTypes, query, subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing fetchWebhookEventTypes query: %v", err)
+	}
+
+	return eventTypes, nil
+}
+
+func (c *Client) AddWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (_ *webhook.Subscription, err error) {
+	ctx, span := startSpan(ctx, "AddWebhookSubscription")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO webhook_subscription (url, device_id, secret, enabled, consecutive_failures, created_at)
+		VALUES ($1, $2, $3, TRUE, 0, $4);
+	`
+
+	result, err := tx.ExecContext(ctx, query, subscription.URL, subscription.DeviceID, subscription.Secret, dbTime(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error executing AddWebhookSubscription statement: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting subscription ID: %v", err)
+	}
+
+	err = c.replaceWebhookEventTypes(ctx, tx, id, subscription.EventTypes)
+	if err != nil {
+		return nil, fmt.Errorf("error replacing event types: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchWebhookSubscription(ctx, id)
+}
+
+// UpdateWebhookSubscription replaces the subscription. An empty secret keeps
+// the current one. Enabling the subscription resets its failures.
+func (c *Client) UpdateWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (_ *webhook.Subscription, err error) {
+	ctx, span := startSpan(ctx, "UpdateWebhookSubscription")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE webhook_subscription
+		SET url = $1,
+			device_id = $2,
+			secret = COALESCE(NULLIF($3, ''), secret),
+			consecutive_failures = CASE WHEN $4 THEN 0 ELSE consecutive_failures END,
+			disabled_at = CASE WHEN $4 THEN NULL ELSE COALESCE(disabled_at, $5) END,
+			enabled = $4
+		WHERE id = $6;
+	`
+
+	result, err := tx.ExecContext(ctx, query, subscription.URL, subscription.DeviceID, subscription.Secret, subscription.Enabled, dbTime(time.Now()), subscription.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error executing UpdateWebhookSubscription statement: %v", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if updated == 0 {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("webhook subscription %d not found", subscription.ID)}
+	}
+
+	err = c.replaceWebhookEventTypes(ctx, tx, subscription.ID, subscription.EventTypes)
+	if err != nil {
+		return nil, fmt.Errorf("error replacing event types: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return c.FetchWebhookSubscription(ctx, subscription.ID)
+}
+
+func (c *Client) replaceWebhookEventTypes(ctx context.Context, tx *sqlx.Tx, subscriptionID int64, eventTypes []webhook.EventType) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM webhook_subscription_event WHERE subscription_id = $1;`, subscriptionID)
+	if err != nil {
+		return fmt.Errorf("error executing delete event types statement: %v", err)
+	}
+
+	for _, eventType := range eventTypes {
+		query := `
+			INSERT INTO webhook_subscription_event (subscription_id, event_type)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING;
+		`
+
+		_, err = tx.ExecContext(ctx, query, subscriptionID, eventType)
+		if err != nil {
+			return fmt.Errorf("error executing add event type statement: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteWebhookSubscription removes the subscription together with its
+// deliveries.
+func (c *Client) DeleteWebhookSubscription(ctx context.Context, id int64) (err error) {
+	ctx, span := startSpan(ctx, "DeleteWebhookSubscription")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM webhook_subscription WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing DeleteWebhookSubscription statement: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %v", err)
+	}
+
+	if deleted == 0 {
+		return &client.ErrNotFound{Err: fmt.Errorf("webhook subscription %d not found", id)}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM webhook_subscription_event WHERE subscription_id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing subscription event statement: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM webhook_delivery WHERE subscription_id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("error executing webhook delivery statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// enqueueWebhookEvent has to run in the same transaction as the change the
+// event is about. A delivery is enqueued for every enabled subscription to the
+// event.
+func (c *Client) enqueueWebhookEvent(ctx context.Context, tx sqlx.ExecerContext, event *webhook.Event, now time.Time) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %v", err)
+	}
+
+	query := `
+		INSERT INTO webhook_delivery (subscription_id, event_type, device_id, payload, status, attempts, next_attempt_at, created_at)
+		SELECT s.id, $1, $2, $3, $4, 0, $5, $5
+		FROM webhook_subscription s
+		JOIN webhook_subscription_event e ON e.subscription_id = s.id
+		WHERE s.enabled AND e.event_type = $1 AND (s.device_id IS NULL OR s.device_id = $2);
+	`
+
+	_, err = tx.ExecContext(ctx, query, event.Type, event.DeviceID, string(payload), webhook.PendingStatus, dbTime(now))
+	if err != nil {
+		return fmt.Errorf("error executing enqueueWebhookEvent statement: %v", err)
+	}
+
+	return nil
+}
+
+// FetchWebhookDeliveries returns the most recent deliveries to the
+// subscription, newest first.
+func (c *Client) FetchWebhookDeliveries(ctx context.Context, subscriptionID int64, limit int) (_ []webhook.Delivery, err error) {
+	ctx, span := startSpan(ctx, "FetchWebhookDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT id, subscription_id, event_type, device_id, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, completed_at
+		FROM webhook_delivery
+		WHERE subscription_id = $1
+		ORDER BY id DESC
+		LIMIT $2;
+	`
+
+	deliveries := []webhook.Delivery{}
+	err = c.db.SelectContext(ctx, &deliveries, query, subscriptionID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchWebhookDeliveries query: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+// FetchDueWebhookDeliveries returns pending deliveries to enabled
+// subscriptions that are due for an attempt, oldest first.
+func (c *Client) FetchDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) (_ []webhook.Delivery, err error) {
+	ctx, span := startSpan(ctx, "FetchDueWebhookDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT d.id, d.subscription_id, d.event_type, d.device_id, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_status_code, d.last_error, d.created_at, d.completed_at
+		FROM webhook_delivery d
+		JOIN webhook_subscription s ON s.id = d.subscription_id
+		WHERE d.status = $1 AND d.next_attempt_at <= $2 AND s.enabled
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT $3;
+	`
+
+	deliveries := []webhook.Delivery{}
+	err = c.db.SelectContext(ctx, &deliveries, query, webhook.PendingStatus, dbTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing FetchDueWebhookDeliveries query: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+func (c *Client) CountPendingWebhookDeliveries(ctx context.Context) (_ int, err error) {
+	ctx, span := startSpan(ctx, "CountPendingWebhookDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		SELECT COUNT(*)
+		FROM webhook_delivery
+		WHERE status = $1;
+	`
+
+	var count int
+	err = c.db.GetContext(ctx, &count, query, webhook.PendingStatus)
+	if err != nil {
+		return 0, fmt.Errorf("error executing CountPendingWebhookDeliveries query: %v", err)
+	}
+
+	return count, nil
+}
+
+// CompleteWebhookDelivery marks the delivery as delivered, and resets the
+// failures of its subscription.
+func (c *Client) CompleteWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode int, completedAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "CompleteWebhookDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE webhook_delivery
+		SET status = $1, attempts = attempts + 1, last_status_code = $2, last_error = NULL, completed_at = $3
+		WHERE id = $4;
+	`
+
+	_, err = tx.ExecContext(ctx, query, webhook.DeliveredStatus, statusCode, dbTime(completedAt), delivery.ID)
+	if err != nil {
+		return fmt.Errorf("error executing CompleteWebhookDelivery statement: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE webhook_subscription SET consecutive_failures = 0 WHERE id = $1;`, delivery.SubscriptionID)
+	if err != nil {
+		return fmt.Errorf("error executing reset failures statement: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// FailWebhookDelivery records a failed attempt of the delivery. It is retried
+// at nextAttemptAt, or given up on if that isn't set. The subscription is
+// disabled once it reaches maxFailures in a row, which is reported back.
+func (c *Client) FailWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode *int, lastError string, nextAttemptAt *time.Time, maxFailures int, now time.Time) (_ bool, err error) {
+	ctx, span := startSpan(ctx, "FailWebhookDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	status := webhook.PendingStatus
+	next := now
+	var completedAt *time.Time
+	if nextAttemptAt != nil {
+		next = *nextAttemptAt
+	} else {
+		status = webhook.FailedStatus
+		completedAt = &now
+	}
+
+	query := `
+		UPDATE webhook_delivery
+		SET status = $1, attempts = attempts + 1, next_attempt_at = $2, last_status_code = $3, last_error = $4, completed_at = $5
+		WHERE id = $6;
+	`
+
+	if completedAt != nil {
+		*completedAt = dbTime(*completedAt)
+	}
+
+	_, err = tx.ExecContext(ctx, query, status, dbTime(next), statusCode, lastError, completedAt, delivery.ID)
+	if err != nil {
+		return false, fmt.Errorf("error executing FailWebhookDelivery statement: %v", err)
+	}
+
+	query = `
+		UPDATE webhook_subscription
+		SET consecutive_failures = consecutive_failures + 1,
+			enabled = consecutive_failures + 1 < $1,
+			disabled_at = CASE WHEN consecutive_failures + 1 >= $1 THEN $2 ELSE disabled_at END
+		WHERE id = $3 AND enabled
+		RETURNING enabled;
+	`
+
+	var enabled bool
+	err = tx.GetContext(ctx, &enabled, query, maxFailures, dbTime(now), delivery.SubscriptionID)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("error executing subscription failure statement: %v", err)
+	}
+	disabled := err == nil && !enabled
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return disabled, nil
+}
+
+// PruneWebhookDeliveries forgets deliveries completed before expiredBefore,
+// so that the delivery log stays bounded.
+func (c *Client) PruneWebhookDeliveries(ctx context.Context, expiredBefore time.Time) (err error) {
+	ctx, span := startSpan(ctx, "PruneWebhookDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	query := `
+		DELETE FROM webhook_delivery
+		WHERE status != $1 AND completed_at < $2;
+	`
+
+	_, err = c.db.ExecContext(ctx, query, webhook.PendingStatus, dbTime(expiredBefore))
+	if err != nil {
+		return fmt.Errorf("error executing PruneWebhookDeliveries statement: %v", err)
+	}
+
+	return nil
+}
+
+// markAvailable has to run in the same transaction as the current state
+// update it belongs to. It emits an AvailabilityEvent if the device was
+// unavailable.
+func (c *Client) markAvailable(ctx context.Context, tx *sqlx.Tx, deviceID string, now time.Time) error {
+	query := `
+		SELECT available
+		FROM device_availability
+		WHERE device_id = $1;
+	`
+
+	var available bool
+	err := tx.GetContext(ctx, &available, query, deviceID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error executing availability query: %v", err)
+	}
+	// Devices reporting for the first time are announced as available
+	changed := err == sql.ErrNoRows || !available
+
+	query = `
+		INSERT INTO device_availability (device_id, available, last_seen_at)
+		VALUES ($1, TRUE, $2)
+		ON CONFLICT (device_id) DO UPDATE SET available = TRUE, last_seen_at = excluded.last_seen_at;
+	`
+
+	_, err = tx.ExecContext(ctx, query, deviceID, dbTime(now))
+	if err != nil {
+		return fmt.Errorf("error executing markAvailable statement: %v", err)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	err = c.enqueueWebhookEvent(ctx, tx, &webhook.Event{
+		Type:       webhook.AvailabilityEvent,
+		DeviceID:   deviceID,
+		OccurredAt: now,
+		Data:       webhook.Availability{DeviceID: deviceID, Available: true, LastSeenAt: now},
+	}, now)
+	if err != nil {
+		return fmt.Errorf("error enqueueing availability event: %v", err)
+	}
+
+	return nil
+}
+
+// MarkUnavailableDevices marks devices that haven't been seen since
+// staleBefore as unavailable, and emits an AvailabilityEvent for each of them.
+func (c *Client) MarkUnavailableDevices(ctx context.Context, staleBefore, now time.Time) (_ []webhook.Availability, err error) {
+	ctx, span := startSpan(ctx, "MarkUnavailableDevices")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT device_id, available, last_seen_at
+		FROM device_availability
+		WHERE available AND last_seen_at < $1
+		ORDER BY device_id;
+	`
+
+	stale := []webhook.Availability{}
+	err = tx.SelectContext(ctx, &stale, query, dbTime(staleBefore))
+	if err != nil {
+		return nil, fmt.Errorf("error executing MarkUnavailableDevices query: %v", err)
+	}
+
+	for i := range stale {
+		stale[i].Available = false
+
+		_, err := tx.ExecContext(ctx, `UPDATE device_availability SET available = FALSE WHERE device_id = $1;`, stale[i].DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("error executing mark unavailable statement: %v", err)
+		}
+
+		err = c.enqueueWebhookEvent(ctx, tx, &webhook.Event{
+			Type:       webhook.AvailabilityEvent,
+			DeviceID:   stale[i].DeviceID,
+			OccurredAt: now,
+			Data:       stale[i],
+		}, now)
+		if err != nil {
+			return nil, fmt.Errorf("error enqueueing availability event: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,87 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+// Client fetches outdoor conditions from an HTTP weather provider. Providers
+// are expected to respond to GET requests with the current conditions:
+//
+//	{"temperature": 12.5, "humidity": 80, "timestamp": "2024-06-07T12:00:00Z"}
+//
+// Humidity and timestamp are optional. Providers with other formats can be
+// plugged in behind a small adapter serving this one.
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+type Config struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func New(config Config) *Client {
+	var c Client
+
+	c.url = config.URL
+	c.httpClient = &http.Client{Timeout: config.Timeout}
+
+	return &c
+}
+
+type conditions struct {
+	Temperature *float64  `json:"temperature"`
+	Humidity    *float64  `json:"humidity"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (c *Client) FetchOutdoorReading(ctx context.Context) (*outdoor.Reading, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, body)
+	}
+
+	var cond conditions
+	err = json.NewDecoder(res.Body).Decode(&cond)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding conditions: %v", err)
+	}
+
+	if cond.Temperature == nil {
+		return nil, fmt.Errorf("conditions are missing temperature")
+	}
+
+	reading := outdoor.Reading{
+		Timestamp:   cond.Timestamp,
+		Temperature: *cond.Temperature,
+		Humidity:    cond.Humidity,
+		Source:      outdoor.ProviderSource,
+	}
+
+	// Providers that don't timestamp their conditions report them as current
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = time.Now()
+	}
+
+	return &reading, nil
+}
@@ -0,0 +1,98 @@
+package weather
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+func TestFetchOutdoorReading(t *testing.T) {
+	timestamp := time.Date(2024, 6, 7, 12, 0, 0, 0, time.UTC)
+	humidity := 80.0
+
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantErr     bool
+		wantReading *outdoor.Reading
+	}{
+		{
+			name:   "should fetch outdoor reading",
+			status: http.StatusOK,
+			body:   `{"temperature": 12.5, "humidity": 80, "timestamp": "2024-06-07T12:00:00Z"}`,
+			wantReading: &outdoor.Reading{
+				Timestamp:   timestamp,
+				Temperature: 12.5,
+				Humidity:    &humidity,
+				Source:      outdoor.ProviderSource,
+			},
+		},
+		{
+			name:    "should return error, if temperature is missing",
+			status:  http.StatusOK,
+			body:    `{"humidity": 80}`,
+			wantErr: true,
+		},
+		{
+			name:    "should return error, if provider fails",
+			status:  http.StatusServiceUnavailable,
+			body:    `unavailable`,
+			wantErr: true,
+		},
+		{
+			name:    "should return error, if response is invalid",
+			status:  http.StatusOK,
+			body:    `{`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer provider.Close()
+
+			c := New(Config{URL: provider.URL, Timeout: time.Second})
+
+			reading, err := c.FetchOutdoorReading(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FetchOutdoorReading() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if !reading.Timestamp.Equal(tt.wantReading.Timestamp) || reading.Temperature != tt.wantReading.Temperature ||
+				*reading.Humidity != *tt.wantReading.Humidity || reading.Source != tt.wantReading.Source {
+				t.Errorf("FetchOutdoorReading() = %+v, want %+v", reading, tt.wantReading)
+			}
+		})
+	}
+}
+
+func TestFetchOutdoorReadingWithoutTimestamp(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"temperature": 12.5}`))
+	}))
+	defer provider.Close()
+
+	c := New(Config{URL: provider.URL, Timeout: time.Second})
+
+	before := time.Now()
+	reading, err := c.FetchOutdoorReading(context.Background())
+	if err != nil {
+		t.Fatalf("FetchOutdoorReading() error = %v", err)
+	}
+
+	if reading.Timestamp.Before(before) || reading.Timestamp.After(time.Now()) {
+		t.Errorf("FetchOutdoorReading() timestamp = %v, want time of the request", reading.Timestamp)
+	}
+}
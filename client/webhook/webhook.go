@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+)
+
+// Client posts alert notifications and signed events as JSON to webhook URLs.
+// Any 2xx response is taken as delivered.
+type Client struct {
+	httpClient *http.Client
+}
+
+type Config struct {
+	Timeout time.Duration
+}
+
+func New(config Config) *Client {
+	var c Client
+
+	c.httpClient = &http.Client{Timeout: config.Timeout}
+
+	return &c
+}
+
+func (c *Client) SendNotification(ctx context.Context, url string, n *alert.Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("error marshalling notification: %v", err)
+	}
+
+	_, err = c.post(ctx, url, payload, nil)
+	return err
+}
+
+const (
+	SignatureHeader = "X-Thermostat-Signature"
+	TimestampHeader = "X-Thermostat-Timestamp"
+	EventHeader     = "X-Thermostat-Event"
+	DeliveryHeader  = "X-Thermostat-Delivery"
+)
+
+// DeliverEvent posts the event payload signed with the secret. The status code
+// is returned whenever the webhook responded, even if it failed.
+func (c *Client) DeliverEvent(ctx context.Context, url, secret string, deliveryID int64, eventType webhook.EventType, payload []byte) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	return c.post(ctx, url, payload, map[string]string{
+		SignatureHeader: Sign(secret, timestamp, payload),
+		TimestampHeader: timestamp,
+		EventHeader:     string(eventType),
+		DeliveryHeader:  strconv.FormatInt(deliveryID, 10),
+	})
+}
+
+// Sign returns the signature receivers verify deliveries with: the hex encoded
+// HMAC-SHA256 of "<timestamp>.<payload>" keyed with the subscription secret.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Client) post(ctx context.Context, url string, payload []byte, headers map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, body)
+	}
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,138 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+)
+
+func TestSendNotification(t *testing.T) {
+	notification := alert.Notification{
+		RuleID:   1,
+		RuleName: "Living room too cold",
+		Kind:     alert.TemperatureRangeRule,
+		DeviceID: "test_device_id",
+		Status:   alert.FiringStatus,
+		Message:  "temperature 14.50 is below 16.00",
+		SentAt:   time.Date(2024, 6, 7, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{
+			name:   "should post notification",
+			status: http.StatusOK,
+		},
+		{
+			name:   "should accept any successful status",
+			status: http.StatusNoContent,
+		},
+		{
+			name:    "should return error, if webhook fails",
+			status:  http.StatusInternalServerError,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received alert.Notification
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("webhook received %s with content type %s, want POST with application/json", r.Method, r.Header.Get("Content-Type"))
+				}
+
+				err := json.NewDecoder(r.Body).Decode(&received)
+				if err != nil {
+					t.Errorf("error decoding notification: %v", err)
+				}
+
+				w.WriteHeader(tt.status)
+			}))
+			defer hook.Close()
+
+			c := New(Config{Timeout: time.Second})
+			err := c.SendNotification(context.Background(), hook.URL, &notification)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SendNotification() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if received.RuleID != notification.RuleID || received.Status != notification.Status || !received.SentAt.Equal(notification.SentAt) {
+				t.Errorf("SendNotification() webhook received %+v, want %+v", received, notification)
+			}
+		})
+	}
+}
+
+func TestDeliverEvent(t *testing.T) {
+	payload := []byte(`{"type":"TARGET_STATE_UPDATED","deviceId":"test_device_id"}`)
+	secret := "test_secret_0123456789"
+
+	tests := []struct {
+		name           string
+		status         int
+		wantStatusCode int
+		wantErr        bool
+	}{
+		{
+			name:           "should deliver signed event",
+			status:         http.StatusAccepted,
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name:           "should return status code, if webhook fails",
+			status:         http.StatusServiceUnavailable,
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("error reading body: %v", err)
+				}
+
+				signature := Sign(secret, r.Header.Get(TimestampHeader), body)
+				if r.Header.Get(SignatureHeader) != signature {
+					t.Errorf("webhook received signature %s, want %s", r.Header.Get(SignatureHeader), signature)
+				}
+
+				if r.Header.Get(EventHeader) != string(webhook.TargetStateEvent) || r.Header.Get(DeliveryHeader) != "42" {
+					t.Errorf("webhook received event %s with delivery %s, want %s with 42", r.Header.Get(EventHeader), r.Header.Get(DeliveryHeader), webhook.TargetStateEvent)
+				}
+
+				w.WriteHeader(tt.status)
+			}))
+			defer hook.Close()
+
+			c := New(Config{Timeout: time.Second})
+			statusCode, err := c.DeliverEvent(context.Background(), hook.URL, secret, 42, webhook.TargetStateEvent, payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeliverEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if statusCode != tt.wantStatusCode {
+				t.Errorf("DeliverEvent() status code = %d, want %d", statusCode, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	want := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	got := Sign("secret", "1700000000", []byte("{}"))
+	if got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+}
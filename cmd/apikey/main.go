@@ -0,0 +1,161 @@
+// Command apikey issues, lists and revokes API keys in the storage of the
+// app. It is how the first admin key is issued.
+//
+//	apikey create -name <name> -scopes read,write,admin [-home <home>]
+//	apikey list
+//	apikey revoke -id <id>
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client/storage"
+	"github.com/alexchebotarsky/thermostat-api/env"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+)
+
+func main() {
+	ctx := context.Background()
+
+	err := run(ctx, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("command is required: create, list or revoke")
+	}
+
+	env, err := env.LoadConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading env config: %v", err)
+	}
+
+	s, err := storage.New(ctx, env.StoragePath, env.DefaultMode, env.DefaultTargetTemperature)
+	if err != nil {
+		return fmt.Errorf("error creating new storage client: %v", err)
+	}
+	defer s.Close()
+
+	switch args[0] {
+	case "create":
+		return create(ctx, s, args[1:])
+	case "list":
+		return list(ctx, s)
+	case "revoke":
+		return revoke(ctx, s, args[1:])
+	default:
+		return fmt.Errorf("command must be one of create, list or revoke, got: '%s'", args[0])
+	}
+}
+
+func create(ctx context.Context, s *storage.Client, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the key")
+	scopes := flags.String("scopes", string(apikey.ReadScope), "comma separated scopes of the key")
+	homeID := flags.String("home", "", "ID of the home the key is scoped to, the default home if empty")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Checked before the key is issued, so that a key meant for a home is
+	// never left scoped to the default one
+	if *homeID != "" {
+		_, err = s.FetchHome(ctx, *homeID)
+		if err != nil {
+			return fmt.Errorf("error fetching home: %v", err)
+		}
+	}
+
+	key := apikey.Key{Name: *name}
+	for _, scope := range strings.Split(*scopes, ",") {
+		key.Scopes = append(key.Scopes, apikey.Scope(strings.TrimSpace(scope)))
+	}
+
+	err = key.Validate()
+	if err != nil {
+		return fmt.Errorf("error validating api key: %v", err)
+	}
+
+	key.Token, key.Prefix, key.Hash, err = apikey.Generate()
+	if err != nil {
+		return fmt.Errorf("error generating api key: %v", err)
+	}
+
+	added, err := s.AddAPIKey(ctx, &key)
+	if err != nil {
+		return fmt.Errorf("error adding api key: %v", err)
+	}
+
+	if *homeID != "" {
+		_, err = s.UpdateMember(ctx, &home.Member{
+			Subject: added.Subject(),
+			HomeID:  *homeID,
+		})
+		if err != nil {
+			return fmt.Errorf("error adding api key %d to home: %v", added.ID, err)
+		}
+	}
+
+	fmt.Printf("Issued api key %d (%s), it won't be shown again:\n%s\n", added.ID, added.Name, added.Token)
+
+	return nil
+}
+
+func list(ctx context.Context, s *storage.Client) error {
+	keys, err := s.FetchAPIKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching api keys: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tLAST USED\tREVOKED")
+	for _, key := range keys {
+		scopes := make([]string, len(key.Scopes))
+		for i, scope := range key.Scopes {
+			scopes[i] = string(scope)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Prefix, strings.Join(scopes, ","), formatTime(key.LastUsedAt), formatTime(key.RevokedAt))
+	}
+
+	return w.Flush()
+}
+
+func revoke(ctx context.Context, s *storage.Client, args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	id := flags.Int64("id", 0, "ID of the key")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = s.RevokeAPIKey(ctx, *id, time.Now())
+	if err != nil {
+		return fmt.Errorf("error revoking api key: %v", err)
+	}
+
+	fmt.Printf("Revoked api key %d\n", *id)
+
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
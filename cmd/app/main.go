@@ -6,11 +6,13 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/alexchebotarsky/thermostat-api/app"
 	"github.com/alexchebotarsky/thermostat-api/env"
 	"github.com/alexchebotarsky/thermostat-api/logger"
 	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
 )
 
 func main() {
@@ -30,6 +32,18 @@ func main() {
 		slog.Error(fmt.Sprintf("Error initializing metrics: %v", err))
 	}
 
+	shutdownTracing, err := tracing.Init(ctx, tracing.Config{
+		Exporter:    env.TraceExporter,
+		Endpoint:    env.TraceOTLPEndpoint,
+		Insecure:    env.TraceOTLPInsecure,
+		ServiceName: env.TraceServiceName,
+		SampleRatio: env.TraceSampleRatio,
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error initializing tracing: %v", err))
+		os.Exit(1)
+	}
+
 	app, err := app.New(ctx, env)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Error creating app: %v", err))
@@ -37,4 +51,13 @@ func main() {
 	}
 
 	app.Launch(ctx)
+
+	// Spans of the shutdown are still buffered
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+
+	err = shutdownTracing(shutdownCtx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error flushing traces: %v", err))
+	}
 }
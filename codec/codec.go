@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec encodes device payloads. Payload types are shared between codecs, so
+// they only need json struct tags, which CBOR falls back to.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+const (
+	JSONContentType = "application/json"
+	CBORContentType = "application/cbor"
+)
+
+var (
+	JSON Codec = jsonCodec{}
+	CBOR Codec = cborCodec{}
+)
+
+// ForContentType returns the codec for the MQTT content type. Payloads without
+// content type are JSON.
+func ForContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing content type: %v", err)
+	}
+
+	switch mediaType {
+	case JSONContentType:
+		return JSON, nil
+	case CBORContentType:
+		return CBOR, nil
+	default:
+		return nil, fmt.Errorf("unsupported content type: '%s'", contentType)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return JSONContentType
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return CBORContentType
+}
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	return cbor.Unmarshal(data, v)
+}
@@ -0,0 +1,100 @@
+package codec
+
+import (
+	"testing"
+)
+
+type testPayload struct {
+	DeviceID    string   `json:"deviceId"`
+	Temperature float64  `json:"temperature"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+}
+
+func TestForContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        Codec
+		wantErr     bool
+	}{
+		{
+			name:        "should default to JSON without content type",
+			contentType: "",
+			want:        JSON,
+		},
+		{
+			name:        "should choose JSON",
+			contentType: "application/json; charset=utf-8",
+			want:        JSON,
+		},
+		{
+			name:        "should choose CBOR",
+			contentType: "application/cbor",
+			want:        CBOR,
+		},
+		{
+			name:        "should error on unsupported content type",
+			contentType: "application/x-protobuf",
+			wantErr:     true,
+		},
+		{
+			name:        "should error on malformed content type",
+			contentType: "application/json;;",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ForContentType(tt.contentType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ForContentType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("ForContentType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	humidity := 45.5
+	want := testPayload{DeviceID: "test-device-id", Temperature: 21.5, Humidity: &humidity}
+
+	for _, c := range []Codec{JSON, CBOR} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var got testPayload
+			err = c.Unmarshal(data, &got)
+			if err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if got.DeviceID != want.DeviceID || got.Temperature != want.Temperature || got.Humidity == nil || *got.Humidity != *want.Humidity {
+				t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCBORIsCompact(t *testing.T) {
+	payload := testPayload{DeviceID: "test-device-id", Temperature: 21.5}
+
+	jsonData, err := JSON.Marshal(payload)
+	if err != nil {
+		t.Fatalf("JSON Marshal() error = %v", err)
+	}
+
+	cborData, err := CBOR.Marshal(payload)
+	if err != nil {
+		t.Fatalf("CBOR Marshal() error = %v", err)
+	}
+
+	if len(cborData) >= len(jsonData) {
+		t.Errorf("len(CBOR) = %d, want less than len(JSON) = %d", len(cborData), len(jsonData))
+	}
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// Controller runs the control loop of server controlled devices, which only
+// report their temperature and switch their relay on command.
+type Controller struct {
+	Interval          time.Duration
+	Policy            Policy
+	DecisionRetention time.Duration
+	Clients           Clients
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type Clients struct {
+	Storage StorageClient
+	PubSub  PubSubClient
+}
+
+type StorageClient interface {
+	FetchServerControlledDevices(ctx context.Context) ([]string, error)
+	FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error)
+	FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error)
+	FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error)
+	FetchContentType(ctx context.Context, deviceID string) (string, error)
+	FetchControlSettings(ctx context.Context, deviceID string) (*control.Settings, error)
+	FetchLatestControlDecision(ctx context.Context, deviceID string) (*control.Decision, error)
+	FetchLastControlCycleStart(ctx context.Context, deviceID string) (*control.Decision, error)
+	AddControlDecision(ctx context.Context, decision *control.Decision, expiredBefore time.Time) error
+}
+
+type PubSubClient interface {
+	PublishRelayCommand(ctx context.Context, h *home.Home, command *control.RelayCommand, c codec.Codec) error
+}
+
+func New(interval, decisionRetention time.Duration, policy Policy, clients Clients) *Controller {
+	var c Controller
+
+	c.Interval = interval
+	c.Policy = policy
+	c.DecisionRetention = decisionRetention
+	c.Clients = clients
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	return &c
+}
+
+func (c *Controller) Start(ctx context.Context, errc chan<- error) {
+	defer close(c.done)
+
+	slog.Info(fmt.Sprintf("Server side controller running every %s", c.Interval))
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.run(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Controller) Stop(ctx context.Context) error {
+	close(c.stop)
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for controller to stop: %v", ctx.Err())
+	}
+}
+
+func (c *Controller) run(ctx context.Context) {
+	deviceIDs, err := c.Clients.Storage.FetchServerControlledDevices(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error fetching server controlled devices: %v", err))
+		return
+	}
+
+	for _, deviceID := range deviceIDs {
+		err := c.control(ctx, deviceID, time.Now())
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error controlling device %s: %v", deviceID, err))
+		}
+	}
+}
+
+// control decides the relay command for the device, records the decision and
+// publishes the command. The command is published on every run, so that a
+// relay board which restarted or missed a message catches up.
+func (c *Controller) control(ctx context.Context, deviceID string, now time.Time) error {
+	h, err := c.Clients.Storage.FetchDeviceHome(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching device home: %v", err)
+	}
+
+	target, err := c.Clients.Storage.FetchTargetState(ctx, h.ID, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching target state: %v", err)
+	}
+
+	current, err := c.Clients.Storage.FetchCurrentState(ctx, h.ID, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Device hasn't reported yet, decided as stale
+		default:
+			return fmt.Errorf("error fetching current state: %v", err)
+		}
+	}
+
+	last, err := c.Clients.Storage.FetchLatestControlDecision(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// First run for the device, relay is assumed to be off
+		default:
+			return fmt.Errorf("error fetching latest control decision: %v", err)
+		}
+	}
+
+	lastStart, err := c.Clients.Storage.FetchLastControlCycleStart(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Relay hasn't been switched on yet
+		default:
+			return fmt.Errorf("error fetching last control cycle start: %v", err)
+		}
+	}
+
+	settings, err := c.Clients.Storage.FetchControlSettings(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching control settings: %v", err)
+	}
+
+	decision := c.Policy.decide(now, target, current, last, lastStart, settings.MinCycleTime(c.Policy.MinCycleTime))
+
+	err = c.Clients.Storage.AddControlDecision(ctx, decision, now.Add(-c.DecisionRetention))
+	if err != nil {
+		return fmt.Errorf("error adding control decision: %v", err)
+	}
+
+	if last == nil || last.Command != decision.Command {
+		slog.Info(fmt.Sprintf("Switching device %s to %s: %s", deviceID, decision.Command, decision.Reason))
+	}
+
+	contentType, err := c.Clients.Storage.FetchContentType(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			contentType = codec.JSONContentType
+		default:
+			return fmt.Errorf("error fetching content type: %v", err)
+		}
+	}
+
+	cd, err := codec.ForContentType(contentType)
+	if err != nil {
+		return fmt.Errorf("error choosing relay command codec: %v", err)
+	}
+
+	err = c.Clients.PubSub.PublishRelayCommand(ctx, h, &control.RelayCommand{
+		DeviceID:  deviceID,
+		Command:   decision.Command,
+		Timestamp: now,
+	}, cd)
+	if err != nil {
+		return fmt.Errorf("error publishing relay command: %v", err)
+	}
+
+	metrics.SetThermostatRelayCommand(h.ID, deviceID, decision.Command)
+
+	return nil
+}
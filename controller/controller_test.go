@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type fakeStorage struct {
+	TargetStates  map[string]thermostat.TargetState
+	CurrentStates map[string]thermostat.CurrentState
+	Decisions     map[string][]control.Decision
+	Settings      map[string]control.Settings
+
+	shouldFail bool
+}
+
+func (f *fakeStorage) FetchServerControlledDevices(ctx context.Context) ([]string, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var deviceIDs []string
+	for deviceID := range f.TargetStates {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	return deviceIDs, nil
+}
+
+func (f *fakeStorage) FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error) {
+	return &home.Home{ID: home.DefaultID}, nil
+}
+
+func (f *fakeStorage) FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state := f.TargetStates[deviceID]
+	return &state, nil
+}
+
+func (f *fakeStorage) FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state, exists := f.CurrentStates[deviceID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("current state not found")}
+	}
+
+	return &state, nil
+}
+
+func (f *fakeStorage) FetchContentType(ctx context.Context, deviceID string) (string, error) {
+	return "", &client.ErrNotFound{Err: errors.New("content type not found")}
+}
+
+func (f *fakeStorage) FetchControlSettings(ctx context.Context, deviceID string) (*control.Settings, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	settings, exists := f.Settings[deviceID]
+	if !exists {
+		return &control.Settings{DeviceID: deviceID, ControlledBy: control.ServerControlled}, nil
+	}
+
+	return &settings, nil
+}
+
+func (f *fakeStorage) FetchLastControlCycleStart(ctx context.Context, deviceID string) (*control.Decision, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	decisions := f.Decisions[deviceID]
+	for i := len(decisions) - 1; i >= 0; i-- {
+		if decisions[i].Command != control.IdleCommand {
+			return &decisions[i], nil
+		}
+	}
+
+	return nil, &client.ErrNotFound{Err: errors.New("control decision not found")}
+}
+
+func (f *fakeStorage) FetchLatestControlDecision(ctx context.Context, deviceID string) (*control.Decision, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	decisions := f.Decisions[deviceID]
+	if len(decisions) == 0 {
+		return nil, &client.ErrNotFound{Err: errors.New("control decision not found")}
+	}
+
+	return &decisions[len(decisions)-1], nil
+}
+
+func (f *fakeStorage) AddControlDecision(ctx context.Context, decision *control.Decision, expiredBefore time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.Decisions == nil {
+		f.Decisions = make(map[string][]control.Decision)
+	}
+	f.Decisions[decision.DeviceID] = append(f.Decisions[decision.DeviceID], *decision)
+
+	return nil
+}
+
+type fakePubSub struct {
+	Commands []control.RelayCommand
+
+	shouldFail bool
+}
+
+func (f *fakePubSub) PublishRelayCommand(ctx context.Context, h *home.Home, command *control.RelayCommand, c codec.Codec) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Commands = append(f.Commands, *command)
+
+	return nil
+}
+
+func TestControl(t *testing.T) {
+	now := time.Now()
+	heatMode := thermostat.HeatMode
+	targetTemperature := 20
+
+	storage := &fakeStorage{
+		TargetStates: map[string]thermostat.TargetState{
+			"test_device_id": {DeviceID: "test_device_id", Mode: &heatMode, TargetTemperature: &targetTemperature},
+		},
+		CurrentStates: map[string]thermostat.CurrentState{
+			"test_device_id": {DeviceID: "test_device_id", Timestamp: now, CurrentTemperature: 18},
+		},
+	}
+	pubsub := &fakePubSub{}
+
+	c := New(time.Minute, time.Hour, testPolicy, Clients{
+		Storage: storage,
+		PubSub:  pubsub,
+	})
+
+	// Heats right away, then keeps heating through minimum on time after the
+	// target is reached
+	steps := []struct {
+		after       time.Duration
+		temperature float64
+		wantCommand control.Command
+	}{
+		{after: 0, temperature: 18, wantCommand: control.HeatCommand},
+		{after: time.Minute, temperature: 21, wantCommand: control.HeatCommand},
+		{after: 4 * time.Minute, temperature: 21, wantCommand: control.IdleCommand},
+		{after: 5 * time.Minute, temperature: 19, wantCommand: control.IdleCommand},
+		{after: 10 * time.Minute, temperature: 19, wantCommand: control.HeatCommand},
+	}
+	for i, step := range steps {
+		at := now.Add(step.after)
+		storage.CurrentStates["test_device_id"] = thermostat.CurrentState{DeviceID: "test_device_id", Timestamp: at, CurrentTemperature: step.temperature}
+
+		err := c.control(context.Background(), "test_device_id", at)
+		if err != nil {
+			t.Fatalf("control() step %d error = %v", i, err)
+		}
+
+		published := pubsub.Commands[len(pubsub.Commands)-1]
+		if published.Command != step.wantCommand {
+			t.Errorf("control() step %d published %s, want %s", i, published.Command, step.wantCommand)
+		}
+	}
+
+	if len(storage.Decisions["test_device_id"]) != len(steps) {
+		t.Errorf("control() recorded %d decisions, want %d", len(storage.Decisions["test_device_id"]), len(steps))
+	}
+}
+
+func TestControlPublishFailure(t *testing.T) {
+	heatMode := thermostat.HeatMode
+	targetTemperature := 20
+
+	storage := &fakeStorage{
+		TargetStates: map[string]thermostat.TargetState{
+			"test_device_id": {DeviceID: "test_device_id", Mode: &heatMode, TargetTemperature: &targetTemperature},
+		},
+	}
+
+	c := New(time.Minute, time.Hour, testPolicy, Clients{
+		Storage: storage,
+		PubSub:  &fakePubSub{shouldFail: true},
+	})
+
+	err := c.control(context.Background(), "test_device_id", time.Now())
+	if err == nil {
+		t.Error("control() error = nil, want error")
+	}
+
+	// Decision is still recorded for debugging
+	if len(storage.Decisions["test_device_id"]) != 1 {
+		t.Errorf("control() recorded %d decisions, want %d", len(storage.Decisions["test_device_id"]), 1)
+	}
+}
+
+func TestControlMinCycleTime(t *testing.T) {
+	now := time.Now()
+	heatMode := thermostat.HeatMode
+	targetTemperature := 20
+	minCycleSeconds := int((20 * time.Minute).Seconds())
+
+	storage := &fakeStorage{
+		TargetStates: map[string]thermostat.TargetState{
+			"test_device_id": {DeviceID: "test_device_id", Mode: &heatMode, TargetTemperature: &targetTemperature},
+		},
+		CurrentStates: map[string]thermostat.CurrentState{},
+		Settings: map[string]control.Settings{
+			"test_device_id": {DeviceID: "test_device_id", ControlledBy: control.ServerControlled, MinCycleSeconds: &minCycleSeconds},
+		},
+	}
+	pubsub := &fakePubSub{}
+
+	c := New(time.Minute, time.Hour, testPolicy, Clients{
+		Storage: storage,
+		PubSub:  pubsub,
+	})
+
+	// Minimum on and off times have elapsed by the time heating is called for
+	// again, but the device minimum cycle time hasn't
+	steps := []struct {
+		after       time.Duration
+		temperature float64
+		wantCommand control.Command
+	}{
+		{after: 0, temperature: 18, wantCommand: control.HeatCommand},
+		{after: 5 * time.Minute, temperature: 21, wantCommand: control.IdleCommand},
+		{after: 10 * time.Minute, temperature: 18, wantCommand: control.IdleCommand},
+		{after: 20 * time.Minute, temperature: 18, wantCommand: control.HeatCommand},
+	}
+	for i, step := range steps {
+		at := now.Add(step.after)
+		storage.CurrentStates["test_device_id"] = thermostat.CurrentState{DeviceID: "test_device_id", Timestamp: at, CurrentTemperature: step.temperature}
+
+		err := c.control(context.Background(), "test_device_id", at)
+		if err != nil {
+			t.Fatalf("control() step %d error = %v", i, err)
+		}
+
+		published := pubsub.Commands[len(pubsub.Commands)-1]
+		if published.Command != step.wantCommand {
+			t.Errorf("control() step %d published %s, want %s", i, published.Command, step.wantCommand)
+		}
+	}
+}
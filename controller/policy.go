@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// Policy is how the controller switches relays. The relay switches on once the
+// temperature is Hysteresis past the target, and off once it is Hysteresis past
+// the target on the other side, so that it doesn't flap around the target.
+// Relays stay on for at least MinOnTime and off for at least MinOffTime, and
+// don't switch on sooner than MinCycleTime after they last switched on.
+// MinCycleTime can be overridden per device.
+type Policy struct {
+	Hysteresis   float64
+	MinOnTime    time.Duration
+	MinOffTime   time.Duration
+	MinCycleTime time.Duration
+	// MaxStateAge switches off relays of devices that stopped reporting their
+	// temperature
+	MaxStateAge time.Duration
+}
+
+// decide settles on the command for the device, given the last decision and
+// the last decision that switched the relay on.
+func (p Policy) decide(now time.Time, target *thermostat.TargetState, current *thermostat.CurrentState, last, lastStart *control.Decision, minCycleTime time.Duration) *control.Decision {
+	decision := control.Decision{
+		DeviceID:     target.DeviceID,
+		DecidedAt:    now,
+		Command:      control.IdleCommand,
+		CommandSince: now,
+	}
+
+	if target.Mode != nil {
+		decision.Mode = *target.Mode
+	}
+
+	if target.TargetTemperature != nil {
+		decision.TargetTemperature = *target.TargetTemperature
+	}
+
+	lastCommand := control.IdleCommand
+	if last != nil {
+		lastCommand = last.Command
+		decision.CommandSince = last.CommandSince
+	}
+
+	var want control.Command
+	want, decision.Reason = p.want(now, &decision, current, lastCommand)
+
+	if want == lastCommand {
+		decision.Command = lastCommand
+		return &decision
+	}
+
+	// Relays switch between heating and cooling through idle, so that both
+	// minimum times apply
+	if lastCommand != control.IdleCommand && want != control.IdleCommand {
+		want = control.IdleCommand
+		decision.Reason = fmt.Sprintf("%s, switching off %s first", decision.Reason, lastCommand)
+	}
+
+	if last != nil {
+		held := now.Sub(last.CommandSince)
+
+		if lastCommand != control.IdleCommand && held < p.MinOnTime {
+			decision.Command = lastCommand
+			decision.Reason = fmt.Sprintf("%s, holding %s for minimum on time (%s left)", decision.Reason, lastCommand, p.MinOnTime-held)
+			return &decision
+		}
+
+		if lastCommand == control.IdleCommand && held < p.MinOffTime {
+			decision.Command = lastCommand
+			decision.Reason = fmt.Sprintf("%s, holding %s for minimum off time (%s left)", decision.Reason, lastCommand, p.MinOffTime-held)
+			return &decision
+		}
+	}
+
+	if lastStart != nil && want != control.IdleCommand {
+		cycle := now.Sub(lastStart.CommandSince)
+
+		if cycle < minCycleTime {
+			decision.Command = lastCommand
+			decision.Reason = fmt.Sprintf("%s, holding %s for minimum cycle time (%s left)", decision.Reason, lastCommand, minCycleTime-cycle)
+			return &decision
+		}
+	}
+
+	decision.Command = want
+	decision.CommandSince = now
+
+	return &decision
+}
+
+// want returns the command the temperature calls for, ignoring minimum times.
+func (p Policy) want(now time.Time, decision *control.Decision, current *thermostat.CurrentState, lastCommand control.Command) (control.Command, string) {
+	if decision.Mode == thermostat.OffMode {
+		return control.IdleCommand, "mode is OFF"
+	}
+
+	if current == nil {
+		return control.IdleCommand, "device hasn't reported its temperature"
+	}
+
+	if age := now.Sub(current.Timestamp); age > p.MaxStateAge {
+		return control.IdleCommand, fmt.Sprintf("temperature is stale, last reported %s ago", age.Round(time.Second))
+	}
+
+	temperature := current.CurrentTemperature
+	decision.CurrentTemperature = &temperature
+
+	target := float64(decision.TargetTemperature)
+	heatOn, heatOff := target-p.Hysteresis, target+p.Hysteresis
+	coolOn, coolOff := target+p.Hysteresis, target-p.Hysteresis
+
+	canHeat := decision.Mode == thermostat.HeatMode || decision.Mode == thermostat.AutoMode
+	canCool := decision.Mode == thermostat.CoolMode || decision.Mode == thermostat.AutoMode
+
+	switch {
+	case canHeat && lastCommand == control.HeatCommand && temperature < heatOff:
+		return control.HeatCommand, fmt.Sprintf("temperature %.2f is below %.2f", temperature, heatOff)
+	case canCool && lastCommand == control.CoolCommand && temperature > coolOff:
+		return control.CoolCommand, fmt.Sprintf("temperature %.2f is above %.2f", temperature, coolOff)
+	case canHeat && temperature <= heatOn:
+		return control.HeatCommand, fmt.Sprintf("temperature %.2f is at or below %.2f", temperature, heatOn)
+	case canCool && temperature >= coolOn:
+		return control.CoolCommand, fmt.Sprintf("temperature %.2f is at or above %.2f", temperature, coolOn)
+	default:
+		return control.IdleCommand, fmt.Sprintf("temperature %.2f needs no heating or cooling in %s mode", temperature, decision.Mode)
+	}
+}
@@ -0,0 +1,210 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+var testPolicy = Policy{
+	Hysteresis:   0.5,
+	MinOnTime:    3 * time.Minute,
+	MinOffTime:   3 * time.Minute,
+	MinCycleTime: 10 * time.Minute,
+	MaxStateAge:  5 * time.Minute,
+}
+
+func TestPolicyDecide(t *testing.T) {
+	now := time.Now()
+
+	targetState := func(mode thermostat.Mode, temperature int) *thermostat.TargetState {
+		return &thermostat.TargetState{DeviceID: "test_device_id", Mode: &mode, TargetTemperature: &temperature}
+	}
+	currentState := func(temperature float64, age time.Duration) *thermostat.CurrentState {
+		return &thermostat.CurrentState{DeviceID: "test_device_id", Timestamp: now.Add(-age), CurrentTemperature: temperature}
+	}
+	lastDecision := func(command control.Command, held time.Duration) *control.Decision {
+		return &control.Decision{DeviceID: "test_device_id", Command: command, CommandSince: now.Add(-held)}
+	}
+
+	type args struct {
+		target    *thermostat.TargetState
+		current   *thermostat.CurrentState
+		last      *control.Decision
+		lastStart *control.Decision
+	}
+	tests := []struct {
+		name             string
+		args             args
+		wantCommand      control.Command
+		wantCommandSince time.Time
+		wantReason       string
+	}{
+		{
+			name: "should start heating below hysteresis band",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(19.5, time.Minute),
+				last:    lastDecision(control.IdleCommand, time.Hour),
+			},
+			wantCommand:      control.HeatCommand,
+			wantCommandSince: now,
+		},
+		{
+			name: "should stay idle within hysteresis band",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(19.8, time.Minute),
+				last:    lastDecision(control.IdleCommand, time.Hour),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now.Add(-time.Hour),
+		},
+		{
+			name: "should keep heating within hysteresis band",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(20.2, time.Minute),
+				last:    lastDecision(control.HeatCommand, time.Hour),
+			},
+			wantCommand:      control.HeatCommand,
+			wantCommandSince: now.Add(-time.Hour),
+		},
+		{
+			name: "should stop heating above hysteresis band",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(20.5, time.Minute),
+				last:    lastDecision(control.HeatCommand, time.Hour),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now,
+		},
+		{
+			name: "should start cooling above hysteresis band",
+			args: args{
+				target:  targetState(thermostat.CoolMode, 20),
+				current: currentState(20.5, time.Minute),
+				last:    lastDecision(control.IdleCommand, time.Hour),
+			},
+			wantCommand:      control.CoolCommand,
+			wantCommandSince: now,
+		},
+		{
+			name: "should heat in auto mode below hysteresis band",
+			args: args{
+				target:  targetState(thermostat.AutoMode, 20),
+				current: currentState(19, time.Minute),
+			},
+			wantCommand:      control.HeatCommand,
+			wantCommandSince: now,
+		},
+		{
+			name: "should hold heating for minimum on time",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(21, time.Minute),
+				last:    lastDecision(control.HeatCommand, time.Minute),
+			},
+			wantCommand:      control.HeatCommand,
+			wantCommandSince: now.Add(-time.Minute),
+			wantReason:       "minimum on time",
+		},
+		{
+			name: "should hold idle for minimum off time",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(18, time.Minute),
+				last:    lastDecision(control.IdleCommand, time.Minute),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now.Add(-time.Minute),
+			wantReason:       "minimum off time",
+		},
+		{
+			name: "should hold idle for minimum cycle time",
+			args: args{
+				target:    targetState(thermostat.HeatMode, 20),
+				current:   currentState(18, time.Minute),
+				last:      lastDecision(control.IdleCommand, 5*time.Minute),
+				lastStart: lastDecision(control.HeatCommand, 9*time.Minute),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now.Add(-5 * time.Minute),
+			wantReason:       "minimum cycle time",
+		},
+		{
+			name: "should start heating after minimum cycle time",
+			args: args{
+				target:    targetState(thermostat.HeatMode, 20),
+				current:   currentState(18, time.Minute),
+				last:      lastDecision(control.IdleCommand, 5*time.Minute),
+				lastStart: lastDecision(control.HeatCommand, 10*time.Minute),
+			},
+			wantCommand:      control.HeatCommand,
+			wantCommandSince: now,
+		},
+		{
+			name: "should switch from heating to cooling through idle",
+			args: args{
+				target:  targetState(thermostat.CoolMode, 20),
+				current: currentState(22, time.Minute),
+				last:    lastDecision(control.HeatCommand, time.Hour),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now,
+			wantReason:       "switching off HEAT first",
+		},
+		{
+			name: "should switch off in OFF mode",
+			args: args{
+				target:  targetState(thermostat.OffMode, 20),
+				current: currentState(15, time.Minute),
+				last:    lastDecision(control.HeatCommand, time.Hour),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now,
+			wantReason:       "mode is OFF",
+		},
+		{
+			name: "should switch off, if temperature is stale",
+			args: args{
+				target:  targetState(thermostat.HeatMode, 20),
+				current: currentState(15, time.Hour),
+				last:    lastDecision(control.HeatCommand, time.Hour),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now,
+			wantReason:       "stale",
+		},
+		{
+			name: "should stay idle, if device hasn't reported",
+			args: args{
+				target: targetState(thermostat.HeatMode, 20),
+			},
+			wantCommand:      control.IdleCommand,
+			wantCommandSince: now,
+			wantReason:       "hasn't reported",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := testPolicy.decide(now, tt.args.target, tt.args.current, tt.args.last, tt.args.lastStart, testPolicy.MinCycleTime)
+
+			if decision.Command != tt.wantCommand {
+				t.Errorf("decide() command = %s, want %s (reason: %s)", decision.Command, tt.wantCommand, decision.Reason)
+			}
+
+			if !decision.CommandSince.Equal(tt.wantCommandSince) {
+				t.Errorf("decide() command since = %v, want %v", decision.CommandSince, tt.wantCommandSince)
+			}
+
+			if !strings.Contains(decision.Reason, tt.wantReason) {
+				t.Errorf("decide() reason = %q, want it to contain %q", decision.Reason, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/outbox"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// Dispatcher drains the target state outbox to the devices, retrying failed
+// deliveries with exponential backoff. Updates to a device within the debounce
+// window of its last successful delivery are coalesced into one delivery at
+// the end of the window, whether they are dispatched or drained.
+type Dispatcher struct {
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	Debounce     time.Duration
+	Clients      Clients
+
+	// Deliveries are serialized, so that the immediate dispatch from a request
+	// and the background drain don't race each other
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	debounceMu sync.Mutex
+	// delivered holds the time of the last successful delivery to each device
+	delivered map[string]time.Time
+	scheduled map[string]*time.Timer
+	stopped   bool
+	// flushes tracks scheduled and running deliveries at the end of debounce
+	// windows, so that stopping waits for them
+	flushes sync.WaitGroup
+
+	// ctx is passed to flushes, it's only cancelled if they take longer than
+	// allowed on stop
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type Clients struct {
+	Storage StorageClient
+	PubSub  PubSubClient
+}
+
+type StorageClient interface {
+	FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error)
+	FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error)
+	FetchSchemaVersion(ctx context.Context, deviceID string) (thermostat.SchemaVersion, error)
+	FetchContentType(ctx context.Context, deviceID string) (string, error)
+	FetchDelivery(ctx context.Context, deviceID string) (*outbox.Entry, error)
+	FetchDueDeliveries(ctx context.Context, now time.Time, limit int) ([]outbox.Entry, error)
+	CountPendingDeliveries(ctx context.Context) (int, error)
+	CompleteDelivery(ctx context.Context, deviceID string, version int) error
+	RetryDelivery(ctx context.Context, deviceID string, version int, nextAttemptAt time.Time, lastError string) error
+}
+
+type PubSubClient interface {
+	PublishTargetState(context.Context, *home.Home, *thermostat.TargetState, thermostat.SchemaVersion, codec.Codec) error
+}
+
+const batchSize = 100
+
+func New(pollInterval, minBackoff, maxBackoff, debounce time.Duration, clients Clients) *Dispatcher {
+	var d Dispatcher
+
+	d.PollInterval = pollInterval
+	d.MinBackoff = minBackoff
+	d.MaxBackoff = maxBackoff
+	d.Debounce = debounce
+	d.Clients = clients
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	d.delivered = make(map[string]time.Time)
+	d.scheduled = make(map[string]*time.Timer)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	return &d
+}
+
+func (d *Dispatcher) Start(ctx context.Context, errc chan<- error) {
+	defer close(d.done)
+
+	slog.Info(fmt.Sprintf("Target state dispatcher polling every %s", d.PollInterval))
+
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.drain(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stop) })
+
+	// Coalesced deliveries stay in the outbox and are drained on next start
+	d.debounceMu.Lock()
+	d.stopped = true
+	for deviceID, timer := range d.scheduled {
+		if timer.Stop() {
+			d.flushes.Done()
+		}
+		delete(d.scheduled, deviceID)
+	}
+	d.debounceMu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		d.flushes.Wait()
+		close(flushed)
+	}()
+
+	for _, done := range []chan struct{}{d.done, flushed} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			d.cancel()
+			return fmt.Errorf("error waiting for dispatcher to stop: %v", ctx.Err())
+		}
+	}
+
+	d.cancel()
+
+	return nil
+}
+
+// DispatchTargetState attempts to deliver the pending target state of the
+// device right away. If it fails, the delivery stays in the outbox and is
+// retried in the background. If the device got a delivery within the debounce
+// window, the update is left pending and delivered at the end of the window
+// together with any updates that follow.
+func (d *Dispatcher) DispatchTargetState(ctx context.Context, deviceID string) (outbox.DeliveryStatus, error) {
+	// The debounce window is checked once running deliveries are done, so that
+	// an update following one being published is coalesced too
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.coalesce(deviceID, time.Now()) {
+		metrics.AddDeliveryCoalesced()
+		return outbox.PendingStatus, nil
+	}
+
+	entry, err := d.Clients.Storage.FetchDelivery(ctx, deviceID)
+	if err != nil {
+		return outbox.PendingStatus, fmt.Errorf("error fetching delivery: %v", err)
+	}
+
+	err = d.deliver(ctx, entry)
+	if err != nil {
+		return outbox.PendingStatus, err
+	}
+
+	return outbox.DeliveredStatus, nil
+}
+
+// coalesce returns true if the delivery to the device has to wait for the end
+// of its debounce window, scheduling it if it isn't already. Once stopped,
+// nothing is scheduled and the delivery is left in the outbox.
+//
+// Callers must hold mu, so that the window can't start while checking it.
+func (d *Dispatcher) coalesce(deviceID string, now time.Time) bool {
+	if d.Debounce <= 0 {
+		return false
+	}
+
+	d.debounceMu.Lock()
+	defer d.debounceMu.Unlock()
+
+	_, scheduled := d.scheduled[deviceID]
+	if scheduled {
+		return true
+	}
+
+	deliveredAt, delivered := d.delivered[deviceID]
+	if delivered && now.Sub(deliveredAt) < d.Debounce {
+		if d.stopped {
+			return true
+		}
+
+		d.flushes.Add(1)
+		d.scheduled[deviceID] = time.AfterFunc(deliveredAt.Add(d.Debounce).Sub(now), func() {
+			d.flush(deviceID)
+		})
+		return true
+	}
+
+	return false
+}
+
+// markDelivered starts the debounce window of the device, once a delivery to
+// it succeeded. Failed deliveries don't start it, so that their retries and
+// the updates that follow them aren't held back.
+func (d *Dispatcher) markDelivered(deviceID string, now time.Time) {
+	if d.Debounce <= 0 {
+		return
+	}
+
+	d.debounceMu.Lock()
+	defer d.debounceMu.Unlock()
+
+	d.delivered[deviceID] = now
+}
+
+// flush delivers the coalesced updates of the device at the end of its
+// debounce window.
+func (d *Dispatcher) flush(deviceID string) {
+	defer d.flushes.Done()
+
+	d.debounceMu.Lock()
+	delete(d.scheduled, deviceID)
+	d.debounceMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ctx := d.ctx
+
+	entry, err := d.Clients.Storage.FetchDelivery(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Already delivered
+		default:
+			slog.Error(fmt.Sprintf("Error fetching delivery to device %s: %v", deviceID, err))
+		}
+		return
+	}
+
+	err = d.deliver(ctx, entry)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Error delivering coalesced target state to device %s: %v", deviceID, err))
+	}
+}
+
+// forgetDelivered drops the deliveries whose debounce window has ended, so
+// that devices seen once don't pile up.
+func (d *Dispatcher) forgetDelivered(now time.Time) {
+	d.debounceMu.Lock()
+	defer d.debounceMu.Unlock()
+
+	for deviceID, deliveredAt := range d.delivered {
+		if now.Sub(deliveredAt) >= d.Debounce {
+			delete(d.delivered, deviceID)
+		}
+	}
+}
+
+func (d *Dispatcher) drain(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.forgetDelivered(now)
+
+	entries, err := d.Clients.Storage.FetchDueDeliveries(ctx, now, batchSize)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error fetching due deliveries: %v", err))
+		return
+	}
+
+	for _, entry := range entries {
+		// Updates within the debounce window are delivered at its end, like
+		// dispatched ones
+		if d.coalesce(entry.DeviceID, now) {
+			continue
+		}
+
+		err := d.deliver(ctx, &entry)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Error delivering target state to device %s (attempt %d): %v", entry.DeviceID, entry.Attempts+1, err))
+		}
+	}
+
+	count, err := d.Clients.Storage.CountPendingDeliveries(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error counting pending deliveries: %v", err))
+		return
+	}
+
+	metrics.SetPendingDeliveries(count)
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, entry *outbox.Entry) error {
+	err := d.publish(ctx, entry.DeviceID)
+	if err != nil {
+		metrics.AddDeliveryAttempt("ERR")
+
+		nextAttemptAt := time.Now().Add(d.backoff(entry.Attempts + 1))
+		retryErr := d.Clients.Storage.RetryDelivery(ctx, entry.DeviceID, entry.Version, nextAttemptAt, err.Error())
+		if retryErr != nil {
+			return fmt.Errorf("error scheduling retry: %v, after: %v", retryErr, err)
+		}
+
+		return err
+	}
+
+	metrics.AddDeliveryAttempt("OK")
+	d.markDelivered(entry.DeviceID, time.Now())
+
+	err = d.Clients.Storage.CompleteDelivery(ctx, entry.DeviceID, entry.Version)
+	if err != nil {
+		return fmt.Errorf("error completing delivery: %v", err)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) publish(ctx context.Context, deviceID string) error {
+	h, err := d.Clients.Storage.FetchDeviceHome(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching device home: %v", err)
+	}
+
+	state, err := d.Clients.Storage.FetchTargetState(ctx, h.ID, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching target state: %v", err)
+	}
+
+	version, err := d.Clients.Storage.FetchSchemaVersion(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Device hasn't reported yet, assume the oldest firmware
+			version = thermostat.SchemaV1
+		default:
+			return fmt.Errorf("error fetching schema version: %v", err)
+		}
+	}
+
+	contentType, err := d.Clients.Storage.FetchContentType(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			contentType = codec.JSONContentType
+		default:
+			return fmt.Errorf("error fetching content type: %v", err)
+		}
+	}
+
+	c, err := codec.ForContentType(contentType)
+	if err != nil {
+		return fmt.Errorf("error choosing target state codec: %v", err)
+	}
+
+	err = d.Clients.PubSub.PublishTargetState(ctx, h, state, version, c)
+	if err != nil {
+		return fmt.Errorf("error publishing target state: %v", err)
+	}
+
+	metrics.AddPayloadSchemaVersion("target-state", version)
+
+	return nil
+}
+
+// backoff doubles the delay with every failed attempt, within the configured
+// bounds.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.MinBackoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, d.MaxBackoff)
+}
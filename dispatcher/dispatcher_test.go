@@ -0,0 +1,528 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/outbox"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type fakeStorage struct {
+	States       map[string]thermostat.TargetState
+	Versions     map[string]thermostat.SchemaVersion
+	ContentTypes map[string]string
+	Entries      map[string]outbox.Entry
+}
+
+func (f *fakeStorage) FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error) {
+	return &home.Home{ID: home.DefaultID}, nil
+}
+
+func (f *fakeStorage) FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error) {
+	state := f.States[deviceID]
+	return &state, nil
+}
+
+func (f *fakeStorage) FetchSchemaVersion(ctx context.Context, deviceID string) (thermostat.SchemaVersion, error) {
+	version, exists := f.Versions[deviceID]
+	if !exists {
+		return 0, &client.ErrNotFound{Err: errors.New("schema version not found")}
+	}
+
+	return version, nil
+}
+
+func (f *fakeStorage) FetchContentType(ctx context.Context, deviceID string) (string, error) {
+	contentType, exists := f.ContentTypes[deviceID]
+	if !exists {
+		return "", &client.ErrNotFound{Err: errors.New("content type not found")}
+	}
+
+	return contentType, nil
+}
+
+func (f *fakeStorage) FetchDelivery(ctx context.Context, deviceID string) (*outbox.Entry, error) {
+	entry, exists := f.Entries[deviceID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("delivery not found")}
+	}
+
+	return &entry, nil
+}
+
+func (f *fakeStorage) FetchDueDeliveries(ctx context.Context, now time.Time, limit int) ([]outbox.Entry, error) {
+	var entries []outbox.Entry
+	for _, entry := range f.Entries {
+		if !entry.NextAttemptAt.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (f *fakeStorage) CountPendingDeliveries(ctx context.Context) (int, error) {
+	return len(f.Entries), nil
+}
+
+func (f *fakeStorage) CompleteDelivery(ctx context.Context, deviceID string, version int) error {
+	if f.Entries[deviceID].Version == version {
+		delete(f.Entries, deviceID)
+	}
+
+	return nil
+}
+
+func (f *fakeStorage) RetryDelivery(ctx context.Context, deviceID string, version int, nextAttemptAt time.Time, lastError string) error {
+	entry := f.Entries[deviceID]
+	if entry.Version == version {
+		entry.Attempts++
+		entry.NextAttemptAt = nextAttemptAt
+		entry.LastError = &lastError
+		f.Entries[deviceID] = entry
+	}
+
+	return nil
+}
+
+type fakePubSub struct {
+	States   []thermostat.TargetState
+	Versions []thermostat.SchemaVersion
+	Codecs   []codec.Codec
+	// Delay is how long publishing takes
+	Delay time.Duration
+
+	shouldFail bool
+}
+
+func (f *fakePubSub) PublishTargetState(ctx context.Context, h *home.Home, state *thermostat.TargetState, version thermostat.SchemaVersion, c codec.Codec) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	select {
+	case <-time.After(f.Delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	f.States = append(f.States, *state)
+	f.Versions = append(f.Versions, version)
+	f.Codecs = append(f.Codecs, c)
+
+	return nil
+}
+
+func newTestStorage() *fakeStorage {
+	mode := thermostat.HeatMode
+	return &fakeStorage{
+		States: map[string]thermostat.TargetState{
+			"test_device_id": {DeviceID: "test_device_id", Mode: &mode},
+		},
+		Entries: map[string]outbox.Entry{
+			"test_device_id": {DeviceID: "test_device_id", Version: 1, NextAttemptAt: time.Now()},
+		},
+	}
+}
+
+func TestDispatchTargetState(t *testing.T) {
+	tests := []struct {
+		name          string
+		pubSub        *fakePubSub
+		wantErr       bool
+		wantPublished int
+		wantEntries   int
+		wantAttempts  int
+	}{
+		{
+			name:          "should publish and complete delivery",
+			pubSub:        &fakePubSub{shouldFail: false},
+			wantErr:       false,
+			wantPublished: 1,
+			wantEntries:   0,
+		},
+		{
+			name:          "should keep delivery for retry, if failed to publish",
+			pubSub:        &fakePubSub{shouldFail: true},
+			wantErr:       true,
+			wantPublished: 0,
+			wantEntries:   1,
+			wantAttempts:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage()
+			d := New(time.Second, time.Second, time.Minute, 0, Clients{Storage: storage, PubSub: tt.pubSub})
+
+			_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DispatchTargetState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(tt.pubSub.States) != tt.wantPublished {
+				t.Errorf("DispatchTargetState() len(pubSub.States) = %d, want %d", len(tt.pubSub.States), tt.wantPublished)
+			}
+
+			if len(storage.Entries) != tt.wantEntries {
+				t.Errorf("DispatchTargetState() len(storage.Entries) = %d, want %d", len(storage.Entries), tt.wantEntries)
+			}
+
+			if entry, exists := storage.Entries["test_device_id"]; exists {
+				if entry.Attempts != tt.wantAttempts {
+					t.Errorf("DispatchTargetState() entry.Attempts = %d, want %d", entry.Attempts, tt.wantAttempts)
+				}
+				if !entry.NextAttemptAt.After(time.Now()) {
+					t.Errorf("DispatchTargetState() entry.NextAttemptAt = %v, want in the future", entry.NextAttemptAt)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchTargetStateSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		versions    map[string]thermostat.SchemaVersion
+		wantVersion thermostat.SchemaVersion
+	}{
+		{
+			name:        "should publish in negotiated schema version",
+			versions:    map[string]thermostat.SchemaVersion{"test_device_id": thermostat.SchemaV2},
+			wantVersion: thermostat.SchemaV2,
+		},
+		{
+			name:        "should publish in oldest schema version, if device hasn't reported yet",
+			versions:    map[string]thermostat.SchemaVersion{},
+			wantVersion: thermostat.SchemaV1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage()
+			storage.Versions = tt.versions
+			pubSub := &fakePubSub{}
+			d := New(time.Second, time.Second, time.Minute, 0, Clients{Storage: storage, PubSub: pubSub})
+
+			_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+			if err != nil {
+				t.Fatalf("DispatchTargetState() error = %v", err)
+			}
+
+			if len(pubSub.Versions) != 1 || pubSub.Versions[0] != tt.wantVersion {
+				t.Errorf("DispatchTargetState() pubSub.Versions = %v, want [%d]", pubSub.Versions, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestDispatchTargetStateContentType(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentTypes map[string]string
+		wantCodec    codec.Codec
+	}{
+		{
+			name:         "should publish in content type preferred by device",
+			contentTypes: map[string]string{"test_device_id": codec.CBORContentType},
+			wantCodec:    codec.CBOR,
+		},
+		{
+			name:         "should publish JSON, if device hasn't reported yet",
+			contentTypes: map[string]string{},
+			wantCodec:    codec.JSON,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage()
+			storage.ContentTypes = tt.contentTypes
+			pubSub := &fakePubSub{}
+			d := New(time.Second, time.Second, time.Minute, 0, Clients{Storage: storage, PubSub: pubSub})
+
+			_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+			if err != nil {
+				t.Fatalf("DispatchTargetState() error = %v", err)
+			}
+
+			if len(pubSub.Codecs) != 1 || pubSub.Codecs[0] != tt.wantCodec {
+				t.Errorf("DispatchTargetState() pubSub.Codecs = %v, want [%v]", pubSub.Codecs, tt.wantCodec)
+			}
+		})
+	}
+}
+
+func TestDispatchTargetStateDebounce(t *testing.T) {
+	debounce := 50 * time.Millisecond
+	storage := newTestStorage()
+	pubSub := &fakePubSub{}
+	d := New(time.Second, time.Second, time.Minute, debounce, Clients{Storage: storage, PubSub: pubSub})
+
+	// First update is delivered right away, following ones are coalesced
+	wantStatuses := []outbox.DeliveryStatus{outbox.DeliveredStatus, outbox.PendingStatus, outbox.PendingStatus}
+	for i, wantStatus := range wantStatuses {
+		storage.Entries["test_device_id"] = outbox.Entry{DeviceID: "test_device_id", Version: i + 1, NextAttemptAt: time.Now()}
+
+		status, err := d.DispatchTargetState(context.Background(), "test_device_id")
+		if err != nil {
+			t.Fatalf("DispatchTargetState() error = %v", err)
+		}
+
+		if status != wantStatus {
+			t.Errorf("DispatchTargetState() update %d status = %v, want %v", i, status, wantStatus)
+		}
+	}
+
+	// Drain leaves coalesced updates to the end of the debounce window
+	d.drain(context.Background())
+
+	d.mu.Lock()
+	published := len(pubSub.States)
+	d.mu.Unlock()
+
+	if published != 1 {
+		t.Fatalf("DispatchTargetState() len(pubSub.States) = %d within debounce window, want %d", published, 1)
+	}
+
+	time.Sleep(3 * debounce)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(pubSub.States) != 2 {
+		t.Errorf("DispatchTargetState() len(pubSub.States) = %d after debounce window, want %d", len(pubSub.States), 2)
+	}
+
+	if len(storage.Entries) != 0 {
+		t.Errorf("DispatchTargetState() len(storage.Entries) = %d after debounce window, want %d", len(storage.Entries), 0)
+	}
+}
+
+func TestDispatchTargetStateDebounceAfterFailure(t *testing.T) {
+	debounce := time.Minute
+	storage := newTestStorage()
+	pubSub := &fakePubSub{shouldFail: true}
+	d := New(time.Second, time.Second, time.Minute, debounce, Clients{Storage: storage, PubSub: pubSub})
+
+	_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+	if err == nil {
+		t.Fatalf("DispatchTargetState() error = nil, want error")
+	}
+
+	// Failed delivery doesn't start the debounce window, so the next update
+	// isn't held back
+	pubSub.shouldFail = false
+	storage.Entries["test_device_id"] = outbox.Entry{DeviceID: "test_device_id", Version: 2, NextAttemptAt: time.Now()}
+
+	status, err := d.DispatchTargetState(context.Background(), "test_device_id")
+	if err != nil {
+		t.Fatalf("DispatchTargetState() error = %v", err)
+	}
+
+	if status != outbox.DeliveredStatus {
+		t.Errorf("DispatchTargetState() status = %v, want %v", status, outbox.DeliveredStatus)
+	}
+
+	if len(pubSub.States) != 1 {
+		t.Errorf("DispatchTargetState() len(pubSub.States) = %d, want %d", len(pubSub.States), 1)
+	}
+}
+
+func TestDrainDebounce(t *testing.T) {
+	debounce := 50 * time.Millisecond
+	storage := newTestStorage()
+	pubSub := &fakePubSub{}
+	d := New(time.Second, time.Second, time.Minute, debounce, Clients{Storage: storage, PubSub: pubSub})
+
+	_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+	if err != nil {
+		t.Fatalf("DispatchTargetState() error = %v", err)
+	}
+
+	// Update that wasn't dispatched is found by the drain within the debounce
+	// window
+	d.mu.Lock()
+	storage.Entries["test_device_id"] = outbox.Entry{DeviceID: "test_device_id", Version: 2, NextAttemptAt: time.Now()}
+	d.mu.Unlock()
+
+	d.drain(context.Background())
+
+	d.mu.Lock()
+	published := len(pubSub.States)
+	d.mu.Unlock()
+
+	if published != 1 {
+		t.Fatalf("drain() len(pubSub.States) = %d within debounce window, want %d", published, 1)
+	}
+
+	time.Sleep(3 * debounce)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(pubSub.States) != 2 {
+		t.Errorf("drain() len(pubSub.States) = %d after debounce window, want %d", len(pubSub.States), 2)
+	}
+
+	if len(storage.Entries) != 0 {
+		t.Errorf("drain() len(storage.Entries) = %d after debounce window, want %d", len(storage.Entries), 0)
+	}
+}
+
+// newDebouncedDispatcher returns a started dispatcher that delivered an update
+// to the device, and coalesced the update that followed.
+func newDebouncedDispatcher(t *testing.T, debounce, delay time.Duration) (*Dispatcher, *fakeStorage, *fakePubSub) {
+	storage := newTestStorage()
+	pubSub := &fakePubSub{}
+	d := New(time.Minute, time.Second, time.Minute, debounce, Clients{Storage: storage, PubSub: pubSub})
+
+	for i := range 2 {
+		storage.Entries["test_device_id"] = outbox.Entry{DeviceID: "test_device_id", Version: i + 1, NextAttemptAt: time.Now()}
+
+		_, err := d.DispatchTargetState(context.Background(), "test_device_id")
+		if err != nil {
+			t.Fatalf("DispatchTargetState() error = %v", err)
+		}
+	}
+
+	// Only the coalesced delivery is slow
+	d.mu.Lock()
+	pubSub.Delay = delay
+	d.mu.Unlock()
+
+	go d.Start(context.Background(), make(chan error, 1))
+
+	return d, storage, pubSub
+}
+
+func TestStopDebounce(t *testing.T) {
+	debounce := 100 * time.Millisecond
+	d, storage, pubSub := newDebouncedDispatcher(t, debounce, 0)
+
+	time.Sleep(debounce / 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := d.Stop(ctx)
+	if err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	// Updates after stop are left in the outbox too
+	storage.Entries["test_device_id"] = outbox.Entry{DeviceID: "test_device_id", Version: 3, NextAttemptAt: time.Now()}
+
+	status, err := d.DispatchTargetState(context.Background(), "test_device_id")
+	if err != nil {
+		t.Fatalf("DispatchTargetState() after stop error = %v", err)
+	}
+
+	if status != outbox.PendingStatus {
+		t.Errorf("DispatchTargetState() after stop status = %v, want %v", status, outbox.PendingStatus)
+	}
+
+	time.Sleep(2 * debounce)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(pubSub.States) != 1 {
+		t.Errorf("Stop() len(pubSub.States) = %d after debounce window, want %d", len(pubSub.States), 1)
+	}
+
+	if len(storage.Entries) != 1 {
+		t.Errorf("Stop() len(storage.Entries) = %d after debounce window, want %d", len(storage.Entries), 1)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	d, _, _ := newDebouncedDispatcher(t, 100*time.Millisecond, 0)
+
+	for i := range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := d.Stop(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Stop() call %d error = %v", i+1, err)
+		}
+	}
+}
+
+func TestStopWaitsForFlush(t *testing.T) {
+	debounce := 20 * time.Millisecond
+	d, storage, pubSub := newDebouncedDispatcher(t, debounce, 100*time.Millisecond)
+
+	// Coalesced delivery is being published
+	time.Sleep(2 * debounce)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := d.Stop(ctx)
+	if err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(pubSub.States) != 2 {
+		t.Errorf("Stop() len(pubSub.States) = %d, want %d", len(pubSub.States), 2)
+	}
+
+	if len(storage.Entries) != 0 {
+		t.Errorf("Stop() len(storage.Entries) = %d, want %d", len(storage.Entries), 0)
+	}
+}
+
+func TestDrainAfterOutage(t *testing.T) {
+	storage := newTestStorage()
+	pubSub := &fakePubSub{shouldFail: true}
+	d := New(time.Second, 0, 0, 0, Clients{Storage: storage, PubSub: pubSub})
+
+	// Broker is down, delivery stays in the outbox
+	d.drain(context.Background())
+
+	if len(storage.Entries) != 1 {
+		t.Fatalf("drain() len(storage.Entries) = %d, want %d", len(storage.Entries), 1)
+	}
+
+	// Broker is back, delivery is drained
+	pubSub.shouldFail = false
+	d.drain(context.Background())
+
+	if len(storage.Entries) != 0 {
+		t.Errorf("drain() len(storage.Entries) = %d, want %d", len(storage.Entries), 0)
+	}
+
+	if len(pubSub.States) != 1 {
+		t.Errorf("drain() len(pubSub.States) = %d, want %d", len(pubSub.States), 1)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := New(time.Second, time.Second, time.Minute, 0, Clients{})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+		{attempts: 6, want: 32 * time.Second},
+		{attempts: 7, want: time.Minute},
+		{attempts: 100, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/joho/godotenv"
 	envconfig "github.com/sethvargo/go-envconfig"
@@ -19,13 +21,116 @@ type Config struct {
 
 	StoragePath string `env:"STORAGE_PATH,default=./storage.db"`
 
+	TraceExporter     string  `env:"TRACE_EXPORTER,default=none"` // One of: none, otlp
+	TraceOTLPEndpoint string  `env:"TRACE_OTLP_ENDPOINT,default=localhost:4318"`
+	TraceOTLPInsecure bool    `env:"TRACE_OTLP_INSECURE,default=false"`
+	TraceServiceName  string  `env:"TRACE_SERVICE_NAME,default=thermostat-api"`
+	TraceSampleRatio  float64 `env:"TRACE_SAMPLE_RATIO,default=1"`
+
+	AuthEnabled        bool `env:"AUTH_ENABLED,default=true"`
+	AuthProtectHealth  bool `env:"AUTH_PROTECT_HEALTH,default=false"`
+	AuthProtectMetrics bool `env:"AUTH_PROTECT_METRICS,default=false"`
+
+	RateLimitAddressRate  float64 `env:"RATE_LIMIT_ADDRESS_RATE,default=20"`  // Requests per second, the
+	RateLimitAddressBurst int     `env:"RATE_LIMIT_ADDRESS_BURST,default=40"` // limit is disabled if 0
+	RateLimitClientRate   float64 `env:"RATE_LIMIT_CLIENT_RATE,default=10"`
+	RateLimitClientBurst  int     `env:"RATE_LIMIT_CLIENT_BURST,default=20"`
+	RateLimitDeviceRate   float64 `env:"RATE_LIMIT_DEVICE_RATE,default=1"`
+	RateLimitDeviceBurst  int     `env:"RATE_LIMIT_DEVICE_BURST,default=5"`
+
+	JWTJWKSURL             string        `env:"JWT_JWKS_URL"`  // JWTs are rejected if both
+	JWTJWKSFile            string        `env:"JWT_JWKS_FILE"` // JWKS URL and file are empty
+	JWTIssuer              string        `env:"JWT_ISSUER"`
+	JWTAudience            string        `env:"JWT_AUDIENCE"`
+	JWTRolesClaim          string        `env:"JWT_ROLES_CLAIM,default=roles"`
+	JWTHomeClaim           string        `env:"JWT_HOME_CLAIM,default=home"`
+	JWTLeeway              time.Duration `env:"JWT_LEEWAY,default=1m"`
+	JWTJWKSRefreshInterval time.Duration `env:"JWT_JWKS_REFRESH_INTERVAL,default=1h"`
+	JWTJWKSTimeout         time.Duration `env:"JWT_JWKS_TIMEOUT,default=10s"`
+
+	// Values of the scope claim of JWTs are mapped to the scopes of the API by
+	// claimed=scope pairs, tokens with none of them get the default scopes
+	JWTScopes        map[string]apikey.Scope `env:"JWT_SCOPES,separator==,default=thermostat.read=read,thermostat.write=write,thermostat.admin=admin"`
+	JWTDefaultScopes []apikey.Scope          `env:"JWT_DEFAULT_SCOPES,default=read"`
+
 	DefaultMode              thermostat.Mode `env:"DEFAULT_MODE,default=OFF"`
 	DefaultTargetTemperature int             `env:"DEFAULT_TARGET_TEMPERATURE,default=20"`
 
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL,default=1s"`
+	OutboxMinBackoff   time.Duration `env:"OUTBOX_MIN_BACKOFF,default=1s"`
+	OutboxMaxBackoff   time.Duration `env:"OUTBOX_MAX_BACKOFF,default=5m"`
+
+	TargetStateDebounce time.Duration `env:"TARGET_STATE_DEBOUNCE,default=500ms"` // 0 disables coalescing
+
+	ProcessorWorkers   int `env:"PROCESSOR_WORKERS,default=4"`
+	ProcessorQueueSize int `env:"PROCESSOR_QUEUE_SIZE,default=100"`
+
+	EventDedupWindow time.Duration `env:"EVENT_DEDUP_WINDOW,default=24h"`
+
+	TimestampMaxAge                time.Duration `env:"TIMESTAMP_MAX_AGE,default=1h"`
+	TimestampMaxAhead              time.Duration `env:"TIMESTAMP_MAX_AHEAD,default=1m"`
+	TimestampSubstituteReceiveTime bool          `env:"TIMESTAMP_SUBSTITUTE_RECEIVE_TIME,default=false"`
+
+	MinCycleTime            time.Duration `env:"MIN_CYCLE_TIME,default=10m"`
+	OperatingStateRetention time.Duration `env:"OPERATING_STATE_RETENTION,default=720h"`
+
+	SafetyFloorTemperature   float64 `env:"SAFETY_FLOOR_TEMPERATURE,default=5"`
+	SafetyCeilingTemperature float64 `env:"SAFETY_CEILING_TEMPERATURE,default=35"`
+	SafetyMargin             float64 `env:"SAFETY_MARGIN,default=2"`
+
+	SensorReadingMaxAge time.Duration `env:"SENSOR_READING_MAX_AGE,default=15m"`
+
+	ControlEnabled           bool          `env:"CONTROL_ENABLED,default=false"`
+	ControlInterval          time.Duration `env:"CONTROL_INTERVAL,default=30s"`
+	ControlHysteresis        float64       `env:"CONTROL_HYSTERESIS,default=0.5"`
+	ControlMinOnTime         time.Duration `env:"CONTROL_MIN_ON_TIME,default=3m"`
+	ControlMinOffTime        time.Duration `env:"CONTROL_MIN_OFF_TIME,default=3m"`
+	ControlMaxStateAge       time.Duration `env:"CONTROL_MAX_STATE_AGE,default=5m"`
+	ControlDecisionRetention time.Duration `env:"CONTROL_DECISION_RETENTION,default=168h"`
+
+	OutdoorRetention time.Duration `env:"OUTDOOR_RETENTION,default=720h"`
+
+	WeatherProviderURL  string        `env:"WEATHER_PROVIDER_URL"` // Polling is disabled if empty
+	WeatherPollInterval time.Duration `env:"WEATHER_POLL_INTERVAL,default=10m"`
+	WeatherTimeout      time.Duration `env:"WEATHER_TIMEOUT,default=10s"`
+
+	AlertInterval  time.Duration `env:"ALERT_INTERVAL,default=1m"`
+	WebhookTimeout time.Duration `env:"WEBHOOK_TIMEOUT,default=10s"`
+
+	WebhookPollInterval      time.Duration `env:"WEBHOOK_POLL_INTERVAL,default=1s"`
+	WebhookMinBackoff        time.Duration `env:"WEBHOOK_MIN_BACKOFF,default=10s"`
+	WebhookMaxBackoff        time.Duration `env:"WEBHOOK_MAX_BACKOFF,default=1h"`
+	WebhookMaxAttempts       int           `env:"WEBHOOK_MAX_ATTEMPTS,default=10"`
+	WebhookMaxFailures       int           `env:"WEBHOOK_MAX_FAILURES,default=20"`
+	WebhookDeliveryRetention time.Duration `env:"WEBHOOK_DELIVERY_RETENTION,default=168h"`
+	AvailabilityTimeout      time.Duration `env:"AVAILABILITY_TIMEOUT,default=5m"`
+
+	SMTPHost     string        `env:"SMTP_HOST"` // Email channels are disabled if empty
+	SMTPPort     uint16        `env:"SMTP_PORT,default=25"`
+	SMTPUsername string        `env:"SMTP_USERNAME"`
+	SMTPPassword string        `env:"SMTP_PASSWORD"`
+	SMTPFrom     string        `env:"SMTP_FROM,default=thermostat-api@localhost"`
+	SMTPTimeout  time.Duration `env:"SMTP_TIMEOUT,default=10s"`
+
+	EventRetryMaxAttempts int           `env:"EVENT_RETRY_MAX_ATTEMPTS,default=5"`
+	EventRetryMinBackoff  time.Duration `env:"EVENT_RETRY_MIN_BACKOFF,default=100ms"`
+	EventRetryMaxBackoff  time.Duration `env:"EVENT_RETRY_MAX_BACKOFF,default=5s"`
+	DeadLetterTopic       string        `env:"DEAD_LETTER_TOPIC"`
+
+	PubSubScheme   string `env:"PUBSUB_SCHEME,default=mqtt"`
 	PubSubHost     string `env:"PUBSUB_HOST,default=localhost"`
 	PubSubPort     uint16 `env:"PUBSUB_PORT,default=1883"`
+	PubSubPath     string `env:"PUBSUB_PATH"`
 	PubSubClientID string `env:"PUBSUB_CLIENT_ID,default=thermostat-api"`
 	PubSubQoS      byte   `env:"PUBSUB_QOS,default=1"`
+
+	PubSubUsername     string `env:"PUBSUB_USERNAME"`
+	PubSubPassword     string `env:"PUBSUB_PASSWORD"`
+	PubSubPasswordFile string `env:"PUBSUB_PASSWORD_FILE"`
+
+	PubSubCACertPath     string `env:"PUBSUB_CA_CERT_PATH"`
+	PubSubClientCertPath string `env:"PUBSUB_CLIENT_CERT_PATH"`
+	PubSubClientKeyPath  string `env:"PUBSUB_CLIENT_KEY_PATH"`
 }
 
 func LoadConfig(ctx context.Context) (*Config, error) {
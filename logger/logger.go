@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"context"
 	"os"
 
 	"log/slog"
@@ -25,3 +26,21 @@ func Init(level slog.Level, format string) {
 
 	slog.SetDefault(logger)
 }
+
+type loggerKey struct{}
+
+// WithContext stores a logger carrying attributes of the request or event, such
+// as its ID.
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger stored in the context, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+
+	return logger
+}
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/model/control"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -22,6 +23,13 @@ var (
 		Buckets: []float64{.005, .01, .025, .05, .075, .1, .25, .5, .75, 1.0, 2.5, 5.0, 7.5, 10.0, math.Inf(1)},
 	}, []string{"route_name", "status_code", "device_id"}))
 
+	requestsRateLimited = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "requests_rate_limited",
+		Help: "Requests rejected for exceeding a rate limit",
+	},
+		[]string{"limit"},
+	))
+
 	eventsProcessed = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "events_processed",
 		Help: "Handled PubSub events counter and metadata associated with them",
@@ -36,28 +44,129 @@ var (
 		[]string{"event_name", "status", "device_id"},
 	))
 
+	eventDuplicatesDropped = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "event_duplicates_dropped",
+		Help: "Redelivered events dropped because they were already processed",
+	},
+		[]string{"event_name"},
+	))
+
+	eventsRetried = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_retried",
+		Help: "Events handled again after a transient failure",
+	},
+		[]string{"event_name"},
+	))
+
+	eventQueueDepth = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "event_queue_depth",
+		Help: "Events waiting in the processor worker queue",
+	},
+		[]string{"worker"},
+	))
+	eventQueueBlocked = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "event_queue_blocked",
+		Help: "Events that had to wait for room in a full processor worker queue",
+	},
+		[]string{"worker"},
+	))
+
+	pendingDeliveries = newCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deliveries",
+		Help: "Target state deliveries waiting in the outbox",
+	}))
+	deliveryAttempts = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "delivery_attempts",
+		Help: "Target state delivery attempts counter",
+	},
+		[]string{"status"},
+	))
+	deliveriesCoalesced = newCollector(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "deliveries_coalesced",
+		Help: "Target state updates coalesced into a later delivery within the debounce window",
+	}))
+
+	payloadSchemaVersions = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "payload_schema_versions",
+		Help: "Device payloads counter by schema version",
+	},
+		[]string{"payload", "schema_version"},
+	))
+
 	thermostatMode = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thermostat_mode",
 		Help: "Mode of the thermostat",
 	},
-		[]string{"device_id"}))
+		[]string{"home_id", "device_id"}))
 	thermostatTargetTemperature = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thermostat_target_temperature",
 		Help: "Target temperature of the thermostat",
 	},
-		[]string{"device_id"}))
+		[]string{"home_id", "device_id"}))
 	thermostatOperatingState = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thermostat_operating_state",
 		Help: "Operating state of the thermostat",
-	}, []string{"device_id"}))
+	}, []string{"home_id", "device_id"}))
 	thermostatCurrentTemperature = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thermostat_current_temperature",
 		Help: "Current temperature reading of the thermostat",
-	}, []string{"device_id"}))
+	}, []string{"home_id", "device_id"}))
 	thermostatCurrentHumidity = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thermostat_current_humidity",
 		Help: "Current humidity reading of the thermostat",
-	}, []string{"device_id"}))
+	}, []string{"home_id", "device_id"}))
+	thermostatEffectiveTemperature = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thermostat_effective_temperature",
+		Help: "Temperature combined from the sensors assigned to the thermostat",
+	}, []string{"home_id", "device_id"}))
+	thermostatRelayCommand = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thermostat_relay_command",
+		Help: "Relay command of a server controlled thermostat",
+	}, []string{"home_id", "device_id"}))
+	thermostatShortCycles = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thermostat_short_cycles",
+		Help: "Starts of the thermostat equipment sooner than its minimum cycle time",
+	}, []string{"home_id", "device_id"}))
+	thermostatSafetyEvents = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thermostat_safety_events",
+		Help: "Times the thermostat was forced into a protective state by its safety limits",
+	}, []string{"home_id", "device_id", "kind"}))
+	thermostatClockSkew = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thermostat_clock_skew_seconds",
+		Help: "How far ahead of the receive time the thermostat timestamps its readings",
+	}, []string{"home_id", "device_id"}))
+
+	alertNotifications = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "alert_notifications",
+		Help: "Alert notifications sent to channels of alert rules",
+	}, []string{"channel", "status"}))
+
+	pendingWebhookDeliveries = newCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_webhook_deliveries",
+		Help: "Webhook deliveries waiting to be sent",
+	}))
+	webhookDeliveryAttempts = newCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_delivery_attempts",
+		Help: "Webhook delivery attempts counter",
+	}, []string{"event_type", "status"}))
+	webhookSubscriptionsDisabled = newCollector(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_subscriptions_disabled",
+		Help: "Webhook subscriptions disabled after too many failed deliveries",
+	}))
+
+	sensorTemperature = newCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sensor_temperature",
+		Help: "Latest temperature reading of the sensor",
+	}, []string{"sensor_id"}))
+
+	outdoorTemperature = newCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outdoor_temperature",
+		Help: "Latest outdoor temperature reading",
+	}))
+	outdoorHumidity = newCollector(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outdoor_humidity",
+		Help: "Latest outdoor humidity reading",
+	}))
 )
 
 func AddRequestHandled(routeName string, statusCode int, deviceID string) {
@@ -68,6 +177,10 @@ func ObserveRequestDuration(routeName string, statusCode int, deviceID string, d
 	requestsDuration.WithLabelValues(routeName, strconv.Itoa(statusCode), deviceID).Observe(duration.Seconds())
 }
 
+func AddRequestRateLimited(limit string) {
+	requestsRateLimited.WithLabelValues(limit).Inc()
+}
+
 func AddEventProcessed(eventName, status, deviceID string) {
 	eventsProcessed.WithLabelValues(eventName, status, deviceID).Inc()
 }
@@ -76,7 +189,39 @@ func ObserveEventDuration(eventName, status, deviceID string, duration time.Dura
 	eventsDuration.WithLabelValues(eventName, status, deviceID).Observe(duration.Seconds())
 }
 
-func SetThermostatMode(deviceID string, mode thermostat.Mode) {
+func AddEventDuplicateDropped(eventName string) {
+	eventDuplicatesDropped.WithLabelValues(eventName).Inc()
+}
+
+func AddEventRetried(eventName string) {
+	eventsRetried.WithLabelValues(eventName).Inc()
+}
+
+func SetEventQueueDepth(worker string, depth int) {
+	eventQueueDepth.WithLabelValues(worker).Set(float64(depth))
+}
+
+func AddEventQueueBlocked(worker string) {
+	eventQueueBlocked.WithLabelValues(worker).Inc()
+}
+
+func SetPendingDeliveries(count int) {
+	pendingDeliveries.Set(float64(count))
+}
+
+func AddDeliveryAttempt(status string) {
+	deliveryAttempts.WithLabelValues(status).Inc()
+}
+
+func AddDeliveryCoalesced() {
+	deliveriesCoalesced.Inc()
+}
+
+func AddPayloadSchemaVersion(payload string, version thermostat.SchemaVersion) {
+	payloadSchemaVersions.WithLabelValues(payload, strconv.Itoa(int(version))).Inc()
+}
+
+func SetThermostatMode(homeID, deviceID string, mode thermostat.Mode) {
 	var modeValue float64
 	switch mode {
 	case thermostat.OffMode:
@@ -91,14 +236,14 @@ func SetThermostatMode(deviceID string, mode thermostat.Mode) {
 		modeValue = -1
 	}
 
-	thermostatMode.WithLabelValues(deviceID).Set(modeValue)
+	thermostatMode.WithLabelValues(homeID, deviceID).Set(modeValue)
 }
 
-func SetThermostatTargetTemperature(deviceID string, temperature int) {
-	thermostatTargetTemperature.WithLabelValues(deviceID).Set(float64(temperature))
+func SetThermostatTargetTemperature(homeID, deviceID string, temperature int) {
+	thermostatTargetTemperature.WithLabelValues(homeID, deviceID).Set(float64(temperature))
 }
 
-func SetThermostatOperatingState(deviceID string, mode thermostat.OperatingState) {
+func SetThermostatOperatingState(homeID, deviceID string, mode thermostat.OperatingState) {
 	var modeValue float64
 	switch mode {
 	case thermostat.IdleOperatingState:
@@ -111,24 +256,96 @@ func SetThermostatOperatingState(deviceID string, mode thermostat.OperatingState
 		modeValue = -1
 	}
 
-	thermostatOperatingState.WithLabelValues(deviceID).Set(modeValue)
+	thermostatOperatingState.WithLabelValues(homeID, deviceID).Set(modeValue)
+}
+
+func SetThermostatCurrentTemperature(homeID, deviceID string, temperature float64) {
+	thermostatCurrentTemperature.WithLabelValues(homeID, deviceID).Set(temperature)
+}
+
+func SetThermostatCurrentHumidity(homeID, deviceID string, humidity float64) {
+	thermostatCurrentHumidity.WithLabelValues(homeID, deviceID).Set(humidity)
 }
 
-func SetThermostatCurrentTemperature(deviceID string, temperature float64) {
-	thermostatCurrentTemperature.WithLabelValues(deviceID).Set(temperature)
+func SetThermostatClockSkew(homeID, deviceID string, skew time.Duration) {
+	thermostatClockSkew.WithLabelValues(homeID, deviceID).Set(skew.Seconds())
 }
 
-func SetThermostatCurrentHumidity(deviceID string, humidity float64) {
-	thermostatCurrentHumidity.WithLabelValues(deviceID).Set(humidity)
+func SetThermostatEffectiveTemperature(homeID, deviceID string, temperature float64) {
+	thermostatEffectiveTemperature.WithLabelValues(homeID, deviceID).Set(temperature)
 }
 
+func SetThermostatRelayCommand(homeID, deviceID string, command control.Command) {
+	var commandValue float64
+	switch command {
+	case control.IdleCommand:
+		commandValue = 0
+	case control.HeatCommand:
+		commandValue = 1
+	case control.CoolCommand:
+		commandValue = 2
+	default:
+		commandValue = -1
+	}
+
+	thermostatRelayCommand.WithLabelValues(homeID, deviceID).Set(commandValue)
+}
+
+func AddThermostatShortCycle(homeID, deviceID string) {
+	thermostatShortCycles.WithLabelValues(homeID, deviceID).Inc()
+}
+
+func AddThermostatSafetyEvent(homeID, deviceID, kind string) {
+	thermostatSafetyEvents.WithLabelValues(homeID, deviceID, kind).Inc()
+}
+
+// DeleteThermostatMetrics deletes the metrics of the device in whichever home
+// they were reported in.
 func DeleteThermostatMetrics(deviceID string) {
+	labels := prometheus.Labels{"device_id": deviceID}
+
 	// Target state
-	thermostatMode.DeleteLabelValues(deviceID)
-	thermostatTargetTemperature.DeleteLabelValues(deviceID)
+	thermostatMode.DeletePartialMatch(labels)
+	thermostatTargetTemperature.DeletePartialMatch(labels)
 
 	// Current state
-	thermostatOperatingState.DeleteLabelValues(deviceID)
-	thermostatCurrentTemperature.DeleteLabelValues(deviceID)
-	thermostatCurrentHumidity.DeleteLabelValues(deviceID)
+	thermostatOperatingState.DeletePartialMatch(labels)
+	thermostatCurrentTemperature.DeletePartialMatch(labels)
+	thermostatCurrentHumidity.DeletePartialMatch(labels)
+	thermostatClockSkew.DeletePartialMatch(labels)
+	thermostatEffectiveTemperature.DeletePartialMatch(labels)
+	thermostatRelayCommand.DeletePartialMatch(labels)
+	thermostatShortCycles.DeletePartialMatch(labels)
+	thermostatSafetyEvents.DeletePartialMatch(labels)
+}
+
+func AddAlertNotification(channel, status string) {
+	alertNotifications.WithLabelValues(channel, status).Inc()
+}
+
+func SetPendingWebhookDeliveries(count int) {
+	pendingWebhookDeliveries.Set(float64(count))
+}
+
+func AddWebhookDeliveryAttempt(eventType, status string) {
+	webhookDeliveryAttempts.WithLabelValues(eventType, status).Inc()
+}
+
+func AddWebhookSubscriptionDisabled() {
+	webhookSubscriptionsDisabled.Inc()
+}
+
+func SetSensorTemperature(sensorID string, temperature float64) {
+	sensorTemperature.WithLabelValues(sensorID).Set(temperature)
+}
+
+func DeleteSensorMetrics(sensorID string) {
+	sensorTemperature.DeleteLabelValues(sensorID)
+}
+
+func SetOutdoorReading(temperature float64, humidity *float64) {
+	outdoorTemperature.Set(temperature)
+	if humidity != nil {
+		outdoorHumidity.Set(*humidity)
+	}
 }
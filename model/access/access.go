@@ -0,0 +1,180 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Role is a named set of grants that users are given, either by assigning it
+// to them or through the roles claim of their tokens.
+type Role struct {
+	Name   string  `json:"name" db:"name"`
+	Grants []Grant `json:"grants" db:"-"`
+}
+
+func (r *Role) Validate() error {
+	if r.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+
+	for _, grant := range r.Grants {
+		err := grant.Validate()
+		if err != nil {
+			return fmt.Errorf("error validating grant of device %s: %v", grant.DeviceID, err)
+		}
+	}
+
+	return nil
+}
+
+// AnyDevice is the device ID of grants that apply to every device.
+const AnyDevice = "*"
+
+// Grant allows a permission on a device.
+type Grant struct {
+	DeviceID   string     `json:"deviceId" db:"device_id"`
+	Permission Permission `json:"permission" db:"permission"`
+	// Range of target temperatures a SET_TEMPERATURE grant allows, unbounded
+	// on a side that is left out
+	MinTemperature *int `json:"minTemperature,omitempty" db:"min_temperature"`
+	MaxTemperature *int `json:"maxTemperature,omitempty" db:"max_temperature"`
+}
+
+func (g *Grant) Validate() error {
+	if g.DeviceID == "" {
+		return fmt.Errorf("device ID cannot be empty, use %s for every device", AnyDevice)
+	}
+
+	switch g.Permission {
+	case ViewPermission, SetTemperaturePermission, ChangeModePermission, AdminPermission:
+	default:
+		return fmt.Errorf("permission must be one of %s, %s, %s or %s. got: %s", ViewPermission, SetTemperaturePermission, ChangeModePermission, AdminPermission, g.Permission)
+	}
+
+	if (g.MinTemperature != nil || g.MaxTemperature != nil) && g.Permission != SetTemperaturePermission {
+		return fmt.Errorf("temperature range can only be set on %s grants", SetTemperaturePermission)
+	}
+
+	if g.MinTemperature != nil && g.MaxTemperature != nil && *g.MinTemperature > *g.MaxTemperature {
+		return fmt.Errorf("min temperature %d cannot be above max temperature %d", *g.MinTemperature, *g.MaxTemperature)
+	}
+
+	return nil
+}
+
+func (g *Grant) appliesTo(deviceID string) bool {
+	return g.DeviceID == AnyDevice || g.DeviceID == deviceID
+}
+
+func (g *Grant) allowsTemperature(temperature int) bool {
+	switch g.Permission {
+	case AdminPermission:
+		return true
+	case SetTemperaturePermission:
+		return (g.MinTemperature == nil || temperature >= *g.MinTemperature) &&
+			(g.MaxTemperature == nil || temperature <= *g.MaxTemperature)
+	default:
+		return false
+	}
+}
+
+type Permission string
+
+const (
+	// ViewPermission allows reading the state and configuration of a device
+	ViewPermission Permission = "VIEW"
+	// SetTemperaturePermission allows changing the target temperature of a
+	// device within the range of the grant, and viewing it
+	SetTemperaturePermission Permission = "SET_TEMPERATURE"
+	// ChangeModePermission allows changing the mode of a device, and viewing it
+	ChangeModePermission Permission = "CHANGE_MODE"
+	// AdminPermission allows everything on a device, including its
+	// configuration
+	AdminPermission Permission = "ADMIN"
+)
+
+// includes reports whether having the permission also allows the other one.
+func (p Permission) includes(other Permission) bool {
+	switch p {
+	case AdminPermission:
+		return true
+	case SetTemperaturePermission, ChangeModePermission:
+		return other == p || other == ViewPermission
+	default:
+		return other == p
+	}
+}
+
+// User is assigned roles on top of the ones in the claims of their tokens.
+// API keys are users too, with "api-key:<id>" subjects.
+type User struct {
+	Subject string   `json:"subject" db:"subject"`
+	Name    string   `json:"name,omitempty" db:"name"`
+	Roles   []string `json:"roles" db:"-"`
+}
+
+func (u *User) Validate() error {
+	if u.Subject == "" {
+		return errors.New("subject cannot be empty")
+	}
+
+	for _, role := range u.Roles {
+		if role == "" {
+			return errors.New("role cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// Policy is what a request is allowed to do on devices, made of the grants of
+// every role of its identity. A nil policy allows everything, for requests
+// that aren't restricted to devices.
+type Policy struct {
+	Grants []Grant
+}
+
+// Allows reports whether the permission is granted on the device.
+func (p *Policy) Allows(deviceID string, permission Permission) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, grant := range p.Grants {
+		if grant.appliesTo(deviceID) && grant.Permission.includes(permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsTemperature reports whether the target temperature of the device may
+// be set to the temperature.
+func (p *Policy) AllowsTemperature(deviceID string, temperature int) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, grant := range p.Grants {
+		if grant.appliesTo(deviceID) && grant.allowsTemperature(temperature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type policyKey struct{}
+
+func WithContext(ctx context.Context, policy *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// FromContext returns the policy of the request, or nil if it isn't
+// restricted.
+func FromContext(ctx context.Context) *Policy {
+	policy, _ := ctx.Value(policyKey{}).(*Policy)
+	return policy
+}
@@ -0,0 +1,25 @@
+package alert
+
+import "time"
+
+// Alert is raised when something about a device needs attention.
+type Alert struct {
+	Type     Type      `json:"type"`
+	DeviceID string    `json:"deviceId"`
+	Message  string    `json:"message"`
+	RaisedAt time.Time `json:"raisedAt"`
+}
+
+type Type string
+
+const (
+	// ShortCycleAlert is raised when equipment starts again sooner than its
+	// minimum cycle time after the previous start
+	ShortCycleAlert Type = "SHORT_CYCLE"
+	// FreezeAlert is raised when the temperature drops below the floor of the
+	// device and it is forced to heat
+	FreezeAlert Type = "FREEZE"
+	// OverheatAlert is raised when the temperature rises above the ceiling of
+	// the device and it is forced to cool
+	OverheatAlert Type = "OVERHEAT"
+)
@@ -0,0 +1,182 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Rule is a condition of a device that users want to be notified about. Rules
+// without a device apply to every device.
+type Rule struct {
+	ID       int64     `json:"id" db:"id"`
+	Name     string    `json:"name" db:"name"`
+	Kind     RuleKind  `json:"kind" db:"kind"`
+	DeviceID *string   `json:"deviceId,omitempty" db:"device_id"`
+	Min      *float64  `json:"min,omitempty" db:"min"`
+	Max      *float64  `json:"max,omitempty" db:"max"`
+	Minutes  *int      `json:"minutes,omitempty" db:"minutes"`
+	Channels []Channel `json:"channels" db:"-"`
+}
+
+type RuleKind string
+
+const (
+	// DeviceOfflineRule fires when the device hasn't reported its current
+	// state for Minutes
+	DeviceOfflineRule RuleKind = "DEVICE_OFFLINE"
+	// TemperatureRangeRule fires when the current temperature is below Min or
+	// above Max
+	TemperatureRangeRule RuleKind = "TEMPERATURE_RANGE"
+	// HumidityHighRule fires when the current humidity is above Max
+	HumidityHighRule RuleKind = "HUMIDITY_HIGH"
+	// TargetNotReachedRule fires when the device has been heating or cooling
+	// for Minutes without reaching its target temperature
+	TargetNotReachedRule RuleKind = "TARGET_NOT_REACHED"
+)
+
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+
+	switch r.Kind {
+	case DeviceOfflineRule, TargetNotReachedRule:
+		if r.Minutes == nil || *r.Minutes < 1 {
+			return fmt.Errorf("minutes must be a positive number for rule %s", r.Kind)
+		}
+	case TemperatureRangeRule:
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("min or max must be set for rule %s", r.Kind)
+		}
+		if r.Min != nil && r.Max != nil && *r.Min >= *r.Max {
+			return fmt.Errorf("min must be below max, got: %.2f and %.2f", *r.Min, *r.Max)
+		}
+	case HumidityHighRule:
+		if r.Max == nil || *r.Max < 0 || *r.Max > 100 {
+			return fmt.Errorf("max must be in range [0,100] for rule %s", r.Kind)
+		}
+	default:
+		return fmt.Errorf("kind must be one of %s, %s, %s or %s. got: %s", DeviceOfflineRule, TemperatureRangeRule, HumidityHighRule, TargetNotReachedRule, r.Kind)
+	}
+
+	if r.DeviceID != nil && *r.DeviceID == "" {
+		return errors.New("device ID cannot be empty, leave it out to apply the rule to every device")
+	}
+
+	if len(r.Channels) == 0 {
+		return errors.New("at least one channel must be set")
+	}
+
+	for _, c := range r.Channels {
+		err := c.Validate()
+		if err != nil {
+			return fmt.Errorf("error validating channel: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Duration is how long the condition of the rule has to last before it fires.
+func (r *Rule) Duration() time.Duration {
+	if r.Minutes == nil {
+		return 0
+	}
+
+	return time.Duration(*r.Minutes) * time.Minute
+}
+
+// Channel is where notifications of a rule are sent to: the URL of a webhook,
+// the address of an email recipient, or an MQTT topic.
+type Channel struct {
+	Type   ChannelType `json:"type" db:"type"`
+	Target string      `json:"target" db:"target"`
+}
+
+type ChannelType string
+
+const (
+	WebhookChannel ChannelType = "WEBHOOK"
+	EmailChannel   ChannelType = "EMAIL"
+	MQTTChannel    ChannelType = "MQTT"
+)
+
+func (c *Channel) Validate() error {
+	switch c.Type {
+	case WebhookChannel:
+		u, err := url.Parse(c.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("target of %s channel must be an http(s) URL, got: '%s'", c.Type, c.Target)
+		}
+	case EmailChannel:
+		_, err := mail.ParseAddress(c.Target)
+		if err != nil {
+			return fmt.Errorf("target of %s channel must be an email address, got: '%s'", c.Type, c.Target)
+		}
+	case MQTTChannel:
+		if c.Target == "" {
+			return fmt.Errorf("target of %s channel must be a topic", c.Type)
+		}
+
+		if strings.ContainsAny(c.Target, "+#") || strings.HasPrefix(c.Target, "$") {
+			return fmt.Errorf("target of %s channel cannot contain wildcards or be a system topic, got: '%s'", c.Type, c.Target)
+		}
+
+		if isDeviceTopic(c.Target) {
+			return fmt.Errorf("target of %s channel cannot be a topic of devices, got: '%s'", c.Type, c.Target)
+		}
+	default:
+		return fmt.Errorf("type must be one of %s, %s or %s. got: %s", WebhookChannel, EmailChannel, MQTTChannel, c.Type)
+	}
+
+	return nil
+}
+
+// deviceTopicLevels are the first levels of the topics devices publish to and
+// are set through, with or without the topic prefix of their home.
+var deviceTopicLevels = []string{"thermostat", "sensor", "outdoor"}
+
+// isDeviceTopic reports whether notifications published to the topic would be
+// taken for messages of devices, or sent to devices.
+func isDeviceTopic(topic string) bool {
+	levels := strings.SplitN(topic, "/", 3)
+
+	if slices.Contains(deviceTopicLevels, levels[0]) {
+		return true
+	}
+
+	return len(levels) > 1 && slices.Contains(deviceTopicLevels, levels[1])
+}
+
+type Status string
+
+const (
+	FiringStatus   Status = "FIRING"
+	ResolvedStatus Status = "RESOLVED"
+)
+
+// State is whether the rule fires for the device, and since when.
+type State struct {
+	RuleID    int64     `json:"ruleId" db:"rule_id"`
+	DeviceID  string    `json:"deviceId" db:"device_id"`
+	Status    Status    `json:"status" db:"status"`
+	Message   string    `json:"message" db:"message"`
+	ChangedAt time.Time `json:"changedAt" db:"changed_at"`
+}
+
+// Notification is sent to the channels of a rule when it starts or stops
+// firing for a device.
+type Notification struct {
+	RuleID   int64     `json:"ruleId"`
+	RuleName string    `json:"ruleName"`
+	Kind     RuleKind  `json:"kind"`
+	DeviceID string    `json:"deviceId"`
+	Status   Status    `json:"status"`
+	Message  string    `json:"message"`
+	SentAt   time.Time `json:"sentAt"`
+}
@@ -0,0 +1,81 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// ControlledBy tells whether the device runs its own control loop, or is a
+// relay board switched by the server.
+type ControlledBy string
+
+const (
+	DeviceControlled ControlledBy = "device"
+	ServerControlled ControlledBy = "server"
+)
+
+type Settings struct {
+	DeviceID     string       `json:"deviceId" db:"device_id"`
+	ControlledBy ControlledBy `json:"controlledBy" db:"controlled_by"`
+	// MinCycleSeconds is the shortest time the equipment may take between two
+	// starts, the configured default is used if not set
+	MinCycleSeconds *int `json:"minCycleSeconds,omitempty" db:"min_cycle_seconds"`
+}
+
+func (s *Settings) Validate() error {
+	switch s.ControlledBy {
+	case DeviceControlled, ServerControlled:
+		// Valid
+	default:
+		return fmt.Errorf("controlled by must be one of: [%s, %s], got: '%s'", DeviceControlled, ServerControlled, s.ControlledBy)
+	}
+
+	if s.MinCycleSeconds != nil && *s.MinCycleSeconds < 0 {
+		return fmt.Errorf("min cycle seconds cannot be negative, got: %d", *s.MinCycleSeconds)
+	}
+
+	return nil
+}
+
+// MinCycleTime returns the minimum cycle time of the device, or fallback if it
+// isn't configured.
+func (s *Settings) MinCycleTime(fallback time.Duration) time.Duration {
+	if s.MinCycleSeconds == nil {
+		return fallback
+	}
+
+	return time.Duration(*s.MinCycleSeconds) * time.Second
+}
+
+// Command is the relay state the server switches a server controlled device
+// to.
+type Command string
+
+const (
+	IdleCommand Command = "IDLE"
+	HeatCommand Command = "HEAT"
+	CoolCommand Command = "COOL"
+)
+
+// Decision records a run of the control loop for a device: what it was based
+// on, which command it settled on and why.
+type Decision struct {
+	ID                 int64           `json:"id" db:"id"`
+	DeviceID           string          `json:"deviceId" db:"device_id"`
+	DecidedAt          time.Time       `json:"decidedAt" db:"decided_at"`
+	Mode               thermostat.Mode `json:"mode" db:"mode"`
+	TargetTemperature  int             `json:"targetTemperature" db:"target_temperature"`
+	CurrentTemperature *float64        `json:"currentTemperature" db:"current_temperature"` // Not set if the device hasn't reported recently
+	Command            Command         `json:"command" db:"command"`
+	CommandSince       time.Time       `json:"commandSince" db:"command_since"` // When the relay was switched to the command
+	Reason             string          `json:"reason" db:"reason"`
+}
+
+// RelayCommand is published to server controlled devices.
+type RelayCommand struct {
+	DeviceID  string    `json:"deviceId"`
+	Command   Command   `json:"command"`
+	Timestamp time.Time `json:"timestamp"`
+}
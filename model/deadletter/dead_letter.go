@@ -0,0 +1,14 @@
+package deadletter
+
+import "time"
+
+// DeadLetter is a message that was rejected by its event handler, kept so that
+// it can be inspected and replayed later.
+type DeadLetter struct {
+	ID         int64      `json:"id" db:"id"`
+	Topic      string     `json:"topic" db:"topic"`
+	Payload    []byte     `json:"payload" db:"payload"`
+	Reason     string     `json:"reason" db:"reason"`
+	ReceivedAt time.Time  `json:"receivedAt" db:"received_at"`
+	ReplayedAt *time.Time `json:"replayedAt,omitempty" db:"replayed_at"`
+}
@@ -0,0 +1,108 @@
+package home
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Home is a household that owns devices and members. Requests and device
+// messages are scoped to a single home, so that homes served by the same
+// deployment can't see each other's devices.
+type Home struct {
+	ID   string `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+	// TopicPrefix is the first level of the MQTT topics of devices of the
+	// home, empty for the default home
+	TopicPrefix string    `json:"topicPrefix" db:"topic_prefix"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+// DefaultID is the home of devices and members that were never assigned to
+// another one. The default home is managed by the operator of the deployment.
+const DefaultID = "default"
+
+var (
+	idPattern          = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	topicPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+func (h *Home) Validate() error {
+	if !idPattern.MatchString(h.ID) {
+		return fmt.Errorf("id must be lowercase letters, digits and dashes, got: '%s'", h.ID)
+	}
+
+	if h.ID == DefaultID {
+		return fmt.Errorf("id %s is reserved", DefaultID)
+	}
+
+	if h.Name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+
+	// Prefixes are a single topic level, so that the topics of every home can
+	// be subscribed to with one wildcard
+	if !topicPrefixPattern.MatchString(h.TopicPrefix) {
+		return fmt.Errorf("topic prefix must be letters, digits, underscores and dashes, got: '%s'", h.TopicPrefix)
+	}
+
+	return nil
+}
+
+// Topic returns the topic of the home for a device topic.
+func (h *Home) Topic(topic string) string {
+	if h.TopicPrefix == "" {
+		return topic
+	}
+
+	return h.TopicPrefix + "/" + topic
+}
+
+// SplitTopic returns the topic prefix of a topic received for a device topic,
+// and false if the topic isn't one of the device topic.
+func SplitTopic(topic, deviceTopic string) (string, bool) {
+	if topic == deviceTopic {
+		return "", true
+	}
+
+	prefix, found := strings.CutSuffix(topic, "/"+deviceTopic)
+	if !found || prefix == "" || strings.Contains(prefix, "/") {
+		return "", false
+	}
+
+	return prefix, true
+}
+
+// Device is a thermostat owned by a home. Devices are registered by the first
+// home they report or are set in, and can be moved by the operator.
+type Device struct {
+	ID        string    `json:"id" db:"id"`
+	HomeID    string    `json:"homeId" db:"home_id"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// Member is an identity whose requests are scoped to a home, either an API key
+// or a user of the identity provider.
+type Member struct {
+	Subject string `json:"subject" db:"subject"`
+	HomeID  string `json:"homeId" db:"home_id"`
+}
+
+type homeKey struct{}
+
+func WithContext(ctx context.Context, h *Home) context.Context {
+	return context.WithValue(ctx, homeKey{}, h)
+}
+
+// FromContext returns the home the request is scoped to, or the default home
+// if auth is disabled.
+func FromContext(ctx context.Context) *Home {
+	h, ok := ctx.Value(homeKey{}).(*Home)
+	if !ok || h == nil {
+		return &Home{ID: DefaultID}
+	}
+
+	return h
+}
@@ -0,0 +1,51 @@
+package identity
+
+import (
+	"context"
+	"slices"
+
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+)
+
+// Identity is who a request was made by, either an API key or a user of the
+// identity provider.
+type Identity struct {
+	// Subject is unique per user, or "api-key:<id>" for API keys
+	Subject string   `json:"subject"`
+	Name    string   `json:"name,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	// HomeID is the home claimed by the token of the identity provider, the
+	// home the request is scoped to is resolved from it and memberships
+	HomeID string         `json:"homeId,omitempty"`
+	Scopes []apikey.Scope `json:"scopes"`
+	Method Method         `json:"method"`
+}
+
+type Method string
+
+const (
+	APIKeyMethod Method = "API_KEY"
+	JWTMethod    Method = "JWT"
+)
+
+func (i *Identity) HasScope(scope apikey.Scope) bool {
+	return slices.Contains(i.Scopes, scope)
+}
+
+func (i *Identity) HasRole(role string) bool {
+	return slices.Contains(i.Roles, role)
+}
+
+type identityKey struct{}
+
+func WithContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns who made the request, or nil if authentication is
+// disabled.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,22 @@
+package outbox
+
+import "time"
+
+// Entry marks a device whose latest target state still has to be delivered
+// to it. Version is bumped on every update, so that a delivery of an older
+// version doesn't complete a newer one.
+type Entry struct {
+	DeviceID      string    `json:"deviceId" db:"device_id"`
+	Version       int       `json:"version" db:"version"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt" db:"next_attempt_at"`
+	LastError     *string   `json:"lastError,omitempty" db:"last_error"`
+	CreatedAt     time.Time `json:"createdAt" db:"created_at"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveredStatus DeliveryStatus = "delivered"
+	PendingStatus   DeliveryStatus = "pending"
+)
@@ -0,0 +1,40 @@
+package outdoor
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reading is an outdoor measurement, either reported by a weather station over
+// MQTT or polled from a weather provider.
+type Reading struct {
+	Timestamp   time.Time `json:"timestamp" db:"timestamp"`
+	Temperature float64   `json:"temperature" db:"temperature"`
+	Humidity    *float64  `json:"humidity,omitempty" db:"humidity"`
+	Source      Source    `json:"source" db:"source"`
+}
+
+func (r *Reading) Validate() error {
+	if r.Timestamp.IsZero() {
+		return fmt.Errorf("timestamp cannot be empty")
+	}
+
+	if r.Temperature < -90 || r.Temperature > 60 {
+		return fmt.Errorf("temperature must be in range [-90,60]. got: %.2f", r.Temperature)
+	}
+
+	if r.Humidity != nil {
+		if *r.Humidity < 0 || *r.Humidity > 100 {
+			return fmt.Errorf("humidity must be in range [0,100]. got: %.2f", *r.Humidity)
+		}
+	}
+
+	return nil
+}
+
+type Source string
+
+const (
+	StationSource  Source = "STATION"
+	ProviderSource Source = "PROVIDER"
+)
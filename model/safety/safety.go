@@ -0,0 +1,87 @@
+package safety
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+// Limits are the temperatures a device must be kept between, regardless of
+// its target state. Configured defaults are used for limits that aren't set.
+type Limits struct {
+	DeviceID           string   `json:"deviceId" db:"device_id"`
+	FloorTemperature   *float64 `json:"floorTemperature,omitempty" db:"floor_temperature"`
+	CeilingTemperature *float64 `json:"ceilingTemperature,omitempty" db:"ceiling_temperature"`
+}
+
+func (l *Limits) Validate() error {
+	if l.FloorTemperature != nil {
+		if *l.FloorTemperature < -20 || *l.FloorTemperature > 50 {
+			return fmt.Errorf("floor temperature must be in range [-20,50]. got: %.2f", *l.FloorTemperature)
+		}
+	}
+
+	if l.CeilingTemperature != nil {
+		if *l.CeilingTemperature < -20 || *l.CeilingTemperature > 50 {
+			return fmt.Errorf("ceiling temperature must be in range [-20,50]. got: %.2f", *l.CeilingTemperature)
+		}
+	}
+
+	if l.FloorTemperature != nil && l.CeilingTemperature != nil {
+		if *l.FloorTemperature >= *l.CeilingTemperature {
+			return fmt.Errorf("floor temperature must be below ceiling temperature, got: %.2f and %.2f", *l.FloorTemperature, *l.CeilingTemperature)
+		}
+	}
+
+	return nil
+}
+
+type Kind string
+
+const (
+	FreezeKind   Kind = "FREEZE"
+	OverheatKind Kind = "OVERHEAT"
+)
+
+// Event is a period the device spent past one of its limits. While it lasts,
+// the device is held in a protective target state, which can't be overridden.
+type Event struct {
+	ID          int64      `json:"id" db:"id"`
+	DeviceID    string     `json:"deviceId" db:"device_id"`
+	Kind        Kind       `json:"kind" db:"kind"`
+	Temperature float64    `json:"temperature" db:"temperature"` // Temperature that crossed the limit
+	Limit       float64    `json:"limit" db:"limit_temperature"`
+	TriggeredAt time.Time  `json:"triggeredAt" db:"triggered_at"`
+	ClearedAt   *time.Time `json:"clearedAt,omitempty" db:"cleared_at"`
+
+	// Target state the device was in before, restored once the event clears
+	PreviousMode              *thermostat.Mode `json:"previousMode,omitempty" db:"previous_mode"`
+	PreviousTargetTemperature *int             `json:"previousTargetTemperature,omitempty" db:"previous_target_temperature"`
+}
+
+// ProtectiveState returns the target state the device is held in while the
+// event lasts: heating to margin above the floor, or cooling to margin below
+// the ceiling. The event clears once the device reaches it.
+func (e *Event) ProtectiveState(margin float64) *thermostat.TargetState {
+	var mode thermostat.Mode
+	var temperature int
+	switch e.Kind {
+	case FreezeKind:
+		mode = thermostat.HeatMode
+		temperature = int(math.Ceil(e.Limit + margin))
+	case OverheatKind:
+		mode = thermostat.CoolMode
+		temperature = int(math.Floor(e.Limit - margin))
+	}
+
+	// Kept within the range devices accept
+	temperature = min(max(temperature, 0), 30)
+
+	return &thermostat.TargetState{
+		DeviceID:          e.DeviceID,
+		Mode:              &mode,
+		TargetTemperature: &temperature,
+	}
+}
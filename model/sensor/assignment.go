@@ -0,0 +1,122 @@
+package sensor
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Assignment is the set of sensors a thermostat controls on, and the strategy
+// their readings are combined with.
+type Assignment struct {
+	DeviceID  string   `json:"deviceId" db:"device_id"`
+	Strategy  Strategy `json:"strategy" db:"strategy"`
+	SensorID  *string  `json:"sensorId,omitempty" db:"sensor_id"` // Sensor used by SensorStrategy
+	SensorIDs []string `json:"sensorIds" db:"-"`
+}
+
+func (a *Assignment) Validate() error {
+	if a.DeviceID == "" {
+		return fmt.Errorf("device ID cannot be empty")
+	}
+
+	if len(a.SensorIDs) == 0 {
+		return fmt.Errorf("sensor IDs cannot be empty")
+	}
+
+	switch a.Strategy {
+	case AverageStrategy, MinStrategy, MaxStrategy, OccupiedStrategy:
+		if a.SensorID != nil {
+			return fmt.Errorf("sensor ID can only be set for strategy %s", SensorStrategy)
+		}
+	case SensorStrategy:
+		if a.SensorID == nil || !slices.Contains(a.SensorIDs, *a.SensorID) {
+			return fmt.Errorf("sensor ID must be one of the assigned sensors for strategy %s", SensorStrategy)
+		}
+	default:
+		return fmt.Errorf("strategy must be one of: [%s, %s, %s, %s, %s], got: '%s'", AverageStrategy, MinStrategy, MaxStrategy, SensorStrategy, OccupiedStrategy, a.Strategy)
+	}
+
+	return nil
+}
+
+type Strategy string
+
+const (
+	AverageStrategy Strategy = "AVERAGE"
+	MinStrategy     Strategy = "MIN"
+	MaxStrategy     Strategy = "MAX"
+	SensorStrategy  Strategy = "SENSOR"
+	// OccupiedStrategy averages the sensors in occupied rooms, or all of them
+	// when no room is occupied
+	OccupiedStrategy Strategy = "OCCUPIED"
+)
+
+// EffectiveTemperature is the temperature a thermostat controls on, combined
+// from the readings of its assigned sensors.
+type EffectiveTemperature struct {
+	DeviceID    string    `json:"deviceId"`
+	Temperature float64   `json:"temperature"`
+	Strategy    Strategy  `json:"strategy"`
+	SensorIDs   []string  `json:"sensorIds"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Combine applies the assignment strategy to the readings of the assigned
+// sensors. Readings of other sensors are ignored.
+func Combine(assignment *Assignment, readings []Reading) (*EffectiveTemperature, error) {
+	var assigned []Reading
+	for _, reading := range readings {
+		if slices.Contains(assignment.SensorIDs, reading.SensorID) {
+			assigned = append(assigned, reading)
+		}
+	}
+
+	switch assignment.Strategy {
+	case SensorStrategy:
+		assigned = slices.DeleteFunc(assigned, func(r Reading) bool {
+			return assignment.SensorID == nil || r.SensorID != *assignment.SensorID
+		})
+	case OccupiedStrategy:
+		occupied := slices.DeleteFunc(slices.Clone(assigned), func(r Reading) bool {
+			return r.Occupied == nil || !*r.Occupied
+		})
+		if len(occupied) > 0 {
+			assigned = occupied
+		}
+	}
+
+	if len(assigned) == 0 {
+		return nil, fmt.Errorf("no readings of assigned sensors for strategy %s", assignment.Strategy)
+	}
+
+	effective := EffectiveTemperature{
+		DeviceID: assignment.DeviceID,
+		Strategy: assignment.Strategy,
+	}
+
+	for i, reading := range assigned {
+		effective.SensorIDs = append(effective.SensorIDs, reading.SensorID)
+		if reading.Timestamp.After(effective.Timestamp) {
+			effective.Timestamp = reading.Timestamp
+		}
+
+		switch {
+		case i == 0:
+			effective.Temperature = reading.Temperature
+		case assignment.Strategy == MinStrategy:
+			effective.Temperature = min(effective.Temperature, reading.Temperature)
+		case assignment.Strategy == MaxStrategy:
+			effective.Temperature = max(effective.Temperature, reading.Temperature)
+		default:
+			effective.Temperature += reading.Temperature
+		}
+	}
+
+	switch assignment.Strategy {
+	case AverageStrategy, OccupiedStrategy:
+		effective.Temperature /= float64(len(assigned))
+	}
+
+	return &effective, nil
+}
@@ -0,0 +1,55 @@
+package sensor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sensor is a standalone temperature sensor, which reports on its own topic
+// and can be assigned to thermostats.
+type Sensor struct {
+	ID   string `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+	Room string `json:"room" db:"room"`
+}
+
+func (s *Sensor) Validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("sensor ID cannot be empty")
+	}
+
+	// Sensor ID is a topic level, so it can't contain separators or wildcards
+	if strings.ContainsAny(s.ID, "/+#") {
+		return fmt.Errorf("sensor ID cannot contain any of '/', '+', '#', got: '%s'", s.ID)
+	}
+
+	return nil
+}
+
+// Reading is the latest measurement reported by a sensor.
+type Reading struct {
+	SensorID    string    `json:"sensorId" db:"sensor_id"`
+	Timestamp   time.Time `json:"timestamp" db:"timestamp"`
+	Temperature float64   `json:"temperature" db:"temperature"`
+	Humidity    *float64  `json:"humidity,omitempty" db:"humidity"`
+	Occupied    *bool     `json:"occupied,omitempty" db:"occupied"` // Only sensors with presence detection report occupancy
+}
+
+func (r *Reading) Validate() error {
+	if r.SensorID == "" {
+		return fmt.Errorf("sensor ID cannot be empty")
+	}
+
+	if r.Temperature < -55 || r.Temperature > 125 {
+		return fmt.Errorf("temperature must be in range [-55,125]. got: %.2f", r.Temperature)
+	}
+
+	if r.Humidity != nil {
+		if *r.Humidity < 0 || *r.Humidity > 100 {
+			return fmt.Errorf("humidity must be in range [0,100]. got: %.2f", *r.Humidity)
+		}
+	}
+
+	return nil
+}
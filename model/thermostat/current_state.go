@@ -18,8 +18,8 @@ func (s *CurrentState) Validate() error {
 		return fmt.Errorf("device ID cannot be empty")
 	}
 
-	if time.Since(s.Timestamp) > 1*time.Hour {
-		return fmt.Errorf("timestamp cannot be older than 1 hour, got: '%s'", s.Timestamp)
+	if s.Timestamp.IsZero() {
+		return fmt.Errorf("timestamp cannot be empty")
 	}
 
 	switch s.OperatingState {
@@ -42,6 +42,31 @@ func (s *CurrentState) Validate() error {
 	return nil
 }
 
+// TimestampPolicy bounds how far reported timestamps may be from the time the
+// reading was received, so that a device with a bad clock can't store a reading
+// that no later reading is considered newer than.
+type TimestampPolicy struct {
+	MaxAge   time.Duration
+	MaxAhead time.Duration
+	// SubstituteReceiveTime stores readings with out of bounds timestamps at
+	// the time they were received, instead of rejecting them
+	SubstituteReceiveTime bool
+}
+
+// Check reports whether the timestamp is within bounds, given how far ahead of
+// the receive time it is.
+func (p TimestampPolicy) Check(skew time.Duration) error {
+	if skew < -p.MaxAge {
+		return fmt.Errorf("timestamp cannot be more than %s before receive time, got: %s", p.MaxAge, -skew)
+	}
+
+	if skew > p.MaxAhead {
+		return fmt.Errorf("timestamp cannot be more than %s after receive time, got: %s", p.MaxAhead, skew)
+	}
+
+	return nil
+}
+
 type OperatingState string
 
 const (
@@ -49,3 +74,15 @@ const (
 	HeatingOperatingState OperatingState = "HEATING"
 	CoolingOperatingState OperatingState = "COOLING"
 )
+
+// Active reports whether the equipment is running in this operating state.
+func (s OperatingState) Active() bool {
+	return s == HeatingOperatingState || s == CoolingOperatingState
+}
+
+// OperatingStateChange records the time a device entered an operating state.
+type OperatingStateChange struct {
+	DeviceID       string         `json:"deviceId" db:"device_id"`
+	OperatingState OperatingState `json:"operatingState" db:"operating_state"`
+	ChangedAt      time.Time      `json:"changedAt" db:"changed_at"`
+}
@@ -0,0 +1,110 @@
+package thermostat
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/codec"
+)
+
+// SchemaVersion is the version of the payload shape exchanged with a device.
+// Payloads without a version are from firmware that predates versioning and
+// are treated as SchemaV1.
+type SchemaVersion int
+
+const (
+	SchemaV1 SchemaVersion = 1
+	// SchemaV2 uses compact field names and unix timestamps
+	SchemaV2 SchemaVersion = 2
+)
+
+const LatestSchemaVersion = SchemaV2
+
+func (v SchemaVersion) Validate() error {
+	if v < SchemaV1 || v > LatestSchemaVersion {
+		return fmt.Errorf("schema version must be in range [%d,%d], got: %d", SchemaV1, LatestSchemaVersion, v)
+	}
+
+	return nil
+}
+
+type schemaHeader struct {
+	SchemaVersion SchemaVersion `json:"schemaVersion"`
+}
+
+type currentStateV2 struct {
+	SchemaVersion  SchemaVersion  `json:"schemaVersion"`
+	DeviceID       string         `json:"deviceId"`
+	Timestamp      int64          `json:"ts"`
+	OperatingState OperatingState `json:"state"`
+	Temperature    float64        `json:"temp"`
+	Humidity       *float64       `json:"hum,omitempty"`
+}
+
+type targetStateV2 struct {
+	SchemaVersion     SchemaVersion `json:"schemaVersion"`
+	DeviceID          string        `json:"deviceId"`
+	Mode              *Mode         `json:"mode"`
+	TargetTemperature *int          `json:"target"`
+}
+
+// UnmarshalCurrentState decodes current state reported by a device in any
+// supported schema version, and returns the version it was reported in.
+func UnmarshalCurrentState(data []byte, c codec.Codec) (*CurrentState, SchemaVersion, error) {
+	var header schemaHeader
+	err := c.Unmarshal(data, &header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error unmarshalling schema version: %v", err)
+	}
+
+	version := header.SchemaVersion
+	if version == 0 {
+		version = SchemaV1
+	}
+
+	switch version {
+	case SchemaV1:
+		var state CurrentState
+		err := c.Unmarshal(data, &state)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error unmarshalling current state v1: %v", err)
+		}
+
+		return &state, version, nil
+	case SchemaV2:
+		var payload currentStateV2
+		err := c.Unmarshal(data, &payload)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error unmarshalling current state v2: %v", err)
+		}
+
+		return &CurrentState{
+			DeviceID:           payload.DeviceID,
+			Timestamp:          time.Unix(payload.Timestamp, 0),
+			OperatingState:     payload.OperatingState,
+			CurrentTemperature: payload.Temperature,
+			CurrentHumidity:    payload.Humidity,
+		}, version, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported schema version: %d", version)
+	}
+}
+
+// MarshalTargetState encodes target state in the schema version the device
+// understands.
+func MarshalTargetState(state *TargetState, version SchemaVersion, c codec.Codec) ([]byte, error) {
+	switch version {
+	case SchemaV1:
+		// Old firmware doesn't expect the version field
+		return c.Marshal(state)
+	case SchemaV2:
+		return c.Marshal(targetStateV2{
+			SchemaVersion:     version,
+			DeviceID:          state.DeviceID,
+			Mode:              state.Mode,
+			TargetTemperature: state.TargetTemperature,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported schema version: %d", version)
+	}
+}
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Subscription is an endpoint that wants to be told about events of devices.
+// Subscriptions without a device are told about every device.
+type Subscription struct {
+	ID         int64       `json:"id" db:"id"`
+	URL        string      `json:"url" db:"url"`
+	EventTypes []EventType `json:"eventTypes" db:"-"`
+	DeviceID   *string     `json:"deviceId,omitempty" db:"device_id"`
+	// Secret deliveries are signed with, never returned by the API
+	Secret string `json:"secret,omitempty" db:"secret"`
+	// Subscriptions are disabled after too many failed deliveries in a row
+	Enabled             bool       `json:"enabled" db:"enabled"`
+	ConsecutiveFailures int        `json:"consecutiveFailures" db:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabledAt,omitempty" db:"disabled_at"`
+	CreatedAt           time.Time  `json:"createdAt" db:"created_at"`
+}
+
+const minSecretLength = 16
+
+func (s *Subscription) Validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http(s) URL, got: '%s'", s.URL)
+	}
+
+	if len(s.EventTypes) == 0 {
+		return errors.New("at least one event type must be set")
+	}
+
+	for _, t := range s.EventTypes {
+		switch t {
+		case TargetStateEvent, CurrentStateEvent, AvailabilityEvent:
+		default:
+			return fmt.Errorf("event type must be one of %s, %s or %s. got: %s", TargetStateEvent, CurrentStateEvent, AvailabilityEvent, t)
+		}
+	}
+
+	if s.DeviceID != nil && *s.DeviceID == "" {
+		return errors.New("device ID cannot be empty, leave it out to subscribe to every device")
+	}
+
+	// Secret is left out on updates that keep the current one
+	if s.Secret != "" && len(s.Secret) < minSecretLength {
+		return fmt.Errorf("secret must be at least %d characters long", minSecretLength)
+	}
+
+	return nil
+}
+
+type EventType string
+
+const (
+	// TargetStateEvent is emitted when the target state of a device is
+	// updated, by a user or by its safety limits
+	TargetStateEvent EventType = "TARGET_STATE_UPDATED"
+	// CurrentStateEvent is emitted when a device reports its current state
+	CurrentStateEvent EventType = "CURRENT_STATE_RECEIVED"
+	// AvailabilityEvent is emitted when a device stops reporting its current
+	// state, or starts reporting again
+	AvailabilityEvent EventType = "AVAILABILITY_CHANGED"
+)
+
+// Event is the body of a webhook delivery.
+type Event struct {
+	Type       EventType `json:"type"`
+	DeviceID   string    `json:"deviceId"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Data       any       `json:"data"`
+}
+
+// Availability is the data of an AvailabilityEvent.
+type Availability struct {
+	DeviceID   string    `json:"deviceId" db:"device_id"`
+	Available  bool      `json:"available" db:"available"`
+	LastSeenAt time.Time `json:"lastSeenAt" db:"last_seen_at"`
+}
+
+type DeliveryStatus string
+
+const (
+	PendingStatus   DeliveryStatus = "PENDING"
+	DeliveredStatus DeliveryStatus = "DELIVERED"
+	FailedStatus    DeliveryStatus = "FAILED"
+)
+
+// Delivery is an event on its way to a subscription, kept as a log once it is
+// delivered or given up on.
+type Delivery struct {
+	ID             int64          `json:"id" db:"id"`
+	SubscriptionID int64          `json:"subscriptionId" db:"subscription_id"`
+	EventType      EventType      `json:"eventType" db:"event_type"`
+	DeviceID       string         `json:"deviceId" db:"device_id"`
+	Payload        string         `json:"payload" db:"payload"`
+	Status         DeliveryStatus `json:"status" db:"status"`
+	Attempts       int            `json:"attempts" db:"attempts"`
+	NextAttemptAt  time.Time      `json:"nextAttemptAt" db:"next_attempt_at"`
+	LastStatusCode *int           `json:"lastStatusCode,omitempty" db:"last_status_code"`
+	LastError      *string        `json:"lastError,omitempty" db:"last_error"`
+	CreatedAt      time.Time      `json:"createdAt" db:"created_at"`
+	CompletedAt    *time.Time     `json:"completedAt,omitempty" db:"completed_at"`
+}
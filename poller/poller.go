@@ -0,0 +1,104 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+// Poller periodically fetches outdoor conditions from a weather provider and
+// appends them to the outdoor temperature series.
+type Poller struct {
+	Interval  time.Duration
+	Retention time.Duration
+	Clients   Clients
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type Clients struct {
+	Storage StorageClient
+	Weather WeatherProvider
+}
+
+type StorageClient interface {
+	AddOutdoorReading(ctx context.Context, reading *outdoor.Reading, expiredBefore time.Time) error
+}
+
+type WeatherProvider interface {
+	FetchOutdoorReading(ctx context.Context) (*outdoor.Reading, error)
+}
+
+func New(interval, retention time.Duration, clients Clients) *Poller {
+	var p Poller
+
+	p.Interval = interval
+	p.Retention = retention
+	p.Clients = clients
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	return &p
+}
+
+func (p *Poller) Start(ctx context.Context, errc chan<- error) {
+	defer close(p.done)
+
+	slog.Info(fmt.Sprintf("Weather provider polled every %s", p.Interval))
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.poll(ctx)
+		if err != nil {
+			// Outdoor temperature is informational, keep the last known one
+			slog.Warn(fmt.Sprintf("Error polling weather provider: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) Stop(ctx context.Context) error {
+	close(p.stop)
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for poller to stop: %v", ctx.Err())
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) error {
+	reading, err := p.Clients.Weather.FetchOutdoorReading(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching outdoor reading: %v", err)
+	}
+
+	err = reading.Validate()
+	if err != nil {
+		return fmt.Errorf("error validating outdoor reading: %v", err)
+	}
+
+	err = p.Clients.Storage.AddOutdoorReading(ctx, reading, time.Now().Add(-p.Retention))
+	if err != nil {
+		return fmt.Errorf("error adding outdoor reading: %v", err)
+	}
+
+	metrics.SetOutdoorReading(reading.Temperature, reading.Humidity)
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+type fakeStorage struct {
+	Readings []outdoor.Reading
+
+	shouldFail bool
+}
+
+func (f *fakeStorage) AddOutdoorReading(ctx context.Context, reading *outdoor.Reading, expiredBefore time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Readings = append(f.Readings, *reading)
+
+	return nil
+}
+
+type fakeWeatherProvider struct {
+	Reading outdoor.Reading
+
+	shouldFail bool
+}
+
+func (f *fakeWeatherProvider) FetchOutdoorReading(ctx context.Context) (*outdoor.Reading, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	reading := f.Reading
+	return &reading, nil
+}
+
+func TestPoll(t *testing.T) {
+	now := time.Now()
+
+	type args struct {
+		storage *fakeStorage
+		weather *fakeWeatherProvider
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantErr      bool
+		wantReadings int
+	}{
+		{
+			name: "should store outdoor reading",
+			args: args{
+				storage: &fakeStorage{},
+				weather: &fakeWeatherProvider{Reading: outdoor.Reading{Timestamp: now, Temperature: 12.5, Source: outdoor.ProviderSource}},
+			},
+			wantErr:      false,
+			wantReadings: 1,
+		},
+		{
+			name: "should return error, if reading is invalid",
+			args: args{
+				storage: &fakeStorage{},
+				weather: &fakeWeatherProvider{Reading: outdoor.Reading{Timestamp: now, Temperature: 200, Source: outdoor.ProviderSource}},
+			},
+			wantErr:      true,
+			wantReadings: 0,
+		},
+		{
+			name: "should return error, if provider fails",
+			args: args{
+				storage: &fakeStorage{},
+				weather: &fakeWeatherProvider{shouldFail: true},
+			},
+			wantErr:      true,
+			wantReadings: 0,
+		},
+		{
+			name: "should return error, if storage fails",
+			args: args{
+				storage: &fakeStorage{shouldFail: true},
+				weather: &fakeWeatherProvider{Reading: outdoor.Reading{Timestamp: now, Temperature: 12.5, Source: outdoor.ProviderSource}},
+			},
+			wantErr:      true,
+			wantReadings: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(time.Minute, time.Hour, Clients{
+				Storage: tt.args.storage,
+				Weather: tt.args.weather,
+			})
+
+			err := p.poll(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("poll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(tt.args.storage.Readings) != tt.wantReadings {
+				t.Errorf("poll() stored %d readings, want %d", len(tt.args.storage.Readings), tt.wantReadings)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+)
+
+// deadLetterSink stores dead letters and, if a topic is configured, also
+// republishes them to it.
+type deadLetterSink struct {
+	topic   string
+	storage StorageClient
+	pubsub  PubSubClient
+}
+
+func (s *deadLetterSink) AddDeadLetter(ctx context.Context, letter *deadletter.DeadLetter) error {
+	var errs []error
+
+	err := s.storage.AddDeadLetter(ctx, letter)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error storing dead letter: %v", err))
+	}
+
+	if s.topic != "" {
+		err := s.pubsub.PublishDeadLetter(ctx, s.topic, letter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error publishing dead letter: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package event
+
+import (
+	"context"
+	"time"
+)
+
+type replayKey struct{}
+
+// WithReplay marks the context of a message that is being replayed, rather
+// than received from the broker.
+func WithReplay(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayKey{}, true)
+}
+
+func IsReplay(ctx context.Context) bool {
+	replay, _ := ctx.Value(replayKey{}).(bool)
+	return replay
+}
+
+// Metadata describes the broker message an event payload was received in.
+type Metadata struct {
+	Topic          string
+	ContentType    string
+	UserProperties map[string]string
+	ReceivedAt     time.Time
+}
+
+type metadataKey struct{}
+
+func WithMetadata(ctx context.Context, metadata *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// MetadataFromContext returns the message metadata, or empty metadata if the
+// payload didn't come from the broker.
+func MetadataFromContext(ctx context.Context) *Metadata {
+	metadata, ok := ctx.Value(metadataKey{}).(*Metadata)
+	if !ok {
+		return &Metadata{}
+	}
+
+	return metadata
+}
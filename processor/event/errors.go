@@ -0,0 +1,29 @@
+package event
+
+// ErrPermanent is returned by handlers for messages that can never be
+// processed successfully, such as malformed or invalid payloads.
+type ErrPermanent struct {
+	Err error
+}
+
+func (e *ErrPermanent) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrPermanent) Unwrap() error {
+	return e.Err
+}
+
+// ErrTransient is returned by handlers for failures that may succeed if the
+// message is handled again, such as a locked database.
+type ErrTransient struct {
+	Err error
+}
+
+func (e *ErrTransient) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrTransient) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,17 @@
+package event
+
+import (
+	"context"
+
+	"github.com/alexchebotarsky/thermostat-api/codec"
+)
+
+// UnmarshalPayload decodes the payload with the codec of its content type.
+func UnmarshalPayload(ctx context.Context, payload []byte, v any) error {
+	c, err := codec.ForContentType(MetadataFromContext(ctx).ContentType)
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(payload, v)
+}
@@ -0,0 +1,37 @@
+package event
+
+import "strings"
+
+// MatchTopic reports whether the topic matches the MQTT topic filter, which
+// may contain single level '+' and multi level '#' wildcards.
+func MatchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// TopicLevel returns the level of the topic at index, or an empty string if
+// the topic doesn't have that many levels.
+func TopicLevel(topic string, index int) string {
+	levels := strings.Split(topic, "/")
+	if index < 0 || index >= len(levels) {
+		return ""
+	}
+
+	return levels[index]
+}
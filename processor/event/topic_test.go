@@ -0,0 +1,26 @@
+package event
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "thermostat/current-state", topic: "thermostat/current-state", want: true},
+		{filter: "thermostat/current-state", topic: "thermostat/target-state", want: false},
+		{filter: "sensor/+/reading", topic: "sensor/kitchen/reading", want: true},
+		{filter: "sensor/+/reading", topic: "sensor/kitchen/battery", want: false},
+		{filter: "sensor/+/reading", topic: "sensor/kitchen/reading/extra", want: false},
+		{filter: "sensor/+/reading", topic: "sensor/reading", want: false},
+		{filter: "sensor/#", topic: "sensor/kitchen/reading", want: true},
+		{filter: "sensor/#", topic: "sensor", want: true}, // "#" includes the parent level
+		{filter: "#", topic: "sensor/kitchen/reading", want: true},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -7,10 +7,41 @@ import (
 )
 
 func (p *Processor) setupEvents() {
+	p.use(middleware.Tracing)
+	p.use(middleware.Deduplicate(p.Clients.Storage, p.Config.DedupWindow))
+	p.use(middleware.Logging)
 	p.use(middleware.Metrics)
+	p.use(middleware.DeadLetter(&deadLetterSink{
+		topic:   p.Config.DeadLetterTopic,
+		storage: p.Clients.Storage,
+		pubsub:  p.Clients.PubSub,
+	}))
+	p.use(middleware.Retry(p.Config.Retry))
+	// Recover is innermost, so that a panicking message is dead-lettered and
+	// reported by the middlewares above like any other rejected message
+	p.use(middleware.Recover)
+
+	currentState := handler.CurrentState(p.Clients.Storage, p.Clients.PubSub, p.Clients.Alerter, p.Config.Timestamps, p.Config.Cycles, p.Config.Safety)
+
+	p.handle(event.Event{
+		Topic:   handler.CurrentStateTopic,
+		Handler: currentState,
+	})
+
+	// Devices of other homes than the default one report under the topic
+	// prefix of their home
+	p.handle(event.Event{
+		Topic:   "+/" + handler.CurrentStateTopic,
+		Handler: currentState,
+	})
+
+	p.handle(event.Event{
+		Topic:   "sensor/+/reading",
+		Handler: handler.SensorReading(p.Clients.Storage, p.Clients.PubSub, p.Config.SensorReadingMaxAge),
+	})
 
 	p.handle(event.Event{
-		Topic:   "thermostat/current-state",
-		Handler: handler.CurrentState(p.Clients.Storage),
+		Topic:   "outdoor/reading",
+		Handler: handler.OutdoorReading(p.Clients.Storage, p.Config.OutdoorRetention),
 	})
 }
@@ -2,50 +2,222 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"log/slog"
+	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
 	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/alexchebotarsky/thermostat-api/processor/event"
 )
 
 type CurrentStateManager interface {
-	FetchCurrentState(ctx context.Context, deviceID string) (*thermostat.CurrentState, error)
-	UpdateCurrentState(context.Context, *thermostat.CurrentState) (*thermostat.CurrentState, error)
+	FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error)
+	ClaimDevice(ctx context.Context, homeID, deviceID string) error
+	UpdateCurrentState(ctx context.Context, homeID string, state *thermostat.CurrentState) (*thermostat.CurrentState, error)
+	UpdateSchemaVersion(ctx context.Context, deviceID string, version thermostat.SchemaVersion) error
+	UpdateContentType(ctx context.Context, deviceID string, contentType string) error
+	FetchControlSettings(ctx context.Context, deviceID string) (*control.Settings, error)
+	FetchLastCycleStart(ctx context.Context, deviceID string, before time.Time) (*thermostat.OperatingStateChange, error)
+	AddOperatingStateChange(ctx context.Context, change *thermostat.OperatingStateChange, expiredBefore time.Time) error
+	SafetyManager
+	HomeResolver
 }
 
-func CurrentState(manager CurrentStateManager) event.Handler {
+type AlertPublisher interface {
+	PublishAlert(ctx context.Context, a *alert.Alert) error
+}
+
+type AlertEvaluator interface {
+	EvaluateAlerts(ctx context.Context, deviceID string) error
+}
+
+// CyclePolicy is how short cycles of the equipment are detected. A short cycle
+// is the equipment starting again sooner than MinCycleTime after its previous
+// start. MinCycleTime can be overridden per device.
+type CyclePolicy struct {
+	MinCycleTime     time.Duration
+	HistoryRetention time.Duration
+}
+
+func CurrentState(manager CurrentStateManager, alerts AlertPublisher, evaluator AlertEvaluator, policy thermostat.TimestampPolicy, cycles CyclePolicy, safety SafetyPolicy) event.Handler {
 	return func(ctx context.Context, payload []byte) error {
-		var state thermostat.CurrentState
-		err := json.Unmarshal(payload, &state)
+		metadata := event.MetadataFromContext(ctx)
+
+		receivedAt := metadata.ReceivedAt
+		if receivedAt.IsZero() {
+			receivedAt = time.Now()
+		}
+
+		h, err := resolveHome(ctx, manager, metadata.Topic, CurrentStateTopic)
 		if err != nil {
-			return fmt.Errorf("error unmarshalling current state: %v", err)
+			return err
+		}
+
+		c, err := codec.ForContentType(metadata.ContentType)
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error choosing current state codec: %v", err)}
+		}
+
+		state, version, err := thermostat.UnmarshalCurrentState(payload, c)
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error unmarshalling current state: %v", err)}
 		}
 
 		err = state.Validate()
 		if err != nil {
-			return fmt.Errorf("error validating current state: %v", err)
+			return &event.ErrPermanent{Err: fmt.Errorf("error validating current state: %v", err)}
 		}
 
-		lastState, err := manager.FetchCurrentState(ctx, state.DeviceID)
+		// Devices of other homes are rejected before anything about them is
+		// tracked or reported
+		err = manager.ClaimDevice(ctx, h.ID, state.DeviceID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				return &event.ErrPermanent{Err: fmt.Errorf("error claiming device: %v", err)}
+			default:
+				return &event.ErrTransient{Err: fmt.Errorf("error claiming device: %v", err)}
+			}
+		}
+
+		skew := state.Timestamp.Sub(receivedAt)
+		metrics.SetThermostatClockSkew(h.ID, state.DeviceID, skew)
+
+		err = policy.Check(skew)
+		if err != nil {
+			if !policy.SubstituteReceiveTime {
+				return &event.ErrPermanent{Err: fmt.Errorf("error validating current state timestamp: %v", err)}
+			}
+
+			slog.Warn(fmt.Sprintf("Substituting receive time for current state timestamp of device %s: %v", state.DeviceID, err))
+			state.Timestamp = receivedAt
+		}
+
+		lastState, err := manager.FetchCurrentState(ctx, h.ID, state.DeviceID)
 		if err != nil {
 			// Failed to fetch last known state, ignore
+		} else if lastState.Timestamp.After(receivedAt.Add(policy.MaxAhead)) {
+			// Last known state was stored with a bad timestamp before the policy
+			// was in place, don't let it shadow valid readings
 		} else if state.Timestamp.Before(lastState.Timestamp) {
 			return fmt.Errorf("current state is older than the last known state for device %s", state.DeviceID)
 		}
 
-		updatedState, err := manager.UpdateCurrentState(ctx, &state)
+		// Tracked before the state is stored, so that a retry after a failed
+		// update tracks the change again. Tracking is idempotent, and the short
+		// cycle alert is only published once the state is stored
+		var shortCycle *alert.Alert
+		if lastState == nil || lastState.OperatingState != state.OperatingState {
+			shortCycle, err = trackOperatingState(ctx, manager, cycles, state, receivedAt)
+			if err != nil {
+				return &event.ErrTransient{Err: fmt.Errorf("error tracking operating state: %v", err)}
+			}
+		}
+
+		updatedState, err := manager.UpdateCurrentState(ctx, h.ID, state)
 		if err != nil {
-			return fmt.Errorf("error updating current state: %v", err)
+			switch err.(type) {
+			case *client.ErrNotFound:
+				return &event.ErrPermanent{Err: fmt.Errorf("error updating current state: %v", err)}
+			default:
+				return &event.ErrTransient{Err: fmt.Errorf("error updating current state: %v", err)}
+			}
 		}
 
-		metrics.SetThermostatOperatingState(updatedState.DeviceID, updatedState.OperatingState)
-		metrics.SetThermostatCurrentTemperature(updatedState.DeviceID, updatedState.CurrentTemperature)
+		if shortCycle != nil {
+			metrics.AddThermostatShortCycle(h.ID, shortCycle.DeviceID)
+			slog.Warn(shortCycle.Message)
+
+			err := alerts.PublishAlert(ctx, shortCycle)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error publishing short cycle alert for device %s: %v", shortCycle.DeviceID, err))
+			}
+		}
+
+		// Target state is sent back in the version and encoding the device
+		// reports in
+		err = manager.UpdateSchemaVersion(ctx, state.DeviceID, version)
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error updating schema version: %v", err)}
+		}
+
+		err = manager.UpdateContentType(ctx, state.DeviceID, c.ContentType())
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error updating content type: %v", err)}
+		}
+
+		err = evaluateSafety(ctx, manager, alerts, safety, h.ID, updatedState, receivedAt)
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error evaluating safety: %v", err)}
+		}
+
+		metrics.AddPayloadSchemaVersion("current-state", version)
+
+		metrics.SetThermostatOperatingState(h.ID, updatedState.DeviceID, updatedState.OperatingState)
+		metrics.SetThermostatCurrentTemperature(h.ID, updatedState.DeviceID, updatedState.CurrentTemperature)
 		if updatedState.CurrentHumidity != nil {
-			metrics.SetThermostatCurrentHumidity(updatedState.DeviceID, *updatedState.CurrentHumidity)
+			metrics.SetThermostatCurrentHumidity(h.ID, updatedState.DeviceID, *updatedState.CurrentHumidity)
+		}
+
+		// Rules are evaluated on a timer as well, a failed evaluation only
+		// delays the alert
+		err = evaluator.EvaluateAlerts(ctx, updatedState.DeviceID)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error evaluating alert rules for device %s: %v", updatedState.DeviceID, err))
 		}
 
 		return nil
 	}
 }
+
+// trackOperatingState records the operating state change in the history of the
+// device, and returns a short cycle alert if the device started again too soon.
+func trackOperatingState(ctx context.Context, manager CurrentStateManager, policy CyclePolicy, state *thermostat.CurrentState, receivedAt time.Time) (*alert.Alert, error) {
+	var shortCycle *alert.Alert
+
+	if state.OperatingState.Active() {
+		lastStart, err := manager.FetchLastCycleStart(ctx, state.DeviceID, state.Timestamp)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				// First cycle of the device
+			default:
+				return nil, fmt.Errorf("error fetching last cycle start: %v", err)
+			}
+		}
+
+		if lastStart != nil {
+			settings, err := manager.FetchControlSettings(ctx, state.DeviceID)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching control settings: %v", err)
+			}
+
+			minCycleTime := settings.MinCycleTime(policy.MinCycleTime)
+			cycleTime := state.Timestamp.Sub(lastStart.ChangedAt)
+			if cycleTime < minCycleTime {
+				shortCycle = &alert.Alert{
+					Type:     alert.ShortCycleAlert,
+					DeviceID: state.DeviceID,
+					Message:  fmt.Sprintf("Device %s started %s after the previous start, minimum cycle time is %s", state.DeviceID, cycleTime, minCycleTime),
+					RaisedAt: receivedAt,
+				}
+			}
+		}
+	}
+
+	err := manager.AddOperatingStateChange(ctx, &thermostat.OperatingStateChange{
+		DeviceID:       state.DeviceID,
+		OperatingState: state.OperatingState,
+		ChangedAt:      state.Timestamp,
+	}, receivedAt.Add(-policy.HistoryRetention))
+	if err != nil {
+		return nil, fmt.Errorf("error adding operating state change: %v", err)
+	}
+
+	return shortCycle, nil
+}
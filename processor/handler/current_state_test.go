@@ -7,16 +7,53 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
 )
 
 type fakeCurrentStateManager struct {
-	States map[string]thermostat.CurrentState
+	States       map[string]thermostat.CurrentState
+	Versions     map[string]thermostat.SchemaVersion
+	ContentTypes map[string]string
+	Changes      map[string][]thermostat.OperatingStateChange
+	Settings     map[string]control.Settings
+	TargetStates map[string]thermostat.TargetState
+	Limits       map[string]safety.Limits
+	Events       []safety.Event
+	// Homes are keyed by topic prefix, the default home is always there
+	Homes       map[string]home.Home
+	DeviceHomes map[string]string
+	// FailedUpdates is how many times UpdateCurrentState fails before it
+	// succeeds
+	FailedUpdates int
 
 	shouldFail bool
 }
 
-func (f *fakeCurrentStateManager) FetchCurrentState(ctx context.Context, deviceID string) (*thermostat.CurrentState, error) {
+func (f *fakeCurrentStateManager) FetchHomeByTopicPrefix(ctx context.Context, prefix string) (*home.Home, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if prefix == "" {
+		return &home.Home{ID: home.DefaultID}, nil
+	}
+
+	h, exists := f.Homes[prefix]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("home with topic prefix %s not found", prefix)}
+	}
+
+	return &h, nil
+}
+
+func (f *fakeCurrentStateManager) FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error) {
 	if f.shouldFail {
 		return nil, errors.New("test error")
 	}
@@ -29,11 +66,46 @@ func (f *fakeCurrentStateManager) FetchCurrentState(ctx context.Context, deviceI
 	return &state, nil
 }
 
-func (f *fakeCurrentStateManager) UpdateCurrentState(ctx context.Context, state *thermostat.CurrentState) (*thermostat.CurrentState, error) {
+func (f *fakeCurrentStateManager) ClaimDevice(ctx context.Context, homeID, deviceID string) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.DeviceHomes == nil {
+		f.DeviceHomes = map[string]string{}
+	}
+
+	deviceHomeID, exists := f.DeviceHomes[deviceID]
+	if !exists {
+		f.DeviceHomes[deviceID] = homeID
+	} else if deviceHomeID != homeID {
+		return &client.ErrNotFound{Err: fmt.Errorf("device %s not found in home %s", deviceID, homeID)}
+	}
+
+	return nil
+}
+
+func (f *fakeCurrentStateManager) UpdateCurrentState(ctx context.Context, homeID string, state *thermostat.CurrentState) (*thermostat.CurrentState, error) {
 	if f.shouldFail {
 		return nil, errors.New("test error")
 	}
 
+	if f.FailedUpdates > 0 {
+		f.FailedUpdates--
+		return nil, errors.New("test error")
+	}
+
+	if f.DeviceHomes == nil {
+		f.DeviceHomes = map[string]string{}
+	}
+
+	deviceHomeID, exists := f.DeviceHomes[state.DeviceID]
+	if !exists {
+		f.DeviceHomes[state.DeviceID] = homeID
+	} else if deviceHomeID != homeID {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("device %s not found in home %s", state.DeviceID, homeID)}
+	}
+
 	if state != nil {
 		f.States[state.DeviceID] = *state
 	}
@@ -41,6 +113,201 @@ func (f *fakeCurrentStateManager) UpdateCurrentState(ctx context.Context, state
 	return state, nil
 }
 
+func (f *fakeCurrentStateManager) UpdateSchemaVersion(ctx context.Context, deviceID string, version thermostat.SchemaVersion) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.Versions == nil {
+		f.Versions = make(map[string]thermostat.SchemaVersion)
+	}
+	f.Versions[deviceID] = version
+
+	return nil
+}
+
+func (f *fakeCurrentStateManager) UpdateContentType(ctx context.Context, deviceID string, contentType string) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.ContentTypes == nil {
+		f.ContentTypes = make(map[string]string)
+	}
+	f.ContentTypes[deviceID] = contentType
+
+	return nil
+}
+
+func (f *fakeCurrentStateManager) FetchControlSettings(ctx context.Context, deviceID string) (*control.Settings, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	settings, exists := f.Settings[deviceID]
+	if !exists {
+		return &control.Settings{DeviceID: deviceID, ControlledBy: control.DeviceControlled}, nil
+	}
+
+	return &settings, nil
+}
+
+func (f *fakeCurrentStateManager) FetchLastCycleStart(ctx context.Context, deviceID string, before time.Time) (*thermostat.OperatingStateChange, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var lastStart *thermostat.OperatingStateChange
+	for _, change := range f.Changes[deviceID] {
+		if change.OperatingState.Active() && change.ChangedAt.Before(before) {
+			if lastStart == nil || change.ChangedAt.After(lastStart.ChangedAt) {
+				lastStart = &change
+			}
+		}
+	}
+
+	if lastStart == nil {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("no cycle start for device %s", deviceID)}
+	}
+
+	return lastStart, nil
+}
+
+func (f *fakeCurrentStateManager) AddOperatingStateChange(ctx context.Context, change *thermostat.OperatingStateChange, expiredBefore time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.Changes == nil {
+		f.Changes = make(map[string][]thermostat.OperatingStateChange)
+	}
+
+	for _, existing := range f.Changes[change.DeviceID] {
+		if existing.ChangedAt.Equal(change.ChangedAt) {
+			return nil
+		}
+	}
+
+	f.Changes[change.DeviceID] = append(f.Changes[change.DeviceID], *change)
+
+	return nil
+}
+
+func (f *fakeCurrentStateManager) FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state, exists := f.TargetStates[deviceID]
+	if !exists {
+		return &thermostat.TargetState{DeviceID: deviceID}, nil
+	}
+
+	return &state, nil
+}
+
+func (f *fakeCurrentStateManager) FetchSafetyLimits(ctx context.Context, deviceID string) (*safety.Limits, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	limits, exists := f.Limits[deviceID]
+	if !exists {
+		return &safety.Limits{DeviceID: deviceID}, nil
+	}
+
+	return &limits, nil
+}
+
+func (f *fakeCurrentStateManager) FetchActiveSafetyEvent(ctx context.Context, deviceID string) (*safety.Event, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	for _, e := range f.Events {
+		if e.DeviceID == deviceID && e.ClearedAt == nil {
+			return &e, nil
+		}
+	}
+
+	return nil, &client.ErrNotFound{Err: fmt.Errorf("no active safety event for device %s", deviceID)}
+}
+
+func (f *fakeCurrentStateManager) TriggerSafetyEvent(ctx context.Context, e *safety.Event, protective *thermostat.TargetState) (*safety.Event, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	triggered := *e
+	triggered.ID = int64(len(f.Events) + 1)
+	f.Events = append(f.Events, triggered)
+
+	if f.TargetStates == nil {
+		f.TargetStates = make(map[string]thermostat.TargetState)
+	}
+	f.TargetStates[e.DeviceID] = *protective
+
+	return &triggered, nil
+}
+
+func (f *fakeCurrentStateManager) ClearSafetyEvent(ctx context.Context, e *safety.Event, clearedAt time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	for i := range f.Events {
+		if f.Events[i].ID == e.ID {
+			f.Events[i].ClearedAt = &clearedAt
+		}
+	}
+
+	f.TargetStates[e.DeviceID] = thermostat.TargetState{
+		DeviceID:          e.DeviceID,
+		Mode:              e.PreviousMode,
+		TargetTemperature: e.PreviousTargetTemperature,
+	}
+
+	return nil
+}
+
+type fakeAlertPublisher struct {
+	Alerts []alert.Alert
+
+	shouldFail bool
+}
+
+func (f *fakeAlertPublisher) PublishAlert(ctx context.Context, a *alert.Alert) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Alerts = append(f.Alerts, *a)
+
+	return nil
+}
+
+type fakeAlertEvaluator struct {
+	DeviceIDs []string
+
+	shouldFail bool
+}
+
+func (f *fakeAlertEvaluator) EvaluateAlerts(ctx context.Context, deviceID string) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.DeviceIDs = append(f.DeviceIDs, deviceID)
+
+	return nil
+}
+
+var testCyclePolicy = CyclePolicy{MinCycleTime: 10 * time.Minute, HistoryRetention: 24 * time.Hour}
+
+var testSafetyPolicy = SafetyPolicy{FloorTemperature: 5, CeilingTemperature: 35, Margin: 2}
+
+var testTimestampPolicy = thermostat.TimestampPolicy{MaxAge: time.Hour, MaxAhead: time.Minute}
+
 func TestCurrentState(t *testing.T) {
 	now := time.Now()
 	initialCurrentHumidity := 43.3
@@ -265,7 +532,7 @@ func TestCurrentState(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			handler := CurrentState(tt.args.manager)
+			handler := CurrentState(tt.args.manager, &fakeAlertPublisher{}, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)
 			err := handler(context.Background(), tt.args.payload)
 
 			// Check expected error
@@ -313,3 +580,624 @@ func ptrEqual[T comparable](a, b *T) bool {
 	}
 	return *a == *b
 }
+
+func TestCurrentStateSchemaVersion(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name        string
+		payload     string
+		wantErr     bool
+		wantVersion thermostat.SchemaVersion
+		wantState   thermostat.CurrentState
+	}{
+		{
+			name: "should decode unversioned payload as v1",
+			payload: fmt.Sprintf(`{
+				"deviceId": "test_device_id",
+				"timestamp": "%s",
+				"operatingState": "HEATING",
+				"currentTemperature": 18.8
+			}`, now.Format(time.RFC3339Nano)),
+			wantErr:     false,
+			wantVersion: thermostat.SchemaV1,
+			wantState: thermostat.CurrentState{
+				DeviceID:           "test_device_id",
+				Timestamp:          now,
+				OperatingState:     thermostat.HeatingOperatingState,
+				CurrentTemperature: 18.8,
+			},
+		},
+		{
+			name: "should decode v2 payload",
+			payload: fmt.Sprintf(`{
+				"schemaVersion": 2,
+				"deviceId": "test_device_id",
+				"ts": %d,
+				"state": "COOLING",
+				"temp": 24.1
+			}`, now.Unix()),
+			wantErr:     false,
+			wantVersion: thermostat.SchemaV2,
+			wantState: thermostat.CurrentState{
+				DeviceID:           "test_device_id",
+				Timestamp:          now,
+				OperatingState:     thermostat.CoolingOperatingState,
+				CurrentTemperature: 24.1,
+			},
+		},
+		{
+			name:    "should error if schema version is unsupported",
+			payload: `{"schemaVersion": 99, "deviceId": "test_device_id"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{States: map[string]thermostat.CurrentState{}}
+
+			err := CurrentState(manager, &fakeAlertPublisher{}, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)(context.Background(), []byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CurrentState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if len(manager.Versions) != 0 {
+					t.Errorf("CurrentState() manager.Versions = %v, want none", manager.Versions)
+				}
+				return
+			}
+
+			if manager.Versions["test_device_id"] != tt.wantVersion {
+				t.Errorf("CurrentState() manager.Versions[test_device_id] = %d, want %d", manager.Versions["test_device_id"], tt.wantVersion)
+			}
+
+			state := manager.States["test_device_id"]
+			if !state.Timestamp.Equal(tt.wantState.Timestamp) {
+				t.Errorf("CurrentState() Timestamp = %v, want %v", state.Timestamp, tt.wantState.Timestamp)
+			}
+
+			if state.OperatingState != tt.wantState.OperatingState {
+				t.Errorf("CurrentState() OperatingState = %v, want %v", state.OperatingState, tt.wantState.OperatingState)
+			}
+
+			if state.CurrentTemperature != tt.wantState.CurrentTemperature {
+				t.Errorf("CurrentState() CurrentTemperature = %v, want %v", state.CurrentTemperature, tt.wantState.CurrentTemperature)
+			}
+		})
+	}
+}
+
+func TestCurrentStateContentType(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	cborPayload, err := codec.CBOR.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"deviceId":      "test_device_id",
+		"ts":            now.Unix(),
+		"state":         "HEATING",
+		"temp":          19.5,
+	})
+	if err != nil {
+		t.Fatalf("Error marshalling CBOR payload: %v", err)
+	}
+
+	jsonPayload := fmt.Sprintf(`{"schemaVersion":2,"deviceId":"test_device_id","ts":%d,"state":"HEATING","temp":19.5}`, now.Unix())
+
+	tests := []struct {
+		name            string
+		contentType     string
+		payload         []byte
+		wantErr         bool
+		wantContentType string
+	}{
+		{
+			name:            "should decode JSON payload without content type",
+			contentType:     "",
+			payload:         []byte(jsonPayload),
+			wantErr:         false,
+			wantContentType: codec.JSONContentType,
+		},
+		{
+			name:            "should decode CBOR payload",
+			contentType:     codec.CBORContentType,
+			payload:         cborPayload,
+			wantErr:         false,
+			wantContentType: codec.CBORContentType,
+		},
+		{
+			name:        "should error if content type is unsupported",
+			contentType: "application/x-protobuf",
+			payload:     cborPayload,
+			wantErr:     true,
+		},
+		{
+			name:        "should error if payload doesn't match content type",
+			contentType: codec.JSONContentType,
+			payload:     cborPayload,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{States: map[string]thermostat.CurrentState{}}
+			ctx := event.WithMetadata(context.Background(), &event.Metadata{ContentType: tt.contentType})
+
+			err := CurrentState(manager, &fakeAlertPublisher{}, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)(ctx, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CurrentState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if manager.ContentTypes["test_device_id"] != tt.wantContentType {
+				t.Errorf("CurrentState() manager.ContentTypes[test_device_id] = %v, want %v", manager.ContentTypes["test_device_id"], tt.wantContentType)
+			}
+
+			state := manager.States["test_device_id"]
+			if state.OperatingState != thermostat.HeatingOperatingState || state.CurrentTemperature != 19.5 {
+				t.Errorf("CurrentState() manager.States[test_device_id] = %+v, want heating at 19.5", state)
+			}
+		})
+	}
+}
+
+func TestCurrentStateHome(t *testing.T) {
+	payload := []byte(fmt.Sprintf(`{"deviceId":"test_device_id","timestamp":"%s","operatingState":"IDLE","currentTemperature":19.5}`, time.Now().Format(time.RFC3339Nano)))
+
+	tests := []struct {
+		name        string
+		topic       string
+		deviceHomes map[string]string
+		wantErr     bool
+		wantHomeID  string
+	}{
+		{
+			name:       "should store state in default home",
+			topic:      CurrentStateTopic,
+			wantErr:    false,
+			wantHomeID: home.DefaultID,
+		},
+		{
+			name:       "should store state in home of topic prefix",
+			topic:      "smiths/" + CurrentStateTopic,
+			wantErr:    false,
+			wantHomeID: "smiths",
+		},
+		{
+			name:    "should error if no home has topic prefix",
+			topic:   "joneses/" + CurrentStateTopic,
+			wantErr: true,
+		},
+		{
+			name:        "should error if device belongs to another home",
+			topic:       "smiths/" + CurrentStateTopic,
+			deviceHomes: map[string]string{"test_device_id": home.DefaultID},
+			wantErr:     true,
+			wantHomeID:  home.DefaultID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{
+				States:      map[string]thermostat.CurrentState{},
+				Homes:       map[string]home.Home{"smiths": {ID: "smiths", TopicPrefix: "smiths"}},
+				DeviceHomes: tt.deviceHomes,
+			}
+			ctx := event.WithMetadata(context.Background(), &event.Metadata{Topic: tt.topic})
+
+			err := CurrentState(manager, &fakeAlertPublisher{}, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)(ctx, payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CurrentState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if _, ok := err.(*event.ErrPermanent); !ok {
+					t.Errorf("CurrentState() error = %T, want ErrPermanent", err)
+				}
+
+				if len(manager.Changes["test_device_id"]) != 0 {
+					t.Errorf("CurrentState() tracked %d operating state changes of rejected device, want 0", len(manager.Changes["test_device_id"]))
+				}
+			}
+
+			if manager.DeviceHomes["test_device_id"] != tt.wantHomeID {
+				t.Errorf("CurrentState() home of test_device_id = %s, want %s", manager.DeviceHomes["test_device_id"], tt.wantHomeID)
+			}
+		})
+	}
+}
+
+func TestCurrentStateTimestampPolicy(t *testing.T) {
+	receivedAt := time.Now().Truncate(time.Second)
+	futureTimestamp := receivedAt.Add(365 * 24 * time.Hour)
+
+	payload := func(timestamp time.Time) []byte {
+		return []byte(fmt.Sprintf(`{
+			"deviceId": "test_device_id",
+			"timestamp": "%s",
+			"operatingState": "IDLE",
+			"currentTemperature": 20.5
+		}`, timestamp.Format(time.RFC3339Nano)))
+	}
+
+	tests := []struct {
+		name          string
+		policy        thermostat.TimestampPolicy
+		lastTimestamp *time.Time
+		timestamp     time.Time
+		wantErr       bool
+		wantTimestamp time.Time
+	}{
+		{
+			name:          "should accept timestamp within tolerances",
+			policy:        testTimestampPolicy,
+			timestamp:     receivedAt.Add(30 * time.Second),
+			wantErr:       false,
+			wantTimestamp: receivedAt.Add(30 * time.Second),
+		},
+		{
+			name:      "should reject timestamp too far in the past",
+			policy:    testTimestampPolicy,
+			timestamp: receivedAt.Add(-2 * time.Hour),
+			wantErr:   true,
+		},
+		{
+			name:      "should reject timestamp too far in the future",
+			policy:    testTimestampPolicy,
+			timestamp: receivedAt.Add(24 * time.Hour),
+			wantErr:   true,
+		},
+		{
+			name:          "should substitute receive time for timestamp too far in the future",
+			policy:        thermostat.TimestampPolicy{MaxAge: time.Hour, MaxAhead: time.Minute, SubstituteReceiveTime: true},
+			timestamp:     receivedAt.Add(24 * time.Hour),
+			wantErr:       false,
+			wantTimestamp: receivedAt,
+		},
+		{
+			name:          "should not let last state with future timestamp shadow new readings",
+			policy:        testTimestampPolicy,
+			lastTimestamp: &futureTimestamp,
+			timestamp:     receivedAt,
+			wantErr:       false,
+			wantTimestamp: receivedAt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{States: map[string]thermostat.CurrentState{}}
+			if tt.lastTimestamp != nil {
+				manager.States["test_device_id"] = thermostat.CurrentState{
+					DeviceID:       "test_device_id",
+					Timestamp:      *tt.lastTimestamp,
+					OperatingState: thermostat.IdleOperatingState,
+				}
+			}
+
+			ctx := event.WithMetadata(context.Background(), &event.Metadata{ReceivedAt: receivedAt})
+
+			err := CurrentState(manager, &fakeAlertPublisher{}, &fakeAlertEvaluator{}, tt.policy, testCyclePolicy, testSafetyPolicy)(ctx, payload(tt.timestamp))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CurrentState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			state := manager.States["test_device_id"]
+			if !state.Timestamp.Equal(tt.wantTimestamp) {
+				t.Errorf("CurrentState() Timestamp = %v, want %v", state.Timestamp, tt.wantTimestamp)
+			}
+		})
+	}
+}
+
+func TestCurrentStateShortCycle(t *testing.T) {
+	now := time.Now()
+	minCycleSeconds := 60
+
+	payload := func(operatingState thermostat.OperatingState, timestamp time.Time) []byte {
+		return []byte(fmt.Sprintf(`{
+			"deviceId": "test_device_id",
+			"timestamp": "%s",
+			"operatingState": "%s",
+			"currentTemperature": 19.5
+		}`, timestamp.Format(time.RFC3339Nano), operatingState))
+	}
+
+	tests := []struct {
+		name        string
+		settings    map[string]control.Settings
+		states      []thermostat.OperatingState
+		interval    time.Duration
+		wantChanges int
+		wantAlerts  int
+	}{
+		{
+			name:        "should alert when equipment starts again too soon",
+			states:      []thermostat.OperatingState{thermostat.HeatingOperatingState, thermostat.IdleOperatingState, thermostat.HeatingOperatingState},
+			interval:    2 * time.Minute,
+			wantChanges: 3,
+			wantAlerts:  1,
+		},
+		{
+			name:        "should not alert when equipment cycles slowly",
+			states:      []thermostat.OperatingState{thermostat.HeatingOperatingState, thermostat.IdleOperatingState, thermostat.HeatingOperatingState},
+			interval:    6 * time.Minute,
+			wantChanges: 3,
+			wantAlerts:  0,
+		},
+		{
+			name: "should use minimum cycle time of the device",
+			settings: map[string]control.Settings{
+				"test_device_id": {DeviceID: "test_device_id", ControlledBy: control.DeviceControlled, MinCycleSeconds: &minCycleSeconds},
+			},
+			states:      []thermostat.OperatingState{thermostat.HeatingOperatingState, thermostat.IdleOperatingState, thermostat.HeatingOperatingState},
+			interval:    2 * time.Minute,
+			wantChanges: 3,
+			wantAlerts:  0,
+		},
+		{
+			name:        "should only track changes of operating state",
+			states:      []thermostat.OperatingState{thermostat.HeatingOperatingState, thermostat.HeatingOperatingState, thermostat.HeatingOperatingState},
+			interval:    time.Minute,
+			wantChanges: 1,
+			wantAlerts:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{
+				States:   map[string]thermostat.CurrentState{},
+				Settings: tt.settings,
+			}
+			alerts := &fakeAlertPublisher{}
+			handler := CurrentState(manager, alerts, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)
+
+			start := now.Add(-time.Duration(len(tt.states)) * tt.interval)
+			for i, state := range tt.states {
+				timestamp := start.Add(time.Duration(i) * tt.interval)
+				ctx := event.WithMetadata(context.Background(), &event.Metadata{ReceivedAt: timestamp})
+
+				err := handler(ctx, payload(state, timestamp))
+				if err != nil {
+					t.Fatalf("CurrentState() error = %v", err)
+				}
+			}
+
+			if len(manager.Changes["test_device_id"]) != tt.wantChanges {
+				t.Errorf("CurrentState() tracked %d operating state changes, want %d", len(manager.Changes["test_device_id"]), tt.wantChanges)
+			}
+
+			if len(alerts.Alerts) != tt.wantAlerts {
+				t.Errorf("CurrentState() raised %d alerts, want %d", len(alerts.Alerts), tt.wantAlerts)
+			}
+
+			for _, a := range alerts.Alerts {
+				if a.Type != alert.ShortCycleAlert || a.DeviceID != "test_device_id" {
+					t.Errorf("CurrentState() raised alert %+v, want %s for test_device_id", a, alert.ShortCycleAlert)
+				}
+			}
+		})
+	}
+}
+
+func TestCurrentStateShortCycleRetry(t *testing.T) {
+	now := time.Now()
+
+	manager := &fakeCurrentStateManager{
+		States: map[string]thermostat.CurrentState{},
+	}
+	alerts := &fakeAlertPublisher{}
+	handler := CurrentState(manager, alerts, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)
+
+	states := []thermostat.OperatingState{thermostat.HeatingOperatingState, thermostat.IdleOperatingState, thermostat.HeatingOperatingState}
+	for i, state := range states {
+		timestamp := now.Add(time.Duration(i-len(states)) * time.Minute)
+		ctx := event.WithMetadata(context.Background(), &event.Metadata{ReceivedAt: timestamp})
+		payload := []byte(fmt.Sprintf(`{
+			"deviceId": "test_device_id",
+			"timestamp": "%s",
+			"operatingState": "%s",
+			"currentTemperature": 19.5
+		}`, timestamp.Format(time.RFC3339Nano), state))
+
+		// The last start fails to be stored twice, and is retried
+		if i == len(states)-1 {
+			manager.FailedUpdates = 2
+		}
+
+		var err error
+		for range 3 {
+			err = handler(ctx, payload)
+			if err == nil {
+				break
+			}
+
+			if _, ok := err.(*event.ErrTransient); !ok {
+				t.Fatalf("CurrentState() error = %v, want transient error", err)
+			}
+		}
+		if err != nil {
+			t.Fatalf("CurrentState() error after retries = %v", err)
+		}
+	}
+
+	if len(manager.Changes["test_device_id"]) != len(states) {
+		t.Errorf("CurrentState() tracked %d operating state changes, want %d", len(manager.Changes["test_device_id"]), len(states))
+	}
+
+	if len(alerts.Alerts) != 1 {
+		t.Errorf("CurrentState() raised %d alerts, want 1", len(alerts.Alerts))
+	}
+}
+
+func TestCurrentStateSafety(t *testing.T) {
+	now := time.Now()
+	offMode := thermostat.OffMode
+	heatMode := thermostat.HeatMode
+	coolMode := thermostat.CoolMode
+	targetTemperature := 21
+	floorTemperature := 10.0
+	freezeTemperature, overheatTemperature, floorFreezeTemperature := 7, 30, 12
+
+	payload := func(temperature float64, timestamp time.Time) []byte {
+		return []byte(fmt.Sprintf(`{
+			"deviceId": "test_device_id",
+			"timestamp": "%s",
+			"operatingState": "IDLE",
+			"currentTemperature": %.2f
+		}`, timestamp.Format(time.RFC3339Nano), temperature))
+	}
+
+	tests := []struct {
+		name            string
+		limits          map[string]safety.Limits
+		temperatures    []float64
+		wantEvents      int
+		wantActive      bool
+		wantTargetState thermostat.TargetState
+		wantAlerts      []alert.Type
+	}{
+		{
+			name:            "should leave target state alone within limits",
+			temperatures:    []float64{18, 30},
+			wantEvents:      0,
+			wantTargetState: thermostat.TargetState{Mode: &offMode, TargetTemperature: &targetTemperature},
+		},
+		{
+			name:            "should heat when temperature drops below floor",
+			temperatures:    []float64{4},
+			wantEvents:      1,
+			wantActive:      true,
+			wantTargetState: thermostat.TargetState{Mode: &heatMode, TargetTemperature: &freezeTemperature},
+			wantAlerts:      []alert.Type{alert.FreezeAlert},
+		},
+		{
+			name:            "should cool when temperature rises above ceiling",
+			temperatures:    []float64{36.5},
+			wantEvents:      1,
+			wantActive:      true,
+			wantTargetState: thermostat.TargetState{Mode: &coolMode, TargetTemperature: &overheatTemperature},
+			wantAlerts:      []alert.Type{alert.OverheatAlert},
+		},
+		{
+			name:            "should hold protective state until its target is reached",
+			temperatures:    []float64{4, 5.5, 6.9},
+			wantEvents:      1,
+			wantActive:      true,
+			wantTargetState: thermostat.TargetState{Mode: &heatMode, TargetTemperature: &freezeTemperature},
+			wantAlerts:      []alert.Type{alert.FreezeAlert},
+		},
+		{
+			name:            "should restore previous target state once protective target is reached",
+			temperatures:    []float64{4, 7},
+			wantEvents:      1,
+			wantActive:      false,
+			wantTargetState: thermostat.TargetState{Mode: &offMode, TargetTemperature: &targetTemperature},
+			wantAlerts:      []alert.Type{alert.FreezeAlert},
+		},
+		{
+			name: "should use floor temperature of the device",
+			limits: map[string]safety.Limits{
+				"test_device_id": {DeviceID: "test_device_id", FloorTemperature: &floorTemperature},
+			},
+			temperatures:    []float64{9},
+			wantEvents:      1,
+			wantActive:      true,
+			wantTargetState: thermostat.TargetState{Mode: &heatMode, TargetTemperature: &floorFreezeTemperature},
+			wantAlerts:      []alert.Type{alert.FreezeAlert},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{
+				States: map[string]thermostat.CurrentState{},
+				TargetStates: map[string]thermostat.TargetState{
+					"test_device_id": {DeviceID: "test_device_id", Mode: &offMode, TargetTemperature: &targetTemperature},
+				},
+				Limits: tt.limits,
+			}
+			alerts := &fakeAlertPublisher{}
+			handler := CurrentState(manager, alerts, &fakeAlertEvaluator{}, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)
+
+			start := now.Add(-time.Duration(len(tt.temperatures)) * time.Minute)
+			for i, temperature := range tt.temperatures {
+				timestamp := start.Add(time.Duration(i) * time.Minute)
+				ctx := event.WithMetadata(context.Background(), &event.Metadata{ReceivedAt: timestamp})
+
+				err := handler(ctx, payload(temperature, timestamp))
+				if err != nil {
+					t.Fatalf("CurrentState() error = %v", err)
+				}
+			}
+
+			if len(manager.Events) != tt.wantEvents {
+				t.Errorf("CurrentState() recorded %d safety events, want %d", len(manager.Events), tt.wantEvents)
+			}
+
+			_, err := manager.FetchActiveSafetyEvent(context.Background(), "test_device_id")
+			if active := err == nil; active != tt.wantActive {
+				t.Errorf("CurrentState() safety event active = %v, want %v", active, tt.wantActive)
+			}
+
+			state := manager.TargetStates["test_device_id"]
+			if !ptrEqual(state.Mode, tt.wantTargetState.Mode) || !ptrEqual(state.TargetTemperature, tt.wantTargetState.TargetTemperature) {
+				t.Errorf("CurrentState() target state = %v/%v, want %v/%v", *state.Mode, *state.TargetTemperature, *tt.wantTargetState.Mode, *tt.wantTargetState.TargetTemperature)
+			}
+
+			if len(alerts.Alerts) != len(tt.wantAlerts) {
+				t.Fatalf("CurrentState() raised %d alerts, want %d", len(alerts.Alerts), len(tt.wantAlerts))
+			}
+
+			for i, a := range alerts.Alerts {
+				if a.Type != tt.wantAlerts[i] {
+					t.Errorf("CurrentState() raised alert %s, want %s", a.Type, tt.wantAlerts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCurrentStateEvaluatesAlerts(t *testing.T) {
+	payload := []byte(fmt.Sprintf(`{
+		"deviceId": "test_device_id",
+		"timestamp": "%s",
+		"operatingState": "IDLE",
+		"currentTemperature": 19.5
+	}`, time.Now().Format(time.RFC3339Nano)))
+
+	tests := []struct {
+		name          string
+		evaluator     *fakeAlertEvaluator
+		wantDeviceIDs []string
+	}{
+		{
+			name:          "should evaluate alert rules of the device",
+			evaluator:     &fakeAlertEvaluator{},
+			wantDeviceIDs: []string{"test_device_id"},
+		},
+		{
+			name:      "should not fail, if evaluation fails",
+			evaluator: &fakeAlertEvaluator{shouldFail: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fakeCurrentStateManager{States: map[string]thermostat.CurrentState{}}
+
+			err := CurrentState(manager, &fakeAlertPublisher{}, tt.evaluator, testTimestampPolicy, testCyclePolicy, testSafetyPolicy)(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("CurrentState() error = %v", err)
+			}
+
+			if len(tt.evaluator.DeviceIDs) != len(tt.wantDeviceIDs) || (len(tt.wantDeviceIDs) > 0 && tt.evaluator.DeviceIDs[0] != tt.wantDeviceIDs[0]) {
+				t.Errorf("CurrentState() evaluated alerts for %v, want %v", tt.evaluator.DeviceIDs, tt.wantDeviceIDs)
+			}
+		})
+	}
+}
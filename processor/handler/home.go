@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+// CurrentStateTopic is the topic devices report their current state to, after
+// the topic prefix of their home.
+const CurrentStateTopic = "thermostat/current-state"
+
+type HomeResolver interface {
+	FetchHomeByTopicPrefix(ctx context.Context, prefix string) (*home.Home, error)
+}
+
+// resolveHome returns the home a message was published in, by the prefix of
+// its topic. Payloads that didn't come from the broker belong to the default
+// home.
+func resolveHome(ctx context.Context, resolver HomeResolver, topic, deviceTopic string) (*home.Home, error) {
+	if topic == "" {
+		topic = deviceTopic
+	}
+
+	prefix, ok := home.SplitTopic(topic, deviceTopic)
+	if !ok {
+		return nil, &event.ErrPermanent{Err: fmt.Errorf("topic %s isn't a %s topic of any home", topic, deviceTopic)}
+	}
+
+	h, err := resolver.FetchHomeByTopicPrefix(ctx, prefix)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			return nil, &event.ErrPermanent{Err: fmt.Errorf("no home has topic prefix '%s'", prefix)}
+		default:
+			return nil, &event.ErrTransient{Err: fmt.Errorf("error fetching home: %v", err)}
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type OutdoorReadingAdder interface {
+	AddOutdoorReading(ctx context.Context, reading *outdoor.Reading, expiredBefore time.Time) error
+}
+
+// OutdoorReading appends readings of a weather station to the outdoor
+// temperature series. Readings older than retention are dropped from the
+// series.
+func OutdoorReading(adder OutdoorReadingAdder, retention time.Duration) event.Handler {
+	return func(ctx context.Context, payload []byte) error {
+		metadata := event.MetadataFromContext(ctx)
+
+		receivedAt := metadata.ReceivedAt
+		if receivedAt.IsZero() {
+			receivedAt = time.Now()
+		}
+
+		var reading outdoor.Reading
+		err := event.UnmarshalPayload(ctx, payload, &reading)
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error unmarshalling outdoor reading: %v", err)}
+		}
+
+		reading.Source = outdoor.StationSource
+
+		// Stations without a clock report readings as they take them
+		if reading.Timestamp.IsZero() {
+			reading.Timestamp = receivedAt
+		}
+
+		err = reading.Validate()
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error validating outdoor reading: %v", err)}
+		}
+
+		err = adder.AddOutdoorReading(ctx, &reading, receivedAt.Add(-retention))
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error adding outdoor reading: %v", err)}
+		}
+
+		metrics.SetOutdoorReading(reading.Temperature, reading.Humidity)
+
+		return nil
+	}
+}
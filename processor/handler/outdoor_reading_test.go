@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type fakeOutdoorReadingAdder struct {
+	Readings []outdoor.Reading
+
+	shouldFail bool
+}
+
+func (f *fakeOutdoorReadingAdder) AddOutdoorReading(ctx context.Context, reading *outdoor.Reading, expiredBefore time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Readings = append(f.Readings, *reading)
+
+	return nil
+}
+
+func TestOutdoorReading(t *testing.T) {
+	receivedAt := time.Now()
+
+	type args struct {
+		adder   *fakeOutdoorReadingAdder
+		payload []byte
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantErr       bool
+		wantPermanent bool
+		wantReading   *outdoor.Reading
+	}{
+		{
+			name: "should add outdoor reading",
+			args: args{
+				adder:   &fakeOutdoorReadingAdder{},
+				payload: []byte(`{"timestamp": "2024-06-07T12:00:00Z", "temperature": 12.5}`),
+			},
+			wantErr: false,
+			wantReading: &outdoor.Reading{
+				Timestamp:   time.Date(2024, 6, 7, 12, 0, 0, 0, time.UTC),
+				Temperature: 12.5,
+				Source:      outdoor.StationSource,
+			},
+		},
+		{
+			name: "should add outdoor reading at receive time, if timestamp is missing",
+			args: args{
+				adder:   &fakeOutdoorReadingAdder{},
+				payload: []byte(`{"temperature": 12.5}`),
+			},
+			wantErr: false,
+			wantReading: &outdoor.Reading{
+				Timestamp:   receivedAt,
+				Temperature: 12.5,
+				Source:      outdoor.StationSource,
+			},
+		},
+		{
+			name: "should return permanent error, if temperature is out of range",
+			args: args{
+				adder:   &fakeOutdoorReadingAdder{},
+				payload: []byte(`{"temperature": 120}`),
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "should return permanent error, if payload is invalid",
+			args: args{
+				adder:   &fakeOutdoorReadingAdder{},
+				payload: []byte(`{`),
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "should return transient error, if failed to add",
+			args: args{
+				adder:   &fakeOutdoorReadingAdder{shouldFail: true},
+				payload: []byte(`{"temperature": 12.5}`),
+			},
+			wantErr:       true,
+			wantPermanent: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := event.WithMetadata(context.Background(), &event.Metadata{
+				Topic:      "outdoor/reading",
+				ReceivedAt: receivedAt,
+			})
+
+			err := OutdoorReading(tt.args.adder, time.Hour)(ctx, tt.args.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OutdoorReading() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				var permanentErr *event.ErrPermanent
+				if errors.As(err, &permanentErr) != tt.wantPermanent {
+					t.Errorf("OutdoorReading() error = %v, want permanent %v", err, tt.wantPermanent)
+				}
+				return
+			}
+
+			if len(tt.args.adder.Readings) != 1 {
+				t.Fatalf("OutdoorReading() added %d readings, want %d", len(tt.args.adder.Readings), 1)
+			}
+
+			got := tt.args.adder.Readings[0]
+			if !got.Timestamp.Equal(tt.wantReading.Timestamp) || got.Temperature != tt.wantReading.Temperature || got.Source != tt.wantReading.Source {
+				t.Errorf("OutdoorReading() added reading = %+v, want %+v", got, *tt.wantReading)
+			}
+		})
+	}
+}
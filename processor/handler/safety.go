@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type SafetyManager interface {
+	FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error)
+	FetchSafetyLimits(ctx context.Context, deviceID string) (*safety.Limits, error)
+	FetchActiveSafetyEvent(ctx context.Context, deviceID string) (*safety.Event, error)
+	TriggerSafetyEvent(ctx context.Context, event *safety.Event, protective *thermostat.TargetState) (*safety.Event, error)
+	ClearSafetyEvent(ctx context.Context, event *safety.Event, clearedAt time.Time) error
+}
+
+// SafetyPolicy is how devices are protected from freezing and overheating.
+// FloorTemperature and CeilingTemperature can be overridden per device. While
+// protected, the device is held Margin degrees inside its limits.
+type SafetyPolicy struct {
+	FloorTemperature   float64
+	CeilingTemperature float64
+	Margin             float64
+}
+
+// evaluateSafety holds the device in a protective target state while its
+// temperature is past one of its limits, and restores its previous target
+// state once the protective target is reached.
+func evaluateSafety(ctx context.Context, manager SafetyManager, alerts AlertPublisher, policy SafetyPolicy, homeID string, state *thermostat.CurrentState, receivedAt time.Time) error {
+	active, err := manager.FetchActiveSafetyEvent(ctx, state.DeviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			// Device isn't held in a protective state
+		default:
+			return fmt.Errorf("error fetching active safety event: %v", err)
+		}
+	}
+
+	if active != nil {
+		protective := active.ProtectiveState(policy.Margin)
+		if !reachedTarget(active.Kind, state.CurrentTemperature, *protective.TargetTemperature) {
+			return nil
+		}
+
+		err := manager.ClearSafetyEvent(ctx, active, receivedAt)
+		if err != nil {
+			return fmt.Errorf("error clearing safety event: %v", err)
+		}
+
+		slog.Info(fmt.Sprintf("Device %s recovered from %s at %.2f, restoring previous target state", state.DeviceID, active.Kind, state.CurrentTemperature))
+
+		if active.PreviousMode != nil {
+			metrics.SetThermostatMode(homeID, state.DeviceID, *active.PreviousMode)
+		}
+		if active.PreviousTargetTemperature != nil {
+			metrics.SetThermostatTargetTemperature(homeID, state.DeviceID, *active.PreviousTargetTemperature)
+		}
+
+		return nil
+	}
+
+	limits, err := manager.FetchSafetyLimits(ctx, state.DeviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching safety limits: %v", err)
+	}
+
+	floor := policy.FloorTemperature
+	if limits.FloorTemperature != nil {
+		floor = *limits.FloorTemperature
+	}
+
+	ceiling := policy.CeilingTemperature
+	if limits.CeilingTemperature != nil {
+		ceiling = *limits.CeilingTemperature
+	}
+
+	var kind safety.Kind
+	var limit float64
+	switch {
+	case state.CurrentTemperature < floor:
+		kind, limit = safety.FreezeKind, floor
+	case state.CurrentTemperature > ceiling:
+		kind, limit = safety.OverheatKind, ceiling
+	default:
+		return nil
+	}
+
+	previous, err := manager.FetchTargetState(ctx, homeID, state.DeviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching target state: %v", err)
+	}
+
+	event := safety.Event{
+		DeviceID:                  state.DeviceID,
+		Kind:                      kind,
+		Temperature:               state.CurrentTemperature,
+		Limit:                     limit,
+		TriggeredAt:               receivedAt,
+		PreviousMode:              previous.Mode,
+		PreviousTargetTemperature: previous.TargetTemperature,
+	}
+	protective := event.ProtectiveState(policy.Margin)
+
+	_, err = manager.TriggerSafetyEvent(ctx, &event, protective)
+	if err != nil {
+		return fmt.Errorf("error triggering safety event: %v", err)
+	}
+
+	metrics.AddThermostatSafetyEvent(homeID, state.DeviceID, string(kind))
+	metrics.SetThermostatMode(homeID, state.DeviceID, *protective.Mode)
+	metrics.SetThermostatTargetTemperature(homeID, state.DeviceID, *protective.TargetTemperature)
+
+	a := alert.Alert{
+		DeviceID: state.DeviceID,
+		RaisedAt: receivedAt,
+	}
+	switch kind {
+	case safety.FreezeKind:
+		a.Type = alert.FreezeAlert
+		a.Message = fmt.Sprintf("Device %s is at %.2f, below its floor of %.2f, heating to %d", state.DeviceID, state.CurrentTemperature, limit, *protective.TargetTemperature)
+	case safety.OverheatKind:
+		a.Type = alert.OverheatAlert
+		a.Message = fmt.Sprintf("Device %s is at %.2f, above its ceiling of %.2f, cooling to %d", state.DeviceID, state.CurrentTemperature, limit, *protective.TargetTemperature)
+	}
+
+	slog.Warn(a.Message)
+
+	err = alerts.PublishAlert(ctx, &a)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error publishing %s alert for device %s: %v", kind, state.DeviceID, err))
+	}
+
+	return nil
+}
+
+func reachedTarget(kind safety.Kind, temperature float64, target int) bool {
+	switch kind {
+	case safety.FreezeKind:
+		return temperature >= float64(target)
+	case safety.OverheatKind:
+		return temperature <= float64(target)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type SensorReadingManager interface {
+	FetchSensor(ctx context.Context, sensorID string) (*sensor.Sensor, error)
+	UpdateSensorReading(ctx context.Context, reading *sensor.Reading) error
+	FetchAssignedDevices(ctx context.Context, sensorID string) ([]string, error)
+	FetchSensorAssignment(ctx context.Context, deviceID string) (*sensor.Assignment, error)
+	FetchAssignedReadings(ctx context.Context, deviceID string) ([]sensor.Reading, error)
+	FetchContentType(ctx context.Context, deviceID string) (string, error)
+	FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error)
+}
+
+type EffectiveTemperaturePublisher interface {
+	PublishEffectiveTemperature(ctx context.Context, h *home.Home, temperature *sensor.EffectiveTemperature, c codec.Codec) error
+}
+
+// SensorReading stores the reading of a sensor reporting on
+// sensor/{sensorID}/reading, and publishes the effective temperature to every
+// thermostat the sensor is assigned to. Readings older than maxAge are left out
+// of the effective temperature.
+func SensorReading(manager SensorReadingManager, publisher EffectiveTemperaturePublisher, maxAge time.Duration) event.Handler {
+	return func(ctx context.Context, payload []byte) error {
+		metadata := event.MetadataFromContext(ctx)
+
+		receivedAt := metadata.ReceivedAt
+		if receivedAt.IsZero() {
+			receivedAt = time.Now()
+		}
+
+		var reading sensor.Reading
+		err := event.UnmarshalPayload(ctx, payload, &reading)
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error unmarshalling sensor reading: %v", err)}
+		}
+
+		// Topic is authoritative, sensors don't have to repeat their ID
+		reading.SensorID = event.TopicLevel(metadata.Topic, 1)
+
+		// Sensors without a clock report readings as they take them
+		if reading.Timestamp.IsZero() {
+			reading.Timestamp = receivedAt
+		}
+
+		err = reading.Validate()
+		if err != nil {
+			return &event.ErrPermanent{Err: fmt.Errorf("error validating sensor reading: %v", err)}
+		}
+
+		_, err = manager.FetchSensor(ctx, reading.SensorID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				return &event.ErrPermanent{Err: fmt.Errorf("sensor %s is not registered", reading.SensorID)}
+			default:
+				return &event.ErrTransient{Err: fmt.Errorf("error fetching sensor: %v", err)}
+			}
+		}
+
+		err = manager.UpdateSensorReading(ctx, &reading)
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error updating sensor reading: %v", err)}
+		}
+
+		metrics.SetSensorTemperature(reading.SensorID, reading.Temperature)
+
+		deviceIDs, err := manager.FetchAssignedDevices(ctx, reading.SensorID)
+		if err != nil {
+			return &event.ErrTransient{Err: fmt.Errorf("error fetching assigned devices: %v", err)}
+		}
+
+		for _, deviceID := range deviceIDs {
+			err := publishEffectiveTemperature(ctx, manager, publisher, deviceID, receivedAt.Add(-maxAge))
+			if err != nil {
+				return &event.ErrTransient{Err: fmt.Errorf("error publishing effective temperature of device %s: %v", deviceID, err)}
+			}
+		}
+
+		return nil
+	}
+}
+
+func publishEffectiveTemperature(ctx context.Context, manager SensorReadingManager, publisher EffectiveTemperaturePublisher, deviceID string, staleBefore time.Time) error {
+	assignment, err := manager.FetchSensorAssignment(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching sensor assignment: %v", err)
+	}
+
+	readings, err := manager.FetchAssignedReadings(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching assigned readings: %v", err)
+	}
+
+	var fresh []sensor.Reading
+	for _, reading := range readings {
+		if !reading.Timestamp.Before(staleBefore) {
+			fresh = append(fresh, reading)
+		}
+	}
+
+	effective, err := sensor.Combine(assignment, fresh)
+	if err != nil {
+		// Thermostat keeps controlling on its own reading
+		slog.Warn(fmt.Sprintf("Skipping effective temperature of device %s: %v", deviceID, err))
+		return nil
+	}
+
+	contentType, err := manager.FetchContentType(ctx, deviceID)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			contentType = codec.JSONContentType
+		default:
+			return fmt.Errorf("error fetching content type: %v", err)
+		}
+	}
+
+	c, err := codec.ForContentType(contentType)
+	if err != nil {
+		return fmt.Errorf("error choosing effective temperature codec: %v", err)
+	}
+
+	h, err := manager.FetchDeviceHome(ctx, deviceID)
+	if err != nil {
+		return fmt.Errorf("error fetching device home: %v", err)
+	}
+
+	err = publisher.PublishEffectiveTemperature(ctx, h, effective, c)
+	if err != nil {
+		return fmt.Errorf("error publishing effective temperature: %v", err)
+	}
+
+	metrics.SetThermostatEffectiveTemperature(h.ID, deviceID, effective.Temperature)
+
+	return nil
+}
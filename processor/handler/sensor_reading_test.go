@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/codec"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type fakeSensorReadingManager struct {
+	Sensors     map[string]sensor.Sensor
+	Readings    map[string]sensor.Reading
+	Assignments map[string]sensor.Assignment
+
+	shouldFail bool
+}
+
+func (f *fakeSensorReadingManager) FetchSensor(ctx context.Context, sensorID string) (*sensor.Sensor, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	s, exists := f.Sensors[sensorID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("sensor %s not found", sensorID)}
+	}
+
+	return &s, nil
+}
+
+func (f *fakeSensorReadingManager) UpdateSensorReading(ctx context.Context, reading *sensor.Reading) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	if f.Readings == nil {
+		f.Readings = make(map[string]sensor.Reading)
+	}
+	f.Readings[reading.SensorID] = *reading
+
+	return nil
+}
+
+func (f *fakeSensorReadingManager) FetchAssignedDevices(ctx context.Context, sensorID string) ([]string, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var deviceIDs []string
+	for deviceID, assignment := range f.Assignments {
+		if slices.Contains(assignment.SensorIDs, sensorID) {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+
+	return deviceIDs, nil
+}
+
+func (f *fakeSensorReadingManager) FetchSensorAssignment(ctx context.Context, deviceID string) (*sensor.Assignment, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	assignment, exists := f.Assignments[deviceID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("sensor assignment not found for device %s", deviceID)}
+	}
+
+	return &assignment, nil
+}
+
+func (f *fakeSensorReadingManager) FetchAssignedReadings(ctx context.Context, deviceID string) ([]sensor.Reading, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	var readings []sensor.Reading
+	for _, sensorID := range f.Assignments[deviceID].SensorIDs {
+		reading, exists := f.Readings[sensorID]
+		if exists {
+			readings = append(readings, reading)
+		}
+	}
+
+	return readings, nil
+}
+
+func (f *fakeSensorReadingManager) FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error) {
+	return &home.Home{ID: home.DefaultID}, nil
+}
+
+func (f *fakeSensorReadingManager) FetchContentType(ctx context.Context, deviceID string) (string, error) {
+	if f.shouldFail {
+		return "", errors.New("test error")
+	}
+
+	return "", &client.ErrNotFound{Err: fmt.Errorf("content type not found for device %s", deviceID)}
+}
+
+type fakeEffectiveTemperaturePublisher struct {
+	Published []sensor.EffectiveTemperature
+
+	shouldFail bool
+}
+
+func (f *fakeEffectiveTemperaturePublisher) PublishEffectiveTemperature(ctx context.Context, h *home.Home, temperature *sensor.EffectiveTemperature, c codec.Codec) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Published = append(f.Published, *temperature)
+
+	return nil
+}
+
+func TestSensorReading(t *testing.T) {
+	receivedAt := time.Now()
+	sensors := map[string]sensor.Sensor{
+		"kitchen": {ID: "kitchen", Name: "Kitchen", Room: "kitchen"},
+		"bedroom": {ID: "bedroom", Name: "Bedroom", Room: "bedroom"},
+	}
+
+	type args struct {
+		manager   *fakeSensorReadingManager
+		publisher *fakeEffectiveTemperaturePublisher
+		topic     string
+		payload   []byte
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantErr       bool
+		wantPermanent bool
+		wantReading   *sensor.Reading
+		wantPublished []sensor.EffectiveTemperature
+	}{
+		{
+			name: "should store reading and publish averaged temperature",
+			args: args{
+				manager: &fakeSensorReadingManager{
+					Sensors: sensors,
+					Readings: map[string]sensor.Reading{
+						"bedroom": {SensorID: "bedroom", Timestamp: receivedAt.Add(-time.Minute), Temperature: 19},
+					},
+					Assignments: map[string]sensor.Assignment{
+						"test_device_id": {DeviceID: "test_device_id", Strategy: sensor.AverageStrategy, SensorIDs: []string{"kitchen", "bedroom"}},
+					},
+				},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:     false,
+			wantReading: &sensor.Reading{SensorID: "kitchen", Timestamp: receivedAt, Temperature: 21},
+			wantPublished: []sensor.EffectiveTemperature{
+				{DeviceID: "test_device_id", Temperature: 20, Strategy: sensor.AverageStrategy, SensorIDs: []string{"kitchen", "bedroom"}, Timestamp: receivedAt},
+			},
+		},
+		{
+			name: "should leave stale readings out of effective temperature",
+			args: args{
+				manager: &fakeSensorReadingManager{
+					Sensors: sensors,
+					Readings: map[string]sensor.Reading{
+						"bedroom": {SensorID: "bedroom", Timestamp: receivedAt.Add(-time.Hour), Temperature: 19},
+					},
+					Assignments: map[string]sensor.Assignment{
+						"test_device_id": {DeviceID: "test_device_id", Strategy: sensor.MinStrategy, SensorIDs: []string{"kitchen", "bedroom"}},
+					},
+				},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:     false,
+			wantReading: &sensor.Reading{SensorID: "kitchen", Timestamp: receivedAt, Temperature: 21},
+			wantPublished: []sensor.EffectiveTemperature{
+				{DeviceID: "test_device_id", Temperature: 21, Strategy: sensor.MinStrategy, SensorIDs: []string{"kitchen"}, Timestamp: receivedAt},
+			},
+		},
+		{
+			name: "should store reading without publishing, if sensor isn't assigned",
+			args: args{
+				manager:   &fakeSensorReadingManager{Sensors: sensors},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:     false,
+			wantReading: &sensor.Reading{SensorID: "kitchen", Timestamp: receivedAt, Temperature: 21},
+		},
+		{
+			name: "should return permanent error, if sensor isn't registered",
+			args: args{
+				manager:   &fakeSensorReadingManager{Sensors: sensors},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/garage/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "should return permanent error, if temperature is out of range",
+			args: args{
+				manager:   &fakeSensorReadingManager{Sensors: sensors},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 200}`),
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "should return permanent error, if payload is invalid",
+			args: args{
+				manager:   &fakeSensorReadingManager{Sensors: sensors},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{`),
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name: "should return transient error, if failed to store reading",
+			args: args{
+				manager:   &fakeSensorReadingManager{Sensors: sensors, shouldFail: true},
+				publisher: &fakeEffectiveTemperaturePublisher{},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:       true,
+			wantPermanent: false,
+		},
+		{
+			name: "should return transient error, if failed to publish",
+			args: args{
+				manager: &fakeSensorReadingManager{
+					Sensors: sensors,
+					Assignments: map[string]sensor.Assignment{
+						"test_device_id": {DeviceID: "test_device_id", Strategy: sensor.AverageStrategy, SensorIDs: []string{"kitchen"}},
+					},
+				},
+				publisher: &fakeEffectiveTemperaturePublisher{shouldFail: true},
+				topic:     "sensor/kitchen/reading",
+				payload:   []byte(`{"temperature": 21}`),
+			},
+			wantErr:       true,
+			wantPermanent: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := event.WithMetadata(context.Background(), &event.Metadata{
+				Topic:      tt.args.topic,
+				ReceivedAt: receivedAt,
+			})
+
+			err := SensorReading(tt.args.manager, tt.args.publisher, 15*time.Minute)(ctx, tt.args.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SensorReading() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				var permanentErr *event.ErrPermanent
+				if errors.As(err, &permanentErr) != tt.wantPermanent {
+					t.Errorf("SensorReading() error = %v, want permanent %v", err, tt.wantPermanent)
+				}
+				return
+			}
+
+			reading := tt.args.manager.Readings[tt.wantReading.SensorID]
+			if !reading.Timestamp.Equal(tt.wantReading.Timestamp) || reading.Temperature != tt.wantReading.Temperature {
+				t.Errorf("SensorReading() stored reading = %+v, want %+v", reading, *tt.wantReading)
+			}
+
+			if len(tt.args.publisher.Published) != len(tt.wantPublished) {
+				t.Fatalf("SensorReading() published %d effective temperatures, want %d", len(tt.args.publisher.Published), len(tt.wantPublished))
+			}
+
+			for i, got := range tt.args.publisher.Published {
+				want := tt.wantPublished[i]
+				if got.DeviceID != want.DeviceID || got.Temperature != want.Temperature || got.Strategy != want.Strategy ||
+					!reflect.DeepEqual(got.SensorIDs, want.SensorIDs) || !got.Timestamp.Equal(want.Timestamp) {
+					t.Errorf("SensorReading() published = %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
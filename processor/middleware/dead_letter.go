@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type DeadLetterSink interface {
+	AddDeadLetter(ctx context.Context, letter *deadletter.DeadLetter) error
+}
+
+// DeadLetter hands messages rejected with a permanent error over to the sink,
+// so that they are not lost. Replayed messages are not dead-lettered again.
+func DeadLetter(sink DeadLetterSink) event.Middleware {
+	return func(eventName string, next event.Handler) event.Handler {
+		return func(ctx context.Context, payload []byte) error {
+			err := next(ctx, payload)
+
+			var permanentErr *event.ErrPermanent
+			if err == nil || event.IsReplay(ctx) || !errors.As(err, &permanentErr) {
+				return err
+			}
+
+			metadata := event.MetadataFromContext(ctx)
+
+			// Event name is a topic filter, the letter keeps the actual topic
+			topic := metadata.Topic
+			if topic == "" {
+				topic = eventName
+			}
+
+			receivedAt := metadata.ReceivedAt
+			if receivedAt.IsZero() {
+				receivedAt = time.Now()
+			}
+
+			sinkErr := sink.AddDeadLetter(ctx, &deadletter.DeadLetter{
+				Topic:      topic,
+				Payload:    payload,
+				Reason:     err.Error(),
+				ReceivedAt: receivedAt,
+			})
+			if sinkErr != nil {
+				slog.Error(fmt.Sprintf("Error adding dead letter for topic %s: %v", eventName, sinkErr))
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type fakeDeadLetterSink struct {
+	Letters []deadletter.DeadLetter
+}
+
+func (f *fakeDeadLetterSink) AddDeadLetter(ctx context.Context, letter *deadletter.DeadLetter) error {
+	f.Letters = append(f.Letters, *letter)
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		handlerErr  error
+		wantLetters int
+	}{
+		{
+			name:        "should not dead-letter successfully handled message",
+			ctx:         context.Background(),
+			handlerErr:  nil,
+			wantLetters: 0,
+		},
+		{
+			name:        "should dead-letter message rejected with permanent error",
+			ctx:         context.Background(),
+			handlerErr:  &event.ErrPermanent{Err: errors.New("test error")},
+			wantLetters: 1,
+		},
+		{
+			name:        "should not dead-letter message failed with other error",
+			ctx:         context.Background(),
+			handlerErr:  errors.New("test error"),
+			wantLetters: 0,
+		},
+		{
+			name:        "should not dead-letter replayed message again",
+			ctx:         event.WithReplay(context.Background()),
+			handlerErr:  &event.ErrPermanent{Err: errors.New("test error")},
+			wantLetters: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeDeadLetterSink{}
+			handler := DeadLetter(sink)("test/topic", func(ctx context.Context, payload []byte) error {
+				return tt.handlerErr
+			})
+
+			err := handler(tt.ctx, []byte("test payload"))
+			if err != tt.handlerErr {
+				t.Errorf("DeadLetter() error = %v, want %v", err, tt.handlerErr)
+			}
+
+			if len(sink.Letters) != tt.wantLetters {
+				t.Fatalf("DeadLetter() len(sink.Letters) = %d, want %d", len(sink.Letters), tt.wantLetters)
+			}
+
+			for _, letter := range sink.Letters {
+				if letter.Topic != "test/topic" || string(letter.Payload) != "test payload" || letter.Reason != tt.handlerErr.Error() {
+					t.Errorf("DeadLetter() letter = %+v, want topic, payload and reason of the rejected message", letter)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+// MessageIDProperty is the MQTT v5 user property carrying the message ID.
+const MessageIDProperty = "message-id"
+
+type MessageDeduplicator interface {
+	HasProcessedMessage(ctx context.Context, topic, messageID string, since time.Time) (bool, error)
+	AddProcessedMessage(ctx context.Context, topic, messageID string, processedAt, expiredBefore time.Time) error
+}
+
+// Deduplicate drops messages that were already processed successfully within
+// the window, such as the ones redelivered by the broker. Messages without an
+// ID and replayed messages are always handled.
+func Deduplicate(store MessageDeduplicator, window time.Duration) event.Middleware {
+	return func(eventName string, next event.Handler) event.Handler {
+		return func(ctx context.Context, payload []byte) error {
+			messageID := messageID(ctx, payload)
+			if messageID == "" || event.IsReplay(ctx) {
+				return next(ctx, payload)
+			}
+
+			processed, err := store.HasProcessedMessage(ctx, eventName, messageID, time.Now().Add(-window))
+			if err != nil {
+				// Handling a message twice is better than not handling it at all
+				slog.Warn(fmt.Sprintf("Error checking if message %s was processed: %v", messageID, err))
+			}
+			if processed {
+				metrics.AddEventDuplicateDropped(eventName)
+				return nil
+			}
+
+			err = next(ctx, payload)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			err = store.AddProcessedMessage(ctx, eventName, messageID, now, now.Add(-window))
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Error recording message %s as processed: %v", messageID, err))
+			}
+
+			return nil
+		}
+	}
+}
+
+type messageIDPayload struct {
+	MessageID string `json:"messageId"`
+}
+
+// messageID prefers the ID from the message properties and falls back to the
+// one in the payload.
+func messageID(ctx context.Context, payload []byte) string {
+	metadata := event.MetadataFromContext(ctx)
+	if id := metadata.UserProperties[MessageIDProperty]; id != "" {
+		return id
+	}
+
+	var p messageIDPayload
+	err := event.UnmarshalPayload(ctx, payload, &p)
+	if err != nil {
+		return ""
+	}
+
+	return p.MessageID
+}
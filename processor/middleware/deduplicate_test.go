@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type fakeMessageDeduplicator struct {
+	Processed  map[string]bool
+	shouldFail bool
+}
+
+func (f *fakeMessageDeduplicator) HasProcessedMessage(ctx context.Context, topic, messageID string, since time.Time) (bool, error) {
+	if f.shouldFail {
+		return false, errors.New("test error")
+	}
+
+	return f.Processed[topic+"/"+messageID], nil
+}
+
+func (f *fakeMessageDeduplicator) AddProcessedMessage(ctx context.Context, topic, messageID string, processedAt, expiredBefore time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	f.Processed[topic+"/"+messageID] = true
+	return nil
+}
+
+func TestDeduplicate(t *testing.T) {
+	withMessageID := func(id string) context.Context {
+		return event.WithMetadata(context.Background(), &event.Metadata{
+			UserProperties: map[string]string{MessageIDProperty: id},
+		})
+	}
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		payload       string
+		processed     map[string]bool
+		handlerErr    error
+		shouldFail    bool
+		wantCalls     int
+		wantProcessed bool
+	}{
+		{
+			name:          "should handle new message with ID from properties",
+			ctx:           withMessageID("message-1"),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{},
+			wantCalls:     1,
+			wantProcessed: true,
+		},
+		{
+			name:          "should handle new message with ID from payload",
+			ctx:           context.Background(),
+			payload:       `{"deviceId":"test","messageId":"message-1"}`,
+			processed:     map[string]bool{},
+			wantCalls:     1,
+			wantProcessed: true,
+		},
+		{
+			name:          "should drop already processed message",
+			ctx:           withMessageID("message-1"),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{"test/topic/message-1": true},
+			wantCalls:     0,
+			wantProcessed: true,
+		},
+		{
+			name:          "should handle replayed message even if it was processed",
+			ctx:           event.WithReplay(withMessageID("message-1")),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{"test/topic/message-1": true},
+			wantCalls:     1,
+			wantProcessed: true,
+		},
+		{
+			name:          "should handle message without ID",
+			ctx:           context.Background(),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{},
+			wantCalls:     1,
+			wantProcessed: false,
+		},
+		{
+			name:          "should not record message that failed to be handled",
+			ctx:           withMessageID("message-1"),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{},
+			handlerErr:    errors.New("test error"),
+			wantCalls:     1,
+			wantProcessed: false,
+		},
+		{
+			name:          "should handle message if deduplicator fails",
+			ctx:           withMessageID("message-1"),
+			payload:       `{"deviceId":"test"}`,
+			processed:     map[string]bool{},
+			shouldFail:    true,
+			wantCalls:     1,
+			wantProcessed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeMessageDeduplicator{Processed: tt.processed, shouldFail: tt.shouldFail}
+
+			calls := 0
+			handler := Deduplicate(store, time.Hour)("test/topic", func(ctx context.Context, payload []byte) error {
+				calls++
+				return tt.handlerErr
+			})
+
+			err := handler(tt.ctx, []byte(tt.payload))
+			if err != tt.handlerErr {
+				t.Errorf("Deduplicate() error = %v, want %v", err, tt.handlerErr)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("Deduplicate() calls = %d, want %d", calls, tt.wantCalls)
+			}
+
+			if store.Processed["test/topic/message-1"] != tt.wantProcessed {
+				t.Errorf("Deduplicate() processed = %v, want %v", store.Processed["test/topic/message-1"], tt.wantProcessed)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+// Logging emits a structured record for every handled event.
+func Logging(eventName string, next event.Handler) event.Handler {
+	return func(ctx context.Context, payload []byte) error {
+		start := time.Now()
+		err := next(ctx, payload)
+		duration := time.Since(start)
+
+		var devicePayload DevicePayload
+		_ = event.UnmarshalPayload(ctx, payload, &devicePayload)
+
+		attrs := []slog.Attr{
+			slog.String("topic", eventName),
+			slog.String("deviceId", devicePayload.DeviceID),
+			slog.Duration("duration", duration),
+		}
+
+		if event.IsReplay(ctx) {
+			attrs = append(attrs, slog.Bool("replay", true))
+		}
+
+		if err != nil {
+			attrs = append(attrs, slog.String("outcome", "error"), slog.String("error", err.Error()))
+			slog.LogAttrs(ctx, slog.LevelError, "Error handling event", attrs...)
+			return err
+		}
+
+		attrs = append(attrs, slog.String("outcome", "ok"))
+		slog.LogAttrs(ctx, slog.LevelInfo, "Handled event", attrs...)
+
+		return nil
+	}
+}
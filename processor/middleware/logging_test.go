@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		name        string
+		handlerErr  error
+		wantLevel   string
+		wantOutcome string
+	}{
+		{
+			name:        "should log handled event",
+			handlerErr:  nil,
+			wantLevel:   "INFO",
+			wantOutcome: "ok",
+		},
+		{
+			name:        "should log failed event",
+			handlerErr:  errors.New("test error"),
+			wantLevel:   "ERROR",
+			wantOutcome: "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			defaultLogger := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+			t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+			handler := Logging("test/topic", func(ctx context.Context, payload []byte) error {
+				return tt.handlerErr
+			})
+
+			err := handler(context.Background(), []byte(`{"deviceId":"test-device-id"}`))
+			if err != tt.handlerErr {
+				t.Errorf("Logging() error = %v, want %v", err, tt.handlerErr)
+			}
+
+			var record map[string]any
+			err = json.Unmarshal(buf.Bytes(), &record)
+			if err != nil {
+				t.Fatalf("Error unmarshalling log record %q: %v", buf.String(), err)
+			}
+
+			if record["level"] != tt.wantLevel {
+				t.Errorf("level = %v, want %v", record["level"], tt.wantLevel)
+			}
+
+			if record["topic"] != "test/topic" {
+				t.Errorf("topic = %v, want %v", record["topic"], "test/topic")
+			}
+
+			if record["deviceId"] != "test-device-id" {
+				t.Errorf("deviceId = %v, want %v", record["deviceId"], "test-device-id")
+			}
+
+			if record["outcome"] != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %v", record["outcome"], tt.wantOutcome)
+			}
+
+			if _, ok := record["duration"]; !ok {
+				t.Errorf("record = %v, want duration", record)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package middleware
 
 import (
 	"context"
-	"encoding/json"
 	"time"
 
 	"github.com/alexchebotarsky/thermostat-api/metrics"
@@ -27,8 +26,7 @@ func Metrics(eventName string, next event.Handler) event.Handler {
 		}
 
 		var devicePayload DevicePayload
-		err = json.Unmarshal(payload, &devicePayload)
-		if err != nil {
+		if event.UnmarshalPayload(ctx, payload, &devicePayload) != nil {
 			devicePayload.DeviceID = "n/a"
 		}
 
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		handlerErr error
+	}{
+		{
+			name:       "should pass through handler success",
+			payload:    `{"deviceId":"test-device-id"}`,
+			handlerErr: nil,
+		},
+		{
+			name:       "should pass through handler error",
+			payload:    `{"deviceId":"test-device-id"}`,
+			handlerErr: errors.New("test error"),
+		},
+		{
+			name:       "should pass through handler success with payload without device",
+			payload:    `not json`,
+			handlerErr: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Metrics("test/topic", func(ctx context.Context, payload []byte) error {
+				return tt.handlerErr
+			})
+
+			err := handler(context.Background(), []byte(tt.payload))
+			if err != tt.handlerErr {
+				t.Errorf("Metrics() error = %v, want %v", err, tt.handlerErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+// Recover turns a handler panic into a permanent error with the stack trace,
+// instead of letting it crash the worker and the process with it.
+func Recover(eventName string, next event.Handler) event.Handler {
+	return func(ctx context.Context, payload []byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &event.ErrPermanent{Err: fmt.Errorf("panic handling event %s: %v\n%s", eventName, r, debug.Stack())}
+			}
+		}()
+
+		return next(ctx, payload)
+	}
+}
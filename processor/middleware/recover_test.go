@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       event.Handler
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{
+			name: "should pass through successful handler",
+			handler: func(ctx context.Context, payload []byte) error {
+				return nil
+			},
+			wantErr: false,
+		},
+		{
+			name: "should pass through handler error",
+			handler: func(ctx context.Context, payload []byte) error {
+				return errors.New("test error")
+			},
+			wantErr:       true,
+			wantPermanent: false,
+		},
+		{
+			name: "should turn panic into permanent error",
+			handler: func(ctx context.Context, payload []byte) error {
+				panic("test panic")
+			},
+			wantErr:       true,
+			wantPermanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Recover("test/topic", tt.handler)(context.Background(), []byte("test payload"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Recover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var permanentErr *event.ErrPermanent
+			if errors.As(err, &permanentErr) != tt.wantPermanent {
+				t.Errorf("Recover() error = %v, wantPermanent %v", err, tt.wantPermanent)
+			}
+
+			if tt.wantPermanent && (!strings.Contains(err.Error(), "test panic") || !strings.Contains(err.Error(), "goroutine")) {
+				t.Errorf("Recover() error = %v, want panic value and stack trace", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// Retry handles the message again while the handler fails with a transient
+// error, waiting with exponential backoff and jitter in between. Once the
+// attempts are exhausted, the error is turned into a permanent one, so that
+// the message is dead-lettered.
+func Retry(policy RetryPolicy) event.Middleware {
+	return func(eventName string, next event.Handler) event.Handler {
+		return func(ctx context.Context, payload []byte) error {
+			var err error
+			for attempt := 1; ; attempt++ {
+				err = next(ctx, payload)
+
+				var transientErr *event.ErrTransient
+				if err == nil || !errors.As(err, &transientErr) {
+					return err
+				}
+
+				if attempt >= policy.MaxAttempts {
+					return &event.ErrPermanent{Err: fmt.Errorf("retries exhausted after %d attempts: %w", attempt, err)}
+				}
+
+				metrics.AddEventRetried(eventName)
+
+				select {
+				case <-time.After(policy.backoff(attempt)):
+				case <-ctx.Done():
+					return fmt.Errorf("error waiting to retry: %v, after: %w", ctx.Err(), err)
+				}
+			}
+		}
+	}
+}
+
+// backoff doubles the delay after every attempt within the policy bounds, and
+// randomizes the upper half of it so that retries don't happen in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MinBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+
+	if delay <= 1 {
+		return delay
+	}
+
+	return delay/2 + rand.N(delay/2)
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  2 * time.Millisecond,
+	}
+
+	transientErr := &event.ErrTransient{Err: errors.New("test error")}
+
+	tests := []struct {
+		name          string
+		handlerErrs   []error
+		wantCalls     int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{
+			name:        "should handle message once when it succeeds",
+			handlerErrs: []error{nil},
+			wantCalls:   1,
+			wantErr:     false,
+		},
+		{
+			name:        "should retry message until it succeeds",
+			handlerErrs: []error{transientErr, transientErr, nil},
+			wantCalls:   3,
+			wantErr:     false,
+		},
+		{
+			name:          "should give up with permanent error when retries are exhausted",
+			handlerErrs:   []error{transientErr, transientErr, transientErr},
+			wantCalls:     3,
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name:        "should not retry message failed with other error",
+			handlerErrs: []error{errors.New("test error")},
+			wantCalls:   1,
+			wantErr:     true,
+		},
+		{
+			name:          "should not retry message rejected with permanent error",
+			handlerErrs:   []error{&event.ErrPermanent{Err: errors.New("test error")}},
+			wantCalls:     1,
+			wantErr:       true,
+			wantPermanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := Retry(policy)("test/topic", func(ctx context.Context, payload []byte) error {
+				err := tt.handlerErrs[calls]
+				calls++
+				return err
+			})
+
+			err := handler(context.Background(), []byte("test payload"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Retry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var permanentErr *event.ErrPermanent
+			if errors.As(err, &permanentErr) != tt.wantPermanent {
+				t.Errorf("Retry() error = %v, wantPermanent %v", err, tt.wantPermanent)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("Retry() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  time.Hour,
+		MaxBackoff:  time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := Retry(policy)("test/topic", func(ctx context.Context, payload []byte) error {
+		cancel()
+		return &event.ErrTransient{Err: errors.New("test error")}
+	})
+
+	err := handler(ctx, []byte("test payload"))
+	if err == nil {
+		t.Fatalf("Retry() error = %v, want error", err)
+	}
+
+	var permanentErr *event.ErrPermanent
+	if errors.As(err, &permanentErr) {
+		t.Errorf("Retry() error = %v, want non-permanent error on cancelled context", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 10,
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+	}
+
+	tests := []struct {
+		attempt int
+		wantMax time.Duration
+	}{
+		{attempt: 1, wantMax: 100 * time.Millisecond},
+		{attempt: 2, wantMax: 200 * time.Millisecond},
+		{attempt: 3, wantMax: 400 * time.Millisecond},
+		{attempt: 5, wantMax: time.Second},
+		{attempt: 9, wantMax: time.Second},
+	}
+	for _, tt := range tests {
+		for range 10 {
+			got := policy.backoff(tt.attempt)
+			if got < tt.wantMax/2 || got > tt.wantMax {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.wantMax/2, tt.wantMax)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing starts a span for every handled event, in the trace of the message
+// it was received in.
+func Tracing(eventName string, next event.Handler) event.Handler {
+	return func(ctx context.Context, payload []byte) error {
+		ctx, span := tracing.Start(ctx, fmt.Sprintf("process %s", eventName),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("mqtt"),
+				semconv.MessagingDestinationName(event.MetadataFromContext(ctx).Topic),
+				attribute.Bool("thermostat.replay", event.IsReplay(ctx)),
+			),
+		)
+
+		var devicePayload DevicePayload
+		if event.UnmarshalPayload(ctx, payload, &devicePayload) == nil && devicePayload.DeviceID != "" {
+			span.SetAttributes(tracing.DeviceIDKey.String(devicePayload.DeviceID))
+		}
+
+		err := next(ctx, payload)
+		tracing.End(span, err)
+
+		return err
+	}
+}
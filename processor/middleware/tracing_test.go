@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/alexchebotarsky/thermostat-api/tracing/tracingtest"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name       string
+		handlerErr error
+		wantStatus codes.Code
+	}{
+		{
+			name:       "should record handled event",
+			handlerErr: nil,
+			wantStatus: codes.Unset,
+		},
+		{
+			name:       "should record failed event",
+			handlerErr: errors.New("test error"),
+			wantStatus: codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracingtest.Init()
+
+			parentCtx, parent := tracing.Start(context.Background(), "receive thermostat/current-state")
+			ctx := event.WithMetadata(parentCtx, &event.Metadata{Topic: "thermostat/current-state"})
+
+			var handlerSpan trace.SpanContext
+			handler := Tracing("thermostat/current-state", func(ctx context.Context, payload []byte) error {
+				handlerSpan = trace.SpanContextFromContext(ctx)
+				return tt.handlerErr
+			})
+
+			err := handler(ctx, []byte(`{"deviceId":"test-device-id"}`))
+			if err != tt.handlerErr {
+				t.Errorf("Tracing() error = %v, want %v", err, tt.handlerErr)
+			}
+			parent.End()
+
+			spans := exporter.GetSpans()
+			if len(spans) != 2 {
+				t.Fatalf("len(spans) = %d, want %d", len(spans), 2)
+			}
+
+			span := spans[0]
+			if span.Name != "process thermostat/current-state" {
+				t.Errorf("span.Name = %v, want %v", span.Name, "process thermostat/current-state")
+			}
+
+			if span.SpanContext.SpanID() != handlerSpan.SpanID() {
+				t.Errorf("handler span = %v, want %v", handlerSpan.SpanID(), span.SpanContext.SpanID())
+			}
+
+			if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("span.Parent = %v, want %v", span.Parent.SpanID(), parent.SpanContext().SpanID())
+			}
+
+			if span.Status.Code != tt.wantStatus {
+				t.Errorf("span.Status = %v, want %v", span.Status.Code, tt.wantStatus)
+			}
+
+			var deviceID string
+			for _, attr := range span.Attributes {
+				if attr.Key == tracing.DeviceIDKey {
+					deviceID = attr.Value.AsString()
+				}
+			}
+			if deviceID != "test-device-id" {
+				t.Errorf("span %s = %v, want %v", tracing.DeviceIDKey, deviceID, "test-device-id")
+			}
+		})
+	}
+}
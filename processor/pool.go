@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+// pool processes events on a fixed number of workers. Events are sharded
+// between workers by device, so events of the same device are processed in
+// the order they were received, while different devices are processed in
+// parallel.
+type pool struct {
+	queues []chan job
+	wg     sync.WaitGroup
+
+	// ctx is passed to handlers, it's only cancelled if draining takes longer
+	// than allowed on stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type job struct {
+	// ctx carries the values of the message, but not its cancellation, since
+	// the job outlives the broker callback
+	ctx     context.Context
+	handler event.Handler
+	payload []byte
+}
+
+var errPoolStopped = errors.New("processor pool is stopped")
+
+func newPool(workers, queueSize int) *pool {
+	var p pool
+
+	p.queues = make([]chan job, workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan job, queueSize)
+	}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	return &p
+}
+
+func (p *pool) start() {
+	for i, queue := range p.queues {
+		p.wg.Add(1)
+		go p.work(strconv.Itoa(i), queue)
+	}
+}
+
+func (p *pool) work(worker string, queue <-chan job) {
+	defer p.wg.Done()
+
+	for j := range queue {
+		metrics.SetEventQueueDepth(worker, len(queue))
+
+		// Outcome is already logged by the handler middlewares
+		_ = p.handle(j)
+	}
+}
+
+// handle runs the job handler with the message values, cancelling it together
+// with the pool.
+func (p *pool) handle(j job) error {
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer stop()
+
+	return j.handler(ctx, j.payload)
+}
+
+// submit queues the event on the worker of its device. If that queue is full,
+// it blocks until there is room, which applies backpressure to the broker.
+func (p *pool) submit(ctx context.Context, handler event.Handler, payload []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return errPoolStopped
+	}
+
+	i := p.shard(ctx, payload)
+	worker := strconv.Itoa(i)
+	j := job{ctx: context.WithoutCancel(ctx), handler: handler, payload: payload}
+
+	select {
+	case p.queues[i] <- j:
+	default:
+		metrics.AddEventQueueBlocked(worker)
+
+		select {
+		case p.queues[i] <- j:
+		case <-ctx.Done():
+			return fmt.Errorf("error queueing event: %v", ctx.Err())
+		}
+	}
+
+	metrics.SetEventQueueDepth(worker, len(p.queues[i]))
+
+	return nil
+}
+
+// stop rejects new events and waits for the queued ones to be processed. If
+// ctx is done first, in-flight handlers are cancelled.
+func (p *pool) stop(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return fmt.Errorf("error draining event queues: %v", ctx.Err())
+	}
+}
+
+type devicePayload struct {
+	DeviceID string `json:"deviceId"`
+}
+
+// shard picks the worker by device, or by topic for payloads that don't belong
+// to a device, such as sensor readings that carry their ID in the topic.
+func (p *pool) shard(ctx context.Context, payload []byte) int {
+	var device devicePayload
+	_ = event.UnmarshalPayload(ctx, payload, &device)
+
+	key := device.DeviceID
+	if key == "" {
+		key = event.MetadataFromContext(ctx).Topic
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
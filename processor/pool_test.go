@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/processor/event"
+)
+
+func TestPoolOrderingPerDevice(t *testing.T) {
+	p := newPool(4, 10)
+	p.start()
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+
+	handler := func(ctx context.Context, payload []byte) error {
+		var event struct {
+			DeviceID string `json:"deviceId"`
+			Seq      int    `json:"seq"`
+		}
+		err := json.Unmarshal(payload, &event)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		got[event.DeviceID] = append(got[event.DeviceID], event.Seq)
+		mu.Unlock()
+
+		return nil
+	}
+
+	devices := []string{"device_a", "device_b", "device_c", "device_d", "device_e"}
+	for seq := range 50 {
+		for _, deviceID := range devices {
+			payload := fmt.Sprintf(`{"deviceId":"%s","seq":%d}`, deviceID, seq)
+			err := p.submit(context.Background(), handler, []byte(payload))
+			if err != nil {
+				t.Fatalf("submit() error = %v", err)
+			}
+		}
+	}
+
+	err := p.stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop() error = %v", err)
+	}
+
+	for _, deviceID := range devices {
+		if len(got[deviceID]) != 50 {
+			t.Fatalf("processed %d events for %s, want %d", len(got[deviceID]), deviceID, 50)
+		}
+		for i, seq := range got[deviceID] {
+			if seq != i {
+				t.Fatalf("events for %s processed in order %v, want ascending", deviceID, got[deviceID])
+			}
+		}
+	}
+}
+
+func TestPoolParallelAcrossDevices(t *testing.T) {
+	p := newPool(2, 10)
+	p.start()
+	defer p.stop(context.Background())
+
+	// Find two devices which end up on different workers
+	deviceA, deviceB := "device_0", ""
+	for i := 1; deviceB == ""; i++ {
+		deviceID := fmt.Sprintf("device_%d", i)
+		if p.shard(context.Background(), devicePayloadJSON(deviceID)) != p.shard(context.Background(), devicePayloadJSON(deviceA)) {
+			deviceB = deviceID
+		}
+	}
+
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, payload []byte) error {
+		<-release
+		return nil
+	}
+
+	done := make(chan struct{})
+	nonBlocking := func(ctx context.Context, payload []byte) error {
+		close(done)
+		return nil
+	}
+
+	err := p.submit(context.Background(), blocking, devicePayloadJSON(deviceA))
+	if err != nil {
+		t.Fatalf("submit() error = %v", err)
+	}
+
+	err = p.submit(context.Background(), nonBlocking, devicePayloadJSON(deviceB))
+	if err != nil {
+		t.Fatalf("submit() error = %v", err)
+	}
+
+	select {
+	case <-done:
+		// Expected, slow device doesn't stall others
+	case <-time.After(time.Second):
+		t.Error("event of another device was stalled by a slow handler")
+	}
+
+	close(release)
+}
+
+func TestPoolBackpressure(t *testing.T) {
+	p := newPool(1, 1)
+	p.start()
+
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, payload []byte) error {
+		<-release
+		return nil
+	}
+
+	// First event is picked up by the worker, second fills the queue. Second
+	// submit waits for the worker to pick up the first one, if it hasn't yet.
+	for range 2 {
+		err := p.submit(context.Background(), blocking, devicePayloadJSON("device_a"))
+		if err != nil {
+			t.Fatalf("submit() error = %v", err)
+		}
+	}
+
+	// Third event blocks until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := p.submit(ctx, blocking, devicePayloadJSON("device_a"))
+	if err == nil {
+		t.Error("submit() to a full queue error = nil, want error")
+	}
+
+	close(release)
+
+	err = p.stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop() error = %v", err)
+	}
+}
+
+func TestPoolStop(t *testing.T) {
+	p := newPool(2, 10)
+	p.start()
+
+	var mu sync.Mutex
+	processed := 0
+	slow := func(ctx context.Context, payload []byte) error {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		processed++
+		mu.Unlock()
+		return nil
+	}
+
+	for range 5 {
+		err := p.submit(context.Background(), slow, devicePayloadJSON("device_a"))
+		if err != nil {
+			t.Fatalf("submit() error = %v", err)
+		}
+	}
+
+	// Queued events are drained on stop
+	err := p.stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop() error = %v", err)
+	}
+
+	if processed != 5 {
+		t.Errorf("processed %d events before stop returned, want %d", processed, 5)
+	}
+
+	// New events are rejected after stop
+	err = p.submit(context.Background(), slow, devicePayloadJSON("device_a"))
+	if err != errPoolStopped {
+		t.Errorf("submit() after stop error = %v, want %v", err, errPoolStopped)
+	}
+}
+
+func devicePayloadJSON(deviceID string) []byte {
+	return []byte(fmt.Sprintf(`{"deviceId":"%s"}`, deviceID))
+}
+
+func TestPoolMessageContext(t *testing.T) {
+	p := newPool(1, 10)
+	p.start()
+
+	metadata := &event.Metadata{Topic: "test/topic"}
+	ctx, cancel := context.WithCancel(event.WithMetadata(context.Background(), metadata))
+
+	var gotMetadata *event.Metadata
+	var gotErr error
+	handler := func(ctx context.Context, payload []byte) error {
+		gotMetadata = event.MetadataFromContext(ctx)
+		gotErr = ctx.Err()
+		return nil
+	}
+
+	err := p.submit(ctx, handler, []byte(`{"deviceId":"device_a"}`))
+	if err != nil {
+		t.Fatalf("submit() error = %v", err)
+	}
+
+	// The broker callback returns once the event is queued
+	cancel()
+
+	err = p.stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop() error = %v", err)
+	}
+
+	if gotMetadata != metadata {
+		t.Errorf("handler metadata = %+v, want %+v", gotMetadata, metadata)
+	}
+
+	if gotErr != nil {
+		t.Errorf("handler ctx.Err() = %v, want nil after message ctx is cancelled", gotErr)
+	}
+}
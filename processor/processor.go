@@ -5,57 +5,94 @@ import (
 	"fmt"
 	"log/slog"
 	"slices"
+	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/alexchebotarsky/thermostat-api/processor/event"
 	"github.com/alexchebotarsky/thermostat-api/processor/handler"
+	"github.com/alexchebotarsky/thermostat-api/processor/middleware"
 )
 
 type Processor struct {
 	Events      []event.Event
 	Middlewares []event.Middleware
+	Config      Config
 	Clients     Clients
+
+	pool *pool
+}
+
+type Config struct {
+	Workers   int
+	QueueSize int
+
+	DedupWindow     time.Duration
+	Retry           middleware.RetryPolicy
+	DeadLetterTopic string
+
+	Timestamps thermostat.TimestampPolicy
+	Cycles     handler.CyclePolicy
+	Safety     handler.SafetyPolicy
+	// SensorReadingMaxAge leaves readings of sensors that stopped reporting
+	// out of the effective temperature
+	SensorReadingMaxAge time.Duration
+	OutdoorRetention    time.Duration
 }
 
 type Clients struct {
 	PubSub  PubSubClient
 	Storage StorageClient
+	Alerter AlerterClient
 }
 
 type PubSubClient interface {
 	Subscribe(ctx context.Context, topic string, handler event.Handler) error
+	PublishDeadLetter(ctx context.Context, topic string, letter *deadletter.DeadLetter) error
+	handler.EffectiveTemperaturePublisher
+	handler.AlertPublisher
+}
+
+type AlerterClient interface {
+	handler.AlertEvaluator
 }
 
 type StorageClient interface {
 	handler.CurrentStateManager
+	handler.SensorReadingManager
+	handler.OutdoorReadingAdder
+	middleware.MessageDeduplicator
+	AddDeadLetter(ctx context.Context, letter *deadletter.DeadLetter) error
 }
 
-func New(clients Clients) *Processor {
+func New(config Config, clients Clients) (*Processor, error) {
+	if config.Workers < 1 {
+		return nil, fmt.Errorf("processor needs at least one worker, got %d", config.Workers)
+	}
+	if config.QueueSize < 0 {
+		return nil, fmt.Errorf("processor queue size can't be negative, got %d", config.QueueSize)
+	}
+
 	var p Processor
 
+	p.pool = newPool(config.Workers, config.QueueSize)
+	p.Config = config
 	p.Clients = clients
 
 	p.setupEvents()
 
-	return &p
+	return &p, nil
 }
 
 func (p *Processor) Start(ctx context.Context, errc chan<- error) {
+	p.pool.start()
+
 	for _, e := range p.Events {
-		// Gather global processor middlewares and event specific middlewares
-		middlewares := make([]event.Middleware, 0, len(p.Middlewares)+len(e.Middlewares))
-		middlewares = append(middlewares, p.Middlewares...)
-		middlewares = append(middlewares, e.Middlewares...)
-
-		// Middlewares should be applied in the order they are defined, but this
-		// means we have to reverse them before applying.
-		slices.Reverse(middlewares)
-
-		// Apply relevant middlewares before listening to the event
-		for _, middleware := range middlewares {
-			e.Handler = middleware(e.Topic, e.Handler)
-		}
+		handler := p.wrap(e)
 
-		err := p.Clients.PubSub.Subscribe(ctx, e.Topic, e.Handler)
+		err := p.Clients.PubSub.Subscribe(ctx, e.Topic, func(ctx context.Context, payload []byte) error {
+			return p.pool.submit(ctx, handler, payload)
+		})
 		if err != nil {
 			errc <- fmt.Errorf("error subscribing to topic %s: %v", e.Topic, err)
 			return
@@ -66,9 +103,49 @@ func (p *Processor) Start(ctx context.Context, errc chan<- error) {
 }
 
 func (p *Processor) Stop(ctx context.Context) error {
+	err := p.pool.stop(ctx)
+	if err != nil {
+		return fmt.Errorf("error stopping processor pool: %v", err)
+	}
+
 	return nil
 }
 
+// Replay runs the payload through the handler of the event with the given
+// topic, as if it was received from the broker again at the original time. It is handled right
+// away instead of being queued, so that the caller gets the outcome.
+func (p *Processor) Replay(ctx context.Context, topic string, payload []byte, receivedAt time.Time) error {
+	ctx = event.WithReplay(ctx)
+	ctx = event.WithMetadata(ctx, &event.Metadata{Topic: topic, ReceivedAt: receivedAt})
+
+	for _, e := range p.Events {
+		if event.MatchTopic(e.Topic, topic) {
+			return p.wrap(e)(ctx, payload)
+		}
+	}
+
+	return fmt.Errorf("no event is handled for topic %s", topic)
+}
+
+// wrap applies global processor middlewares and event specific middlewares to
+// the event handler.
+func (p *Processor) wrap(e event.Event) event.Handler {
+	middlewares := make([]event.Middleware, 0, len(p.Middlewares)+len(e.Middlewares))
+	middlewares = append(middlewares, p.Middlewares...)
+	middlewares = append(middlewares, e.Middlewares...)
+
+	// Middlewares should be applied in the order they are defined, but this
+	// means we have to reverse them before applying.
+	slices.Reverse(middlewares)
+
+	handler := e.Handler
+	for _, middleware := range middlewares {
+		handler = middleware(e.Topic, handler)
+	}
+
+	return handler
+}
+
 func (p *Processor) handle(e event.Event) {
 	p.Events = append(p.Events, e)
 }
@@ -0,0 +1,40 @@
+package processor
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "should create processor with workers and a queue",
+			config:  Config{Workers: 4, QueueSize: 100},
+			wantErr: false,
+		},
+		{
+			name:    "should create processor with unbuffered queues",
+			config:  Config{Workers: 1, QueueSize: 0},
+			wantErr: false,
+		},
+		{
+			name:    "should return error, if there are no workers",
+			config:  Config{Workers: 0, QueueSize: 100},
+			wantErr: true,
+		},
+		{
+			name:    "should return error, if queue size is negative",
+			config:  Config{Workers: 4, QueueSize: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config, Clients{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
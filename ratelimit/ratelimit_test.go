@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+
+	type request struct {
+		key string
+		at  time.Duration
+	}
+	tests := []struct {
+		name          string
+		rate          float64
+		burst         int
+		requests      []request
+		wantAllowed   []bool
+		wantLastRetry time.Duration
+	}{
+		{
+			name:  "should allow requests within burst",
+			rate:  1,
+			burst: 3,
+			requests: []request{
+				{key: "a", at: 0},
+				{key: "a", at: 0},
+				{key: "a", at: 0},
+			},
+			wantAllowed:   []bool{true, true, true},
+			wantLastRetry: 0,
+		},
+		{
+			name:  "should deny requests over burst until refilled",
+			rate:  2,
+			burst: 2,
+			requests: []request{
+				{key: "a", at: 0},
+				{key: "a", at: 0},
+				{key: "a", at: 0},
+			},
+			wantAllowed:   []bool{true, true, false},
+			wantLastRetry: 500 * time.Millisecond,
+		},
+		{
+			name:  "should allow request after refill",
+			rate:  2,
+			burst: 1,
+			requests: []request{
+				{key: "a", at: 0},
+				{key: "a", at: 100 * time.Millisecond},
+				{key: "a", at: 500 * time.Millisecond},
+			},
+			wantAllowed:   []bool{true, false, true},
+			wantLastRetry: 0,
+		},
+		{
+			name:  "should limit keys separately",
+			rate:  1,
+			burst: 1,
+			requests: []request{
+				{key: "a", at: 0},
+				{key: "b", at: 0},
+				{key: "a", at: 0},
+			},
+			wantAllowed:   []bool{true, true, false},
+			wantLastRetry: time.Second,
+		},
+		{
+			name:  "should allow everything, if rate is zero",
+			rate:  0,
+			burst: 1,
+			requests: []request{
+				{key: "a", at: 0},
+				{key: "a", at: 0},
+			},
+			wantAllowed:   []bool{true, true},
+			wantLastRetry: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate, tt.burst)
+
+			var retryAfter time.Duration
+			for i, req := range tt.requests {
+				var allowed bool
+				allowed, retryAfter = l.Allow(req.key, now.Add(req.at))
+				if allowed != tt.wantAllowed[i] {
+					t.Errorf("Allow() request %d allowed = %v, want %v", i, allowed, tt.wantAllowed[i])
+				}
+			}
+
+			if retryAfter != tt.wantLastRetry {
+				t.Errorf("Allow() retryAfter = %v, want %v", retryAfter, tt.wantLastRetry)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 2)
+
+	l.Allow("a", now)
+	l.Allow("b", now.Add(sweepInterval-time.Second))
+	l.Allow("b", now.Add(sweepInterval-time.Second))
+	l.Allow("c", now.Add(sweepInterval))
+
+	_, exists := l.buckets["a"]
+	if exists {
+		t.Errorf("Allow() bucket a kept, want it swept after refilling")
+	}
+
+	_, exists = l.buckets["b"]
+	if !exists {
+		t.Errorf("Allow() bucket b swept, want it kept until refilled")
+	}
+}
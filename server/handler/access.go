@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/go-chi/chi/v5"
+)
+
+// authorize returns an error if the access policy of the request doesn't
+// allow the permission on the device.
+func authorize(r *http.Request, deviceID string, permission access.Permission) error {
+	if !access.FromContext(r.Context()).Allows(deviceID, permission) {
+		return fmt.Errorf("permission %s on device %s is required", permission, deviceID)
+	}
+
+	return nil
+}
+
+type RolesFetcher interface {
+	FetchRoles(ctx context.Context) ([]access.Role, error)
+}
+
+func GetRoles(fetcher RolesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roles, err := fetcher.FetchRoles(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching roles: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(roles)
+		handleWritingErr(r, err)
+	}
+}
+
+type RoleUpdater interface {
+	UpdateRole(ctx context.Context, role *access.Role) (*access.Role, error)
+}
+
+// UpdateRole creates the role, or replaces the grants of an existing one.
+func UpdateRole(updater RoleUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var role access.Role
+		err := json.NewDecoder(r.Body).Decode(&role)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding role: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		role.Name = chi.URLParam(r, "role")
+
+		err = role.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating role: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedRole, err := updater.UpdateRole(r.Context(), &role)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error updating role: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedRole)
+		handleWritingErr(r, err)
+	}
+}
+
+type RoleDeleter interface {
+	DeleteRole(ctx context.Context, name string) error
+}
+
+func DeleteRole(deleter RoleDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := deleter.DeleteRole(r.Context(), chi.URLParam(r, "role"))
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("role not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting role: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type UsersFetcher interface {
+	FetchUsers(ctx context.Context) ([]access.User, error)
+}
+
+func GetUsers(fetcher UsersFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := fetcher.FetchUsers(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching users: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(users)
+		handleWritingErr(r, err)
+	}
+}
+
+type UserUpdater interface {
+	UpdateUser(ctx context.Context, user *access.User) (*access.User, error)
+}
+
+// UpdateUser assigns roles to the user, replacing the ones it had.
+func UpdateUser(updater UserUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, err := userSubject(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		var user access.User
+		err = json.NewDecoder(r.Body).Decode(&user)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding user: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		user.Subject = subject
+
+		err = user.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating user: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedUser, err := updater.UpdateUser(r.Context(), &user)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrConflict:
+				HandleError(w, r, fmt.Errorf("error updating user: %v", err), http.StatusConflict, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating user: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedUser)
+		handleWritingErr(r, err)
+	}
+}
+
+type UserDeleter interface {
+	DeleteUser(ctx context.Context, subject string) error
+}
+
+func DeleteUser(deleter UserDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, err := userSubject(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		err = deleter.DeleteUser(r.Context(), subject)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("user not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting user: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// userSubject returns the subject of the user the request is for. Subjects of
+// identity providers may contain characters that are escaped in the path.
+func userSubject(r *http.Request) (string, error) {
+	subject, err := url.PathUnescape(chi.URLParam(r, "subject"))
+	if err != nil {
+		return "", fmt.Errorf("error unescaping subject: %v", err)
+	}
+
+	return subject, nil
+}
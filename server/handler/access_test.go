@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+)
+
+func TestAuthorize(t *testing.T) {
+	policy := &access.Policy{Grants: []access.Grant{
+		{DeviceID: "bedroom", Permission: access.SetTemperaturePermission},
+		{DeviceID: "office", Permission: access.ViewPermission},
+	}}
+
+	tests := []struct {
+		name       string
+		policy     *access.Policy
+		deviceID   string
+		permission access.Permission
+		wantErr    bool
+	}{
+		{
+			name:       "should allow viewing with set temperature grant",
+			policy:     policy,
+			deviceID:   "bedroom",
+			permission: access.ViewPermission,
+			wantErr:    false,
+		},
+		{
+			name:       "should allow viewing with view grant",
+			policy:     policy,
+			deviceID:   "office",
+			permission: access.ViewPermission,
+			wantErr:    false,
+		},
+		{
+			name:       "should return error, if permission isn't granted on device",
+			policy:     policy,
+			deviceID:   "bedroom",
+			permission: access.AdminPermission,
+			wantErr:    true,
+		},
+		{
+			name:       "should return error, if device isn't granted",
+			policy:     policy,
+			deviceID:   "living_room",
+			permission: access.ViewPermission,
+			wantErr:    true,
+		},
+		{
+			name:       "should allow everything, if request isn't restricted",
+			policy:     nil,
+			deviceID:   "living_room",
+			permission: access.AdminPermission,
+			wantErr:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/target-state/"+tt.deviceID, nil)
+			req = req.WithContext(access.WithContext(req.Context(), tt.policy))
+
+			err := authorize(req, tt.deviceID, tt.permission)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type fakeAccessStore struct {
+	Roles map[string]access.Role
+	Users map[string]access.User
+
+	shouldFail bool
+}
+
+func (f *fakeAccessStore) UpdateRole(ctx context.Context, role *access.Role) (*access.Role, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	f.Roles[role.Name] = *role
+
+	return role, nil
+}
+
+func (f *fakeAccessStore) UpdateUser(ctx context.Context, user *access.User) (*access.User, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	for _, role := range user.Roles {
+		_, exists := f.Roles[role]
+		if !exists {
+			return nil, &client.ErrConflict{Err: fmt.Errorf("role %s doesn't exist", role)}
+		}
+	}
+
+	f.Users[user.Subject] = *user
+
+	return user, nil
+}
+
+func TestUpdateRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeAccessStore
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should update role",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}},
+			body:       `{"grants": [{"deviceId": "bedroom", "permission": "SET_TEMPERATURE", "minTemperature": 18, "maxTemperature": 22}]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 400, if permission is unknown",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}},
+			body:       `{"grants": [{"deviceId": "bedroom", "permission": "OWNER"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if temperature range is inverted",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}},
+			body:       `{"grants": [{"deviceId": "bedroom", "permission": "SET_TEMPERATURE", "minTemperature": 22, "maxTemperature": 18}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if temperature range is set on another permission",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}},
+			body:       `{"grants": [{"deviceId": "bedroom", "permission": "VIEW", "maxTemperature": 22}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to update",
+			store:      &fakeAccessStore{shouldFail: true},
+			body:       `{"grants": []}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/access/roles/kid", bytes.NewReader([]byte(tt.body))), map[string]string{
+				"role": "kid",
+			})
+			handler := UpdateRole(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateRole() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			_, updated := tt.store.Roles["kid"]
+			if updated != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("UpdateRole() updated = %v, want %v", updated, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		store       *fakeAccessStore
+		subject     string
+		body        string
+		wantStatus  int
+		wantSubject string
+	}{
+		{
+			name:        "should update user",
+			store:       &fakeAccessStore{Roles: map[string]access.Role{"kid": {Name: "kid"}}, Users: map[string]access.User{}},
+			subject:     "user-1",
+			body:        `{"name": "Alex", "roles": ["kid"]}`,
+			wantStatus:  http.StatusOK,
+			wantSubject: "user-1",
+		},
+		{
+			name:        "should unescape subject",
+			store:       &fakeAccessStore{Roles: map[string]access.Role{"kid": {Name: "kid"}}, Users: map[string]access.User{}},
+			subject:     "auth0%7C123",
+			body:        `{"roles": ["kid"]}`,
+			wantStatus:  http.StatusOK,
+			wantSubject: "auth0|123",
+		},
+		{
+			name:       "should return error 409, if role doesn't exist",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}, Users: map[string]access.User{}},
+			subject:    "user-1",
+			body:       `{"roles": ["kid"]}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "should return error 400, if role is empty",
+			store:      &fakeAccessStore{Roles: map[string]access.Role{}, Users: map[string]access.User{}},
+			subject:    "user-1",
+			body:       `{"roles": [""]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to update",
+			store:      &fakeAccessStore{shouldFail: true},
+			subject:    "user-1",
+			body:       `{"roles": []}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/access/users/"+tt.subject, bytes.NewReader([]byte(tt.body))), map[string]string{
+				"subject": tt.subject,
+			})
+			handler := UpdateUser(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateUser() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantSubject == "" {
+				return
+			}
+
+			user, exists := tt.store.Users[tt.wantSubject]
+			if !exists || !slices.Equal(user.Roles, []string{"kid"}) {
+				t.Errorf("UpdateUser() stored users = %+v, want %s with role kid", tt.store.Users, tt.wantSubject)
+			}
+		})
+	}
+}
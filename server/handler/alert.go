@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+	"github.com/go-chi/chi/v5"
+)
+
+type AlertRulesFetcher interface {
+	FetchAlertRules(ctx context.Context) ([]alert.Rule, error)
+}
+
+func GetAlertRules(fetcher AlertRulesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := fetcher.FetchAlertRules(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching alert rules: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(rules)
+		handleWritingErr(r, err)
+	}
+}
+
+type AlertRuleFetcher interface {
+	FetchAlertRule(ctx context.Context, id int64) (*alert.Rule, error)
+}
+
+func GetAlertRule(fetcher AlertRuleFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := alertRuleID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		rule, err := fetcher.FetchAlertRule(r.Context(), id)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("alert rule not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching alert rule: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(rule)
+		handleWritingErr(r, err)
+	}
+}
+
+type AlertRuleAdder interface {
+	AddAlertRule(ctx context.Context, rule *alert.Rule) (*alert.Rule, error)
+}
+
+func AddAlertRule(adder AlertRuleAdder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rule alert.Rule
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding alert rule: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		err = rule.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating alert rule: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		addedRule, err := adder.AddAlertRule(r.Context(), &rule)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error adding alert rule: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		err = json.NewEncoder(w).Encode(addedRule)
+		handleWritingErr(r, err)
+	}
+}
+
+type AlertRuleUpdater interface {
+	UpdateAlertRule(ctx context.Context, rule *alert.Rule) (*alert.Rule, error)
+}
+
+// UpdateAlertRule replaces the rule. Devices it fires for are notified again
+// on its next evaluation.
+func UpdateAlertRule(updater AlertRuleUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := alertRuleID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		var rule alert.Rule
+		err = json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding alert rule: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		rule.ID = id
+
+		err = rule.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating alert rule: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedRule, err := updater.UpdateAlertRule(r.Context(), &rule)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("alert rule not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating alert rule: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedRule)
+		handleWritingErr(r, err)
+	}
+}
+
+type AlertRuleDeleter interface {
+	DeleteAlertRule(ctx context.Context, id int64) error
+}
+
+func DeleteAlertRule(deleter AlertRuleDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := alertRuleID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		err = deleter.DeleteAlertRule(r.Context(), id)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("alert rule not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting alert rule: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type AlertStatesFetcher interface {
+	FetchAlertStates(ctx context.Context, status *alert.Status) ([]alert.State, error)
+}
+
+// GetAlerts returns the state of every rule for the devices it fired for,
+// optionally filtered by status.
+func GetAlerts(fetcher AlertStatesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status *alert.Status
+		if statusParam := r.URL.Query().Get("status"); statusParam != "" {
+			s := alert.Status(statusParam)
+			if s != alert.FiringStatus && s != alert.ResolvedStatus {
+				HandleError(w, r, fmt.Errorf("status must be one of %s or %s, got: '%s'", alert.FiringStatus, alert.ResolvedStatus, statusParam), http.StatusBadRequest, false)
+				return
+			}
+			status = &s
+		}
+
+		states, err := fetcher.FetchAlertStates(r.Context(), status)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching alert states: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(states)
+		handleWritingErr(r, err)
+	}
+}
+
+func alertRuleID(r *http.Request) (int64, error) {
+	idParam := chi.URLParam(r, "ruleID")
+
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("rule ID must be an integer, got: '%s'", idParam)
+	}
+
+	return id, nil
+}
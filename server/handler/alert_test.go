@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/alert"
+)
+
+type fakeAlertRuleStore struct {
+	Rules map[int64]alert.Rule
+
+	shouldFail bool
+}
+
+func (f *fakeAlertRuleStore) AddAlertRule(ctx context.Context, rule *alert.Rule) (*alert.Rule, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if f.Rules == nil {
+		f.Rules = make(map[int64]alert.Rule)
+	}
+
+	added := *rule
+	added.ID = int64(len(f.Rules) + 1)
+	f.Rules[added.ID] = added
+
+	return &added, nil
+}
+
+func (f *fakeAlertRuleStore) UpdateAlertRule(ctx context.Context, rule *alert.Rule) (*alert.Rule, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	_, exists := f.Rules[rule.ID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("alert rule %d not found", rule.ID)}
+	}
+
+	f.Rules[rule.ID] = *rule
+
+	return rule, nil
+}
+
+const testAlertRule = `{
+	"name": "Living room too cold",
+	"kind": "TEMPERATURE_RANGE",
+	"deviceId": "test_device_id",
+	"min": 16,
+	"channels": [{"type": "WEBHOOK", "target": "https://example.com/hook"}]
+}`
+
+func TestAddAlertRule(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeAlertRuleStore
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should add alert rule",
+			store:      &fakeAlertRuleStore{},
+			body:       testAlertRule,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "should return error 400, if rule has no channels",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Living room too cold", "kind": "TEMPERATURE_RANGE", "min": 16, "channels": []}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if rule is missing its threshold",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Device offline", "kind": "DEVICE_OFFLINE", "channels": [{"type": "MQTT", "target": "alerts"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if channel target is invalid",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Too humid", "kind": "HUMIDITY_HIGH", "max": 70, "channels": [{"type": "EMAIL", "target": "not an address"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should add alert rule with mqtt channel",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Too humid", "kind": "HUMIDITY_HIGH", "max": 70, "channels": [{"type": "MQTT", "target": "alerts/humidity"}]}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "should return error 400, if mqtt channel target has wildcards",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Too humid", "kind": "HUMIDITY_HIGH", "max": 70, "channels": [{"type": "MQTT", "target": "alerts/#"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if mqtt channel target is a topic of devices",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Too humid", "kind": "HUMIDITY_HIGH", "max": 70, "channels": [{"type": "MQTT", "target": "thermostat/set/target-state"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if mqtt channel target is a topic of devices of a home",
+			store:      &fakeAlertRuleStore{},
+			body:       `{"name": "Too humid", "kind": "HUMIDITY_HIGH", "max": 70, "channels": [{"type": "MQTT", "target": "smiths/thermostat/set/target-state"}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to add",
+			store:      &fakeAlertRuleStore{shouldFail: true},
+			body:       testAlertRule,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/alerts/rules", bytes.NewReader([]byte(tt.body)))
+			handler := AddAlertRule(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AddAlertRule() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resBody alert.Rule
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("AddAlertRule() error json decoding response body: %v", err)
+			}
+
+			if resBody.ID != 1 || len(resBody.Channels) != 1 {
+				t.Errorf("AddAlertRule() response body = %+v, want rule 1 with a channel", resBody)
+			}
+		})
+	}
+}
+
+func TestUpdateAlertRule(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeAlertRuleStore
+		ruleID     string
+		wantStatus int
+	}{
+		{
+			name:       "should update alert rule",
+			store:      &fakeAlertRuleStore{Rules: map[int64]alert.Rule{1: {ID: 1}}},
+			ruleID:     "1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 404, if rule is not found",
+			store:      &fakeAlertRuleStore{Rules: map[int64]alert.Rule{}},
+			ruleID:     "1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 400, if rule ID is invalid",
+			store:      &fakeAlertRuleStore{},
+			ruleID:     "first",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to update",
+			store:      &fakeAlertRuleStore{shouldFail: true},
+			ruleID:     "1",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/alerts/rules/"+tt.ruleID, bytes.NewReader([]byte(testAlertRule))), map[string]string{
+				"ruleID": tt.ruleID,
+			})
+			handler := UpdateAlertRule(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("UpdateAlertRule() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/go-chi/chi/v5"
+)
+
+type APIKeysFetcher interface {
+	FetchAPIKeys(ctx context.Context) ([]apikey.Key, error)
+}
+
+func GetAPIKeys(fetcher APIKeysFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := fetcher.FetchAPIKeys(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching api keys: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(keys)
+		handleWritingErr(r, err)
+	}
+}
+
+type APIKeyAdder interface {
+	AddAPIKey(ctx context.Context, key *apikey.Key) (*apikey.Key, error)
+}
+
+// AddAPIKey issues a new key. The key is only ever returned in this response.
+func AddAPIKey(adder APIKeyAdder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key apikey.Key
+		err := json.NewDecoder(r.Body).Decode(&key)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding api key: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		err = key.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating api key: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		key.Token, key.Prefix, key.Hash, err = apikey.Generate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error generating api key: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		addedKey, err := adder.AddAPIKey(r.Context(), &key)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error adding api key: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		err = json.NewEncoder(w).Encode(addedKey)
+		handleWritingErr(r, err)
+	}
+}
+
+type APIKeyRevoker interface {
+	RevokeAPIKey(ctx context.Context, id int64, revokedAt time.Time) error
+}
+
+func RevokeAPIKey(revoker APIKeyRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idParam := chi.URLParam(r, "keyID")
+
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("key ID must be an integer, got: '%s'", idParam), http.StatusBadRequest, false)
+			return
+		}
+
+		err = revoker.RevokeAPIKey(r.Context(), id, time.Now())
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("api key not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error revoking api key: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
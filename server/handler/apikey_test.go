@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+)
+
+type fakeAPIKeyStore struct {
+	Keys map[int64]apikey.Key
+
+	shouldFail bool
+}
+
+func (f *fakeAPIKeyStore) AddAPIKey(ctx context.Context, key *apikey.Key) (*apikey.Key, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if f.Keys == nil {
+		f.Keys = make(map[int64]apikey.Key)
+	}
+
+	added := *key
+	added.ID = int64(len(f.Keys) + 1)
+	f.Keys[added.ID] = added
+
+	return &added, nil
+}
+
+func (f *fakeAPIKeyStore) RevokeAPIKey(ctx context.Context, id int64, revokedAt time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	key, exists := f.Keys[id]
+	if !exists || key.RevokedAt != nil {
+		return &client.ErrNotFound{Err: errors.New("active api key not found")}
+	}
+
+	key.RevokedAt = &revokedAt
+	f.Keys[id] = key
+
+	return nil
+}
+
+func TestAddAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeAPIKeyStore
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should issue api key",
+			store:      &fakeAPIKeyStore{},
+			body:       `{"name": "Home Assistant", "scopes": ["read", "write"]}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "should return error 400, if scope is unknown",
+			store:      &fakeAPIKeyStore{},
+			body:       `{"name": "Home Assistant", "scopes": ["everything"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if name is missing",
+			store:      &fakeAPIKeyStore{},
+			body:       `{"scopes": ["read"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to add",
+			store:      &fakeAPIKeyStore{shouldFail: true},
+			body:       `{"name": "Home Assistant", "scopes": ["read"]}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/api-keys", bytes.NewReader([]byte(tt.body)))
+			handler := AddAPIKey(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AddAPIKey() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resBody apikey.Key
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("AddAPIKey() error json decoding response body: %v", err)
+			}
+
+			if !strings.HasPrefix(resBody.Token, resBody.Prefix) || len(resBody.Scopes) != 2 {
+				t.Errorf("AddAPIKey() response body = %+v, want token starting with its prefix and 2 scopes", resBody)
+			}
+
+			// Only the hash of the returned token is stored
+			stored := tt.store.Keys[resBody.ID]
+			if stored.Hash != apikey.Hash(resBody.Token) {
+				t.Errorf("AddAPIKey() stored hash = %s, want hash of returned token", stored.Hash)
+			}
+		})
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeAPIKeyStore
+		keyID      string
+		wantStatus int
+	}{
+		{
+			name:       "should revoke api key",
+			store:      &fakeAPIKeyStore{Keys: map[int64]apikey.Key{1: {ID: 1}}},
+			keyID:      "1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "should return error 404, if key is not found",
+			store:      &fakeAPIKeyStore{Keys: map[int64]apikey.Key{}},
+			keyID:      "1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 400, if key ID is invalid",
+			store:      &fakeAPIKeyStore{},
+			keyID:      "first",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to revoke",
+			store:      &fakeAPIKeyStore{shouldFail: true},
+			keyID:      "1",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodDelete, "/api/v1/api-keys/"+tt.keyID, nil), map[string]string{
+				"keyID": tt.keyID,
+			})
+			handler := RevokeAPIKey(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("RevokeAPIKey() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+	"github.com/go-chi/chi/v5"
+)
+
+type ControlSettingsFetcher interface {
+	FetchControlSettings(ctx context.Context, deviceID string) (*control.Settings, error)
+}
+
+func GetControlSettings(fetcher ControlSettingsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		settings, err := fetcher.FetchControlSettings(r.Context(), deviceID)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching control settings: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(settings)
+		handleWritingErr(r, err)
+	}
+}
+
+type ControlSettingsUpdater interface {
+	UpdateControlSettings(ctx context.Context, settings *control.Settings) (*control.Settings, error)
+}
+
+// UpdateControlSettings hands control of the device over to the server, or
+// back to the device. The server switches the relay of a server controlled
+// device on its next run.
+func UpdateControlSettings(updater ControlSettingsUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := authorize(r, chi.URLParam(r, "deviceID"), access.AdminPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		var settings control.Settings
+		err = json.NewDecoder(r.Body).Decode(&settings)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding control settings: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		settings.DeviceID = chi.URLParam(r, "deviceID")
+
+		err = settings.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating control settings: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedSettings, err := updater.UpdateControlSettings(r.Context(), &settings)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error updating control settings: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedSettings)
+		handleWritingErr(r, err)
+	}
+}
+
+type ControlDecisionsFetcher interface {
+	FetchControlDecisions(ctx context.Context, deviceID string, limit int) ([]control.Decision, error)
+}
+
+const (
+	defaultControlDecisionsLimit = 100
+	maxControlDecisionsLimit     = 1000
+)
+
+func GetControlDecisions(fetcher ControlDecisionsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		limit := defaultControlDecisionsLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > maxControlDecisionsLimit {
+				HandleError(w, r, fmt.Errorf("limit must be an integer in range [1,%d], got: '%s'", maxControlDecisionsLimit, limitParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		decisions, err := fetcher.FetchControlDecisions(r.Context(), deviceID, limit)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching control decisions: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(decisions)
+		handleWritingErr(r, err)
+	}
+}
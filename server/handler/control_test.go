@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/model/control"
+)
+
+type fakeControlSettingsStore struct {
+	Settings map[string]control.Settings
+
+	shouldFail bool
+}
+
+func (f *fakeControlSettingsStore) UpdateControlSettings(ctx context.Context, settings *control.Settings) (*control.Settings, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if f.Settings == nil {
+		f.Settings = make(map[string]control.Settings)
+	}
+	f.Settings[settings.DeviceID] = *settings
+
+	return settings, nil
+}
+
+func TestUpdateControlSettings(t *testing.T) {
+	type args struct {
+		store *fakeControlSettingsStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *control.Settings
+	}{
+		{
+			name: "should hand control over to the server",
+			args: args{
+				store: &fakeControlSettingsStore{},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/control", bytes.NewReader(
+					[]byte(`{"controlledBy": "server"}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody:   &control.Settings{DeviceID: "test_device_id", ControlledBy: control.ServerControlled},
+		},
+		{
+			name: "should return error 400, if controlled by is invalid",
+			args: args{
+				store: &fakeControlSettingsStore{},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/control", bytes.NewReader(
+					[]byte(`{"controlledBy": "cloud"}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to update",
+			args: args{
+				store: &fakeControlSettingsStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/control", bytes.NewReader(
+					[]byte(`{"controlledBy": "server"}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := UpdateControlSettings(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("UpdateControlSettings() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("UpdateControlSettings() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody control.Settings
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("UpdateControlSettings() error json decoding response body: %v", err)
+			}
+
+			if resBody != *tt.wantBody {
+				t.Errorf("UpdateControlSettings() response body = %+v, want %+v", resBody, *tt.wantBody)
+			}
+		})
+	}
+}
@@ -8,25 +8,33 @@ import (
 
 	"github.com/alexchebotarsky/thermostat-api/client"
 	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/go-chi/chi/v5"
 )
 
 type CurrentStateFetcher interface {
-	FetchCurrentState(ctx context.Context, deviceID string) (*thermostat.CurrentState, error)
+	FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error)
 }
 
 func GetCurrentState(fetcher CurrentStateFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		deviceID := chi.URLParam(r, "deviceID")
 
-		state, err := fetcher.FetchCurrentState(r.Context(), deviceID)
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		state, err := fetcher.FetchCurrentState(r.Context(), home.FromContext(r.Context()).ID, deviceID)
 		if err != nil {
 			switch err.(type) {
 			case *client.ErrNotFound:
-				HandleError(w, fmt.Errorf("current state not found: %v", err), http.StatusNotFound, true)
+				HandleError(w, r, fmt.Errorf("current state not found: %v", err), http.StatusNotFound, true)
 			default:
-				HandleError(w, fmt.Errorf("error fetching current state: %v", err), http.StatusInternalServerError, true)
+				HandleError(w, r, fmt.Errorf("error fetching current state: %v", err), http.StatusInternalServerError, true)
 			}
 			return
 		}
@@ -36,7 +44,7 @@ func GetCurrentState(fetcher CurrentStateFetcher) http.HandlerFunc {
 			// Clear metrics for invalid device
 			metrics.DeleteThermostatMetrics(deviceID)
 
-			HandleError(w, fmt.Errorf("error invalid current state: %v", err), http.StatusInternalServerError, true)
+			HandleError(w, r, fmt.Errorf("error invalid current state: %v", err), http.StatusInternalServerError, true)
 			return
 		}
 
@@ -44,6 +52,6 @@ func GetCurrentState(fetcher CurrentStateFetcher) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 
 		err = json.NewEncoder(w).Encode(state)
-		handleWritingErr(err)
+		handleWritingErr(r, err)
 	}
 }
@@ -19,7 +19,7 @@ type fakeCurrentStateFetcher struct {
 	shouldFail bool
 }
 
-func (f *fakeCurrentStateFetcher) FetchCurrentState(ctx context.Context, deviceID string) (*thermostat.CurrentState, error) {
+func (f *fakeCurrentStateFetcher) FetchCurrentState(ctx context.Context, homeID, deviceID string) (*thermostat.CurrentState, error) {
 	if f.shouldFail {
 		return nil, errors.New("test error")
 	}
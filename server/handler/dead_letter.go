@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+)
+
+type DeadLetterFetcher interface {
+	FetchDeadLetters(ctx context.Context, limit int) ([]deadletter.DeadLetter, error)
+}
+
+const (
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 1000
+)
+
+func GetDeadLetters(fetcher DeadLetterFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultDeadLettersLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > maxDeadLettersLimit {
+				HandleError(w, r, fmt.Errorf("limit must be an integer in range [1,%d], got: '%s'", maxDeadLettersLimit, limitParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		letters, err := fetcher.FetchDeadLetters(r.Context(), limit)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching dead letters: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(letters)
+		handleWritingErr(r, err)
+	}
+}
+
+type DeadLetterManager interface {
+	FetchDeadLetter(ctx context.Context, id int64) (*deadletter.DeadLetter, error)
+	MarkDeadLetterReplayed(ctx context.Context, id int64, replayedAt time.Time) error
+}
+
+type MessageReplayer interface {
+	Replay(ctx context.Context, topic string, payload []byte, receivedAt time.Time) error
+}
+
+type replayRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+type replayResult struct {
+	ID       int64  `json:"id"`
+	Replayed bool   `json:"replayed"`
+	Error    string `json:"error,omitempty"`
+}
+
+type replayResponse struct {
+	Results []replayResult `json:"results"`
+}
+
+func ReplayDeadLetters(manager DeadLetterManager, replayer MessageReplayer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req replayRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding replay request: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		if len(req.IDs) == 0 {
+			HandleError(w, r, fmt.Errorf("ids cannot be empty"), http.StatusBadRequest, false)
+			return
+		}
+
+		res := replayResponse{
+			Results: make([]replayResult, 0, len(req.IDs)),
+		}
+
+		for _, id := range req.IDs {
+			result := replayResult{ID: id}
+
+			err := replayDeadLetter(r.Context(), manager, replayer, id)
+			if err != nil {
+				switch err.(type) {
+				case *client.ErrNotFound:
+					result.Error = "dead letter not found"
+				default:
+					result.Error = err.Error()
+				}
+			} else {
+				result.Replayed = true
+			}
+
+			res.Results = append(res.Results, result)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(res)
+		handleWritingErr(r, err)
+	}
+}
+
+func replayDeadLetter(ctx context.Context, manager DeadLetterManager, replayer MessageReplayer, id int64) error {
+	letter, err := manager.FetchDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = replayer.Replay(ctx, letter.Topic, letter.Payload, letter.ReceivedAt)
+	if err != nil {
+		return fmt.Errorf("error replaying dead letter: %v", err)
+	}
+
+	err = manager.MarkDeadLetterReplayed(ctx, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("error marking dead letter as replayed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/deadletter"
+)
+
+type fakeDeadLetterStore struct {
+	Letters map[int64]deadletter.DeadLetter
+
+	shouldFail bool
+}
+
+func (f *fakeDeadLetterStore) FetchDeadLetters(ctx context.Context, limit int) ([]deadletter.DeadLetter, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	letters := []deadletter.DeadLetter{}
+	for _, letter := range f.Letters {
+		if len(letters) == limit {
+			break
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, nil
+}
+
+func (f *fakeDeadLetterStore) FetchDeadLetter(ctx context.Context, id int64) (*deadletter.DeadLetter, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	letter, exists := f.Letters[id]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("dead letter not found")}
+	}
+
+	return &letter, nil
+}
+
+func (f *fakeDeadLetterStore) MarkDeadLetterReplayed(ctx context.Context, id int64, replayedAt time.Time) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	letter := f.Letters[id]
+	letter.ReplayedAt = &replayedAt
+	f.Letters[id] = letter
+
+	return nil
+}
+
+type fakeMessageReplayer struct {
+	Payloads []string
+
+	// Payloads that should still be rejected when replayed
+	rejected map[string]bool
+}
+
+func (f *fakeMessageReplayer) Replay(ctx context.Context, topic string, payload []byte, receivedAt time.Time) error {
+	if f.rejected[string(payload)] {
+		return errors.New("test error")
+	}
+
+	f.Payloads = append(f.Payloads, string(payload))
+
+	return nil
+}
+
+func TestGetDeadLetters(t *testing.T) {
+	type args struct {
+		store *fakeDeadLetterStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantLen    int
+	}{
+		{
+			name: "should fetch dead letters",
+			args: args{
+				store: &fakeDeadLetterStore{
+					Letters: map[int64]deadletter.DeadLetter{
+						1: {ID: 1, Topic: "thermostat/current-state", Payload: []byte("{"), Reason: "test reason"},
+						2: {ID: 2, Topic: "thermostat/current-state", Payload: []byte("{"), Reason: "test reason"},
+					},
+				},
+				req: httptest.NewRequest(http.MethodGet, "/api/v1/admin/dead-letters", nil),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantLen:    2,
+		},
+		{
+			name: "should fetch dead letters up to limit",
+			args: args{
+				store: &fakeDeadLetterStore{
+					Letters: map[int64]deadletter.DeadLetter{
+						1: {ID: 1, Topic: "thermostat/current-state", Payload: []byte("{"), Reason: "test reason"},
+						2: {ID: 2, Topic: "thermostat/current-state", Payload: []byte("{"), Reason: "test reason"},
+					},
+				},
+				req: httptest.NewRequest(http.MethodGet, "/api/v1/admin/dead-letters?limit=1", nil),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantLen:    1,
+		},
+		{
+			name: "should return error 400, if limit is invalid",
+			args: args{
+				store: &fakeDeadLetterStore{},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/admin/dead-letters?limit=abc", nil),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to fetch",
+			args: args{
+				store: &fakeDeadLetterStore{shouldFail: true},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/admin/dead-letters", nil),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := GetDeadLetters(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetDeadLetters() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("GetDeadLetters() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody []deadletter.DeadLetter
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetDeadLetters() error json decoding response body: %v", err)
+			}
+
+			if len(resBody) != tt.wantLen {
+				t.Errorf("GetDeadLetters() len(response body) = %d, want %d", len(resBody), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	type args struct {
+		store    *fakeDeadLetterStore
+		replayer *fakeMessageReplayer
+		req      *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *replayResponse
+		// Replayer expectations
+		wantReplayed []string
+	}{
+		{
+			name: "should replay selected dead letters",
+			args: args{
+				store: &fakeDeadLetterStore{
+					Letters: map[int64]deadletter.DeadLetter{
+						1: {ID: 1, Topic: "thermostat/current-state", Payload: []byte("first")},
+						2: {ID: 2, Topic: "thermostat/current-state", Payload: []byte("second")},
+						3: {ID: 3, Topic: "thermostat/current-state", Payload: []byte("third")},
+					},
+				},
+				replayer: &fakeMessageReplayer{},
+				req: httptest.NewRequest(http.MethodPost, "/api/v1/admin/dead-letters/replay", bytes.NewReader(
+					[]byte(`{"ids": [1, 3]}`),
+				)),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody: &replayResponse{
+				Results: []replayResult{
+					{ID: 1, Replayed: true},
+					{ID: 3, Replayed: true},
+				},
+			},
+			wantReplayed: []string{"first", "third"},
+		},
+		{
+			name: "should report dead letters that failed to replay or were not found",
+			args: args{
+				store: &fakeDeadLetterStore{
+					Letters: map[int64]deadletter.DeadLetter{
+						1: {ID: 1, Topic: "thermostat/current-state", Payload: []byte("first")},
+						2: {ID: 2, Topic: "thermostat/current-state", Payload: []byte("second")},
+					},
+				},
+				replayer: &fakeMessageReplayer{
+					rejected: map[string]bool{"second": true},
+				},
+				req: httptest.NewRequest(http.MethodPost, "/api/v1/admin/dead-letters/replay", bytes.NewReader(
+					[]byte(`{"ids": [1, 2, 5]}`),
+				)),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody: &replayResponse{
+				Results: []replayResult{
+					{ID: 1, Replayed: true},
+					{ID: 2, Replayed: false, Error: "error replaying dead letter: test error"},
+					{ID: 5, Replayed: false, Error: "dead letter not found"},
+				},
+			},
+			wantReplayed: []string{"first"},
+		},
+		{
+			name: "should return error 400, if request body is invalid JSON",
+			args: args{
+				store:    &fakeDeadLetterStore{},
+				replayer: &fakeMessageReplayer{},
+				req: httptest.NewRequest(http.MethodPost, "/api/v1/admin/dead-letters/replay", bytes.NewReader(
+					[]byte(`{"ids": [`),
+				)),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if ids are empty",
+			args: args{
+				store:    &fakeDeadLetterStore{},
+				replayer: &fakeMessageReplayer{},
+				req: httptest.NewRequest(http.MethodPost, "/api/v1/admin/dead-letters/replay", bytes.NewReader(
+					[]byte(`{"ids": []}`),
+				)),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := ReplayDeadLetters(tt.args.store, tt.args.replayer)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ReplayDeadLetters() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("ReplayDeadLetters() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody replayResponse
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("ReplayDeadLetters() error json decoding response body: %v", err)
+			}
+
+			if !reflect.DeepEqual(&resBody, tt.wantBody) {
+				t.Errorf("ReplayDeadLetters() response body = %v, want %v", resBody, tt.wantBody)
+			}
+
+			if !reflect.DeepEqual(tt.args.replayer.Payloads, tt.wantReplayed) {
+				t.Errorf("ReplayDeadLetters() replayed = %v, want %v", tt.args.replayer.Payloads, tt.wantReplayed)
+			}
+
+			for _, result := range resBody.Results {
+				if !result.Replayed {
+					continue
+				}
+				if tt.args.store.Letters[result.ID].ReplayedAt == nil {
+					t.Errorf("ReplayDeadLetters() store.Letters[%d].ReplayedAt = nil, want set", result.ID)
+				}
+			}
+		})
+	}
+}
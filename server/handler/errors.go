@@ -2,12 +2,14 @@ package handler
 
 import (
 	"fmt"
-	"log/slog"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
 )
 
-func handleWritingErr(err error) {
+func handleWritingErr(r *http.Request, err error) {
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error writing to http.ResponseWriter: %v", err))
+		logger.FromContext(r.Context()).Error(fmt.Sprintf("Error writing to http.ResponseWriter: %v", err))
 	}
 }
 
@@ -3,13 +3,14 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
-	"log/slog"
 	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
 )
 
-func HandleError(w http.ResponseWriter, handlerErr error, statusCode int, shouldLog bool) {
+func HandleError(w http.ResponseWriter, r *http.Request, handlerErr error, statusCode int, shouldLog bool) {
 	if shouldLog {
-		slog.Error(fmt.Sprintf("Handler error: %v", handlerErr), "status", statusCode)
+		logger.FromContext(r.Context()).Error(fmt.Sprintf("Handler error: %v", handlerErr), "status", statusCode)
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -25,5 +26,5 @@ func HandleError(w http.ResponseWriter, handlerErr error, statusCode int, should
 		Error:      returnedErr.Error(),
 		StatusCode: statusCode,
 	})
-	handleWritingErr(err)
+	handleWritingErr(r, err)
 }
@@ -48,7 +48,7 @@ func TestHandleError(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			HandleError(w, tt.args.err, tt.args.statusCode, false)
+			HandleError(w, tt.args.req, tt.args.err, tt.args.statusCode, false)
 
 			if w.Code != tt.args.statusCode {
 				t.Errorf("Expected status code %d, got %d", tt.args.statusCode, w.Code)
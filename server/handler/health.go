@@ -16,5 +16,5 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	err := json.NewEncoder(w).Encode(healthResponse{
 		Status: http.StatusText(http.StatusOK),
 	})
-	handleWritingErr(err)
+	handleWritingErr(r, err)
 }
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/go-chi/chi/v5"
+)
+
+type HomesFetcher interface {
+	FetchHomes(ctx context.Context) ([]home.Home, error)
+}
+
+func GetHomes(fetcher HomesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		homes, err := fetcher.FetchHomes(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching homes: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(homes)
+		handleWritingErr(r, err)
+	}
+}
+
+type HomeAdder interface {
+	AddHome(ctx context.Context, h *home.Home) (*home.Home, error)
+}
+
+func AddHome(adder HomeAdder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var h home.Home
+		err := json.NewDecoder(r.Body).Decode(&h)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding home: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		err = h.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating home: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		addedHome, err := adder.AddHome(r.Context(), &h)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrConflict:
+				HandleError(w, r, fmt.Errorf("error adding home: %v", err), http.StatusConflict, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error adding home: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		err = json.NewEncoder(w).Encode(addedHome)
+		handleWritingErr(r, err)
+	}
+}
+
+type HomeDeleter interface {
+	DeleteHome(ctx context.Context, id string) error
+}
+
+// DeleteHome deletes a home without devices. Devices have to be moved to
+// another home first.
+func DeleteHome(deleter HomeDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := deleter.DeleteHome(r.Context(), chi.URLParam(r, "homeID"))
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("home not found: %v", err), http.StatusNotFound, false)
+			case *client.ErrConflict:
+				HandleError(w, r, fmt.Errorf("error deleting home: %v", err), http.StatusConflict, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting home: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type DevicesFetcher interface {
+	FetchHome(ctx context.Context, id string) (*home.Home, error)
+	FetchDevices(ctx context.Context, homeID string) ([]home.Device, error)
+}
+
+func GetDevices(fetcher DevicesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		homeID := chi.URLParam(r, "homeID")
+
+		_, err := fetcher.FetchHome(r.Context(), homeID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("home not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching home: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		devices, err := fetcher.FetchDevices(r.Context(), homeID)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching devices: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(devices)
+		handleWritingErr(r, err)
+	}
+}
+
+type DeviceUpdater interface {
+	UpdateDevice(ctx context.Context, device *home.Device) (*home.Device, error)
+}
+
+// UpdateDevice registers the device in the home, or moves it there from the
+// home it was in.
+func UpdateDevice(updater DeviceUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := home.Device{
+			ID:     chi.URLParam(r, "deviceID"),
+			HomeID: chi.URLParam(r, "homeID"),
+		}
+
+		updatedDevice, err := updater.UpdateDevice(r.Context(), &device)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("home not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating device: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		// Metrics of the device are labelled with the home it was in, they are
+		// reported again with the new home as the device reports
+		metrics.DeleteThermostatMetrics(device.ID)
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedDevice)
+		handleWritingErr(r, err)
+	}
+}
+
+type MembersFetcher interface {
+	FetchHome(ctx context.Context, id string) (*home.Home, error)
+	FetchMembers(ctx context.Context, homeID string) ([]home.Member, error)
+}
+
+func GetMembers(fetcher MembersFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		homeID := chi.URLParam(r, "homeID")
+
+		_, err := fetcher.FetchHome(r.Context(), homeID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("home not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching home: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		members, err := fetcher.FetchMembers(r.Context(), homeID)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching members: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(members)
+		handleWritingErr(r, err)
+	}
+}
+
+type MemberUpdater interface {
+	UpdateMember(ctx context.Context, member *home.Member) (*home.Member, error)
+}
+
+// UpdateMember makes the API key or user a member of the home, moving it from
+// the home it was a member of.
+func UpdateMember(updater MemberUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, err := userSubject(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		if subject == "" {
+			HandleError(w, r, fmt.Errorf("subject cannot be empty"), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedMember, err := updater.UpdateMember(r.Context(), &home.Member{
+			Subject: subject,
+			HomeID:  chi.URLParam(r, "homeID"),
+		})
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("home not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating member: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedMember)
+		handleWritingErr(r, err)
+	}
+}
+
+type MemberDeleter interface {
+	DeleteMember(ctx context.Context, homeID, subject string) error
+}
+
+// DeleteMember removes the API key or user from the home, its requests are
+// scoped to the home its token claims, or the default home, from then on.
+func DeleteMember(deleter MemberDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject, err := userSubject(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		err = deleter.DeleteMember(r.Context(), chi.URLParam(r, "homeID"), subject)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("member not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting member: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
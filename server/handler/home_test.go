@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+)
+
+type fakeHomeStore struct {
+	Homes   map[string]home.Home
+	Devices map[string]string
+	Members map[string]string
+
+	shouldFail bool
+}
+
+func (f *fakeHomeStore) AddHome(ctx context.Context, h *home.Home) (*home.Home, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	for _, existing := range f.Homes {
+		if existing.ID == h.ID || existing.TopicPrefix == h.TopicPrefix {
+			return nil, &client.ErrConflict{Err: fmt.Errorf("home %s or topic prefix %s is taken", h.ID, h.TopicPrefix)}
+		}
+	}
+
+	f.Homes[h.ID] = *h
+
+	return h, nil
+}
+
+func (f *fakeHomeStore) UpdateDevice(ctx context.Context, device *home.Device) (*home.Device, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	_, exists := f.Homes[device.HomeID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("home %s not found", device.HomeID)}
+	}
+
+	f.Devices[device.ID] = device.HomeID
+
+	return device, nil
+}
+
+func (f *fakeHomeStore) UpdateMember(ctx context.Context, member *home.Member) (*home.Member, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	_, exists := f.Homes[member.HomeID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("home %s not found", member.HomeID)}
+	}
+
+	f.Members[member.Subject] = member.HomeID
+
+	return member, nil
+}
+
+func TestAddHome(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeHomeStore
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should add home",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{}},
+			body:       `{"id": "smiths", "name": "The Smiths", "topicPrefix": "smiths"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "should return error 400, if id is reserved",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{}},
+			body:       `{"id": "default", "name": "Default", "topicPrefix": "default"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if topic prefix has more than one level",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{}},
+			body:       `{"id": "smiths", "name": "The Smiths", "topicPrefix": "homes/smiths"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 409, if topic prefix is taken",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{"joneses": {ID: "joneses", TopicPrefix: "smiths"}}},
+			body:       `{"id": "smiths", "name": "The Smiths", "topicPrefix": "smiths"}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "should return error 500, if failed to add",
+			store:      &fakeHomeStore{shouldFail: true},
+			body:       `{"id": "smiths", "name": "The Smiths", "topicPrefix": "smiths"}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/homes", bytes.NewReader([]byte(tt.body)))
+			handler := AddHome(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("AddHome() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUpdateDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeHomeStore
+		homeID     string
+		wantStatus int
+	}{
+		{
+			name:       "should move device to home",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{"smiths": {ID: "smiths"}}, Devices: map[string]string{"bedroom": home.DefaultID}},
+			homeID:     "smiths",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 404, if home doesn't exist",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{}, Devices: map[string]string{"bedroom": home.DefaultID}},
+			homeID:     "smiths",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 500, if failed to update",
+			store:      &fakeHomeStore{shouldFail: true},
+			homeID:     "smiths",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/homes/"+tt.homeID+"/devices/bedroom", nil), map[string]string{
+				"homeID":   tt.homeID,
+				"deviceID": "bedroom",
+			})
+			handler := UpdateDevice(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateDevice() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusOK && tt.store.Devices["bedroom"] != tt.homeID {
+				t.Errorf("UpdateDevice() home of bedroom = %s, want %s", tt.store.Devices["bedroom"], tt.homeID)
+			}
+		})
+	}
+}
+
+func TestUpdateMember(t *testing.T) {
+	tests := []struct {
+		name        string
+		store       *fakeHomeStore
+		subject     string
+		wantStatus  int
+		wantSubject string
+	}{
+		{
+			name:        "should add member to home",
+			store:       &fakeHomeStore{Homes: map[string]home.Home{"smiths": {ID: "smiths"}}, Members: map[string]string{}},
+			subject:     "api-key:1",
+			wantStatus:  http.StatusOK,
+			wantSubject: "api-key:1",
+		},
+		{
+			name:        "should unescape subject",
+			store:       &fakeHomeStore{Homes: map[string]home.Home{"smiths": {ID: "smiths"}}, Members: map[string]string{}},
+			subject:     "auth0%7C123",
+			wantStatus:  http.StatusOK,
+			wantSubject: "auth0|123",
+		},
+		{
+			name:       "should return error 404, if home doesn't exist",
+			store:      &fakeHomeStore{Homes: map[string]home.Home{}, Members: map[string]string{}},
+			subject:    "api-key:1",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 500, if failed to update",
+			store:      &fakeHomeStore{shouldFail: true},
+			subject:    "api-key:1",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/homes/smiths/members/"+tt.subject, nil), map[string]string{
+				"homeID":  "smiths",
+				"subject": tt.subject,
+			})
+			handler := UpdateMember(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateMember() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantSubject != "" && tt.store.Members[tt.wantSubject] != "smiths" {
+				t.Errorf("UpdateMember() members = %v, want %s in smiths", tt.store.Members, tt.wantSubject)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+)
+
+// GetIdentity returns who the request was authenticated as, so that clients
+// can tell which user and roles their credentials map to.
+func GetIdentity(w http.ResponseWriter, r *http.Request) {
+	id := identity.FromContext(r.Context())
+	if id == nil {
+		HandleError(w, r, errors.New("request isn't authenticated, auth is disabled"), http.StatusNotFound, false)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(id)
+	handleWritingErr(r, err)
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+)
+
+func TestGetIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		identity   *identity.Identity
+		wantStatus int
+	}{
+		{
+			name:       "should return identity of request",
+			identity:   &identity.Identity{Subject: "user-1", Roles: []string{"parent"}, Method: identity.JWTMethod},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 404, if auth is disabled",
+			identity:   nil,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+			if tt.identity != nil {
+				req = req.WithContext(identity.WithContext(req.Context(), tt.identity))
+			}
+			GetIdentity(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GetIdentity() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resBody identity.Identity
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetIdentity() error json decoding response body: %v", err)
+			}
+
+			if resBody.Subject != tt.identity.Subject || !resBody.HasRole("parent") {
+				t.Errorf("GetIdentity() response body = %+v, want %+v", resBody, tt.identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/go-chi/chi/v5"
+)
+
+type LiveStateRequester interface {
+	RequestCurrentState(ctx context.Context, h *home.Home, deviceID string) (*thermostat.CurrentState, error)
+}
+
+// liveStateTimeout has to fit within the server write timeout
+const liveStateTimeout = 3 * time.Second
+
+// GetLiveState requests the current state from the device and responds with it
+// once the device answers. Timestamps out of the bounds of the policy are
+// rejected, or substituted with the time the answer was received, like current
+// states reported over MQTT.
+func GetLiveState(requester LiveStateRequester, policy thermostat.TimestampPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), liveStateTimeout)
+		defer cancel()
+
+		state, err := requester.RequestCurrentState(ctx, home.FromContext(r.Context()), deviceID)
+		receivedAt := time.Now()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				HandleError(w, r, fmt.Errorf("device did not respond in time: %v", err), http.StatusGatewayTimeout, true)
+			} else {
+				HandleError(w, r, fmt.Errorf("error requesting live state: %v", err), http.StatusBadGateway, true)
+			}
+			return
+		}
+
+		if state.DeviceID != deviceID {
+			HandleError(w, r, fmt.Errorf("device responded with state for another device: %s", state.DeviceID), http.StatusBadGateway, true)
+			return
+		}
+
+		err = state.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error invalid live state: %v", err), http.StatusBadGateway, true)
+			return
+		}
+
+		err = policy.Check(state.Timestamp.Sub(receivedAt))
+		if err != nil {
+			if !policy.SubstituteReceiveTime {
+				HandleError(w, r, fmt.Errorf("error invalid live state timestamp: %v", err), http.StatusBadGateway, true)
+				return
+			}
+
+			logger.FromContext(r.Context()).Warn(fmt.Sprintf("Substituting receive time for live state timestamp of device %s: %v", deviceID, err))
+			state.Timestamp = receivedAt
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(state)
+		handleWritingErr(r, err)
+	}
+}
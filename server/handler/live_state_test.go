@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+)
+
+type fakeLiveStateRequester struct {
+	States map[string]thermostat.CurrentState
+
+	shouldTimeout bool
+	shouldFail    bool
+}
+
+func (f *fakeLiveStateRequester) RequestCurrentState(ctx context.Context, h *home.Home, deviceID string) (*thermostat.CurrentState, error) {
+	if f.shouldTimeout {
+		return nil, context.DeadlineExceeded
+	}
+
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	state, exists := f.States[deviceID]
+	if !exists {
+		return nil, context.DeadlineExceeded
+	}
+
+	return &state, nil
+}
+
+var testTimestampPolicy = thermostat.TimestampPolicy{MaxAge: time.Hour, MaxAhead: time.Minute}
+
+func TestGetLiveState(t *testing.T) {
+	now := time.Now()
+	testHumidity := 41.5
+
+	type args struct {
+		requester *fakeLiveStateRequester
+		req       *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *thermostat.CurrentState
+	}{
+		{
+			name: "should return live state reported by device",
+			args: args{
+				requester: &fakeLiveStateRequester{
+					States: map[string]thermostat.CurrentState{
+						"test_device_id": {
+							DeviceID:           "test_device_id",
+							Timestamp:          now,
+							OperatingState:     thermostat.HeatingOperatingState,
+							CurrentTemperature: 21.3,
+							CurrentHumidity:    &testHumidity,
+						},
+					},
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody: &thermostat.CurrentState{
+				DeviceID:           "test_device_id",
+				Timestamp:          now,
+				OperatingState:     thermostat.HeatingOperatingState,
+				CurrentTemperature: 21.3,
+				CurrentHumidity:    &testHumidity,
+			},
+		},
+		{
+			name: "should return error 504, if device did not respond in time",
+			args: args{
+				requester: &fakeLiveStateRequester{
+					shouldTimeout: true,
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusGatewayTimeout,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 502, if request failed",
+			args: args{
+				requester: &fakeLiveStateRequester{
+					shouldFail: true,
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusBadGateway,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 502, if device responded with invalid state",
+			args: args{
+				requester: &fakeLiveStateRequester{
+					States: map[string]thermostat.CurrentState{
+						"test_device_id": {
+							DeviceID:           "test_device_id",
+							Timestamp:          now,
+							OperatingState:     "INVALID",
+							CurrentTemperature: 21.3,
+						},
+					},
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusBadGateway,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 502, if device responded for another device",
+			args: args{
+				requester: &fakeLiveStateRequester{
+					States: map[string]thermostat.CurrentState{
+						"test_device_id": {
+							DeviceID:           "other_device_id",
+							Timestamp:          now,
+							OperatingState:     thermostat.IdleOperatingState,
+							CurrentTemperature: 21.3,
+						},
+					},
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusBadGateway,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := GetLiveState(tt.args.requester, testTimestampPolicy)
+			handler(w, tt.args.req)
+
+			// Check the status code
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetLiveState() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			// If we expect an error, we just check that response body is not empty and return early
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("GetLiveState() response body is empty, want error")
+				}
+				return
+			}
+
+			// Decode the response body into struct for checking
+			var resBody thermostat.CurrentState
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetLiveState() error json decoding response body: %v", err)
+			}
+
+			// Check response body fields
+			if resBody.DeviceID != tt.wantBody.DeviceID {
+				t.Errorf("GetLiveState() response body DeviceID = %v, want %v", resBody.DeviceID, tt.wantBody.DeviceID)
+			}
+			if !resBody.Timestamp.Equal(tt.wantBody.Timestamp) {
+				t.Errorf("GetLiveState() response body Timestamp = %v, want %v", resBody.Timestamp, tt.wantBody.Timestamp)
+			}
+			if resBody.OperatingState != tt.wantBody.OperatingState {
+				t.Errorf("GetLiveState() response body OperatingState = %v, want %v", resBody.OperatingState, tt.wantBody.OperatingState)
+			}
+			if resBody.CurrentTemperature != tt.wantBody.CurrentTemperature {
+				t.Errorf("GetLiveState() response body CurrentTemperature = %v, want %v", resBody.CurrentTemperature, tt.wantBody.CurrentTemperature)
+			}
+			if !ptrEqual(resBody.CurrentHumidity, tt.wantBody.CurrentHumidity) {
+				t.Errorf("GetLiveState() response body CurrentHumidity = %v, want %v", resBody.CurrentHumidity, tt.wantBody.CurrentHumidity)
+			}
+		})
+	}
+}
+
+func TestGetLiveStateTimestampPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		skew           time.Duration
+		policy         thermostat.TimestampPolicy
+		wantStatus     int
+		wantSubstitute bool
+	}{
+		{
+			name:       "should accept timestamp within bounds",
+			skew:       -time.Minute,
+			policy:     testTimestampPolicy,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 502, if timestamp is too far in the future",
+			skew:       time.Hour,
+			policy:     testTimestampPolicy,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "should return error 502, if timestamp is too old",
+			skew:       -2 * time.Hour,
+			policy:     testTimestampPolicy,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "should substitute receive time, if timestamp is out of bounds and policy allows it",
+			skew:           time.Hour,
+			policy:         thermostat.TimestampPolicy{MaxAge: time.Hour, MaxAhead: time.Minute, SubstituteReceiveTime: true},
+			wantStatus:     http.StatusOK,
+			wantSubstitute: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamp := time.Now().Add(tt.skew)
+			requester := &fakeLiveStateRequester{
+				States: map[string]thermostat.CurrentState{
+					"test_device_id": {
+						DeviceID:           "test_device_id",
+						Timestamp:          timestamp,
+						OperatingState:     thermostat.IdleOperatingState,
+						CurrentTemperature: 21.3,
+					},
+				},
+			}
+
+			before := time.Now()
+			w := httptest.NewRecorder()
+			req := addChiURLParams(
+				httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/live-state", nil),
+				map[string]string{"deviceID": "test_device_id"},
+			)
+			GetLiveState(requester, tt.policy)(w, req)
+			after := time.Now()
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GetLiveState() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resBody thermostat.CurrentState
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetLiveState() error json decoding response body: %v", err)
+			}
+
+			if tt.wantSubstitute {
+				if resBody.Timestamp.Before(before) || resBody.Timestamp.After(after) {
+					t.Errorf("GetLiveState() response body Timestamp = %v, want receive time", resBody.Timestamp)
+				}
+			} else if !resBody.Timestamp.Equal(timestamp) {
+				t.Errorf("GetLiveState() response body Timestamp = %v, want %v", resBody.Timestamp, timestamp)
+			}
+		})
+	}
+}
@@ -11,12 +11,12 @@ func OpenapiYAML(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/yaml")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(openapi.OpenapiYAML)))
 	_, err := w.Write(openapi.OpenapiYAML)
-	handleWritingErr(err)
+	handleWritingErr(r, err)
 }
 
 func SwaggerUI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(openapi.SwaggerHTML)))
 	_, err := w.Write(openapi.SwaggerHTML)
-	handleWritingErr(err)
+	handleWritingErr(r, err)
 }
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+type OutdoorReadingsFetcher interface {
+	FetchOutdoorReadings(ctx context.Context, since time.Time, limit int) ([]outdoor.Reading, error)
+	FetchLatestOutdoorReading(ctx context.Context) (*outdoor.Reading, error)
+}
+
+const (
+	defaultOutdoorReadingsWindow = 24 * time.Hour
+	defaultOutdoorReadingsLimit  = 100
+	maxOutdoorReadingsLimit      = 1000
+)
+
+type outdoorResponse struct {
+	Latest   *outdoor.Reading  `json:"latest"`
+	Readings []outdoor.Reading `json:"readings"`
+}
+
+// GetOutdoor responds with the latest outdoor reading, and the series of
+// readings taken since the given time, newest first.
+func GetOutdoor(fetcher OutdoorReadingsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := time.Now().Add(-defaultOutdoorReadingsWindow)
+		if sinceParam := r.URL.Query().Get("since"); sinceParam != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, sinceParam)
+			if err != nil {
+				HandleError(w, r, fmt.Errorf("since must be a timestamp in RFC3339 format, got: '%s'", sinceParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		limit := defaultOutdoorReadingsLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > maxOutdoorReadingsLimit {
+				HandleError(w, r, fmt.Errorf("limit must be an integer in range [1,%d], got: '%s'", maxOutdoorReadingsLimit, limitParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		latest, err := fetcher.FetchLatestOutdoorReading(r.Context())
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				// No outdoor source has reported yet
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching latest outdoor reading: %v", err), http.StatusInternalServerError, true)
+				return
+			}
+		}
+
+		readings, err := fetcher.FetchOutdoorReadings(r.Context(), since, limit)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching outdoor readings: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(outdoorResponse{
+			Latest:   latest,
+			Readings: readings,
+		})
+		handleWritingErr(r, err)
+	}
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/outdoor"
+)
+
+type fakeOutdoorStore struct {
+	Readings []outdoor.Reading // Newest first
+
+	shouldFail bool
+}
+
+func (f *fakeOutdoorStore) FetchOutdoorReadings(ctx context.Context, since time.Time, limit int) ([]outdoor.Reading, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	readings := []outdoor.Reading{}
+	for _, reading := range f.Readings {
+		if len(readings) == limit {
+			break
+		}
+		if !reading.Timestamp.Before(since) {
+			readings = append(readings, reading)
+		}
+	}
+
+	return readings, nil
+}
+
+func (f *fakeOutdoorStore) FetchLatestOutdoorReading(ctx context.Context) (*outdoor.Reading, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if len(f.Readings) == 0 {
+		return nil, &client.ErrNotFound{Err: errors.New("outdoor reading not found")}
+	}
+
+	return &f.Readings[0], nil
+}
+
+func TestGetOutdoor(t *testing.T) {
+	now := time.Now()
+	readings := []outdoor.Reading{
+		{Timestamp: now.Add(-time.Hour), Temperature: 12, Source: outdoor.StationSource},
+		{Timestamp: now.Add(-2 * time.Hour), Temperature: 11, Source: outdoor.StationSource},
+		{Timestamp: now.Add(-48 * time.Hour), Temperature: 8, Source: outdoor.StationSource},
+	}
+
+	type args struct {
+		store *fakeOutdoorStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantLatest bool
+		wantLen    int
+	}{
+		{
+			name: "should fetch outdoor readings of the last day",
+			args: args{
+				store: &fakeOutdoorStore{Readings: readings},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor", nil),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantLatest: true,
+			wantLen:    2,
+		},
+		{
+			name: "should fetch outdoor readings since given time up to limit",
+			args: args{
+				store: &fakeOutdoorStore{Readings: readings},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor?since="+now.Add(-72*time.Hour).Format(time.RFC3339)+"&limit=2", nil),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantLatest: true,
+			wantLen:    2,
+		},
+		{
+			name: "should respond without latest reading, if none was reported",
+			args: args{
+				store: &fakeOutdoorStore{},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor", nil),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantLatest: false,
+			wantLen:    0,
+		},
+		{
+			name: "should return error 400, if since is invalid",
+			args: args{
+				store: &fakeOutdoorStore{},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor?since=yesterday", nil),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if limit is invalid",
+			args: args{
+				store: &fakeOutdoorStore{},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor?limit=0", nil),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to fetch",
+			args: args{
+				store: &fakeOutdoorStore{shouldFail: true},
+				req:   httptest.NewRequest(http.MethodGet, "/api/v1/outdoor", nil),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := GetOutdoor(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetOutdoor() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("GetOutdoor() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody outdoorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetOutdoor() error json decoding response body: %v", err)
+			}
+
+			if (resBody.Latest != nil) != tt.wantLatest {
+				t.Errorf("GetOutdoor() latest = %v, want latest %v", resBody.Latest, tt.wantLatest)
+			}
+
+			if len(resBody.Readings) != tt.wantLen {
+				t.Errorf("GetOutdoor() len(readings) = %d, want %d", len(resBody.Readings), tt.wantLen)
+			}
+		})
+	}
+}
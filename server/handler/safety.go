@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
+	"github.com/go-chi/chi/v5"
+)
+
+type SafetyLimitsFetcher interface {
+	FetchSafetyLimits(ctx context.Context, deviceID string) (*safety.Limits, error)
+}
+
+func GetSafetyLimits(fetcher SafetyLimitsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		limits, err := fetcher.FetchSafetyLimits(r.Context(), deviceID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("device not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching safety limits: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(limits)
+		handleWritingErr(r, err)
+	}
+}
+
+type SafetyLimitsUpdater interface {
+	UpdateSafetyLimits(ctx context.Context, limits *safety.Limits) (*safety.Limits, error)
+}
+
+// UpdateSafetyLimits sets the floor and ceiling temperatures of the device.
+// Limits left unset fall back to the configured defaults.
+func UpdateSafetyLimits(updater SafetyLimitsUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := authorize(r, chi.URLParam(r, "deviceID"), access.AdminPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		var limits safety.Limits
+		err = json.NewDecoder(r.Body).Decode(&limits)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding safety limits: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		limits.DeviceID = chi.URLParam(r, "deviceID")
+
+		err = limits.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating safety limits: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedLimits, err := updater.UpdateSafetyLimits(r.Context(), &limits)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("device not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating safety limits: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedLimits)
+		handleWritingErr(r, err)
+	}
+}
+
+type SafetyEventsFetcher interface {
+	FetchSafetyEvents(ctx context.Context, deviceID string, limit int) ([]safety.Event, error)
+}
+
+const (
+	defaultSafetyEventsLimit = 100
+	maxSafetyEventsLimit     = 1000
+)
+
+func GetSafetyEvents(fetcher SafetyEventsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		limit := defaultSafetyEventsLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			var err error
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > maxSafetyEventsLimit {
+				HandleError(w, r, fmt.Errorf("limit must be an integer in range [1,%d], got: '%s'", maxSafetyEventsLimit, limitParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		events, err := fetcher.FetchSafetyEvents(r.Context(), deviceID, limit)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("device not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching safety events: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(events)
+		handleWritingErr(r, err)
+	}
+}
@@ -0,0 +1,440 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/safety"
+)
+
+type fakeSafetyStore struct {
+	Limits map[string]safety.Limits
+	Events map[string][]safety.Event
+
+	shouldFail bool
+}
+
+func (f *fakeSafetyStore) FetchSafetyLimits(ctx context.Context, deviceID string) (*safety.Limits, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	limits, ok := f.Limits[deviceID]
+	if !ok {
+		return nil, &client.ErrNotFound{Err: sql.ErrNoRows}
+	}
+
+	return &limits, nil
+}
+
+func (f *fakeSafetyStore) UpdateSafetyLimits(ctx context.Context, limits *safety.Limits) (*safety.Limits, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if _, ok := f.Limits[limits.DeviceID]; !ok {
+		return nil, &client.ErrNotFound{Err: sql.ErrNoRows}
+	}
+	f.Limits[limits.DeviceID] = *limits
+
+	return limits, nil
+}
+
+func (f *fakeSafetyStore) FetchSafetyEvents(ctx context.Context, deviceID string, limit int) ([]safety.Event, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	events, ok := f.Events[deviceID]
+	if !ok {
+		return nil, &client.ErrNotFound{Err: sql.ErrNoRows}
+	}
+
+	return events[:min(limit, len(events))], nil
+}
+
+func newFakeSafetyStore() *fakeSafetyStore {
+	floor := 5.0
+	ceiling := 35.0
+	triggeredAt := time.Date(2026, 1, 10, 6, 0, 0, 0, time.UTC)
+
+	return &fakeSafetyStore{
+		Limits: map[string]safety.Limits{
+			"test_device_id": {DeviceID: "test_device_id", FloorTemperature: &floor, CeilingTemperature: &ceiling},
+		},
+		Events: map[string][]safety.Event{
+			"test_device_id": {
+				{ID: 2, DeviceID: "test_device_id", Kind: safety.FreezeKind, Temperature: 4.5, Limit: 5, TriggeredAt: triggeredAt},
+				{ID: 1, DeviceID: "test_device_id", Kind: safety.OverheatKind, Temperature: 35.5, Limit: 35, TriggeredAt: triggeredAt.Add(-time.Hour)},
+			},
+		},
+	}
+}
+
+func withPolicy(req *http.Request, policy *access.Policy) *http.Request {
+	return req.WithContext(access.WithContext(req.Context(), policy))
+}
+
+func TestGetSafetyLimits(t *testing.T) {
+	floor := 5.0
+	ceiling := 35.0
+
+	type args struct {
+		store *fakeSafetyStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *safety.Limits
+	}{
+		{
+			name: "should return safety limits of the device",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody:   &safety.Limits{DeviceID: "test_device_id", FloorTemperature: &floor, CeilingTemperature: &ceiling},
+		},
+		{
+			name: "should return error 403, if device isn't granted",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: withPolicy(addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}), &access.Policy{Grants: []access.Grant{
+					{DeviceID: "other_device_id", Permission: access.AdminPermission},
+				}}),
+			},
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 404, if device isn't found",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/unknown_device_id/safety", nil), map[string]string{
+					"deviceID": "unknown_device_id",
+				}),
+			},
+			wantStatus: http.StatusNotFound,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to fetch",
+			args: args{
+				store: &fakeSafetyStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := GetSafetyLimits(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetSafetyLimits() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("GetSafetyLimits() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody safety.Limits
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetSafetyLimits() error json decoding response body: %v", err)
+			}
+
+			if !reflect.DeepEqual(resBody, *tt.wantBody) {
+				t.Errorf("GetSafetyLimits() response body = %+v, want %+v", resBody, *tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUpdateSafetyLimits(t *testing.T) {
+	floor := 8.0
+	ceiling := 30.0
+
+	type args struct {
+		store *fakeSafetyStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *safety.Limits
+	}{
+		{
+			name: "should update safety limits of the device",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 8, "ceilingTemperature": 30}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody:   &safety.Limits{DeviceID: "test_device_id", FloorTemperature: &floor, CeilingTemperature: &ceiling},
+		},
+		{
+			name: "should return error 403, if admin permission isn't granted",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: withPolicy(addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 8, "ceilingTemperature": 30}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}), &access.Policy{Grants: []access.Grant{
+					{DeviceID: "test_device_id", Permission: access.ChangeModePermission},
+				}}),
+			},
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if body is invalid json",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 8,`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if floor isn't below ceiling",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 30, "ceilingTemperature": 8}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if limit is out of range",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": -25}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 404, if device isn't found",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/unknown_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 8, "ceilingTemperature": 30}`),
+				)), map[string]string{
+					"deviceID": "unknown_device_id",
+				}),
+			},
+			wantStatus: http.StatusNotFound,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to update",
+			args: args{
+				store: &fakeSafetyStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/safety", bytes.NewReader(
+					[]byte(`{"floorTemperature": 8, "ceilingTemperature": 30}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := UpdateSafetyLimits(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("UpdateSafetyLimits() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("UpdateSafetyLimits() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody safety.Limits
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("UpdateSafetyLimits() error json decoding response body: %v", err)
+			}
+
+			if !reflect.DeepEqual(resBody, *tt.wantBody) {
+				t.Errorf("UpdateSafetyLimits() response body = %+v, want %+v", resBody, *tt.wantBody)
+			}
+
+			if stored := tt.args.store.Limits[resBody.DeviceID]; !reflect.DeepEqual(stored, *tt.wantBody) {
+				t.Errorf("UpdateSafetyLimits() stored limits = %+v, want %+v", stored, *tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestGetSafetyEvents(t *testing.T) {
+	type args struct {
+		store *fakeSafetyStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantIDs    []int64
+	}{
+		{
+			name: "should return safety events of the device",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety/events", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantIDs:    []int64{2, 1},
+		},
+		{
+			name: "should return as many events as the limit",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety/events?limit=1", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantIDs:    []int64{2},
+		},
+		{
+			name: "should return error 403, if device isn't granted",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: withPolicy(addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety/events", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}), &access.Policy{Grants: []access.Grant{
+					{DeviceID: "other_device_id", Permission: access.AdminPermission},
+				}}),
+			},
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if limit is out of range",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety/events?limit=1001", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 404, if device isn't found",
+			args: args{
+				store: newFakeSafetyStore(),
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/unknown_device_id/safety/events", nil), map[string]string{
+					"deviceID": "unknown_device_id",
+				}),
+			},
+			wantStatus: http.StatusNotFound,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to fetch",
+			args: args{
+				store: &fakeSafetyStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/devices/test_device_id/safety/events", nil), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := GetSafetyEvents(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetSafetyEvents() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("GetSafetyEvents() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody []safety.Event
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("GetSafetyEvents() error json decoding response body: %v", err)
+			}
+
+			var ids []int64
+			for _, event := range resBody {
+				ids = append(ids, event.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("GetSafetyEvents() event IDs = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+	"github.com/go-chi/chi/v5"
+)
+
+type SensorsFetcher interface {
+	FetchSensors(ctx context.Context) ([]sensor.Sensor, error)
+}
+
+func GetSensors(fetcher SensorsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sensors, err := fetcher.FetchSensors(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching sensors: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(sensors)
+		handleWritingErr(r, err)
+	}
+}
+
+type SensorFetcher interface {
+	FetchSensor(ctx context.Context, sensorID string) (*sensor.Sensor, error)
+	FetchSensorReading(ctx context.Context, sensorID string) (*sensor.Reading, error)
+}
+
+type sensorResponse struct {
+	*sensor.Sensor
+	Reading *sensor.Reading `json:"reading"`
+}
+
+func GetSensor(fetcher SensorFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sensorID := chi.URLParam(r, "sensorID")
+
+		s, err := fetcher.FetchSensor(r.Context(), sensorID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("sensor not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching sensor: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		reading, err := fetcher.FetchSensorReading(r.Context(), sensorID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				// Sensor hasn't reported yet
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching sensor reading: %v", err), http.StatusInternalServerError, true)
+				return
+			}
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(sensorResponse{
+			Sensor:  s,
+			Reading: reading,
+		})
+		handleWritingErr(r, err)
+	}
+}
+
+type SensorUpdater interface {
+	UpdateSensor(ctx context.Context, s *sensor.Sensor) (*sensor.Sensor, error)
+}
+
+// UpdateSensor registers the sensor, or updates it if it's already registered.
+func UpdateSensor(updater SensorUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s sensor.Sensor
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding sensor: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		s.ID = chi.URLParam(r, "sensorID")
+
+		err = s.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating sensor: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedSensor, err := updater.UpdateSensor(r.Context(), &s)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error updating sensor: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedSensor)
+		handleWritingErr(r, err)
+	}
+}
+
+type SensorDeleter interface {
+	DeleteSensor(ctx context.Context, sensorID string) error
+}
+
+func DeleteSensor(deleter SensorDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sensorID := chi.URLParam(r, "sensorID")
+
+		err := deleter.DeleteSensor(r.Context(), sensorID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("sensor not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting sensor: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		metrics.DeleteSensorMetrics(sensorID)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type SensorAssignmentFetcher interface {
+	FetchSensorAssignment(ctx context.Context, deviceID string) (*sensor.Assignment, error)
+}
+
+func GetSensorAssignment(fetcher SensorAssignmentFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceID")
+
+		err := authorize(r, deviceID, access.ViewPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		assignment, err := fetcher.FetchSensorAssignment(r.Context(), deviceID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("sensor assignment not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching sensor assignment: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(assignment)
+		handleWritingErr(r, err)
+	}
+}
+
+type SensorAssignmentUpdater interface {
+	FetchSensor(ctx context.Context, sensorID string) (*sensor.Sensor, error)
+	UpdateSensorAssignment(ctx context.Context, assignment *sensor.Assignment) (*sensor.Assignment, error)
+}
+
+// UpdateSensorAssignment replaces the sensors the thermostat controls on. The
+// effective temperature is published with the next reading of an assigned
+// sensor.
+func UpdateSensorAssignment(updater SensorAssignmentUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := authorize(r, chi.URLParam(r, "deviceID"), access.AdminPermission)
+		if err != nil {
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		var assignment sensor.Assignment
+		err = json.NewDecoder(r.Body).Decode(&assignment)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding sensor assignment: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		assignment.DeviceID = chi.URLParam(r, "deviceID")
+
+		err = assignment.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating sensor assignment: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		for _, sensorID := range assignment.SensorIDs {
+			_, err := updater.FetchSensor(r.Context(), sensorID)
+			if err != nil {
+				switch err.(type) {
+				case *client.ErrNotFound:
+					HandleError(w, r, fmt.Errorf("sensor %s is not registered", sensorID), http.StatusBadRequest, false)
+				default:
+					HandleError(w, r, fmt.Errorf("error fetching sensor: %v", err), http.StatusInternalServerError, true)
+				}
+				return
+			}
+		}
+
+		updatedAssignment, err := updater.UpdateSensorAssignment(r.Context(), &assignment)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error updating sensor assignment: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedAssignment)
+		handleWritingErr(r, err)
+	}
+}
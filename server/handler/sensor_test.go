@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/sensor"
+)
+
+type fakeSensorStore struct {
+	Sensors     map[string]sensor.Sensor
+	Assignments map[string]sensor.Assignment
+
+	shouldFail bool
+}
+
+func (f *fakeSensorStore) FetchSensor(ctx context.Context, sensorID string) (*sensor.Sensor, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	s, exists := f.Sensors[sensorID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("sensor %s not found", sensorID)}
+	}
+
+	return &s, nil
+}
+
+func (f *fakeSensorStore) DeleteSensor(ctx context.Context, sensorID string) error {
+	if f.shouldFail {
+		return errors.New("test error")
+	}
+
+	_, exists := f.Sensors[sensorID]
+	if !exists {
+		return &client.ErrNotFound{Err: fmt.Errorf("sensor %s not found", sensorID)}
+	}
+
+	delete(f.Sensors, sensorID)
+
+	return nil
+}
+
+func (f *fakeSensorStore) UpdateSensorAssignment(ctx context.Context, assignment *sensor.Assignment) (*sensor.Assignment, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if f.Assignments == nil {
+		f.Assignments = make(map[string]sensor.Assignment)
+	}
+	f.Assignments[assignment.DeviceID] = *assignment
+
+	return assignment, nil
+}
+
+func TestDeleteSensor(t *testing.T) {
+	type args struct {
+		store *fakeSensorStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+	}{
+		{
+			name: "should delete sensor",
+			args: args{
+				store: &fakeSensorStore{Sensors: map[string]sensor.Sensor{"kitchen": {ID: "kitchen"}}},
+				req: addChiURLParams(httptest.NewRequest(http.MethodDelete, "/api/v1/sensors/kitchen", nil), map[string]string{
+					"sensorID": "kitchen",
+				}),
+			},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name: "should return error 404, if sensor is not found",
+			args: args{
+				store: &fakeSensorStore{},
+				req: addChiURLParams(httptest.NewRequest(http.MethodDelete, "/api/v1/sensors/kitchen", nil), map[string]string{
+					"sensorID": "kitchen",
+				}),
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "should return error 500, if failed to delete",
+			args: args{
+				store: &fakeSensorStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodDelete, "/api/v1/sensors/kitchen", nil), map[string]string{
+					"sensorID": "kitchen",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := DeleteSensor(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("DeleteSensor() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUpdateSensorAssignment(t *testing.T) {
+	kitchen := "kitchen"
+
+	type args struct {
+		store *fakeSensorStore
+		req   *http.Request
+	}
+	tests := []struct {
+		name string
+		args args
+		// HTTP response expectations
+		wantStatus int
+		wantErr    bool
+		wantBody   *sensor.Assignment
+	}{
+		{
+			name: "should update sensor assignment",
+			args: args{
+				store: &fakeSensorStore{Sensors: map[string]sensor.Sensor{"kitchen": {ID: "kitchen"}, "bedroom": {ID: "bedroom"}}},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/sensors", bytes.NewReader(
+					[]byte(`{"strategy": "SENSOR", "sensorId": "kitchen", "sensorIds": ["kitchen", "bedroom"]}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusOK,
+			wantErr:    false,
+			wantBody: &sensor.Assignment{
+				DeviceID:  "test_device_id",
+				Strategy:  sensor.SensorStrategy,
+				SensorID:  &kitchen,
+				SensorIDs: []string{"kitchen", "bedroom"},
+			},
+		},
+		{
+			name: "should return error 400, if sensor is not registered",
+			args: args{
+				store: &fakeSensorStore{Sensors: map[string]sensor.Sensor{"kitchen": {ID: "kitchen"}}},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/sensors", bytes.NewReader(
+					[]byte(`{"strategy": "AVERAGE", "sensorIds": ["kitchen", "bedroom"]}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if strategy is invalid",
+			args: args{
+				store: &fakeSensorStore{Sensors: map[string]sensor.Sensor{"kitchen": {ID: "kitchen"}}},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/sensors", bytes.NewReader(
+					[]byte(`{"strategy": "MEDIAN", "sensorIds": ["kitchen"]}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 400, if no sensors are assigned",
+			args: args{
+				store: &fakeSensorStore{},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/sensors", bytes.NewReader(
+					[]byte(`{"strategy": "AVERAGE", "sensorIds": []}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name: "should return error 500, if failed to fetch sensor",
+			args: args{
+				store: &fakeSensorStore{shouldFail: true},
+				req: addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/devices/test_device_id/sensors", bytes.NewReader(
+					[]byte(`{"strategy": "AVERAGE", "sensorIds": ["kitchen"]}`),
+				)), map[string]string{
+					"deviceID": "test_device_id",
+				}),
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler := UpdateSensorAssignment(tt.args.store)
+			handler(w, tt.args.req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("UpdateSensorAssignment() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantErr {
+				if w.Body.Len() == 0 {
+					t.Errorf("UpdateSensorAssignment() response body is empty, want error")
+				}
+				return
+			}
+
+			var resBody sensor.Assignment
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("UpdateSensorAssignment() error json decoding response body: %v", err)
+			}
+
+			if !reflect.DeepEqual(&resBody, tt.wantBody) {
+				t.Errorf("UpdateSensorAssignment() response body = %+v, want %+v", resBody, *tt.wantBody)
+			}
+		})
+	}
+}
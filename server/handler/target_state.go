@@ -6,22 +6,38 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/logger"
 	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/outbox"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 	"github.com/go-chi/chi/v5"
 )
 
 type TargetStateFetcher interface {
-	FetchTargetState(ctx context.Context, deviceID string) (*thermostat.TargetState, error)
+	FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error)
 }
 
 func GetTargetState(fetcher TargetStateFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		deviceID := chi.URLParam(r, "deviceID")
 
-		state, err := fetcher.FetchTargetState(r.Context(), deviceID)
+		err := authorize(r, deviceID, access.ViewPermission)
 		if err != nil {
-			HandleError(w, fmt.Errorf("error fetching target state: %v", err), http.StatusInternalServerError, true)
+			HandleError(w, r, err, http.StatusForbidden, false)
+			return
+		}
+
+		state, err := fetcher.FetchTargetState(r.Context(), home.FromContext(r.Context()).ID, deviceID)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("device not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching target state: %v", err), http.StatusInternalServerError, true)
+			}
 			return
 		}
 
@@ -29,24 +45,29 @@ func GetTargetState(fetcher TargetStateFetcher) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 
 		err = json.NewEncoder(w).Encode(state)
-		handleWritingErr(err)
+		handleWritingErr(r, err)
 	}
 }
 
 type TargetStateUpdater interface {
-	UpdateTargetState(context.Context, *thermostat.TargetState) (*thermostat.TargetState, error)
+	UpdateTargetState(ctx context.Context, homeID string, state *thermostat.TargetState) (*thermostat.TargetState, error)
+}
+
+type TargetStateDispatcher interface {
+	DispatchTargetState(ctx context.Context, deviceID string) (outbox.DeliveryStatus, error)
 }
 
-type TargetStatePublisher interface {
-	PublishTargetState(context.Context, *thermostat.TargetState) error
+type targetStateResponse struct {
+	*thermostat.TargetState
+	Delivery outbox.DeliveryStatus `json:"delivery"`
 }
 
-func UpdateTargetState(updater TargetStateUpdater, publisher TargetStatePublisher) http.HandlerFunc {
+func UpdateTargetState(updater TargetStateUpdater, dispatcher TargetStateDispatcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var state thermostat.TargetState
 		err := json.NewDecoder(r.Body).Decode(&state)
 		if err != nil {
-			HandleError(w, fmt.Errorf("error decoding target state: %v", err), http.StatusBadRequest, false)
+			HandleError(w, r, fmt.Errorf("error decoding target state: %v", err), http.StatusBadRequest, false)
 			return
 		}
 
@@ -55,34 +76,74 @@ func UpdateTargetState(updater TargetStateUpdater, publisher TargetStatePublishe
 
 		err = state.Validate()
 		if err != nil {
-			HandleError(w, fmt.Errorf("error validating target state: %v", err), http.StatusBadRequest, false)
+			HandleError(w, r, fmt.Errorf("error validating target state: %v", err), http.StatusBadRequest, false)
 			return
 		}
 
-		updatedState, err := updater.UpdateTargetState(r.Context(), &state)
+		err = authorizeTargetState(r, &state)
 		if err != nil {
-			HandleError(w, fmt.Errorf("error updating target state: %v", err), http.StatusInternalServerError, true)
+			HandleError(w, r, err, http.StatusForbidden, false)
 			return
 		}
 
-		err = publisher.PublishTargetState(r.Context(), updatedState)
+		h := home.FromContext(r.Context())
+
+		updatedState, err := updater.UpdateTargetState(r.Context(), h.ID, &state)
 		if err != nil {
-			HandleError(w, fmt.Errorf("error publishing target state: %v", err), http.StatusInternalServerError, true)
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("device not found: %v", err), http.StatusNotFound, false)
+			case *client.ErrConflict:
+				HandleError(w, r, fmt.Errorf("error updating target state: %v", err), http.StatusConflict, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating target state: %v", err), http.StatusInternalServerError, true)
+			}
 			return
 		}
 
+		// The update is already persisted with an outbox entry, so a failed or
+		// coalesced delivery is completed in the background instead of failing
+		// the request
+		delivery, err := dispatcher.DispatchTargetState(r.Context(), deviceID)
+		if err != nil {
+			logger.FromContext(r.Context()).Warn(fmt.Sprintf("Target state delivery to device %s is pending: %v", deviceID, err))
+		}
+
 		if updatedState.Mode != nil {
-			metrics.SetThermostatMode(deviceID, *updatedState.Mode)
+			metrics.SetThermostatMode(h.ID, deviceID, *updatedState.Mode)
 		}
 
 		if updatedState.TargetTemperature != nil {
-			metrics.SetThermostatTargetTemperature(deviceID, *updatedState.TargetTemperature)
+			metrics.SetThermostatTargetTemperature(h.ID, deviceID, *updatedState.TargetTemperature)
 		}
 
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
-		err = json.NewEncoder(w).Encode(updatedState)
-		handleWritingErr(err)
+		err = json.NewEncoder(w).Encode(targetStateResponse{
+			TargetState: updatedState,
+			Delivery:    delivery,
+		})
+		handleWritingErr(r, err)
 	}
 }
+
+// authorizeTargetState returns an error if the access policy of the request
+// doesn't allow the mode or target temperature of the update.
+func authorizeTargetState(r *http.Request, state *thermostat.TargetState) error {
+	if state.Mode != nil {
+		err := authorize(r, state.DeviceID, access.ChangeModePermission)
+		if err != nil {
+			return err
+		}
+	}
+
+	if state.TargetTemperature != nil {
+		policy := access.FromContext(r.Context())
+		if !policy.AllowsTemperature(state.DeviceID, *state.TargetTemperature) {
+			return fmt.Errorf("setting target temperature of device %s to %d isn't allowed", state.DeviceID, *state.TargetTemperature)
+		}
+	}
+
+	return nil
+}
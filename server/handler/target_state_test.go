@@ -8,9 +8,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/outbox"
 	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
 )
 
@@ -20,7 +23,7 @@ type fakeTargetStateFetcher struct {
 	shouldFail bool
 }
 
-func (f *fakeTargetStateFetcher) FetchTargetState(ctx context.Context, deviceID string) (*thermostat.TargetState, error) {
+func (f *fakeTargetStateFetcher) FetchTargetState(ctx context.Context, homeID, deviceID string) (*thermostat.TargetState, error) {
 	if f.shouldFail {
 		return nil, errors.New("test error")
 	}
@@ -97,6 +100,22 @@ func TestGetTargetState(t *testing.T) {
 			wantErr:    true,
 			wantBody:   nil,
 		},
+		{
+			name: "should return error 404, if device isn't found in home",
+			args: args{
+				fetcher: &fakeTargetStateFetcher{
+					States:     map[string]thermostat.TargetState{},
+					shouldFail: false,
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodGet, "/api/v1/target-state/test_device_id", nil),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus: http.StatusNotFound,
+			wantErr:    true,
+			wantBody:   nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -139,15 +158,21 @@ func TestGetTargetState(t *testing.T) {
 
 type fakeTargetStateUpdater struct {
 	States map[string]thermostat.TargetState
+	// Devices held in a protective state
+	Locked map[string]bool
 
 	shouldFail bool
 }
 
-func (f *fakeTargetStateUpdater) UpdateTargetState(ctx context.Context, state *thermostat.TargetState) (*thermostat.TargetState, error) {
+func (f *fakeTargetStateUpdater) UpdateTargetState(ctx context.Context, homeID string, state *thermostat.TargetState) (*thermostat.TargetState, error) {
 	if f.shouldFail {
 		return nil, errors.New("test error")
 	}
 
+	if f.Locked[state.DeviceID] {
+		return nil, &client.ErrConflict{Err: errors.New("device is held in a protective state")}
+	}
+
 	if state != nil {
 		oldState, exists := f.States[state.DeviceID]
 		if !exists {
@@ -168,22 +193,25 @@ func (f *fakeTargetStateUpdater) UpdateTargetState(ctx context.Context, state *t
 	return &updatedState, nil
 }
 
-type fakeTargetStatePublisher struct {
-	States []thermostat.TargetState
+type fakeTargetStateDispatcher struct {
+	DeviceIDs []string
 
+	coalesce   bool
 	shouldFail bool
 }
 
-func (m *fakeTargetStatePublisher) PublishTargetState(ctx context.Context, state *thermostat.TargetState) error {
-	if m.shouldFail {
-		return errors.New("test error")
+func (f *fakeTargetStateDispatcher) DispatchTargetState(ctx context.Context, deviceID string) (outbox.DeliveryStatus, error) {
+	if f.shouldFail {
+		return outbox.PendingStatus, errors.New("test error")
 	}
 
-	if state != nil {
-		m.States = append(m.States, *state)
+	f.DeviceIDs = append(f.DeviceIDs, deviceID)
+
+	if f.coalesce {
+		return outbox.PendingStatus, nil
 	}
 
-	return nil
+	return outbox.DeliveredStatus, nil
 }
 
 func TestUpdateTargetState(t *testing.T) {
@@ -195,9 +223,9 @@ func TestUpdateTargetState(t *testing.T) {
 	invalidTargetTemperature := -5
 
 	type args struct {
-		updater   *fakeTargetStateUpdater
-		publisher *fakeTargetStatePublisher
-		req       *http.Request
+		updater    *fakeTargetStateUpdater
+		dispatcher *fakeTargetStateDispatcher
+		req        *http.Request
 	}
 	tests := []struct {
 		name string
@@ -206,13 +234,15 @@ func TestUpdateTargetState(t *testing.T) {
 		wantStatus int
 		wantErr    bool
 		wantBody   *thermostat.TargetState
+		// Delivery reported in the response
+		wantDelivery outbox.DeliveryStatus
 		// Updater expectations
 		wantUpdaterStates map[string]*thermostat.TargetState
-		// Publisher expectations
-		wantPublisherStates []*thermostat.TargetState
+		// Dispatcher expectations
+		wantDispatchedDeviceIDs []string
 	}{
 		{
-			name: "should update target state and publish updated state",
+			name: "should update target state and dispatch updated state",
 			args: args{
 				updater: &fakeTargetStateUpdater{
 					States: map[string]thermostat.TargetState{
@@ -224,8 +254,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -238,8 +268,9 @@ func TestUpdateTargetState(t *testing.T) {
 					map[string]string{"deviceID": "test_device_id"},
 				),
 			},
-			wantStatus: http.StatusOK,
-			wantErr:    false,
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantDelivery: outbox.DeliveredStatus,
 			wantBody: &thermostat.TargetState{
 				DeviceID:          "test_device_id",
 				Mode:              &updatedMode,
@@ -252,16 +283,10 @@ func TestUpdateTargetState(t *testing.T) {
 					TargetTemperature: &updatedTargetTemperature,
 				},
 			},
-			wantPublisherStates: []*thermostat.TargetState{
-				{
-					DeviceID:          "test_device_id",
-					Mode:              &updatedMode,
-					TargetTemperature: &updatedTargetTemperature,
-				},
-			},
+			wantDispatchedDeviceIDs: []string{"test_device_id"},
 		},
 		{
-			name: "should update only mode and publish updated state",
+			name: "should update only mode and dispatch updated state",
 			args: args{
 				updater: &fakeTargetStateUpdater{
 					States: map[string]thermostat.TargetState{
@@ -273,8 +298,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -286,8 +311,9 @@ func TestUpdateTargetState(t *testing.T) {
 					map[string]string{"deviceID": "test_device_id"},
 				),
 			},
-			wantStatus: http.StatusOK,
-			wantErr:    false,
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantDelivery: outbox.DeliveredStatus,
 			wantBody: &thermostat.TargetState{
 				DeviceID:          "test_device_id",
 				Mode:              &updatedMode,
@@ -300,16 +326,10 @@ func TestUpdateTargetState(t *testing.T) {
 					TargetTemperature: &initialTargetTemperature,
 				},
 			},
-			wantPublisherStates: []*thermostat.TargetState{
-				{
-					DeviceID:          "test_device_id",
-					Mode:              &updatedMode,
-					TargetTemperature: &initialTargetTemperature,
-				},
-			},
+			wantDispatchedDeviceIDs: []string{"test_device_id"},
 		},
 		{
-			name: "should update only target temperature and publish updated state",
+			name: "should update only target temperature and dispatch updated state",
 			args: args{
 				updater: &fakeTargetStateUpdater{
 					States: map[string]thermostat.TargetState{
@@ -321,8 +341,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -334,8 +354,9 @@ func TestUpdateTargetState(t *testing.T) {
 					map[string]string{"deviceID": "test_device_id"},
 				),
 			},
-			wantStatus: http.StatusOK,
-			wantErr:    false,
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantDelivery: outbox.DeliveredStatus,
 			wantBody: &thermostat.TargetState{
 				DeviceID:          "test_device_id",
 				Mode:              &initialMode,
@@ -348,13 +369,7 @@ func TestUpdateTargetState(t *testing.T) {
 					TargetTemperature: &updatedTargetTemperature,
 				},
 			},
-			wantPublisherStates: []*thermostat.TargetState{
-				{
-					DeviceID:          "test_device_id",
-					Mode:              &initialMode,
-					TargetTemperature: &updatedTargetTemperature,
-				},
-			},
+			wantDispatchedDeviceIDs: []string{"test_device_id"},
 		},
 		{
 			name: "should return error 400, if request body is invalid JSON",
@@ -369,8 +384,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -398,8 +413,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -428,8 +443,8 @@ func TestUpdateTargetState(t *testing.T) {
 					},
 					shouldFail: true,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
 					shouldFail: false,
 				},
 				req: addChiURLParams(
@@ -446,7 +461,7 @@ func TestUpdateTargetState(t *testing.T) {
 			wantErr:    true,
 		},
 		{
-			name: "should return error 500, if failed to publish",
+			name: "should return error 409, if device is held in a protective state",
 			args: args{
 				updater: &fakeTargetStateUpdater{
 					States: map[string]thermostat.TargetState{
@@ -456,11 +471,12 @@ func TestUpdateTargetState(t *testing.T) {
 							TargetTemperature: &initialTargetTemperature,
 						},
 					},
+					Locked:     map[string]bool{"test_device_id": true},
 					shouldFail: false,
 				},
-				publisher: &fakeTargetStatePublisher{
-					States:     []thermostat.TargetState{},
-					shouldFail: true,
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
+					shouldFail: false,
 				},
 				req: addChiURLParams(
 					httptest.NewRequest(http.MethodPost, "/api/v1/target-state/test_device_id", bytes.NewReader(
@@ -472,14 +488,102 @@ func TestUpdateTargetState(t *testing.T) {
 					map[string]string{"deviceID": "test_device_id"},
 				),
 			},
-			wantStatus: http.StatusInternalServerError,
+			wantStatus: http.StatusConflict,
 			wantErr:    true,
 		},
+		{
+			name: "should report pending delivery, if failed to dispatch",
+			args: args{
+				updater: &fakeTargetStateUpdater{
+					States: map[string]thermostat.TargetState{
+						"test_device_id": {
+							DeviceID:          "test_device_id",
+							Mode:              &initialMode,
+							TargetTemperature: &initialTargetTemperature,
+						},
+					},
+					shouldFail: false,
+				},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
+					shouldFail: true,
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodPost, "/api/v1/target-state/test_device_id", bytes.NewReader(
+						[]byte(fmt.Sprintf(`{
+							"mode": "%s",
+							"targetTemperature": %d
+						}`, updatedMode, updatedTargetTemperature))),
+					),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantDelivery: outbox.PendingStatus,
+			wantBody: &thermostat.TargetState{
+				DeviceID:          "test_device_id",
+				Mode:              &updatedMode,
+				TargetTemperature: &updatedTargetTemperature,
+			},
+			wantUpdaterStates: map[string]*thermostat.TargetState{
+				"test_device_id": {
+					DeviceID:          "test_device_id",
+					Mode:              &updatedMode,
+					TargetTemperature: &updatedTargetTemperature,
+				},
+			},
+			wantDispatchedDeviceIDs: []string{},
+		},
+		{
+			name: "should report pending delivery, if dispatch is coalesced",
+			args: args{
+				updater: &fakeTargetStateUpdater{
+					States: map[string]thermostat.TargetState{
+						"test_device_id": {
+							DeviceID:          "test_device_id",
+							Mode:              &initialMode,
+							TargetTemperature: &initialTargetTemperature,
+						},
+					},
+					shouldFail: false,
+				},
+				dispatcher: &fakeTargetStateDispatcher{
+					DeviceIDs:  []string{},
+					coalesce:   true,
+					shouldFail: false,
+				},
+				req: addChiURLParams(
+					httptest.NewRequest(http.MethodPost, "/api/v1/target-state/test_device_id", bytes.NewReader(
+						[]byte(fmt.Sprintf(`{
+							"targetTemperature": %d
+						}`, updatedTargetTemperature))),
+					),
+					map[string]string{"deviceID": "test_device_id"},
+				),
+			},
+			wantStatus:   http.StatusOK,
+			wantErr:      false,
+			wantDelivery: outbox.PendingStatus,
+			wantBody: &thermostat.TargetState{
+				DeviceID:          "test_device_id",
+				Mode:              &initialMode,
+				TargetTemperature: &updatedTargetTemperature,
+			},
+			wantUpdaterStates: map[string]*thermostat.TargetState{
+				"test_device_id": {
+					DeviceID:          "test_device_id",
+					Mode:              &initialMode,
+					TargetTemperature: &updatedTargetTemperature,
+				},
+			},
+			wantDispatchedDeviceIDs: []string{"test_device_id"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			handler := UpdateTargetState(tt.args.updater, tt.args.publisher)
+			handler := UpdateTargetState(tt.args.updater, tt.args.dispatcher)
 			handler(w, tt.args.req)
 
 			// Check response status code
@@ -496,11 +600,15 @@ func TestUpdateTargetState(t *testing.T) {
 			}
 
 			// Decode the response body into struct for checking
-			var resBody thermostat.TargetState
+			var resBody targetStateResponse
 			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
 				t.Fatalf("UpdateTargetState() error json decoding response body: %v", err)
 			}
 
+			if resBody.Delivery != tt.wantDelivery {
+				t.Errorf("UpdateTargetState() response body Delivery = %v, want %v", resBody.Delivery, tt.wantDelivery)
+			}
+
 			// Check response body fields
 			if resBody.DeviceID != tt.wantBody.DeviceID {
 				t.Errorf("UpdateTargetState() response body DeviceID = %v, want %v", resBody.DeviceID, tt.wantBody.DeviceID)
@@ -532,20 +640,9 @@ func TestUpdateTargetState(t *testing.T) {
 				}
 			}
 
-			// Check publisher states
-			if len(tt.args.publisher.States) != len(tt.wantPublisherStates) {
-				t.Errorf("UpdateTargetState() len(publisher.States) = %d, want %d", len(tt.args.publisher.States), len(tt.wantPublisherStates))
-			}
-			for i, state := range tt.args.publisher.States {
-				wantState := tt.wantPublisherStates[i]
-
-				if !ptrEqual(state.Mode, wantState.Mode) {
-					t.Errorf("UpdateTargetState() publisher.States[%d].Mode = %v, want %v", i, state.Mode, wantState.Mode)
-				}
-
-				if !ptrEqual(state.TargetTemperature, wantState.TargetTemperature) {
-					t.Errorf("UpdateTargetState() publisher.States[%d].TargetTemperature = %v, want %v", i, state.TargetTemperature, wantState.TargetTemperature)
-				}
+			// Check dispatched devices
+			if !reflect.DeepEqual(tt.args.dispatcher.DeviceIDs, tt.wantDispatchedDeviceIDs) {
+				t.Errorf("UpdateTargetState() dispatcher.DeviceIDs = %v, want %v", tt.args.dispatcher.DeviceIDs, tt.wantDispatchedDeviceIDs)
 			}
 		})
 	}
@@ -560,3 +657,88 @@ func ptrEqual[T comparable](a, b *T) bool {
 	}
 	return *a == *b
 }
+
+func TestUpdateTargetStateAccess(t *testing.T) {
+	minTemperature := 18
+	maxTemperature := 22
+	kid := &access.Policy{Grants: []access.Grant{
+		{DeviceID: "bedroom", Permission: access.SetTemperaturePermission, MinTemperature: &minTemperature, MaxTemperature: &maxTemperature},
+	}}
+	parent := &access.Policy{Grants: []access.Grant{
+		{DeviceID: access.AnyDevice, Permission: access.AdminPermission},
+	}}
+
+	tests := []struct {
+		name       string
+		policy     *access.Policy
+		deviceID   string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should allow temperature within range of grant",
+			policy:     kid,
+			deviceID:   "bedroom",
+			body:       `{"targetTemperature": 21}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 403, if temperature is out of range of grant",
+			policy:     kid,
+			deviceID:   "bedroom",
+			body:       `{"targetTemperature": 25}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "should return error 403, if mode change isn't granted",
+			policy:     kid,
+			deviceID:   "bedroom",
+			body:       `{"mode": "HEAT", "targetTemperature": 21}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "should return error 403, if device isn't granted",
+			policy:     kid,
+			deviceID:   "living_room",
+			body:       `{"targetTemperature": 21}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "should allow everything with admin grant on any device",
+			policy:     parent,
+			deviceID:   "living_room",
+			body:       `{"mode": "COOL", "targetTemperature": 28}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should allow everything, if request isn't restricted",
+			policy:     nil,
+			deviceID:   "living_room",
+			body:       `{"mode": "COOL", "targetTemperature": 28}`,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updater := &fakeTargetStateUpdater{States: map[string]thermostat.TargetState{}}
+
+			w := httptest.NewRecorder()
+			req := addChiURLParams(
+				httptest.NewRequest(http.MethodPost, "/api/v1/target-state/"+tt.deviceID, bytes.NewReader([]byte(tt.body))),
+				map[string]string{"deviceID": tt.deviceID},
+			)
+			req = req.WithContext(access.WithContext(req.Context(), tt.policy))
+			handler := UpdateTargetState(updater, &fakeTargetStateDispatcher{})
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateTargetState() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			_, updated := updater.States[tt.deviceID]
+			if updated != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("UpdateTargetState() updated = %v, want %v", updated, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+	"github.com/go-chi/chi/v5"
+)
+
+type WebhookSubscriptionsFetcher interface {
+	FetchWebhookSubscriptions(ctx context.Context) ([]webhook.Subscription, error)
+}
+
+func GetWebhookSubscriptions(fetcher WebhookSubscriptionsFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscriptions, err := fetcher.FetchWebhookSubscriptions(r.Context())
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching webhook subscriptions: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		for i := range subscriptions {
+			subscriptions[i].Secret = ""
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(subscriptions)
+		handleWritingErr(r, err)
+	}
+}
+
+type WebhookSubscriptionFetcher interface {
+	FetchWebhookSubscription(ctx context.Context, id int64) (*webhook.Subscription, error)
+}
+
+func GetWebhookSubscription(fetcher WebhookSubscriptionFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := webhookSubscriptionID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		subscription, err := fetcher.FetchWebhookSubscription(r.Context(), id)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("webhook subscription not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error fetching webhook subscription: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		subscription.Secret = ""
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(subscription)
+		handleWritingErr(r, err)
+	}
+}
+
+type WebhookSubscriptionAdder interface {
+	AddWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (*webhook.Subscription, error)
+}
+
+func AddWebhookSubscription(adder WebhookSubscriptionAdder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var subscription webhook.Subscription
+		err := json.NewDecoder(r.Body).Decode(&subscription)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding webhook subscription: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		err = subscription.Validate()
+		if err == nil && subscription.Secret == "" {
+			err = errors.New("secret must be set")
+		}
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating webhook subscription: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		addedSubscription, err := adder.AddWebhookSubscription(r.Context(), &subscription)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error adding webhook subscription: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		addedSubscription.Secret = ""
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		err = json.NewEncoder(w).Encode(addedSubscription)
+		handleWritingErr(r, err)
+	}
+}
+
+type WebhookSubscriptionUpdater interface {
+	UpdateWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (*webhook.Subscription, error)
+}
+
+// UpdateWebhookSubscription replaces the subscription. The secret is kept if
+// left out, and the subscription is enabled unless set otherwise, which also
+// resets its failures.
+func UpdateWebhookSubscription(updater WebhookSubscriptionUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := webhookSubscriptionID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		subscription := webhook.Subscription{Enabled: true}
+		err = json.NewDecoder(r.Body).Decode(&subscription)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error decoding webhook subscription: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		subscription.ID = id
+
+		err = subscription.Validate()
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error validating webhook subscription: %v", err), http.StatusBadRequest, false)
+			return
+		}
+
+		updatedSubscription, err := updater.UpdateWebhookSubscription(r.Context(), &subscription)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("webhook subscription not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error updating webhook subscription: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		updatedSubscription.Secret = ""
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(updatedSubscription)
+		handleWritingErr(r, err)
+	}
+}
+
+type WebhookSubscriptionDeleter interface {
+	DeleteWebhookSubscription(ctx context.Context, id int64) error
+}
+
+func DeleteWebhookSubscription(deleter WebhookSubscriptionDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := webhookSubscriptionID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		err = deleter.DeleteWebhookSubscription(r.Context(), id)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrNotFound:
+				HandleError(w, r, fmt.Errorf("webhook subscription not found: %v", err), http.StatusNotFound, false)
+			default:
+				HandleError(w, r, fmt.Errorf("error deleting webhook subscription: %v", err), http.StatusInternalServerError, true)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type WebhookDeliveriesFetcher interface {
+	FetchWebhookDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]webhook.Delivery, error)
+}
+
+const (
+	defaultWebhookDeliveriesLimit = 100
+	maxWebhookDeliveriesLimit     = 1000
+)
+
+// GetWebhookDeliveries returns the delivery log of the subscription, newest
+// first.
+func GetWebhookDeliveries(fetcher WebhookDeliveriesFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := webhookSubscriptionID(r)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest, false)
+			return
+		}
+
+		limit := defaultWebhookDeliveriesLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 || limit > maxWebhookDeliveriesLimit {
+				HandleError(w, r, fmt.Errorf("limit must be an integer in range [1,%d], got: '%s'", maxWebhookDeliveriesLimit, limitParam), http.StatusBadRequest, false)
+				return
+			}
+		}
+
+		deliveries, err := fetcher.FetchWebhookDeliveries(r.Context(), id, limit)
+		if err != nil {
+			HandleError(w, r, fmt.Errorf("error fetching webhook deliveries: %v", err), http.StatusInternalServerError, true)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err = json.NewEncoder(w).Encode(deliveries)
+		handleWritingErr(r, err)
+	}
+}
+
+func webhookSubscriptionID(r *http.Request) (int64, error) {
+	idParam := chi.URLParam(r, "subscriptionID")
+
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("subscription ID must be an integer, got: '%s'", idParam)
+	}
+
+	return id, nil
+}
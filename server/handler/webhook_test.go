@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+)
+
+type fakeWebhookSubscriptionStore struct {
+	Subscriptions map[int64]webhook.Subscription
+
+	shouldFail bool
+}
+
+func (f *fakeWebhookSubscriptionStore) FetchWebhookSubscription(ctx context.Context, id int64) (*webhook.Subscription, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	subscription, exists := f.Subscriptions[id]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("webhook subscription %d not found", id)}
+	}
+
+	return &subscription, nil
+}
+
+func (f *fakeWebhookSubscriptionStore) AddWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (*webhook.Subscription, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	if f.Subscriptions == nil {
+		f.Subscriptions = make(map[int64]webhook.Subscription)
+	}
+
+	added := *subscription
+	added.ID = int64(len(f.Subscriptions) + 1)
+	added.Enabled = true
+	f.Subscriptions[added.ID] = added
+
+	return &added, nil
+}
+
+func (f *fakeWebhookSubscriptionStore) UpdateWebhookSubscription(ctx context.Context, subscription *webhook.Subscription) (*webhook.Subscription, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	stored, exists := f.Subscriptions[subscription.ID]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: fmt.Errorf("webhook subscription %d not found", subscription.ID)}
+	}
+
+	updated := *subscription
+	if updated.Secret == "" {
+		updated.Secret = stored.Secret
+	}
+	f.Subscriptions[subscription.ID] = updated
+
+	return &updated, nil
+}
+
+const testWebhookSubscription = `{
+	"url": "https://example.com/hook",
+	"eventTypes": ["TARGET_STATE_UPDATED", "AVAILABILITY_CHANGED"],
+	"deviceId": "test_device_id",
+	"secret": "test_secret_0123456789"
+}`
+
+func TestAddWebhookSubscription(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *fakeWebhookSubscriptionStore
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "should add webhook subscription",
+			store:      &fakeWebhookSubscriptionStore{},
+			body:       testWebhookSubscription,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "should return error 400, if secret is missing",
+			store:      &fakeWebhookSubscriptionStore{},
+			body:       `{"url": "https://example.com/hook", "eventTypes": ["TARGET_STATE_UPDATED"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if secret is too short",
+			store:      &fakeWebhookSubscriptionStore{},
+			body:       `{"url": "https://example.com/hook", "eventTypes": ["TARGET_STATE_UPDATED"], "secret": "short"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if event type is unknown",
+			store:      &fakeWebhookSubscriptionStore{},
+			body:       `{"url": "https://example.com/hook", "eventTypes": ["MODE_CHANGED"], "secret": "test_secret_0123456789"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 400, if url is not http(s)",
+			store:      &fakeWebhookSubscriptionStore{},
+			body:       `{"url": "ftp://example.com/hook", "eventTypes": ["TARGET_STATE_UPDATED"], "secret": "test_secret_0123456789"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "should return error 500, if failed to add",
+			store:      &fakeWebhookSubscriptionStore{shouldFail: true},
+			body:       testWebhookSubscription,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewReader([]byte(tt.body)))
+			handler := AddWebhookSubscription(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AddWebhookSubscription() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resBody webhook.Subscription
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("AddWebhookSubscription() error json decoding response body: %v", err)
+			}
+
+			if resBody.ID != 1 || len(resBody.EventTypes) != 2 || !resBody.Enabled {
+				t.Errorf("AddWebhookSubscription() response body = %+v, want enabled subscription 1 to 2 event types", resBody)
+			}
+
+			if resBody.Secret != "" {
+				t.Errorf("AddWebhookSubscription() response body secret = %s, want it hidden", resBody.Secret)
+			}
+		})
+	}
+}
+
+func TestUpdateWebhookSubscription(t *testing.T) {
+	stored := map[int64]webhook.Subscription{
+		1: {ID: 1, URL: "https://example.com/old", Secret: "stored_secret_0123456789"},
+	}
+
+	tests := []struct {
+		name           string
+		store          *fakeWebhookSubscriptionStore
+		subscriptionID string
+		body           string
+		wantStatus     int
+		wantEnabled    bool
+		wantSecret     string
+	}{
+		{
+			name:           "should update and enable webhook subscription",
+			store:          &fakeWebhookSubscriptionStore{Subscriptions: maps.Clone(stored)},
+			subscriptionID: "1",
+			body:           testWebhookSubscription,
+			wantStatus:     http.StatusOK,
+			wantEnabled:    true,
+			wantSecret:     "test_secret_0123456789",
+		},
+		{
+			name:           "should keep secret and disable, if set so",
+			store:          &fakeWebhookSubscriptionStore{Subscriptions: maps.Clone(stored)},
+			subscriptionID: "1",
+			body:           `{"url": "https://example.com/hook", "eventTypes": ["CURRENT_STATE_RECEIVED"], "enabled": false}`,
+			wantStatus:     http.StatusOK,
+			wantEnabled:    false,
+			wantSecret:     "stored_secret_0123456789",
+		},
+		{
+			name:           "should return error 404, if subscription is not found",
+			store:          &fakeWebhookSubscriptionStore{Subscriptions: map[int64]webhook.Subscription{}},
+			subscriptionID: "1",
+			body:           testWebhookSubscription,
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "should return error 400, if subscription ID is invalid",
+			store:          &fakeWebhookSubscriptionStore{},
+			subscriptionID: "first",
+			body:           testWebhookSubscription,
+			wantStatus:     http.StatusBadRequest,
+		},
+		{
+			name:           "should return error 500, if failed to update",
+			store:          &fakeWebhookSubscriptionStore{shouldFail: true},
+			subscriptionID: "1",
+			body:           testWebhookSubscription,
+			wantStatus:     http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodPut, "/api/v1/webhooks/"+tt.subscriptionID, bytes.NewReader([]byte(tt.body))), map[string]string{
+				"subscriptionID": tt.subscriptionID,
+			})
+			handler := UpdateWebhookSubscription(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("UpdateWebhookSubscription() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			updated := tt.store.Subscriptions[1]
+			if updated.Enabled != tt.wantEnabled || updated.Secret != tt.wantSecret {
+				t.Errorf("UpdateWebhookSubscription() stored enabled = %v with secret %s, want %v with %s", updated.Enabled, updated.Secret, tt.wantEnabled, tt.wantSecret)
+			}
+
+			var resBody webhook.Subscription
+			if err := json.NewDecoder(w.Body).Decode(&resBody); err != nil {
+				t.Fatalf("UpdateWebhookSubscription() error json decoding response body: %v", err)
+			}
+
+			if resBody.Secret != "" {
+				t.Errorf("UpdateWebhookSubscription() response body secret = %s, want it hidden", resBody.Secret)
+			}
+		})
+	}
+}
+
+func TestGetWebhookSubscription(t *testing.T) {
+	tests := []struct {
+		name           string
+		store          *fakeWebhookSubscriptionStore
+		subscriptionID string
+		wantStatus     int
+	}{
+		{
+			name: "should return webhook subscription without its secret",
+			store: &fakeWebhookSubscriptionStore{Subscriptions: map[int64]webhook.Subscription{
+				1: {ID: 1, URL: "https://example.com/hook", Secret: "test_secret_0123456789"},
+			}},
+			subscriptionID: "1",
+			wantStatus:     http.StatusOK,
+		},
+		{
+			name:           "should return error 404, if subscription is not found",
+			store:          &fakeWebhookSubscriptionStore{Subscriptions: map[int64]webhook.Subscription{}},
+			subscriptionID: "1",
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "should return error 500, if failed to fetch",
+			store:          &fakeWebhookSubscriptionStore{shouldFail: true},
+			subscriptionID: "1",
+			wantStatus:     http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := addChiURLParams(httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/"+tt.subscriptionID, nil), map[string]string{
+				"subscriptionID": tt.subscriptionID,
+			})
+			handler := GetWebhookSubscription(tt.store)
+			handler(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("GetWebhookSubscription() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusOK && bytes.Contains(w.Body.Bytes(), []byte("test_secret")) {
+				t.Errorf("GetWebhookSubscription() response body = %s, want secret hidden", w.Body.String())
+			}
+		})
+	}
+}
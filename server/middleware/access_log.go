@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+)
+
+// AccessLog logs every request once it's handled.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crw := customResponseWriter{ResponseWriter: w}
+
+		start := time.Now()
+		next.ServeHTTP(&crw, r)
+		duration := time.Since(start)
+
+		logger.FromContext(r.Context()).Info("Request handled",
+			"method", r.Method,
+			"route", routePattern(r),
+			"status", crw.status,
+			"bytes", crw.bytes,
+			"duration", duration,
+			"deviceId", deviceLabel(r),
+		)
+	})
+}
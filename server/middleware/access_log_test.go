@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+	chi "github.com/go-chi/chi/v5"
+)
+
+func TestAccessLog(t *testing.T) {
+	const delay = 5 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBytes  int
+	}{
+		{
+			name: "should log implicit status and bytes of body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"mode":"HEAT"}`))
+			},
+			wantStatus: http.StatusOK,
+			wantBytes:  len(`{"mode":"HEAT"}`),
+		},
+		{
+			name: "should log status written by handler",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("not found"))
+			},
+			wantStatus: http.StatusNotFound,
+			wantBytes:  len("not found"),
+		},
+		{
+			name: "should log no bytes, if handler wrote no body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			wantStatus: http.StatusNoContent,
+			wantBytes:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			r := chi.NewRouter()
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := logger.WithContext(r.Context(), slog.New(slog.NewJSONHandler(&logs, nil)))
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			})
+			r.Use(RequestID)
+			r.Use(AccessLog)
+			r.Get("/api/v1/target-state/{deviceID}", func(w http.ResponseWriter, r *http.Request) {
+				logger.FromContext(r.Context()).Info("Handling request")
+				time.Sleep(delay)
+				tt.handler(w, r)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/target-state/bedroom", nil)
+			req.Header.Set(RequestIDHeader, "test-request-id")
+			r.ServeHTTP(w, req)
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("AccessLog() logged %d entries, want 2: %s", len(lines), logs.String())
+			}
+
+			var handlerEntry map[string]any
+			err := json.Unmarshal([]byte(lines[0]), &handlerEntry)
+			if err != nil {
+				t.Fatalf("AccessLog() error decoding handler log entry: %v", err)
+			}
+
+			if handlerEntry["requestId"] != "test-request-id" {
+				t.Errorf("AccessLog() handler logged requestId = %v, want %q", handlerEntry["requestId"], "test-request-id")
+			}
+
+			var entry map[string]any
+			err = json.Unmarshal([]byte(lines[1]), &entry)
+			if err != nil {
+				t.Fatalf("AccessLog() error decoding log entry: %v", err)
+			}
+
+			want := map[string]any{
+				"msg":       "Request handled",
+				"method":    http.MethodGet,
+				"route":     "/api/v1/target-state/{deviceID}",
+				"status":    float64(tt.wantStatus),
+				"bytes":     float64(tt.wantBytes),
+				"deviceId":  "bedroom",
+				"requestId": "test-request-id",
+			}
+			for key, value := range want {
+				if entry[key] != value {
+					t.Errorf("AccessLog() logged %s = %v, want %v", key, entry[key], value)
+				}
+			}
+
+			// Durations are logged in nanoseconds
+			duration, ok := entry["duration"].(float64)
+			if !ok {
+				t.Fatalf("AccessLog() logged duration = %v, want number", entry["duration"])
+			}
+			if time.Duration(duration) < delay {
+				t.Errorf("AccessLog() logged duration = %v, want at least %v", time.Duration(duration), delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/access"
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+	"github.com/alexchebotarsky/thermostat-api/server/handler"
+)
+
+type APIKeyAuthenticator interface {
+	AuthenticateAPIKey(ctx context.Context, hash string, now time.Time) (*apikey.Key, error)
+}
+
+// AccessPolicyFetcher returns the roles assigned to users, and the grants
+// of roles.
+type AccessPolicyFetcher interface {
+	FetchUserRoles(ctx context.Context, subject string) ([]string, error)
+	FetchRoleGrants(ctx context.Context, roles []string) ([]access.Grant, error)
+}
+
+// HomeFetcher returns the home identities are members of, and the homes
+// claimed by tokens.
+type HomeFetcher interface {
+	FetchMemberHome(ctx context.Context, subject string) (*home.Home, error)
+	FetchHome(ctx context.Context, id string) (*home.Home, error)
+}
+
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (*identity.Identity, error)
+}
+
+// Authenticators check the credentials of requests. Tokens is nil if JWTs
+// aren't accepted, Access is nil if requests aren't restricted to devices, and
+// Homes is nil if every request is scoped to the default home.
+type Authenticators struct {
+	APIKeys APIKeyAuthenticator
+	Tokens  TokenVerifier
+	Access  AccessPolicyFetcher
+	Homes   HomeFetcher
+}
+
+// ScopeFunc returns the scope an API key needs for the request.
+type ScopeFunc func(r *http.Request) apikey.Scope
+
+// MethodScope requires the read scope for safe methods, and the write scope
+// for everything else.
+func MethodScope(r *http.Request) apikey.Scope {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return apikey.ReadScope
+	default:
+		return apikey.WriteScope
+	}
+}
+
+// Scope requires the same scope for every request.
+func Scope(scope apikey.Scope) ScopeFunc {
+	return func(r *http.Request) apikey.Scope {
+		return scope
+	}
+}
+
+// Auth rejects requests without valid credentials that have the scope they
+// need. Credentials are read from the Authorization bearer token, or the
+// X-API-Key header, and are either an API key or a JWT of the identity
+// provider. The identity they belong to, the access policy of its roles and
+// the home it is scoped to are stored in the request context.
+func Auth(authenticators Authenticators, scopeOf ScopeFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := requestToken(r)
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				handler.HandleError(w, r, errors.New("api key or token is required"), http.StatusUnauthorized, false)
+				return
+			}
+
+			id, err := authenticate(r.Context(), authenticators, token)
+			if err != nil {
+				switch err.(type) {
+				case *client.ErrUnauthorized:
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					handler.HandleError(w, r, err, http.StatusUnauthorized, false)
+				default:
+					handler.HandleError(w, r, fmt.Errorf("error authenticating request: %v", err), http.StatusInternalServerError, true)
+				}
+				return
+			}
+
+			scope := scopeOf(r)
+			if !id.HasScope(scope) {
+				handler.HandleError(w, r, fmt.Errorf("%s is missing scope %s", id.Subject, scope), http.StatusForbidden, false)
+				return
+			}
+
+			policy, err := resolvePolicy(r.Context(), authenticators.Access, id)
+			if err != nil {
+				handler.HandleError(w, r, fmt.Errorf("error resolving access policy: %v", err), http.StatusInternalServerError, true)
+				return
+			}
+
+			h, err := resolveHome(r.Context(), authenticators.Homes, id)
+			if err != nil {
+				switch err.(type) {
+				case *client.ErrNotFound:
+					handler.HandleError(w, r, err, http.StatusForbidden, false)
+				default:
+					handler.HandleError(w, r, fmt.Errorf("error resolving home: %v", err), http.StatusInternalServerError, true)
+				}
+				return
+			}
+
+			ctx := identity.WithContext(r.Context(), id)
+			ctx = access.WithContext(ctx, policy)
+			ctx = home.WithContext(ctx, h)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func authenticate(ctx context.Context, authenticators Authenticators, token string) (*identity.Identity, error) {
+	// JWTs are the only credentials made of three dot separated parts
+	if authenticators.Tokens != nil && strings.Count(token, ".") == 2 {
+		id, err := authenticators.Tokens.VerifyToken(ctx, token)
+		if err != nil {
+			switch err.(type) {
+			case *client.ErrUnauthorized:
+				return nil, &client.ErrUnauthorized{Err: fmt.Errorf("token is invalid: %v", err)}
+			default:
+				return nil, fmt.Errorf("error verifying token: %v", err)
+			}
+		}
+
+		return id, nil
+	}
+
+	key, err := authenticators.APIKeys.AuthenticateAPIKey(ctx, apikey.Hash(token), time.Now())
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			return nil, &client.ErrUnauthorized{Err: errors.New("api key is invalid or revoked")}
+		default:
+			return nil, fmt.Errorf("error authenticating api key: %v", err)
+		}
+	}
+
+	return &identity.Identity{
+		Subject: key.Subject(),
+		Name:    key.Name,
+		Scopes:  key.Scopes,
+		Method:  identity.APIKeyMethod,
+	}, nil
+}
+
+// resolvePolicy adds the roles assigned to the identity to the ones it came
+// with, and returns the grants of all of them. API keys without roles keep
+// access to every device, as they did before roles existed, while users of
+// the identity provider only get what their roles grant.
+func resolvePolicy(ctx context.Context, fetcher AccessPolicyFetcher, id *identity.Identity) (*access.Policy, error) {
+	if fetcher == nil {
+		return nil, nil
+	}
+
+	roles, err := fetcher.FetchUserRoles(ctx, id.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching roles of %s: %v", id.Subject, err)
+	}
+
+	for _, role := range roles {
+		if !id.HasRole(role) {
+			id.Roles = append(id.Roles, role)
+		}
+	}
+
+	if id.Method == identity.APIKeyMethod && len(id.Roles) == 0 {
+		return nil, nil
+	}
+
+	grants, err := fetcher.FetchRoleGrants(ctx, id.Roles)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching grants: %v", err)
+	}
+
+	return &access.Policy{Grants: grants}, nil
+}
+
+// resolveHome returns the home the identity is a member of, or else the home
+// claimed by its token, or else the default home. ErrNotFound is returned if
+// the claimed home doesn't exist.
+func resolveHome(ctx context.Context, fetcher HomeFetcher, id *identity.Identity) (*home.Home, error) {
+	if fetcher == nil {
+		return &home.Home{ID: home.DefaultID}, nil
+	}
+
+	h, err := fetcher.FetchMemberHome(ctx, id.Subject)
+	if err != nil {
+		switch err.(type) {
+		case *client.ErrNotFound:
+			homeID := id.HomeID
+			if homeID == "" {
+				homeID = home.DefaultID
+			}
+
+			h, err = fetcher.FetchHome(ctx, homeID)
+			if err != nil {
+				switch err.(type) {
+				case *client.ErrNotFound:
+					return nil, &client.ErrNotFound{Err: fmt.Errorf("home %s of %s doesn't exist", homeID, id.Subject)}
+				default:
+					return nil, fmt.Errorf("error fetching home %s: %v", homeID, err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("error fetching home of %s: %v", id.Subject, err)
+		}
+	}
+
+	id.HomeID = h.ID
+
+	return h, nil
+}
+
+func requestToken(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		scheme, token, found := strings.Cut(authorization, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	return r.Header.Get("X-API-Key")
+}
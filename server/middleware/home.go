@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	"github.com/alexchebotarsky/thermostat-api/server/handler"
+	chi "github.com/go-chi/chi/v5"
+)
+
+// DefaultHome rejects requests of other homes than the default one, for
+// routes managed by the operator of the deployment.
+func DefaultHome(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := home.FromContext(r.Context())
+		if h.ID != home.DefaultID {
+			handler.HandleError(w, r, fmt.Errorf("route isn't available to home %s", h.ID), http.StatusForbidden, false)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type DeviceHomeFetcher interface {
+	FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error)
+}
+
+// DeviceHome responds with not found to requests for devices of other homes,
+// so that homes can't tell devices of other homes from devices that don't
+// exist.
+func DeviceHome(fetcher DeviceHomeFetcher) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deviceID := chi.URLParam(r, "deviceID")
+
+			deviceHome, err := fetcher.FetchDeviceHome(r.Context(), deviceID)
+			if err != nil {
+				handler.HandleError(w, r, fmt.Errorf("error fetching home of device: %v", err), http.StatusInternalServerError, true)
+				return
+			}
+
+			h := home.FromContext(r.Context())
+			if deviceHome.ID != h.ID {
+				handler.HandleError(w, r, fmt.Errorf("device %s not found in home %s", deviceID, h.ID), http.StatusNotFound, false)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
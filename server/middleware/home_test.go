@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/model/home"
+	chi "github.com/go-chi/chi/v5"
+)
+
+type fakeDeviceHomeFetcher struct {
+	Devices map[string]string
+
+	shouldFail bool
+}
+
+func (f *fakeDeviceHomeFetcher) FetchDeviceHome(ctx context.Context, deviceID string) (*home.Home, error) {
+	if f.shouldFail {
+		return nil, errors.New("test error")
+	}
+
+	homeID, exists := f.Devices[deviceID]
+	if !exists {
+		homeID = home.DefaultID
+	}
+
+	return &home.Home{ID: homeID}, nil
+}
+
+func TestDeviceHome(t *testing.T) {
+	fetcher := &fakeDeviceHomeFetcher{Devices: map[string]string{
+		"bedroom": "smiths",
+	}}
+
+	tests := []struct {
+		name       string
+		fetcher    *fakeDeviceHomeFetcher
+		home       *home.Home
+		deviceID   string
+		wantStatus int
+	}{
+		{
+			name:       "should allow device of home",
+			fetcher:    fetcher,
+			home:       &home.Home{ID: "smiths"},
+			deviceID:   "bedroom",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should allow unregistered device to default home",
+			fetcher:    fetcher,
+			home:       nil,
+			deviceID:   "office",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 404, if device belongs to another home",
+			fetcher:    fetcher,
+			home:       nil,
+			deviceID:   "bedroom",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 404, if device isn't registered in home",
+			fetcher:    fetcher,
+			home:       &home.Home{ID: "smiths"},
+			deviceID:   "office",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "should return error 500, if failed to fetch device home",
+			fetcher:    &fakeDeviceHomeFetcher{shouldFail: true},
+			home:       nil,
+			deviceID:   "bedroom",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("deviceID", tt.deviceID)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/target-state/"+tt.deviceID, nil)
+			ctx := context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx)
+			if tt.home != nil {
+				ctx = home.WithContext(ctx, tt.home)
+			}
+			DeviceHome(tt.fetcher)(next).ServeHTTP(w, req.WithContext(ctx))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("DeviceHome() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDefaultHome(t *testing.T) {
+	tests := []struct {
+		name       string
+		home       *home.Home
+		wantStatus int
+	}{
+		{
+			name:       "should allow default home",
+			home:       &home.Home{ID: home.DefaultID},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should allow requests without home",
+			home:       nil,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should return error 403, if home isn't default",
+			home:       &home.Home{ID: "smiths"},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/sensors", nil)
+			if tt.home != nil {
+				req = req.WithContext(home.WithContext(req.Context(), tt.home))
+			}
+			DefaultHome(next).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("DefaultHome() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -17,24 +17,52 @@ func Metrics(next http.Handler) http.Handler {
 		next.ServeHTTP(&crw, r)
 		duration := time.Since(start)
 
-		routeName := fmt.Sprintf("%s %s", r.Method, chi.RouteContext(r.Context()).RoutePattern())
-
-		deviceID := chi.URLParam(r, "deviceID")
-		if deviceID == "" {
-			deviceID = "n/a"
-		}
+		routeName := fmt.Sprintf("%s %s", r.Method, routePattern(r))
+		deviceID := deviceLabel(r)
 
 		metrics.AddRequestHandled(routeName, crw.status, deviceID)
 		metrics.ObserveRequestDuration(routeName, crw.status, deviceID, duration)
 	})
 }
 
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return r.URL.Path
+	}
+
+	return rctx.RoutePattern()
+}
+
+func deviceLabel(r *http.Request) string {
+	deviceID := chi.URLParam(r, "deviceID")
+	if deviceID == "" {
+		return "n/a"
+	}
+
+	return deviceID
+}
+
 type customResponseWriter struct {
 	http.ResponseWriter
 	status int
+	bytes  int
 }
 
 func (crw *customResponseWriter) WriteHeader(status int) {
-	crw.status = status
+	if crw.status == 0 {
+		crw.status = status
+	}
 	crw.ResponseWriter.WriteHeader(status)
 }
+
+// Write records the implicit OK status of handlers that don't write a header,
+// and counts the bytes of the body written.
+func (crw *customResponseWriter) Write(b []byte) (int, error) {
+	if crw.status == 0 {
+		crw.status = http.StatusOK
+	}
+	n, err := crw.ResponseWriter.Write(b)
+	crw.bytes += n
+	return n, err
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+	"github.com/alexchebotarsky/thermostat-api/ratelimit"
+	"github.com/alexchebotarsky/thermostat-api/server/handler"
+	chi "github.com/go-chi/chi/v5"
+)
+
+// KeyFunc returns the key requests are limited by.
+type KeyFunc func(r *http.Request) string
+
+// ClientKey limits requests by the API key or user that made them, or by the
+// remote address if authentication is disabled.
+func ClientKey(r *http.Request) string {
+	id := identity.FromContext(r.Context())
+	if id != nil {
+		return id.Subject
+	}
+
+	return AddressKey(r)
+}
+
+// AddressKey limits requests by the host they come from, so that requests are
+// limited before they are authenticated.
+func AddressKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// DeviceKey limits requests by the device of the route.
+func DeviceKey(r *http.Request) string {
+	return chi.URLParam(r, "deviceID")
+}
+
+// RateLimit responds with too many requests and when to retry, once the key
+// of the request runs out of tokens. A nil limiter doesn't limit anything.
+func RateLimit(name string, limiter *ratelimit.Limiter, keyOf KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyOf(r)
+
+			allowed, retryAfter := limiter.Allow(key, time.Now())
+			if !allowed {
+				metrics.AddRequestRateLimited(name)
+
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				handler.HandleError(w, r, fmt.Errorf("%s rate limit of %s exceeded, retry in %s", name, key, retryAfter.Round(time.Millisecond)), http.StatusTooManyRequests, false)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
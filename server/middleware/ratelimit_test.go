@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/model/identity"
+	"github.com/alexchebotarsky/thermostat-api/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name           string
+		limiter        *ratelimit.Limiter
+		identities     []*identity.Identity
+		wantStatus     []int
+		wantRetryAfter string
+	}{
+		{
+			name:           "should allow requests within burst",
+			limiter:        ratelimit.New(1, 2),
+			identities:     []*identity.Identity{nil, nil},
+			wantStatus:     []int{http.StatusOK, http.StatusOK},
+			wantRetryAfter: "",
+		},
+		{
+			name:           "should return error 429 with retry after, if limit is exceeded",
+			limiter:        ratelimit.New(0.5, 1),
+			identities:     []*identity.Identity{nil, nil},
+			wantStatus:     []int{http.StatusOK, http.StatusTooManyRequests},
+			wantRetryAfter: "2",
+		},
+		{
+			name:    "should limit clients separately",
+			limiter: ratelimit.New(1, 1),
+			identities: []*identity.Identity{
+				{Subject: "api-key:1"},
+				{Subject: "api-key:2"},
+			},
+			wantStatus:     []int{http.StatusOK, http.StatusOK},
+			wantRetryAfter: "",
+		},
+		{
+			name:           "should allow everything, if limiter is disabled",
+			limiter:        ratelimit.New(0, 1),
+			identities:     []*identity.Identity{nil, nil, nil},
+			wantStatus:     []int{http.StatusOK, http.StatusOK, http.StatusOK},
+			wantRetryAfter: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			limited := RateLimit("client", tt.limiter, ClientKey)(next)
+
+			var w *httptest.ResponseRecorder
+			for i, id := range tt.identities {
+				w = httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/target-state/bedroom", nil)
+				if id != nil {
+					req = req.WithContext(identity.WithContext(context.Background(), id))
+				}
+				limited.ServeHTTP(w, req)
+
+				if w.Code != tt.wantStatus[i] {
+					t.Errorf("RateLimit() request %d status = %v, want %v", i, w.Code, tt.wantStatus[i])
+				}
+			}
+
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("RateLimit() Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestAddressKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		identity   *identity.Identity
+		want       string
+	}{
+		{
+			name:       "should return host of remote address",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "should return host of remote address, even if authenticated",
+			remoteAddr: "192.0.2.1:1234",
+			identity:   &identity.Identity{Subject: "api-key:1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "should return remote address, if it has no port",
+			remoteAddr: "192.0.2.1",
+			want:       "192.0.2.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.identity != nil {
+				req = req.WithContext(identity.WithContext(context.Background(), tt.identity))
+			}
+
+			if got := AddressKey(req); got != tt.want {
+				t.Errorf("AddressKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+	"github.com/alexchebotarsky/thermostat-api/server/handler"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs propagated from clients, longer ones
+// are replaced with a generated ID.
+const maxRequestIDLength = 128
+
+// RequestID propagates the request ID of the client, or generates one, and
+// returns it in the response. Logs of the request carry the ID through the
+// logger stored in the context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				handler.HandleError(w, r, fmt.Errorf("error generating request id: %v", err), http.StatusInternalServerError, true)
+				return
+			}
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := logger.WithContext(r.Context(), logger.FromContext(r.Context()).With("requestId", id))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID accepts printable ASCII IDs without spaces, so that IDs of
+// clients can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
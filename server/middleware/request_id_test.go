@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		wantID    string
+	}{
+		{
+			name:      "should propagate request id of client",
+			requestID: "3f2b8c1e-client",
+			wantID:    "3f2b8c1e-client",
+		},
+		{
+			name:      "should generate request id, if client didn't send one",
+			requestID: "",
+			wantID:    "",
+		},
+		{
+			name:      "should generate request id, if request id of client has spaces",
+			requestID: "forged\nmsg=fake",
+			wantID:    "",
+		},
+		{
+			name:      "should generate request id, if request id of client is too long",
+			requestID: strings.Repeat("a", maxRequestIDLength+1),
+			wantID:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				logger.FromContext(r.Context()).Info("test")
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			req = req.WithContext(logger.WithContext(req.Context(), slog.New(slog.NewJSONHandler(&logs, nil))))
+			RequestID(next).ServeHTTP(w, req)
+
+			gotID := w.Header().Get(RequestIDHeader)
+			if tt.wantID != "" && gotID != tt.wantID {
+				t.Errorf("RequestID() %s = %q, want %q", RequestIDHeader, gotID, tt.wantID)
+			}
+			if tt.wantID == "" && (len(gotID) != 32 || gotID == tt.requestID) {
+				t.Errorf("RequestID() %s = %q, want generated id", RequestIDHeader, gotID)
+			}
+
+			var entry map[string]any
+			err := json.Unmarshal(logs.Bytes(), &entry)
+			if err != nil {
+				t.Fatalf("RequestID() error decoding log entry: %v", err)
+			}
+
+			if entry["requestId"] != gotID {
+				t.Errorf("RequestID() logged requestId = %v, want %q", entry["requestId"], gotID)
+			}
+		})
+	}
+}
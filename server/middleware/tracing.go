@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/logger"
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	chi "github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing starts a span for every request, continuing the trace of the client
+// if it sent a traceparent header. Logs of the request carry the trace ID.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		if span.SpanContext().IsValid() {
+			ctx = logger.WithContext(ctx, logger.FromContext(ctx).With("traceId", span.SpanContext().TraceID().String()))
+		}
+
+		crw := customResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(&crw, r.WithContext(ctx))
+
+		// Route is only known once the request is routed
+		route := routePattern(r)
+		span.SetName(fmt.Sprintf("%s %s", r.Method, route))
+		span.SetAttributes(
+			semconv.HTTPRoute(route),
+			semconv.HTTPResponseStatusCode(crw.status),
+		)
+
+		deviceID := chi.URLParam(r, "deviceID")
+		if deviceID != "" {
+			span.SetAttributes(tracing.DeviceIDKey.String(deviceID))
+		}
+
+		if crw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(crw.status))
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexchebotarsky/thermostat-api/tracing"
+	"github.com/alexchebotarsky/thermostat-api/tracing/tracingtest"
+	chi "github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/codes"
+)
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	tests := []struct {
+		name        string
+		traceparent string
+		status      int
+		wantTraceID string
+		wantStatus  codes.Code
+	}{
+		{
+			name:        "should start trace of request",
+			traceparent: "",
+			status:      http.StatusOK,
+			wantTraceID: "",
+			wantStatus:  codes.Unset,
+		},
+		{
+			name:        "should continue trace of client",
+			traceparent: "00-" + traceID + "-00f067aa0ba902b7-01",
+			status:      http.StatusOK,
+			wantTraceID: traceID,
+			wantStatus:  codes.Unset,
+		},
+		{
+			name:        "should mark span as failed, if request failed",
+			traceparent: "",
+			status:      http.StatusInternalServerError,
+			wantTraceID: "",
+			wantStatus:  codes.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracingtest.Init()
+
+			r := chi.NewRouter()
+			r.Use(Tracing)
+			r.Post("/api/v1/target-state/{deviceID}", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/target-state/bedroom", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("len(spans) = %d, want %d", len(spans), 1)
+			}
+
+			span := spans[0]
+			if span.Name != "POST /api/v1/target-state/{deviceID}" {
+				t.Errorf("span.Name = %v, want %v", span.Name, "POST /api/v1/target-state/{deviceID}")
+			}
+
+			if tt.wantTraceID != "" && span.SpanContext.TraceID().String() != tt.wantTraceID {
+				t.Errorf("span.TraceID = %v, want %v", span.SpanContext.TraceID(), tt.wantTraceID)
+			}
+
+			if span.Status.Code != tt.wantStatus {
+				t.Errorf("span.Status = %v, want %v", span.Status.Code, tt.wantStatus)
+			}
+
+			var deviceID string
+			for _, attr := range span.Attributes {
+				if attr.Key == tracing.DeviceIDKey {
+					deviceID = attr.Value.AsString()
+				}
+			}
+			if deviceID != "bedroom" {
+				t.Errorf("span %s = %v, want %v", tracing.DeviceIDKey, deviceID, "bedroom")
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package server
 
 import (
+	"net/http"
+
+	"github.com/alexchebotarsky/thermostat-api/model/apikey"
 	"github.com/alexchebotarsky/thermostat-api/server/handler"
 	"github.com/alexchebotarsky/thermostat-api/server/middleware"
 	chi "github.com/go-chi/chi/v5"
@@ -8,19 +11,121 @@ import (
 )
 
 func (s *Server) setupRoutes() {
-	s.Router.Get("/_healthz", handler.Health)
+	s.Router.Use(middleware.RequestID)
+	s.Router.Use(middleware.Tracing)
+	s.Router.Use(middleware.AccessLog)
+	// Limited before authentication, so that guessing credentials is limited
+	// as well
+	s.Router.Use(middleware.RateLimit("address", s.Limits.Address, middleware.AddressKey))
+
+	s.Router.With(s.auth(s.Auth.ProtectHealth, middleware.Scope(apikey.ReadScope))).Get("/_healthz", handler.Health)
 	s.Router.Get("/openapi.yaml", handler.OpenapiYAML)
 	s.Router.Get("/docs", handler.SwaggerUI)
-	s.Router.Handle("/metrics", promhttp.Handler())
+	s.Router.With(s.auth(s.Auth.ProtectMetrics, middleware.Scope(apikey.ReadScope))).Handle("/metrics", promhttp.Handler())
 
 	s.Router.Route(v1API, func(r chi.Router) {
 		r.Use(middleware.Metrics)
 
-		r.Get("/target-state/{deviceID}", handler.GetTargetState(s.Clients.Storage))
-		r.Post("/target-state/{deviceID}", handler.UpdateTargetState(s.Clients.Storage, s.Clients.PubSub))
+		r.Group(func(r chi.Router) {
+			r.Use(s.auth(true, middleware.Scope(apikey.AdminScope)))
+			r.Use(middleware.RateLimit("client", s.Limits.Client, middleware.ClientKey))
+			r.Use(middleware.DefaultHome)
+
+			r.Get("/api-keys", handler.GetAPIKeys(s.Clients.Storage))
+			r.Post("/api-keys", handler.AddAPIKey(s.Clients.Storage))
+			r.Delete("/api-keys/{keyID}", handler.RevokeAPIKey(s.Clients.Storage))
+
+			r.Get("/access/roles", handler.GetRoles(s.Clients.Storage))
+			r.Put("/access/roles/{role}", handler.UpdateRole(s.Clients.Storage))
+			r.Delete("/access/roles/{role}", handler.DeleteRole(s.Clients.Storage))
+			r.Get("/access/users", handler.GetUsers(s.Clients.Storage))
+			r.Put("/access/users/{subject}", handler.UpdateUser(s.Clients.Storage))
+			r.Delete("/access/users/{subject}", handler.DeleteUser(s.Clients.Storage))
+
+			r.Get("/admin/dead-letters", handler.GetDeadLetters(s.Clients.Storage))
+			r.Post("/admin/dead-letters/replay", handler.ReplayDeadLetters(s.Clients.Storage, s.Clients.Processor))
+
+			r.Get("/homes", handler.GetHomes(s.Clients.Storage))
+			r.Post("/homes", handler.AddHome(s.Clients.Storage))
+			r.Delete("/homes/{homeID}", handler.DeleteHome(s.Clients.Storage))
+			r.Get("/homes/{homeID}/devices", handler.GetDevices(s.Clients.Storage))
+			r.Put("/homes/{homeID}/devices/{deviceID}", handler.UpdateDevice(s.Clients.Storage))
+			r.Get("/homes/{homeID}/members", handler.GetMembers(s.Clients.Storage))
+			r.Put("/homes/{homeID}/members/{subject}", handler.UpdateMember(s.Clients.Storage))
+			r.Delete("/homes/{homeID}/members/{subject}", handler.DeleteMember(s.Clients.Storage))
+
+			// Sensors, alerts and webhooks are shared by the homes of the
+			// deployment, and aren't limited to the devices the access policy
+			// of the caller allows, so only the operator can use them
+			r.Get("/sensors", handler.GetSensors(s.Clients.Storage))
+			r.Get("/sensors/{sensorID}", handler.GetSensor(s.Clients.Storage))
+			r.Put("/sensors/{sensorID}", handler.UpdateSensor(s.Clients.Storage))
+			r.Delete("/sensors/{sensorID}", handler.DeleteSensor(s.Clients.Storage))
+			// Assigning a sensor to a device publishes its readings to the
+			// device, whichever home the sensor is in
+			r.Put("/devices/{deviceID}/sensors", handler.UpdateSensorAssignment(s.Clients.Storage))
+
+			r.Get("/alerts", handler.GetAlerts(s.Clients.Storage))
+			r.Get("/alerts/rules", handler.GetAlertRules(s.Clients.Storage))
+			r.Post("/alerts/rules", handler.AddAlertRule(s.Clients.Storage))
+			r.Get("/alerts/rules/{ruleID}", handler.GetAlertRule(s.Clients.Storage))
+			r.Put("/alerts/rules/{ruleID}", handler.UpdateAlertRule(s.Clients.Storage))
+			r.Delete("/alerts/rules/{ruleID}", handler.DeleteAlertRule(s.Clients.Storage))
+
+			r.Get("/webhooks", handler.GetWebhookSubscriptions(s.Clients.Storage))
+			r.Post("/webhooks", handler.AddWebhookSubscription(s.Clients.Storage))
+			r.Get("/webhooks/{subscriptionID}", handler.GetWebhookSubscription(s.Clients.Storage))
+			r.Put("/webhooks/{subscriptionID}", handler.UpdateWebhookSubscription(s.Clients.Storage))
+			r.Delete("/webhooks/{subscriptionID}", handler.DeleteWebhookSubscription(s.Clients.Storage))
+			r.Get("/webhooks/{subscriptionID}/deliveries", handler.GetWebhookDeliveries(s.Clients.Storage))
+		})
 
-		r.Get("/current-state/{deviceID}", handler.GetCurrentState(s.Clients.Storage))
+		r.Group(func(r chi.Router) {
+			r.Use(s.auth(true, middleware.MethodScope))
+			r.Use(middleware.RateLimit("client", s.Limits.Client, middleware.ClientKey))
+
+			r.Get("/me", handler.GetIdentity)
+
+			// Outdoor readings are the same for every home, and aren't about
+			// any device
+			r.Get("/outdoor", handler.GetOutdoor(s.Clients.Storage))
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.DeviceHome(s.Clients.Storage))
+
+				r.Get("/target-state/{deviceID}", handler.GetTargetState(s.Clients.Storage))
+				r.With(middleware.RateLimit("device", s.Limits.Device, middleware.DeviceKey)).Post("/target-state/{deviceID}", handler.UpdateTargetState(s.Clients.Storage, s.Clients.Dispatcher))
+
+				r.Get("/current-state/{deviceID}", handler.GetCurrentState(s.Clients.Storage))
+
+				r.Get("/devices/{deviceID}/live-state", handler.GetLiveState(s.Clients.PubSub, s.Timestamps))
+				r.Get("/devices/{deviceID}/sensors", handler.GetSensorAssignment(s.Clients.Storage))
+				r.Get("/devices/{deviceID}/control", handler.GetControlSettings(s.Clients.Storage))
+				r.Put("/devices/{deviceID}/control", handler.UpdateControlSettings(s.Clients.Storage))
+				r.Get("/devices/{deviceID}/control/decisions", handler.GetControlDecisions(s.Clients.Storage))
+				r.Get("/devices/{deviceID}/safety", handler.GetSafetyLimits(s.Clients.Storage))
+				r.Put("/devices/{deviceID}/safety", handler.UpdateSafetyLimits(s.Clients.Storage))
+				r.Get("/devices/{deviceID}/safety/events", handler.GetSafetyEvents(s.Clients.Storage))
+			})
+		})
 	})
 }
 
 const v1API = "/api/v1"
+
+// auth requires an API key with the scope for the routes, if auth is enabled
+// and the routes are protected.
+func (s *Server) auth(protected bool, scopeOf middleware.ScopeFunc) func(http.Handler) http.Handler {
+	if !s.Auth.Enabled || !protected {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	return middleware.Auth(middleware.Authenticators{
+		APIKeys: s.Clients.Storage,
+		Tokens:  s.Clients.Tokens,
+		Access:  s.Clients.Storage,
+		Homes:   s.Clients.Storage,
+	}, scopeOf)
+}
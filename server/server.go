@@ -7,38 +7,137 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/alexchebotarsky/thermostat-api/model/thermostat"
+	"github.com/alexchebotarsky/thermostat-api/ratelimit"
 	"github.com/alexchebotarsky/thermostat-api/server/handler"
+	"github.com/alexchebotarsky/thermostat-api/server/middleware"
 	chi "github.com/go-chi/chi/v5"
 )
 
 type Server struct {
-	Host    string
-	Port    uint16
-	Router  chi.Router
-	HTTP    *http.Server
-	Clients Clients
+	Host       string
+	Port       uint16
+	Auth       AuthPolicy
+	Limits     RateLimits
+	Timestamps thermostat.TimestampPolicy
+	Router     chi.Router
+	HTTP       *http.Server
+	Clients    Clients
+}
+
+// AuthPolicy decides which routes require an API key. The API requires one
+// whenever auth is enabled, health and metrics endpoints only if set so.
+type AuthPolicy struct {
+	Enabled        bool
+	ProtectHealth  bool
+	ProtectMetrics bool
+}
+
+// RateLimitPolicy configures token buckets for each remote address, for each
+// client and for target state updates of each device. A rate of zero disables
+// the limit.
+type RateLimitPolicy struct {
+	AddressRate  float64
+	AddressBurst int
+	ClientRate   float64
+	ClientBurst  int
+	DeviceRate   float64
+	DeviceBurst  int
+}
+
+type RateLimits struct {
+	Address *ratelimit.Limiter
+	Client  *ratelimit.Limiter
+	Device  *ratelimit.Limiter
 }
 
 type Clients struct {
-	Storage StorageClient
-	PubSub  PubSubClient
+	Storage    StorageClient
+	PubSub     PubSubClient
+	Dispatcher DispatcherClient
+	Processor  ProcessorClient
+	// Tokens is nil if JWTs aren't accepted
+	Tokens middleware.TokenVerifier
 }
 
 type StorageClient interface {
 	handler.TargetStateFetcher
 	handler.TargetStateUpdater
 	handler.CurrentStateFetcher
+	handler.DeadLetterFetcher
+	handler.DeadLetterManager
+	handler.SensorsFetcher
+	handler.SensorFetcher
+	handler.SensorUpdater
+	handler.SensorDeleter
+	handler.SensorAssignmentFetcher
+	handler.SensorAssignmentUpdater
+	handler.OutdoorReadingsFetcher
+	handler.ControlSettingsFetcher
+	handler.ControlSettingsUpdater
+	handler.ControlDecisionsFetcher
+	handler.SafetyLimitsFetcher
+	handler.SafetyLimitsUpdater
+	handler.SafetyEventsFetcher
+	handler.AlertRulesFetcher
+	handler.AlertRuleFetcher
+	handler.AlertRuleAdder
+	handler.AlertRuleUpdater
+	handler.AlertRuleDeleter
+	handler.AlertStatesFetcher
+	handler.WebhookSubscriptionsFetcher
+	handler.WebhookSubscriptionFetcher
+	handler.WebhookSubscriptionAdder
+	handler.WebhookSubscriptionUpdater
+	handler.WebhookSubscriptionDeleter
+	handler.WebhookDeliveriesFetcher
+	handler.APIKeysFetcher
+	handler.APIKeyAdder
+	handler.APIKeyRevoker
+	handler.RolesFetcher
+	handler.RoleUpdater
+	handler.RoleDeleter
+	handler.UsersFetcher
+	handler.UserUpdater
+	handler.UserDeleter
+	handler.HomesFetcher
+	handler.HomeAdder
+	handler.HomeDeleter
+	handler.DevicesFetcher
+	handler.DeviceUpdater
+	handler.MembersFetcher
+	handler.MemberUpdater
+	handler.MemberDeleter
+	middleware.APIKeyAuthenticator
+	middleware.AccessPolicyFetcher
+	middleware.HomeFetcher
+	middleware.DeviceHomeFetcher
 }
 
 type PubSubClient interface {
-	handler.TargetStatePublisher
+	handler.LiveStateRequester
 }
 
-func New(host string, port uint16, clients Clients) *Server {
+type DispatcherClient interface {
+	handler.TargetStateDispatcher
+}
+
+type ProcessorClient interface {
+	handler.MessageReplayer
+}
+
+func New(host string, port uint16, auth AuthPolicy, limits RateLimitPolicy, timestamps thermostat.TimestampPolicy, clients Clients) *Server {
 	var s Server
 
 	s.Host = host
 	s.Port = port
+	s.Auth = auth
+	s.Limits = RateLimits{
+		Address: ratelimit.New(limits.AddressRate, limits.AddressBurst),
+		Client:  ratelimit.New(limits.ClientRate, limits.ClientBurst),
+		Device:  ratelimit.New(limits.DeviceRate, limits.DeviceBurst),
+	}
+	s.Timestamps = timestamps
 	s.Router = chi.NewRouter()
 	s.HTTP = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", s.Host, s.Port),
@@ -0,0 +1,216 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/metrics"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+)
+
+// Sender delivers webhook events to their subscriptions in the background,
+// retrying failed deliveries with exponential backoff. It also tells
+// subscriptions about devices that stopped reporting.
+type Sender struct {
+	Config  Config
+	Clients Clients
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type Config struct {
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	// Deliveries are given up on after MaxAttempts, and subscriptions are
+	// disabled after MaxFailures failed attempts in a row
+	MaxAttempts int
+	MaxFailures int
+	// Devices are unavailable after not reporting for AvailabilityTimeout
+	AvailabilityTimeout time.Duration
+	// Completed deliveries are kept in the delivery log for Retention
+	Retention time.Duration
+}
+
+type Clients struct {
+	Storage StorageClient
+	HTTP    HTTPClient
+}
+
+type StorageClient interface {
+	FetchWebhookSubscription(ctx context.Context, id int64) (*webhook.Subscription, error)
+	FetchDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]webhook.Delivery, error)
+	CountPendingWebhookDeliveries(ctx context.Context) (int, error)
+	CompleteWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode int, completedAt time.Time) error
+	FailWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode *int, lastError string, nextAttemptAt *time.Time, maxFailures int, now time.Time) (bool, error)
+	PruneWebhookDeliveries(ctx context.Context, expiredBefore time.Time) error
+	MarkUnavailableDevices(ctx context.Context, staleBefore, now time.Time) ([]webhook.Availability, error)
+}
+
+type HTTPClient interface {
+	DeliverEvent(ctx context.Context, url, secret string, deliveryID int64, eventType webhook.EventType, payload []byte) (int, error)
+}
+
+const batchSize = 100
+
+func New(config Config, clients Clients) *Sender {
+	var s Sender
+
+	s.Config = config
+	s.Clients = clients
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	return &s
+}
+
+func (s *Sender) Start(ctx context.Context, errc chan<- error) {
+	defer close(s.done)
+
+	slog.Info(fmt.Sprintf("Webhook sender polling every %s", s.Config.PollInterval))
+
+	ticker := time.NewTicker(s.Config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+
+		err := s.checkAvailability(ctx, now)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error checking device availability: %v", err))
+		}
+
+		s.drain(ctx, now)
+
+		err = s.Clients.Storage.PruneWebhookDeliveries(ctx, now.Add(-s.Config.Retention))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Error pruning webhook deliveries: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Sender) Stop(ctx context.Context) error {
+	close(s.stop)
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for webhook sender to stop: %v", ctx.Err())
+	}
+}
+
+func (s *Sender) checkAvailability(ctx context.Context, now time.Time) error {
+	unavailable, err := s.Clients.Storage.MarkUnavailableDevices(ctx, now.Add(-s.Config.AvailabilityTimeout), now)
+	if err != nil {
+		return fmt.Errorf("error marking unavailable devices: %v", err)
+	}
+
+	for _, availability := range unavailable {
+		slog.Warn(fmt.Sprintf("Device %s is unavailable, last seen at %s", availability.DeviceID, availability.LastSeenAt.Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+func (s *Sender) drain(ctx context.Context, now time.Time) {
+	deliveries, err := s.Clients.Storage.FetchDueWebhookDeliveries(ctx, now, batchSize)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error fetching due webhook deliveries: %v", err))
+		return
+	}
+
+	subscriptions := make(map[int64]*webhook.Subscription)
+	for _, delivery := range deliveries {
+		subscription, exists := subscriptions[delivery.SubscriptionID]
+		if !exists {
+			subscription, err = s.Clients.Storage.FetchWebhookSubscription(ctx, delivery.SubscriptionID)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Error fetching webhook subscription %d: %v", delivery.SubscriptionID, err))
+				continue
+			}
+			subscriptions[delivery.SubscriptionID] = subscription
+		}
+
+		// Subscription may have been disabled by an earlier delivery of the batch
+		if !subscription.Enabled {
+			continue
+		}
+
+		err := s.deliver(ctx, subscription, &delivery)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Error delivering %s event to webhook subscription %d (attempt %d): %v", delivery.EventType, subscription.ID, delivery.Attempts+1, err))
+		}
+	}
+
+	count, err := s.Clients.Storage.CountPendingWebhookDeliveries(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Error counting pending webhook deliveries: %v", err))
+		return
+	}
+
+	metrics.SetPendingWebhookDeliveries(count)
+}
+
+func (s *Sender) deliver(ctx context.Context, subscription *webhook.Subscription, delivery *webhook.Delivery) error {
+	statusCode, err := s.Clients.HTTP.DeliverEvent(ctx, subscription.URL, subscription.Secret, delivery.ID, delivery.EventType, []byte(delivery.Payload))
+	now := time.Now()
+	if err != nil {
+		metrics.AddWebhookDeliveryAttempt(string(delivery.EventType), "ERR")
+
+		var code *int
+		if statusCode != 0 {
+			code = &statusCode
+		}
+
+		var nextAttemptAt *time.Time
+		if delivery.Attempts+1 < s.Config.MaxAttempts {
+			next := now.Add(s.backoff(delivery.Attempts + 1))
+			nextAttemptAt = &next
+		}
+
+		disabled, failErr := s.Clients.Storage.FailWebhookDelivery(ctx, delivery, code, err.Error(), nextAttemptAt, s.Config.MaxFailures, now)
+		if failErr != nil {
+			return fmt.Errorf("error recording failed delivery: %v, after: %v", failErr, err)
+		}
+
+		if disabled {
+			subscription.Enabled = false
+			metrics.AddWebhookSubscriptionDisabled()
+			slog.Warn(fmt.Sprintf("Webhook subscription %d disabled after %d failed deliveries in a row", subscription.ID, s.Config.MaxFailures))
+		}
+
+		return err
+	}
+
+	metrics.AddWebhookDeliveryAttempt(string(delivery.EventType), "OK")
+
+	err = s.Clients.Storage.CompleteWebhookDelivery(ctx, delivery, statusCode, now)
+	if err != nil {
+		return fmt.Errorf("error completing delivery: %v", err)
+	}
+
+	return nil
+}
+
+// backoff doubles the delay with every failed attempt, within the configured
+// bounds.
+func (s *Sender) backoff(attempts int) time.Duration {
+	delay := s.Config.MinBackoff
+	for i := 1; i < attempts && delay < s.Config.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, s.Config.MaxBackoff)
+}
@@ -0,0 +1,277 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alexchebotarsky/thermostat-api/client"
+	"github.com/alexchebotarsky/thermostat-api/model/webhook"
+)
+
+type fakeStorage struct {
+	Subscriptions map[int64]webhook.Subscription
+	Deliveries    map[int64]webhook.Delivery
+	Availability  []webhook.Availability
+}
+
+func (f *fakeStorage) FetchWebhookSubscription(ctx context.Context, id int64) (*webhook.Subscription, error) {
+	subscription, exists := f.Subscriptions[id]
+	if !exists {
+		return nil, &client.ErrNotFound{Err: errors.New("webhook subscription not found")}
+	}
+
+	return &subscription, nil
+}
+
+func (f *fakeStorage) FetchDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]webhook.Delivery, error) {
+	var deliveries []webhook.Delivery
+	for id := int64(1); id <= int64(len(f.Deliveries)); id++ {
+		delivery := f.Deliveries[id]
+		if delivery.Status == webhook.PendingStatus && !delivery.NextAttemptAt.After(now) && f.Subscriptions[delivery.SubscriptionID].Enabled {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (f *fakeStorage) CountPendingWebhookDeliveries(ctx context.Context) (int, error) {
+	var count int
+	for _, delivery := range f.Deliveries {
+		if delivery.Status == webhook.PendingStatus {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (f *fakeStorage) CompleteWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode int, completedAt time.Time) error {
+	stored := f.Deliveries[delivery.ID]
+	stored.Status = webhook.DeliveredStatus
+	stored.Attempts++
+	stored.LastStatusCode = &statusCode
+	stored.CompletedAt = &completedAt
+	f.Deliveries[delivery.ID] = stored
+
+	subscription := f.Subscriptions[delivery.SubscriptionID]
+	subscription.ConsecutiveFailures = 0
+	f.Subscriptions[delivery.SubscriptionID] = subscription
+
+	return nil
+}
+
+func (f *fakeStorage) FailWebhookDelivery(ctx context.Context, delivery *webhook.Delivery, statusCode *int, lastError string, nextAttemptAt *time.Time, maxFailures int, now time.Time) (bool, error) {
+	stored := f.Deliveries[delivery.ID]
+	stored.Attempts++
+	stored.LastStatusCode = statusCode
+	stored.LastError = &lastError
+	if nextAttemptAt != nil {
+		stored.NextAttemptAt = *nextAttemptAt
+	} else {
+		stored.Status = webhook.FailedStatus
+		stored.CompletedAt = &now
+	}
+	f.Deliveries[delivery.ID] = stored
+
+	subscription := f.Subscriptions[delivery.SubscriptionID]
+	subscription.ConsecutiveFailures++
+	disabled := subscription.ConsecutiveFailures >= maxFailures
+	if disabled {
+		subscription.Enabled = false
+	}
+	f.Subscriptions[delivery.SubscriptionID] = subscription
+
+	return disabled, nil
+}
+
+func (f *fakeStorage) PruneWebhookDeliveries(ctx context.Context, expiredBefore time.Time) error {
+	return nil
+}
+
+func (f *fakeStorage) MarkUnavailableDevices(ctx context.Context, staleBefore, now time.Time) ([]webhook.Availability, error) {
+	var unavailable []webhook.Availability
+	for i, availability := range f.Availability {
+		if availability.Available && availability.LastSeenAt.Before(staleBefore) {
+			f.Availability[i].Available = false
+			unavailable = append(unavailable, f.Availability[i])
+		}
+	}
+
+	return unavailable, nil
+}
+
+type fakeHTTP struct {
+	Delivered []int64
+
+	shouldFail bool
+}
+
+func (f *fakeHTTP) DeliverEvent(ctx context.Context, url, secret string, deliveryID int64, eventType webhook.EventType, payload []byte) (int, error) {
+	if f.shouldFail {
+		return http.StatusInternalServerError, errors.New("test error")
+	}
+
+	f.Delivered = append(f.Delivered, deliveryID)
+
+	return http.StatusOK, nil
+}
+
+var testConfig = Config{
+	PollInterval:        time.Second,
+	MinBackoff:          0,
+	MaxBackoff:          0,
+	MaxAttempts:         3,
+	MaxFailures:         5,
+	AvailabilityTimeout: 5 * time.Minute,
+	Retention:           time.Hour,
+}
+
+func newTestStorage(deliveries int) *fakeStorage {
+	storage := &fakeStorage{
+		Subscriptions: map[int64]webhook.Subscription{
+			1: {ID: 1, URL: "http://localhost/hook", Secret: "test_secret_0123456789", Enabled: true},
+		},
+		Deliveries: map[int64]webhook.Delivery{},
+	}
+
+	for id := int64(1); id <= int64(deliveries); id++ {
+		storage.Deliveries[id] = webhook.Delivery{
+			ID:             id,
+			SubscriptionID: 1,
+			EventType:      webhook.TargetStateEvent,
+			Status:         webhook.PendingStatus,
+			NextAttemptAt:  time.Now().Add(-time.Second),
+		}
+	}
+
+	return storage
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		http         *fakeHTTP
+		drains       int
+		wantStatus   webhook.DeliveryStatus
+		wantAttempts int
+	}{
+		{
+			name:         "should deliver and complete delivery",
+			http:         &fakeHTTP{shouldFail: false},
+			drains:       1,
+			wantStatus:   webhook.DeliveredStatus,
+			wantAttempts: 1,
+		},
+		{
+			name:         "should keep delivery for retry, if webhook fails",
+			http:         &fakeHTTP{shouldFail: true},
+			drains:       1,
+			wantStatus:   webhook.PendingStatus,
+			wantAttempts: 1,
+		},
+		{
+			name:         "should give up on delivery after max attempts",
+			http:         &fakeHTTP{shouldFail: true},
+			drains:       5,
+			wantStatus:   webhook.FailedStatus,
+			wantAttempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newTestStorage(1)
+			s := New(testConfig, Clients{Storage: storage, HTTP: tt.http})
+
+			for range tt.drains {
+				s.drain(context.Background(), time.Now())
+			}
+
+			delivery := storage.Deliveries[1]
+			if delivery.Status != tt.wantStatus {
+				t.Errorf("drain() delivery.Status = %s, want %s", delivery.Status, tt.wantStatus)
+			}
+
+			if delivery.Attempts != tt.wantAttempts {
+				t.Errorf("drain() delivery.Attempts = %d, want %d", delivery.Attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDrainDisablesSubscription(t *testing.T) {
+	storage := newTestStorage(10)
+	hook := &fakeHTTP{shouldFail: true}
+	s := New(testConfig, Clients{Storage: storage, HTTP: hook})
+
+	s.drain(context.Background(), time.Now())
+
+	subscription := storage.Subscriptions[1]
+	if subscription.Enabled {
+		t.Fatalf("drain() subscription.Enabled = true, want false")
+	}
+
+	// Rest of the batch isn't attempted once the subscription is disabled
+	var attempted int
+	for _, delivery := range storage.Deliveries {
+		if delivery.Attempts > 0 {
+			attempted++
+		}
+	}
+	if attempted != testConfig.MaxFailures {
+		t.Errorf("drain() attempted %d deliveries, want %d", attempted, testConfig.MaxFailures)
+	}
+
+	// Disabled subscriptions get nothing, even once the webhook recovers
+	hook.shouldFail = false
+	s.drain(context.Background(), time.Now())
+
+	if len(hook.Delivered) != 0 {
+		t.Errorf("drain() len(hook.Delivered) = %d, want %d", len(hook.Delivered), 0)
+	}
+}
+
+func TestCheckAvailability(t *testing.T) {
+	now := time.Now()
+	storage := newTestStorage(0)
+	storage.Availability = []webhook.Availability{
+		{DeviceID: "stale_device_id", Available: true, LastSeenAt: now.Add(-10 * time.Minute)},
+		{DeviceID: "test_device_id", Available: true, LastSeenAt: now.Add(-time.Minute)},
+	}
+	s := New(testConfig, Clients{Storage: storage, HTTP: &fakeHTTP{}})
+
+	err := s.checkAvailability(context.Background(), now)
+	if err != nil {
+		t.Fatalf("checkAvailability() error = %v", err)
+	}
+
+	if storage.Availability[0].Available || !storage.Availability[1].Available {
+		t.Errorf("checkAvailability() availability = %+v, want only stale_device_id unavailable", storage.Availability)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config := testConfig
+	config.MinBackoff = 10 * time.Second
+	config.MaxBackoff = time.Minute
+	s := New(config, Clients{})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 10 * time.Second},
+		{attempts: 2, want: 20 * time.Second},
+		{attempts: 3, want: 40 * time.Second},
+		{attempts: 4, want: time.Minute},
+		{attempts: 100, want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := s.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}